@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"math/rand"
 	"os"
@@ -22,6 +23,9 @@ func main() {
 		// Generate 1-2 pain descriptions per day
 		numDescriptions := r.Intn(2) + 1
 
+		// The pains of a day are saved like the pains of one message
+		var pains []models.PainDescription
+
 		for j := 0; j < numDescriptions; j++ {
 			// Generate random level of pain between 1 and 10
 			level := r.Intn(10) + 1
@@ -44,7 +48,7 @@ func main() {
 				numbnessDescription = "Numbness in " + models.BodyPartMapping[location]
 			}
 
-			// Create PainDescription and append to data
+			// Create PainDescription and append to the pains of the day
 			painDescription := models.PainDescription{
 				Timestamp:           date,
 				Level:               level,
@@ -55,13 +59,14 @@ func main() {
 				NumbnessDescription: numbnessDescription,
 			}
 
-			pdLog, err := painDescription.MapToLogEntry(175255021)
-			if err != nil {
-				panic(err)
-			}
+			pains = append(pains, painDescription)
+		}
 
-			data = append(data, pdLog)
+		pdLogs, err := models.MapToLogEntries(175255021, pains, models.NewEntryMetadata(0, 0, models.SourceImport))
+		if err != nil {
+			panic(err)
 		}
+		data = append(data, pdLogs...)
 	}
 
 	client, err := database.NewLogAnalyticsClient(
@@ -72,7 +77,7 @@ func main() {
 		panic(err)
 	}
 
-	err = client.SavePainDescriptionsToLogAnalytics(data)
+	err = client.SavePainDescriptionsToLogAnalytics(context.Background(), data)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,89 @@
+// Command evaluate runs a golden set of messages through the language model and reports how accurately the pain
+// descriptions were extracted. It exits with status 1 when the overall accuracy is below the threshold, so it can
+// gate prompt and model changes. An interrupted run exits with status 1 too, as the accuracy of a part of the cases
+// cannot be compared to the threshold
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"t-pain/pkg/evaluation"
+	"t-pain/pkg/openai"
+	"time"
+)
+
+func main() {
+	dataset := flag.String("dataset", "cmd/evaluate/dataset.yaml", "the golden set, a JSON or YAML file")
+	threshold := flag.Float64("threshold", 0.8, "the lowest accepted overall accuracy, from 0 to 1")
+	tolerance := flag.Int("tolerance", 1, "how far a level may be from the expected one and still be counted correct")
+	timezone := flag.String("timezone", "Europe/Helsinki", "the IANA timezone the messages are interpreted in")
+	flag.Parse()
+
+	cases, err := evaluation.LoadDataset(*dataset)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("unable to load timezone %q: %w", *timezone, err))
+	}
+
+	client, err := newClient()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("error creating the OpenAI client. Often relates to missing env variables: %w", err))
+	}
+
+	// Interrupting the run still prints the report of the cases evaluated so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report := evaluation.Evaluate(ctx, client, cases, evaluation.Options{LevelTolerance: *tolerance, Location: loc})
+	if err := report.Print(os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
+	if ctx.Err() != nil {
+		fmt.Printf("\nInterrupted after %d of %d cases\n", len(report.Cases), len(cases))
+		os.Exit(1)
+	}
+
+	if overall := report.Overall(); overall < *threshold {
+		fmt.Printf("\nOverall accuracy %.1f%% is below the threshold of %.1f%%\n", 100*overall, 100**threshold)
+		os.Exit(1)
+	}
+}
+
+// newClient creates the client from the same environment variables as the bot
+func newClient() (*openai.Client, error) {
+	name := os.Getenv("OPENAI_PROVIDER")
+	if name == "" {
+		name = openai.ProviderAzure
+	}
+	provider, err := openai.NewProvider(name, os.Getenv("OPENAI_ENDPOINT"), os.Getenv("OPENAI_DEPLOYMENT"),
+		os.Getenv("OPENAI_KEY"), os.Getenv("OPENAI_USE_MANAGED_IDENTITY") == "true")
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []openai.ConfigOpt
+	if name := os.Getenv("OPENAI_PROMPT"); name != "" {
+		load := openai.LoadPrompt
+		if strings.HasSuffix(name, ".json") {
+			load = openai.LoadPromptFile
+		}
+		prompt, err := load(name)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, openai.WithPrompt(prompt))
+	}
+
+	conf, err := openai.NewConfig(provider, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return openai.NewClient(conf)
+}
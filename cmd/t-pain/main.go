@@ -5,8 +5,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"t-pain/pkg/tgbot"
+	"time"
 )
 
 func main() {
@@ -23,6 +26,129 @@ func main() {
 	dcRuleId := os.Getenv("DATA_COLLECTION_RULE_ID")
 	dcStreamName := os.Getenv("DATA_COLLECTION_STREAM_NAME")
 
+	var opts []tgbot.ConfigOption
+	if draftTimeout := os.Getenv("DRAFT_TIMEOUT"); draftTimeout != "" {
+		timeout, err := time.ParseDuration(draftTimeout)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing DRAFT_TIMEOUT: %w", err))
+		}
+		opts = append(opts, tgbot.WithDraftTimeout(timeout))
+	}
+	if clarificationTimeout := os.Getenv("CLARIFICATION_TIMEOUT"); clarificationTimeout != "" {
+		timeout, err := time.ParseDuration(clarificationTimeout)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing CLARIFICATION_TIMEOUT: %w", err))
+		}
+		opts = append(opts, tgbot.WithClarificationTimeout(timeout))
+	}
+	if lookback := os.Getenv("TIMESTAMP_LOOKBACK"); lookback != "" {
+		d, err := time.ParseDuration(lookback)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing TIMESTAMP_LOOKBACK: %w", err))
+		}
+		opts = append(opts, tgbot.WithTimestampLookback(d))
+	}
+	for name, option := range map[string]func(time.Duration) tgbot.ConfigOption{
+		"SPEECH_TIMEOUT": tgbot.WithSpeechTimeout,
+		"OPENAI_TIMEOUT": tgbot.WithOpenAITimeout,
+		"STORE_TIMEOUT":  tgbot.WithStoreTimeout,
+	} {
+		if value := os.Getenv(name); value != "" {
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("error parsing %s: %w", name, err))
+			}
+			opts = append(opts, option(timeout))
+		}
+	}
+	if gracePeriod := os.Getenv("SHUTDOWN_GRACE_PERIOD"); gracePeriod != "" {
+		d, err := time.ParseDuration(gracePeriod)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing SHUTDOWN_GRACE_PERIOD: %w", err))
+		}
+		opts = append(opts, tgbot.WithShutdownGracePeriod(d))
+	}
+	if pendingPath := os.Getenv("PENDING_PATH"); pendingPath != "" {
+		opts = append(opts, tgbot.WithPendingPath(pendingPath))
+	}
+	if processedPath := os.Getenv("PROCESSED_PATH"); processedPath != "" {
+		opts = append(opts, tgbot.WithProcessedPath(processedPath))
+	}
+	if outboxDir := os.Getenv("OUTBOX_DIR"); outboxDir != "" {
+		opts = append(opts, tgbot.WithOutboxDir(outboxDir))
+	}
+	if os.Getenv("OPENAI_USE_MANAGED_IDENTITY") == "true" {
+		opts = append(opts, tgbot.WithOpenAIManagedIdentity())
+	}
+	if provider := os.Getenv("OPENAI_PROVIDER"); provider != "" {
+		opts = append(opts, tgbot.WithOpenAIProvider(provider))
+	}
+	if tpm := os.Getenv("OPENAI_TPM"); tpm != "" {
+		n, err := strconv.Atoi(tpm)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing OPENAI_TPM: %w", err))
+		}
+		opts = append(opts, tgbot.WithOpenAITokensPerMinute(n))
+	}
+	if retries := os.Getenv("OPENAI_MAX_RETRIES"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing OPENAI_MAX_RETRIES: %w", err))
+		}
+		opts = append(opts, tgbot.WithOpenAIMaxRetries(n))
+	}
+	if prompt := os.Getenv("OPENAI_PROMPT"); prompt != "" {
+		opts = append(opts, tgbot.WithOpenAIPrompt(prompt))
+	}
+	shadowDeployment, shadowPrompt := os.Getenv("SHADOW_OPENAI_DEPLOYMENT"), os.Getenv("SHADOW_OPENAI_PROMPT")
+	if shadowDeployment != "" || shadowPrompt != "" {
+		opts = append(opts, tgbot.WithShadowOpenAI(shadowDeployment, shadowPrompt))
+	}
+	if shadowLog := os.Getenv("SHADOW_LOG_PATH"); shadowLog != "" {
+		opts = append(opts, tgbot.WithShadowLog(shadowLog))
+	}
+	if prices := os.Getenv("OPENAI_PRICES"); prices != "" {
+		opts = append(opts, tgbot.WithOpenAIPrices(prices))
+	}
+	if budget := os.Getenv("DAILY_TOKEN_BUDGET"); budget != "" {
+		n, err := strconv.Atoi(budget)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing DAILY_TOKEN_BUDGET: %w", err))
+		}
+		opts = append(opts, tgbot.WithDailyTokenBudget(n))
+	}
+	if admins := os.Getenv("ADMIN_USER_IDS"); admins != "" {
+		for _, admin := range strings.Split(admins, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(admin), 10, 64)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("error parsing ADMIN_USER_IDS: %w", err))
+			}
+			opts = append(opts, tgbot.WithAdmins(id))
+		}
+	}
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		opts = append(opts, tgbot.WithMetricsAddr(metricsAddr))
+	}
+	if os.Getenv("STORAGE_BACKEND") == tgbot.StorageSQLite {
+		opts = append(opts, tgbot.WithSQLiteStorage(os.Getenv("SQLITE_PATH")))
+	}
+	if workspaceId := os.Getenv("LOG_ANALYTICS_WORKSPACE_ID"); workspaceId != "" {
+		opts = append(opts, tgbot.WithLogAnalyticsWorkspace(workspaceId))
+	}
+	if os.Getenv("LOG_ANALYTICS_GZIP") == "true" {
+		opts = append(opts, tgbot.WithLogAnalyticsGzip())
+	}
+	if flushInterval := os.Getenv("LOG_ANALYTICS_FLUSH_INTERVAL"); flushInterval != "" {
+		d, err := time.ParseDuration(flushInterval)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("error parsing LOG_ANALYTICS_FLUSH_INTERVAL: %w", err))
+		}
+		opts = append(opts, tgbot.WithLogAnalyticsFlushInterval(d))
+	}
+	if timezone := os.Getenv("TIMEZONE"); timezone != "" {
+		opts = append(opts, tgbot.WithTimezone(timezone))
+	}
+
 	conf, err := tgbot.NewConfig(
 		botToken,
 		speechKey,
@@ -33,6 +159,7 @@ func main() {
 		dcEndpoint,
 		dcRuleId,
 		dcStreamName,
+		opts...,
 	)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("error creating config. Often relates to missing env variables in ALL_CAPS_SNAKE_CASE: %w", err))
@@ -52,5 +179,14 @@ func main() {
 		b.Stop()
 	}()
 
-	b.Run()
+	report := b.Run()
+	log.Printf("Bot stopped: %s", report)
+	// Abandoned drafts alone are not an error, nothing was saved for them yet
+	switch {
+	case len(report.Dropped) > 0:
+		os.Exit(1)
+	case len(report.Persisted) > 0:
+		// EX_TEMPFAIL, the saved messages are handled once the bot is started again
+		os.Exit(75)
+	}
 }
\ No newline at end of file
@@ -2,23 +2,36 @@ package database
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azingest"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azquery"
 	"os"
 	"t-pain/pkg/models"
+	"time"
 )
 
 type AzureClient interface {
 	Upload(ctx context.Context, ruleID string, streamName string, logs []byte, options *azingest.UploadOptions) (azingest.UploadResponse, error)
 }
 
+// LogsQueryClient is the part of azquery.LogsClient used for reading the data back
+type LogsQueryClient interface {
+	QueryWorkspace(ctx context.Context, workspaceID string, body azquery.Body, options *azquery.LogsClientQueryWorkspaceOptions) (azquery.LogsClientQueryWorkspaceResponse, error)
+}
+
 type LogAnalyticsClient struct {
-	client     AzureClient
-	ruleId     string
-	streamName string
+	client      AzureClient
+	queryClient LogsQueryClient
+	ruleId      string
+	streamName  string
+	workspaceId string
+	gzip        bool
+	// maxBatchBytes is the size limit of the JSON of one upload call
+	maxBatchBytes int
+	// coalescer gathers concurrent saves into periodic uploads, nil to upload right away
+	coalescer *coalescer
 }
 
 func NewLogAnalyticsClient(endpoint, ruleId, streamName string, opts ...LogAnalyticsClientOption) (*LogAnalyticsClient, error) {
@@ -49,16 +62,49 @@ func NewLogAnalyticsClient(endpoint, ruleId, streamName string, opts ...LogAnaly
 		client = azClient
 	}
 
-	return &LogAnalyticsClient{
-		client:     client,
-		ruleId:     ruleId,
-		streamName: streamName,
-	}, nil
+	// Reading is optional, without a workspace the client can only upload
+	var queryClient LogsQueryClient
+	if options.CustomQueryClient != nil {
+		queryClient = options.CustomQueryClient
+	} else if options.WorkspaceId != "" {
+		logsClient, err := azquery.NewLogsClient(cred, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create query client: %w", err)
+		}
+		queryClient = logsClient
+	}
+
+	lac := &LogAnalyticsClient{
+		client:        client,
+		queryClient:   queryClient,
+		ruleId:        ruleId,
+		streamName:    streamName,
+		workspaceId:   options.WorkspaceId,
+		gzip:          options.Gzip,
+		maxBatchBytes: maxUploadBytes,
+	}
+	if options.MaxBatchBytes > 0 {
+		lac.maxBatchBytes = options.MaxBatchBytes
+	}
+	if options.FlushInterval > 0 {
+		timeout := options.FlushTimeout
+		if timeout <= 0 {
+			timeout = defaultFlushTimeout
+		}
+		lac.coalescer = &coalescer{interval: options.FlushInterval, timeout: timeout, upload: lac.uploadBatches}
+	}
+	return lac, nil
 }
 
 type LogAnalyticsClientOptions struct {
-	CustomCredential azcore.TokenCredential
-	CustomClient     AzureClient
+	CustomCredential  azcore.TokenCredential
+	CustomClient      AzureClient
+	CustomQueryClient LogsQueryClient
+	WorkspaceId       string
+	Gzip              bool
+	MaxBatchBytes     int
+	FlushInterval     time.Duration
+	FlushTimeout      time.Duration
 }
 
 type LogAnalyticsClientOption func(*LogAnalyticsClientOptions)
@@ -75,6 +121,50 @@ func WithCustomClient(client AzureClient) LogAnalyticsClientOption {
 	}
 }
 
+// WithQueryWorkspace enables reading the data back from the Log Analytics workspace with the given ID
+func WithQueryWorkspace(workspaceId string) LogAnalyticsClientOption {
+	return func(options *LogAnalyticsClientOptions) {
+		options.WorkspaceId = workspaceId
+	}
+}
+
+// WithCustomQueryClient replaces the azquery client used for reading, e.g. with a local fake in tests
+func WithCustomQueryClient(client LogsQueryClient) LogAnalyticsClientOption {
+	return func(options *LogAnalyticsClientOptions) {
+		options.CustomQueryClient = client
+	}
+}
+
+// WithGzip compresses the uploaded data
+func WithGzip() LogAnalyticsClientOption {
+	return func(options *LogAnalyticsClientOptions) {
+		options.Gzip = true
+	}
+}
+
+// WithMaxBatchBytes lowers the size of the JSON uploaded in one call from the 1 MB limit of the API
+func WithMaxBatchBytes(n int) LogAnalyticsClientOption {
+	return func(options *LogAnalyticsClientOptions) {
+		options.MaxBatchBytes = n
+	}
+}
+
+// WithFlushInterval gathers the entries saved within the interval into one upload. A save returns once its
+// entries have been uploaded
+func WithFlushInterval(interval time.Duration) LogAnalyticsClientOption {
+	return func(options *LogAnalyticsClientOptions) {
+		options.FlushInterval = interval
+	}
+}
+
+// WithFlushTimeout bounds the upload of the gathered entries, a minute by default. The saves waiting for it give up
+// when their ctx ends, so it should not be longer than what the callers wait
+func WithFlushTimeout(timeout time.Duration) LogAnalyticsClientOption {
+	return func(options *LogAnalyticsClientOptions) {
+		options.FlushTimeout = timeout
+	}
+}
+
 func getCredential() (azcore.TokenCredential, error) {
 	var cred azcore.TokenCredential
 	var err error
@@ -97,17 +187,26 @@ func getCredential() (azcore.TokenCredential, error) {
 
 }
 
-func (lac *LogAnalyticsClient) SavePainDescriptionsToLogAnalytics(pd []models.PainDescriptionLogEntry) error {
-
-	logs, err := json.Marshal(pd)
-	if err != nil {
-		return fmt.Errorf("unable to marshal pain descriptions: %w", err)
+// SavePainDescriptionsToLogAnalytics uploads the entries in batches under the size limit of the API. If only some of
+// the batches fail, the error is an *UploadError telling which entries were saved
+func (lac *LogAnalyticsClient) SavePainDescriptionsToLogAnalytics(ctx context.Context, pd []models.PainDescriptionLogEntry) error {
+	if lac.coalescer != nil {
+		return lac.coalescer.add(ctx, pd)
 	}
+	return lac.uploadBatches(ctx, pd)
+}
 
-	_, err = lac.client.Upload(context.Background(), lac.ruleId, lac.streamName, logs, nil)
-	if err != nil {
-		return fmt.Errorf("unable to upload logs: %w", err)
-	}
+// Append saves the entries to Log Analytics
+func (lac *LogAnalyticsClient) Append(ctx context.Context, entries []models.PainDescriptionLogEntry) error {
+	return lac.SavePainDescriptionsToLogAnalytics(ctx, entries)
+}
 
-	return nil
-}
\ No newline at end of file
+// Update is not supported, ingested data cannot be changed in Log Analytics
+func (lac *LogAnalyticsClient) Update(ctx context.Context, id int64, entry models.PainDescriptionLogEntry) error {
+	return ErrNotSupported
+}
+
+// Delete is not supported, ingested data cannot be deleted in Log Analytics
+func (lac *LogAnalyticsClient) Delete(ctx context.Context, id int64) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,290 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azingest"
+	"net/http"
+	"strings"
+	"sync"
+	"t-pain/pkg/models"
+	"time"
+)
+
+const (
+	// maxUploadBytes is the limit of the Logs Ingestion API for the uncompressed data of a call
+	maxUploadBytes = 1 << 20
+	// defaultFlushTimeout bounds a periodic flush, which is not tied to the ctx of any single caller, when no
+	// timeout is configured
+	defaultFlushTimeout = time.Minute
+)
+
+// BatchResult is the result of uploading one batch of entries
+type BatchResult struct {
+	// Start and End are the range of the batch in the uploaded entries, entries[Start:End]
+	Start, End int
+	// Err is nil if the batch was saved
+	Err error
+}
+
+// UploadError is returned when some of the batches of an upload failed. The batches without an error were saved
+type UploadError struct {
+	// Batches are the results of all the batches in the order of the entries
+	Batches []BatchResult
+}
+
+func (e *UploadError) Error() string {
+	var failed []string
+	for _, b := range e.Batches {
+		if b.Err != nil {
+			failed = append(failed, fmt.Sprintf("entries %d-%d: %v", b.Start, b.End-1, b.Err))
+		}
+	}
+	return fmt.Sprintf("%d of %d batches failed: %s", len(failed), len(e.Batches), strings.Join(failed, "; "))
+}
+
+func (e *UploadError) Unwrap() []error {
+	var errs []error
+	for _, b := range e.Batches {
+		if b.Err != nil {
+			errs = append(errs, b.Err)
+		}
+	}
+	return errs
+}
+
+// Failed returns the entries of the failed batches, given the entries that were uploaded
+func (e *UploadError) Failed(entries []models.PainDescriptionLogEntry) []models.PainDescriptionLogEntry {
+	var failed []models.PainDescriptionLogEntry
+	for _, b := range e.Batches {
+		if b.Err != nil {
+			failed = append(failed, entries[b.Start:b.End]...)
+		}
+	}
+	return failed
+}
+
+// slice returns the results of the entries in [start, end), with the ranges relative to start. Returns nil if all
+// of them were saved
+func (e *UploadError) slice(start, end int) error {
+	var batches []BatchResult
+	failed := false
+	for _, b := range e.Batches {
+		from, to := b.Start, b.End
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if from >= to {
+			continue
+		}
+		batches = append(batches, BatchResult{Start: from - start, End: to - start, Err: b.Err})
+		failed = failed || b.Err != nil
+	}
+	if !failed {
+		return nil
+	}
+	return &UploadError{Batches: batches}
+}
+
+// uploadBatches uploads the entries in batches under the size limit of the API. All the batches are tried, so an
+// error on one does not prevent saving the others
+func (lac *LogAnalyticsClient) uploadBatches(ctx context.Context, entries []models.PainDescriptionLogEntry) error {
+	batches, err := splitBatches(entries, lac.maxBatchBytes)
+	if err != nil {
+		return err
+	}
+
+	result := &UploadError{}
+	failed := false
+	for _, b := range batches {
+		res := BatchResult{Start: b.start, End: b.end, Err: b.err}
+		if res.Err == nil {
+			res.Err = lac.upload(ctx, b.data)
+		}
+		failed = failed || res.Err != nil
+		result.Batches = append(result.Batches, res)
+	}
+	if failed {
+		return result
+	}
+	return nil
+}
+
+// upload sends a JSON array of entries in one call, compressed if enabled
+func (lac *LogAnalyticsClient) upload(ctx context.Context, logs []byte) error {
+	if !lac.gzip {
+		_, err := lac.client.Upload(ctx, lac.ruleId, lac.streamName, logs, nil)
+		if err != nil {
+			return uploadFailed(err)
+		}
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(logs); err != nil {
+		return fmt.Errorf("unable to compress logs: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("unable to compress logs: %w", err)
+	}
+	encoding := "gzip"
+	_, err := lac.client.Upload(ctx, lac.ruleId, lac.streamName, compressed.Bytes(), &azingest.UploadOptions{ContentEncoding: &encoding})
+	if err != nil {
+		return uploadFailed(err)
+	}
+	return nil
+}
+
+// uploadFailed wraps the error of an upload call, with ErrRejected if the API refused the data itself. The other
+// errors, e.g. throttling or a wrong rule or credential, can pass once the service or the configuration is fixed
+func uploadFailed(err error) error {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && (respErr.StatusCode == http.StatusBadRequest || respErr.StatusCode == http.StatusRequestEntityTooLarge) {
+		return fmt.Errorf("%w: unable to upload logs: %w", ErrRejected, err)
+	}
+	return fmt.Errorf("unable to upload logs: %w", err)
+}
+
+// batch is the JSON array of entries[start:end], or the error why they cannot be uploaded
+type batch struct {
+	start, end int
+	data       []byte
+	err        error
+}
+
+// splitBatches marshals the entries into JSON arrays of at most maxBytes. An entry that alone is over the limit
+// becomes a batch of its own with an error
+func splitBatches(entries []models.PainDescriptionLogEntry, maxBytes int) ([]batch, error) {
+	var batches []batch
+	current := batch{data: []byte{'['}}
+	closeCurrent := func() {
+		if current.end > current.start {
+			current.data = append(current.data, ']')
+			batches = append(batches, current)
+		}
+	}
+
+	for i, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal pain descriptions: %w", err)
+		}
+		// Brackets around a single entry
+		if len(data)+2 > maxBytes {
+			closeCurrent()
+			batches = append(batches, batch{start: i, end: i + 1, err: fmt.Errorf("%w: entry of %d bytes is over the limit of %d bytes", ErrRejected, len(data), maxBytes)})
+			current = batch{start: i + 1, end: i + 1, data: []byte{'['}}
+			continue
+		}
+		// A comma before the entry and the closing bracket
+		if current.end > current.start && len(current.data)+1+len(data)+1 > maxBytes {
+			closeCurrent()
+			current = batch{start: i, end: i, data: []byte{'['}}
+		}
+		if current.end > current.start {
+			current.data = append(current.data, ',')
+		}
+		current.data = append(current.data, data...)
+		current.end = i + 1
+	}
+	closeCurrent()
+	return batches, nil
+}
+
+// coalescer gathers the entries of concurrent calls and uploads them together once the interval has passed since
+// the first of them, so that a burst of messages does not make a call each
+type coalescer struct {
+	interval time.Duration
+	// timeout bounds the upload of a flush
+	timeout time.Duration
+	upload  func(ctx context.Context, entries []models.PainDescriptionLogEntry) error
+
+	mu    sync.Mutex
+	group *flushGroup
+}
+
+// flushGroup is the entries of the calls waiting for the same flush
+type flushGroup struct {
+	// parts are the entries of each call, nil if the call gave up before the flush started
+	parts   [][]models.PainDescriptionLogEntry
+	started bool
+	done    chan struct{}
+	errs    []error
+}
+
+// add waits for the entries to be uploaded with the next flush. If ctx is done before the flush has started, the
+// entries are left out of it. If it is done during the flush, add returns right away without knowing whether the
+// entries were saved
+func (c *coalescer) add(ctx context.Context, entries []models.PainDescriptionLogEntry) error {
+	c.mu.Lock()
+	g := c.group
+	if g == nil {
+		g = &flushGroup{done: make(chan struct{})}
+		c.group = g
+		time.AfterFunc(c.interval, func() { c.flush(g) })
+	}
+	slot := len(g.parts)
+	g.parts = append(g.parts, entries)
+	c.mu.Unlock()
+
+	select {
+	case <-g.done:
+		return g.errs[slot]
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	started := g.started
+	if !started {
+		g.parts[slot] = nil
+	}
+	c.mu.Unlock()
+	if !started {
+		return fmt.Errorf("unable to upload logs: %w", ctx.Err())
+	}
+	// The flush goes on without the caller, so a retry of the entries, e.g. by the outbox, may save them twice
+	return fmt.Errorf("unable to upload logs, they may still be saved: %w", ctx.Err())
+}
+
+// flush uploads the entries of the group and gives each call the results of its own entries
+func (c *coalescer) flush(g *flushGroup) {
+	c.mu.Lock()
+	g.started = true
+	c.group = nil
+	c.mu.Unlock()
+
+	var all []models.PainDescriptionLogEntry
+	offsets := make([]int, len(g.parts))
+	for i, part := range g.parts {
+		offsets[i] = len(all)
+		all = append(all, part...)
+	}
+
+	g.errs = make([]error, len(g.parts))
+	if len(all) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err := c.upload(ctx, all)
+		cancel()
+
+		uploadErr, partial := err.(*UploadError)
+		for i, part := range g.parts {
+			switch {
+			case part == nil || err == nil:
+			case partial:
+				g.errs[i] = uploadErr.slice(offsets[i], offsets[i]+len(part))
+			default:
+				g.errs[i] = err
+			}
+		}
+	}
+	close(g.done)
+}
@@ -0,0 +1,291 @@
+package database_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azingest"
+	"io"
+	"strings"
+	"sync"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"testing"
+	"time"
+)
+
+// recordingUploader records the uploaded calls and fails the ones containing failOn
+type recordingUploader struct {
+	mu     sync.Mutex
+	failOn string
+	calls  [][]byte
+	gzip   []bool
+}
+
+func (r *recordingUploader) Upload(_ context.Context, _ string, _ string, logs []byte, opts *azingest.UploadOptions) (azingest.UploadResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	compressed := opts != nil && opts.ContentEncoding != nil && *opts.ContentEncoding == "gzip"
+	r.calls = append(r.calls, logs)
+	r.gzip = append(r.gzip, compressed)
+	if r.failOn != "" && strings.Contains(string(logs), r.failOn) {
+		return azingest.UploadResponse{}, errors.New("bad request")
+	}
+	return azingest.UploadResponse{}, nil
+}
+
+func (r *recordingUploader) numCalls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.calls)
+}
+
+func newTestEntries(t *testing.T, n int) []models.PainDescriptionLogEntry {
+	t.Helper()
+	var entries []models.PainDescriptionLogEntry
+	for i := 0; i < n; i++ {
+		entry := newTestLogEntry(t, time.Date(2023, 8, 1, 12, i, 0, 0, time.UTC), i%11)
+		entry.Description = "entry " + string(rune('a'+i))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// oneEntryLimit is a batch size limit that fits one of the test entries but not two
+func oneEntryLimit(t *testing.T, entries []models.PainDescriptionLogEntry) int {
+	t.Helper()
+	largest := 0
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatalf("error marshalling entry, got %v", err)
+		}
+		if len(data) > largest {
+			largest = len(data)
+		}
+	}
+	return largest + 2
+}
+
+func decodeUpload(t *testing.T, logs []byte) []models.PainDescriptionLogEntry {
+	t.Helper()
+	var entries []models.PainDescriptionLogEntry
+	if err := json.Unmarshal(logs, &entries); err != nil {
+		t.Fatalf("upload is not a JSON array of entries: %v", err)
+	}
+	return entries
+}
+
+func TestLogAnalyticsClient_ShouldSplitUploadsBySize(t *testing.T) {
+	t.Parallel()
+	entries := newTestEntries(t, 7)
+	// Room for two entries per call
+	maxBytes := 2 * oneEntryLimit(t, entries)
+	uploader := &recordingUploader{}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithMaxBatchBytes(maxBytes))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	if err := client.SavePainDescriptionsToLogAnalytics(context.Background(), entries); err != nil {
+		t.Fatalf("SavePainDescriptionsToLogAnalytics() error = %v", err)
+	}
+
+	if len(uploader.calls) != 4 {
+		t.Fatalf("expected the entries to be split into 4 calls, got %d", len(uploader.calls))
+	}
+	var uploaded []models.PainDescriptionLogEntry
+	for _, call := range uploader.calls {
+		if len(call) > maxBytes {
+			t.Errorf("upload of %d bytes is over the limit", len(call))
+		}
+		uploaded = append(uploaded, decodeUpload(t, call)...)
+	}
+	if len(uploaded) != len(entries) {
+		t.Fatalf("got %d entries uploaded, want %d", len(uploaded), len(entries))
+	}
+	for i := range entries {
+		if uploaded[i].Description != entries[i].Description {
+			t.Errorf("entry %d is %q, want %q", i, uploaded[i].Description, entries[i].Description)
+		}
+	}
+}
+
+func TestLogAnalyticsClient_ShouldGzipUploads(t *testing.T) {
+	t.Parallel()
+	uploader := &recordingUploader{}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithGzip())
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	if err := client.SavePainDescriptionsToLogAnalytics(context.Background(), newTestEntries(t, 2)); err != nil {
+		t.Fatalf("SavePainDescriptionsToLogAnalytics() error = %v", err)
+	}
+
+	if len(uploader.calls) != 1 || !uploader.gzip[0] {
+		t.Fatalf("expected one gzipped call, got %d calls, gzip %v", len(uploader.calls), uploader.gzip)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(uploader.calls[0]))
+	if err != nil {
+		t.Fatalf("upload is not gzipped: %v", err)
+	}
+	logs, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("error decompressing upload, got %v", err)
+	}
+	if got := decodeUpload(t, logs); len(got) != 2 {
+		t.Errorf("got %d entries, want 2", len(got))
+	}
+}
+
+func TestLogAnalyticsClient_ShouldReportFailedBatches(t *testing.T) {
+	t.Parallel()
+	entries := newTestEntries(t, 4)
+	maxBytes := oneEntryLimit(t, entries)
+	uploader := &recordingUploader{failOn: "entry c"}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithMaxBatchBytes(maxBytes))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	// Too large to ever be uploaded
+	entries[1].Description = strings.Repeat("x", maxBytes)
+
+	err = client.SavePainDescriptionsToLogAnalytics(context.Background(), entries)
+
+	var uploadErr *database.UploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("SavePainDescriptionsToLogAnalytics() error = %v, want an UploadError", err)
+	}
+	failed := uploadErr.Failed(entries)
+	if len(failed) != 2 || failed[0].Description != entries[1].Description || failed[1].Description != "entry c" {
+		t.Errorf("unexpected failed entries %+v", failed)
+	}
+	if len(uploader.calls) != 3 {
+		t.Errorf("expected the entries that fit to be uploaded one by one, got %d calls", len(uploader.calls))
+	}
+}
+
+func TestLogAnalyticsClient_ShouldCoalesceConcurrentSaves(t *testing.T) {
+	t.Parallel()
+	entries := newTestEntries(t, 3)
+	uploader := &recordingUploader{failOn: "entry b"}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream", database.WithCustomClient(uploader),
+		database.WithFlushInterval(50*time.Millisecond), database.WithMaxBatchBytes(oneEntryLimit(t, entries)))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = client.SavePainDescriptionsToLogAnalytics(context.Background(), entries[i:i+1])
+		}(i)
+	}
+	wg.Wait()
+
+	// Each entry is a batch of its own with the size limit, but all were sent in the same flush
+	if uploader.numCalls() != 3 {
+		t.Errorf("got %d calls, want 3", uploader.numCalls())
+	}
+	var uploadErr *database.UploadError
+	if errs[0] != nil || errs[2] != nil || !errors.As(errs[1], &uploadErr) {
+		t.Fatalf("got errors %v, want only the save of entry b to fail", errs)
+	}
+	if failed := uploadErr.Failed(entries[1:2]); len(failed) != 1 {
+		t.Errorf("the error should be relative to the entries of the save, got %+v", uploadErr.Batches)
+	}
+}
+
+func TestLogAnalyticsClient_CoalescedSaveShouldGiveUpWhenCancelled(t *testing.T) {
+	t.Parallel()
+	uploader := &recordingUploader{}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = client.SavePainDescriptionsToLogAnalytics(ctx, newTestEntries(t, 1))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SavePainDescriptionsToLogAnalytics() error = %v, want DeadlineExceeded", err)
+	}
+	if uploader.numCalls() != 0 {
+		t.Errorf("got %d calls, want none", uploader.numCalls())
+	}
+}
+
+// hangingUploader does not answer until the ctx of the call ends
+type hangingUploader struct{}
+
+func (hangingUploader) Upload(ctx context.Context, _ string, _ string, _ []byte, _ *azingest.UploadOptions) (azingest.UploadResponse, error) {
+	<-ctx.Done()
+	return azingest.UploadResponse{}, ctx.Err()
+}
+
+func TestLogAnalyticsClient_CoalescedSaveShouldStopTheUploadAfterTheFlushTimeout(t *testing.T) {
+	t.Parallel()
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(hangingUploader{}), database.WithFlushInterval(time.Millisecond),
+		database.WithFlushTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	err = client.SavePainDescriptionsToLogAnalytics(context.Background(), newTestEntries(t, 1))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SavePainDescriptionsToLogAnalytics() error = %v, want DeadlineExceeded", err)
+	}
+}
+
+// blockingUploader accepts an upload only when released, like a call to an API that hangs
+type blockingUploader struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingUploader) Upload(_ context.Context, _ string, _ string, _ []byte, _ *azingest.UploadOptions) (azingest.UploadResponse, error) {
+	close(b.started)
+	<-b.release
+	return azingest.UploadResponse{}, nil
+}
+
+func TestLogAnalyticsClient_CoalescedSaveShouldNotWaitForFlushWhenCancelled(t *testing.T) {
+	t.Parallel()
+	uploader := &blockingUploader{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(uploader.release)
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithFlushInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-uploader.started
+		cancel()
+	}()
+
+	entries := newTestEntries(t, 1)
+	saved := make(chan error, 1)
+	go func() {
+		saved <- client.SavePainDescriptionsToLogAnalytics(ctx, entries)
+	}()
+	select {
+	case err := <-saved:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("SavePainDescriptionsToLogAnalytics() error = %v, want Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the save to return once cancelled")
+	}
+}
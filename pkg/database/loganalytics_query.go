@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azquery"
+	"strings"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// List queries the entries of the user from the Log Analytics workspace. The entries have no store ID, as Log
+// Analytics rows cannot be changed, but the entries saved since schema version 2 have an EntryID. The corrections
+// and retractions are listed as records of their own, see LatestVersions
+func (lac *LogAnalyticsClient) List(ctx context.Context, userName string, from, to time.Time) ([]StoredEntry, error) {
+	if lac.queryClient == nil || lac.workspaceId == "" {
+		return nil, fmt.Errorf("no workspace configured for reading: %w", ErrNotSupported)
+	}
+
+	query := fmt.Sprintf(`%s
+| where userName == %s and timestamp >= datetime(%s) and timestamp < datetime(%s)
+| project timestamp, level, locationId, sideId, description, numbness, numbnessDescription, locationName, sideName, userName, parsedBy, promptVersion,
+    entryId, batchId, chatId, messageId, source, schemaVersion, recordedAt, supersedes, retracted
+| order by timestamp asc`,
+		lac.tableName(), kqlString(userName), from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano))
+
+	timespan := azquery.NewTimeInterval(from.UTC(), to.UTC())
+	resp, err := lac.queryClient.QueryWorkspace(ctx, lac.workspaceId, azquery.Body{
+		Query:    &query,
+		Timespan: &timespan,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query logs: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("unable to query logs: %w", resp.Error)
+	}
+	if len(resp.Tables) == 0 {
+		return nil, nil
+	}
+
+	return parseLogsTable(resp.Tables[0])
+}
+
+// tableName is the name of the custom table, which the stream name is derived from in data.bicep
+func (lac *LogAnalyticsClient) tableName() string {
+	return strings.TrimPrefix(lac.streamName, "Custom-")
+}
+
+// kqlString quotes s as a KQL string literal
+func kqlString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// parseLogsTable maps the rows of a query result to entries by the column names
+func parseLogsTable(table *azquery.Table) ([]StoredEntry, error) {
+	columns := make(map[string]int, len(table.Columns))
+	for i, col := range table.Columns {
+		if col.Name != nil {
+			columns[*col.Name] = i
+		}
+	}
+
+	entries := make([]StoredEntry, 0, len(table.Rows))
+	for _, row := range table.Rows {
+		r := logsRow{row: row, columns: columns}
+		var e StoredEntry
+
+		timestamp := r.string("timestamp")
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timestamp %q: %w", timestamp, err)
+		}
+
+		e.PainDescriptionLogEntry = models.PainDescriptionLogEntry{
+			PainDescription: models.PainDescription{
+				Timestamp:           t,
+				Level:               r.int("level"),
+				LocationId:          r.int("locationId"),
+				SideId:              r.int("sideId"),
+				Description:         r.string("description"),
+				Numbness:            r.bool("numbness"),
+				NumbnessDescription: r.string("numbnessDescription"),
+			},
+			LocationName:  r.string("locationName"),
+			SideName:      r.string("sideName"),
+			UserName:      r.string("userName"),
+			ParsedBy:      r.string("parsedBy"),
+			PromptVersion: r.string("promptVersion"),
+			EntryID:       r.string("entryId"),
+			BatchID:       r.string("batchId"),
+			ChatID:        r.int64("chatId"),
+			MessageID:     r.int("messageId"),
+			Source:        r.string("source"),
+			SchemaVersion: r.int("schemaVersion"),
+			Supersedes:    r.string("supersedes"),
+			Retracted:     r.bool("retracted"),
+		}
+		// Entries saved before the column was added have no time
+		if recordedAt := r.string("recordedAt"); recordedAt != "" {
+			e.RecordedAt, err = time.Parse(time.RFC3339Nano, recordedAt)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse recorded time %q: %w", recordedAt, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// logsRow reads typed values from a row of a query result. Missing columns and nulls read as zero values
+type logsRow struct {
+	row     azquery.Row
+	columns map[string]int
+}
+
+func (r logsRow) value(column string) any {
+	i, ok := r.columns[column]
+	if !ok || i >= len(r.row) {
+		return nil
+	}
+	return r.row[i]
+}
+
+func (r logsRow) string(column string) string {
+	s, _ := r.value(column).(string)
+	return s
+}
+
+func (r logsRow) int(column string) int {
+	// Numbers are decoded from JSON, so they are float64
+	f, _ := r.value(column).(float64)
+	return int(f)
+}
+
+func (r logsRow) int64(column string) int64 {
+	f, _ := r.value(column).(float64)
+	return int64(f)
+}
+
+func (r logsRow) bool(column string) bool {
+	b, _ := r.value(column).(bool)
+	return b
+}
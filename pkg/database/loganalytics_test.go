@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azingest"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azquery"
+	"strings"
 	"t-pain/pkg/database"
 	"t-pain/pkg/models"
 	"testing"
+	"time"
 )
 
 type MockAzureClient struct {
@@ -55,11 +58,109 @@ func TestSavePainDescriptionsToLogAnalytics(t *testing.T) {
 				t.Errorf("error mapping to log entry, got %v", err)
 			}
 
-			err = logAnalyticsClient.SavePainDescriptionsToLogAnalytics([]models.PainDescriptionLogEntry{pdLog})
+			err = logAnalyticsClient.SavePainDescriptionsToLogAnalytics(context.Background(), []models.PainDescriptionLogEntry{pdLog})
 
 			if (err != nil) != tc.wantErr {
 				t.Errorf("SavePainDescriptionsToLogAnalytics() error = %v, wantErr %v", err, tc.wantErr)
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestLogAnalyticsClient_ShouldNotSupportEditing(t *testing.T) {
+	t.Parallel()
+	logAnalyticsClient, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream", database.WithCustomClient(&MockAzureClient{}))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	if err = logAnalyticsClient.Update(context.Background(), 1, models.PainDescriptionLogEntry{}); !errors.Is(err, database.ErrNotSupported) {
+		t.Errorf("Update() error = %v, want ErrNotSupported", err)
+	}
+	if err = logAnalyticsClient.Delete(context.Background(), 1); !errors.Is(err, database.ErrNotSupported) {
+		t.Errorf("Delete() error = %v, want ErrNotSupported", err)
+	}
+}
+
+type MockQueryClient struct {
+	QueryWorkspaceFunc func(ctx context.Context, workspaceID string, body azquery.Body, options *azquery.LogsClientQueryWorkspaceOptions) (azquery.LogsClientQueryWorkspaceResponse, error)
+}
+
+func (mqc *MockQueryClient) QueryWorkspace(ctx context.Context, workspaceID string, body azquery.Body, options *azquery.LogsClientQueryWorkspaceOptions) (azquery.LogsClientQueryWorkspaceResponse, error) {
+	return mqc.QueryWorkspaceFunc(ctx, workspaceID, body, options)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestLogAnalyticsClient_List(t *testing.T) {
+	t.Parallel()
+	var gotQuery, gotWorkspace string
+	mockQueryClient := &MockQueryClient{
+		QueryWorkspaceFunc: func(ctx context.Context, workspaceID string, body azquery.Body, options *azquery.LogsClientQueryWorkspaceOptions) (azquery.LogsClientQueryWorkspaceResponse, error) {
+			gotQuery = *body.Query
+			gotWorkspace = workspaceID
+			resp := azquery.LogsClientQueryWorkspaceResponse{}
+			resp.Tables = []*azquery.Table{{
+				Columns: []*azquery.Column{
+					{Name: stringPtr("timestamp")}, {Name: stringPtr("level")}, {Name: stringPtr("locationId")},
+					{Name: stringPtr("sideId")}, {Name: stringPtr("description")}, {Name: stringPtr("numbness")},
+					{Name: stringPtr("numbnessDescription")}, {Name: stringPtr("locationName")}, {Name: stringPtr("sideName")},
+					{Name: stringPtr("userName")}, {Name: stringPtr("entryId")}, {Name: stringPtr("chatId")},
+					{Name: stringPtr("source")}, {Name: stringPtr("schemaVersion")}, {Name: stringPtr("recordedAt")},
+					{Name: stringPtr("supersedes")}, {Name: stringPtr("retracted")},
+				},
+				Rows: []azquery.Row{
+					{"2023-08-01T20:00:00Z", float64(7), float64(9), float64(1), "Back hurts", true, nil, "Lower Back", "Both", "Test",
+						"entry-1", float64(1111111111111111), "voice", float64(3), "2023-08-01T20:05:00.5Z", "entry-0", true},
+				},
+			}}
+			return resp, nil
+		},
+	}
+
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "Custom-PainDescriptions_CL",
+		database.WithCustomClient(&MockAzureClient{}), database.WithCustomQueryClient(mockQueryClient), database.WithQueryWorkspace("workspace"))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	entries, err := client.List(context.Background(), `Test"`, time.Now().Add(-24*time.Hour), time.Now())
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+
+	if gotWorkspace != "workspace" {
+		t.Errorf("expected workspace to be queried, got %q", gotWorkspace)
+	}
+	if !strings.HasPrefix(gotQuery, "PainDescriptions_CL") || !strings.Contains(gotQuery, `userName == "Test\""`) {
+		t.Errorf("unexpected query %s", gotQuery)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Level != 7 || e.LocationId != 9 || !e.Numbness || e.NumbnessDescription != "" || e.UserName != "Test" ||
+		!e.Timestamp.Equal(time.Date(2023, 8, 1, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.EntryID != "entry-1" || e.ChatID != 1111111111111111 || e.Source != models.SourceVoice || e.SchemaVersion != 3 {
+		t.Errorf("unexpected metadata %+v", e)
+	}
+	if e.Supersedes != "entry-0" || !e.Retracted || !e.RecordedAt.Equal(time.Date(2023, 8, 1, 20, 5, 0, 5e8, time.UTC)) {
+		t.Errorf("unexpected version %+v", e)
+	}
+}
+
+func TestLogAnalyticsClient_ListWithoutWorkspaceShouldNotBeSupported(t *testing.T) {
+	t.Parallel()
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream", database.WithCustomClient(&MockAzureClient{}))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+
+	_, err = client.List(context.Background(), "Test", time.Now().Add(-time.Hour), time.Now())
+	if !errors.Is(err, database.ErrNotSupported) {
+		t.Errorf("List() error = %v, want ErrNotSupported", err)
+	}
+}
@@ -0,0 +1,369 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// ErrQueued is returned by Outbox.Append when the store did not accept the entries right away. They are saved in
+// the outbox and uploaded in the background, so the caller should not try again
+var ErrQueued = errors.New("entries queued for upload")
+
+const (
+	defaultOutboxBaseDelay = 5 * time.Second
+	defaultOutboxMaxDelay  = 10 * time.Minute
+	outboxExt              = ".json"
+	// outboxTmpExt is the extension of a batch being written. A leftover one was never acknowledged to the user
+	outboxTmpExt = ".tmp"
+	// outboxBadExt is the extension of a batch that cannot be read or that the store rejected. It is kept on disk
+	// for fixing by hand
+	outboxBadExt = ".bad"
+)
+
+// Outbox is a Store that writes new entries to disk before appending them to the underlying store. Entries the store
+// does not accept are retried in the background with backoff by Run, also after a restart. Reading and editing go
+// straight to the underlying store
+type Outbox struct {
+	Store
+	dir       string
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	mu sync.Mutex
+	// pending are the file names of the batches on disk
+	pending map[string]bool
+	// claimed are the batches being uploaded, so that Append and Flush do not upload the same batch twice
+	claimed map[string]bool
+	seq     int
+	wake    chan struct{}
+}
+
+type OutboxOption func(*Outbox)
+
+// WithOutboxBackoff sets the delay before the first retry, which doubles for every failed retry up to max
+func WithOutboxBackoff(base, max time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		o.baseDelay = base
+		o.maxDelay = max
+	}
+}
+
+// NewOutbox creates an outbox for the store in dir, creating the directory if needed. The batches left in dir by an
+// earlier run are uploaded once Run is started
+func NewOutbox(dir string, store Store, opts ...OutboxOption) (*Outbox, error) {
+	o := &Outbox{
+		Store:     store,
+		dir:       dir,
+		baseDelay: defaultOutboxBaseDelay,
+		maxDelay:  defaultOutboxMaxDelay,
+		pending:   make(map[string]bool),
+		claimed:   make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create outbox directory: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read outbox directory: %w", err)
+	}
+	for _, f := range files {
+		switch filepath.Ext(f.Name()) {
+		case outboxExt:
+			o.pending[f.Name()] = true
+		case outboxTmpExt:
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return nil, fmt.Errorf("unable to remove unfinished outbox file: %w", err)
+			}
+		}
+	}
+	if len(o.pending) > 0 {
+		log.Printf("Outbox has %d batches waiting for upload", len(o.pending))
+	}
+	return o, nil
+}
+
+// Append writes the entries to the outbox and appends them to the store. If the store fails, the entries stay in
+// the outbox and the error wraps ErrQueued. Only if the outbox cannot be written either the entries are lost. The
+// entries the store rejects are set aside instead, and the error wraps ErrRejected
+func (o *Outbox) Append(ctx context.Context, entries []models.PainDescriptionLogEntry) error {
+	name, err := o.write(entries)
+	if err != nil {
+		// The entries can still be saved directly, they are just not retried if that fails
+		log.Printf("Error writing to outbox: %v", err)
+		return o.Store.Append(ctx, entries)
+	}
+
+	err = o.Store.Append(ctx, entries)
+	if err != nil && rejected(err) {
+		o.keepFailed(name, entries, err)
+		log.Printf("Setting aside outbox batch %s the store rejected: %v", name, err)
+		o.setAside(name)
+		return fmt.Errorf("unable to append entries: %w", err)
+	}
+	if err != nil {
+		o.keepFailed(name, entries, err)
+		o.unclaim(name)
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+		return fmt.Errorf("%w: %w", ErrQueued, err)
+	}
+	if err := o.remove(name); err != nil {
+		// The entries were saved, at worst they are uploaded again
+		log.Printf("Error removing uploaded batch from outbox: %v", err)
+	}
+	return nil
+}
+
+// Len returns the number of batches waiting for upload
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Run uploads the queued batches until ctx is done. It waits between the attempts, doubling the delay after every
+// failed one
+func (o *Outbox) Run(ctx context.Context) {
+	failures := 0
+	for {
+		if o.Len() == 0 {
+			failures = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+			}
+		}
+
+		// The queued batches were just refused, so the store needs a moment before trying again
+		timer := time.NewTimer(o.backoff(failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := o.Flush(ctx); err != nil {
+			failures++
+			log.Printf("Error uploading the outbox, %d batches waiting: %v", o.Len(), err)
+			continue
+		}
+		failures = 0
+	}
+}
+
+// Flush appends the queued batches to the store, oldest first. Stops at the first batch the store does not accept
+// for now, the batches it will never accept are set aside
+func (o *Outbox) Flush(ctx context.Context) error {
+	names := o.claimAll()
+	for i, name := range names {
+		entries, err := o.read(name)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			// Retrying does not help, so set the batch aside instead of blocking the rest
+			log.Printf("Setting aside unreadable outbox batch %s: %v", name, err)
+			o.setAside(name)
+			continue
+		}
+		if err == nil {
+			err = o.Store.Append(ctx, entries)
+			if err != nil && rejected(err) {
+				o.keepFailed(name, entries, err)
+				log.Printf("Setting aside outbox batch %s the store rejected: %v", name, err)
+				o.setAside(name)
+				continue
+			}
+			if err != nil {
+				o.keepFailed(name, entries, err)
+				err = fmt.Errorf("unable to append batch %s: %w", name, err)
+			}
+		}
+		if err == nil {
+			err = o.remove(name)
+		}
+		if err != nil {
+			o.unclaim(names[i:]...)
+			return err
+		}
+	}
+	return nil
+}
+
+// rejected tells whether the store will never accept the entries. Of an *UploadError all the failed batches must be
+// rejected, as the others may still be saved by a retry
+func rejected(err error) bool {
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) {
+		return errors.Is(err, ErrRejected)
+	}
+	for _, b := range uploadErr.Batches {
+		if b.Err != nil && !errors.Is(b.Err, ErrRejected) {
+			return false
+		}
+	}
+	return true
+}
+
+// backoff returns the delay before the next attempt after the given number of failed ones
+func (o *Outbox) backoff(failures int) time.Duration {
+	delay := o.baseDelay << failures
+	if delay > o.maxDelay || delay <= 0 {
+		delay = o.maxDelay
+	}
+	return delay
+}
+
+// write saves the entries as a new batch, claimed by the caller. The names sort in the order they were written
+func (o *Outbox) write(entries []models.PainDescriptionLogEntry) (string, error) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal entries: %w", err)
+	}
+
+	o.mu.Lock()
+	o.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), o.seq, outboxExt)
+	o.claimed[name] = true
+	o.mu.Unlock()
+
+	// Renaming is atomic, so a crash while writing leaves only a temporary file that is removed on the next start
+	path := filepath.Join(o.dir, name)
+	tmp := strings.TrimSuffix(path, outboxExt) + outboxTmpExt
+	err = writeFileSync(tmp, data)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		o.unclaim(name)
+		return "", fmt.Errorf("unable to write outbox file: %w", err)
+	}
+
+	o.mu.Lock()
+	o.pending[name] = true
+	o.mu.Unlock()
+	return name, nil
+}
+
+// keepFailed leaves only the entries the store did not save in the batch, when it tells which ones those are, so
+// that the saved ones are not uploaded twice
+func (o *Outbox) keepFailed(name string, entries []models.PainDescriptionLogEntry, err error) {
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) {
+		return
+	}
+	data, err := json.Marshal(uploadErr.Failed(entries))
+	if err != nil {
+		log.Printf("Error marshalling the failed entries of outbox batch %s: %v", name, err)
+		return
+	}
+	path := filepath.Join(o.dir, name)
+	tmp := strings.TrimSuffix(path, outboxExt) + outboxTmpExt
+	err = writeFileSync(tmp, data)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Error rewriting outbox batch %s, the saved entries may be uploaded again: %v", name, err)
+	}
+}
+
+// writeFileSync writes the file and syncs it to disk, so that an acknowledged batch survives a power loss
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (o *Outbox) read(name string) ([]models.PainDescriptionLogEntry, error) {
+	data, err := os.ReadFile(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read outbox file: %w", err)
+	}
+	var entries []models.PainDescriptionLogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse outbox file: %w", err)
+	}
+	return entries, nil
+}
+
+// remove deletes an uploaded batch
+func (o *Outbox) remove(name string) error {
+	err := os.Remove(filepath.Join(o.dir, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		o.unclaim(name)
+		return fmt.Errorf("unable to remove uploaded outbox file: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.pending, name)
+	delete(o.claimed, name)
+	return nil
+}
+
+// setAside renames a claimed batch so that it is no longer uploaded. If that fails, the batch stays pending and
+// is tried again with the next flush
+func (o *Outbox) setAside(name string) {
+	path := filepath.Join(o.dir, name)
+	if err := os.Rename(path, strings.TrimSuffix(path, outboxExt)+outboxBadExt); err != nil {
+		log.Printf("Error setting aside outbox batch %s: %v", name, err)
+		o.unclaim(name)
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.pending, name)
+	delete(o.claimed, name)
+}
+
+// claimAll claims the pending batches nobody else is uploading and returns them oldest first
+func (o *Outbox) claimAll() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var names []string
+	for name := range o.pending {
+		if !o.claimed[name] {
+			o.claimed[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (o *Outbox) unclaim(names ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, name := range names {
+		delete(o.claimed, name)
+	}
+}
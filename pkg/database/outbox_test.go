@@ -0,0 +1,314 @@
+package database_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/azingest"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"testing"
+	"time"
+)
+
+// flakyUploader fails the first uploads and records the logs it accepts after that
+type flakyUploader struct {
+	mu       sync.Mutex
+	failures int
+	accepted [][]models.PainDescriptionLogEntry
+}
+
+func (f *flakyUploader) Upload(_ context.Context, _ string, _ string, logs []byte, _ *azingest.UploadOptions) (azingest.UploadResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return azingest.UploadResponse{}, errors.New("service unavailable")
+	}
+	var entries []models.PainDescriptionLogEntry
+	if err := json.Unmarshal(logs, &entries); err != nil {
+		return azingest.UploadResponse{}, err
+	}
+	f.accepted = append(f.accepted, entries)
+	return azingest.UploadResponse{}, nil
+}
+
+func (f *flakyUploader) uploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.accepted)
+}
+
+func newTestOutbox(t *testing.T, dir string, uploader *flakyUploader) *database.Outbox {
+	t.Helper()
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream", database.WithCustomClient(uploader))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	outbox, err := database.NewOutbox(dir, client, database.WithOutboxBackoff(time.Millisecond, 5*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating outbox, got %v", err)
+	}
+	return outbox
+}
+
+func outboxFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("error listing outbox, got %v", err)
+	}
+	return files
+}
+
+func TestOutbox_AppendShouldUploadRightAway(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	uploader := &flakyUploader{}
+	outbox := newTestOutbox(t, dir, uploader)
+
+	err := outbox.Append(context.Background(), []models.PainDescriptionLogEntry{newTestLogEntry(t, time.Now(), 4)})
+	if err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	if uploader.uploads() != 1 {
+		t.Errorf("got %d uploads, want 1", uploader.uploads())
+	}
+	if outbox.Len() != 0 || len(outboxFiles(t, dir)) != 0 {
+		t.Errorf("uploaded batch should be removed from the outbox, got %v", outboxFiles(t, dir))
+	}
+}
+
+func TestOutbox_ShouldKeepFailedUploadsOverRestart(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	outbox := newTestOutbox(t, dir, &flakyUploader{failures: 2})
+	entry := newTestLogEntry(t, time.Now(), 4)
+
+	err := outbox.Append(context.Background(), []models.PainDescriptionLogEntry{entry})
+	if !errors.Is(err, database.ErrQueued) {
+		t.Fatalf("Append() error = %v, want ErrQueued", err)
+	}
+	err = outbox.Append(context.Background(), []models.PainDescriptionLogEntry{newTestLogEntry(t, time.Now(), 5)})
+	if !errors.Is(err, database.ErrQueued) {
+		t.Fatalf("Append() error = %v, want ErrQueued", err)
+	}
+	if outbox.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", outbox.Len())
+	}
+
+	// A new outbox in the same directory picks up the batches, like after a restart
+	uploader := &flakyUploader{}
+	restarted := newTestOutbox(t, dir, uploader)
+	if restarted.Len() != 2 {
+		t.Fatalf("Len() after restart = %d, want 2", restarted.Len())
+	}
+	if err := restarted.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if uploader.uploads() != 2 || restarted.Len() != 0 {
+		t.Fatalf("got %d uploads and %d waiting, want 2 and 0", uploader.uploads(), restarted.Len())
+	}
+	// The oldest batch is uploaded first
+	if uploader.accepted[0][0].Level != entry.Level {
+		t.Errorf("first upload has level %d, want %d", uploader.accepted[0][0].Level, entry.Level)
+	}
+}
+
+func TestOutbox_RunShouldRetryUntilAccepted(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	uploader := &flakyUploader{failures: 3}
+	outbox := newTestOutbox(t, dir, uploader)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		outbox.Run(ctx)
+		close(stopped)
+	}()
+
+	err := outbox.Append(context.Background(), []models.PainDescriptionLogEntry{newTestLogEntry(t, time.Now(), 4)})
+	if !errors.Is(err, database.ErrQueued) {
+		t.Fatalf("Append() error = %v, want ErrQueued", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for outbox.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-stopped
+	if outbox.Len() != 0 || uploader.uploads() != 1 {
+		t.Errorf("got %d uploads and %d waiting, want 1 and 0", uploader.uploads(), outbox.Len())
+	}
+}
+
+func TestOutbox_ShouldSetAsideUnreadableBatches(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001-000001.json"), []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("error writing batch, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000002-000001.tmp"), []byte("[]"), 0o600); err != nil {
+		t.Fatalf("error writing batch, got %v", err)
+	}
+	uploader := &flakyUploader{}
+	outbox := newTestOutbox(t, dir, uploader)
+
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if outbox.Len() != 0 || uploader.uploads() != 0 {
+		t.Errorf("got %d uploads and %d waiting, want 0 and 0", uploader.uploads(), outbox.Len())
+	}
+	files := outboxFiles(t, dir)
+	if len(files) != 1 || filepath.Ext(files[0]) != ".bad" {
+		t.Errorf("got files %v, want only the batch set aside", files)
+	}
+}
+
+func TestOutbox_ShouldKeepOnlyTheFailedBatches(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	entries := newTestEntries(t, 3)
+	uploader := &recordingUploader{failOn: "entry b"}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithMaxBatchBytes(oneEntryLimit(t, entries)))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	outbox, err := database.NewOutbox(dir, client)
+	if err != nil {
+		t.Fatalf("error creating outbox, got %v", err)
+	}
+
+	err = outbox.Append(context.Background(), entries)
+	if !errors.Is(err, database.ErrQueued) {
+		t.Fatalf("Append() error = %v, want ErrQueued", err)
+	}
+
+	files := outboxFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("got files %v, want one batch", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("error reading batch, got %v", err)
+	}
+	if kept := decodeUpload(t, data); len(kept) != 1 || kept[0].Description != "entry b" {
+		t.Errorf("expected only the failed entry to be kept, got %+v", kept)
+	}
+}
+
+// rejectingUploader refuses every upload like the API refuses invalid data
+type rejectingUploader struct{}
+
+func (rejectingUploader) Upload(context.Context, string, string, []byte, *azingest.UploadOptions) (azingest.UploadResponse, error) {
+	return azingest.UploadResponse{}, &azcore.ResponseError{StatusCode: http.StatusBadRequest, ErrorCode: "InvalidStream"}
+}
+
+func writeTestBatch(t *testing.T, path string, entries ...models.PainDescriptionLogEntry) {
+	t.Helper()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("error marshalling batch, got %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("error writing batch, got %v", err)
+	}
+}
+
+func TestOutbox_FlushShouldSetAsideRejectedBatches(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	entries := newTestEntries(t, 2)
+	limit := oneEntryLimit(t, entries)
+	tooLarge := entries[0]
+	tooLarge.Description = strings.Repeat("x", limit)
+	writeTestBatch(t, filepath.Join(dir, "00000000000000000001-000001.json"), tooLarge)
+	writeTestBatch(t, filepath.Join(dir, "00000000000000000002-000001.json"), entries[1])
+	uploader := &recordingUploader{}
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream",
+		database.WithCustomClient(uploader), database.WithMaxBatchBytes(limit))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	outbox, err := database.NewOutbox(dir, client)
+	if err != nil {
+		t.Fatalf("error creating outbox, got %v", err)
+	}
+
+	// The rejected batch must not block the newer one
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if outbox.Len() != 0 || uploader.numCalls() != 1 {
+		t.Errorf("got %d uploads and %d waiting, want 1 and 0", uploader.numCalls(), outbox.Len())
+	}
+	files := outboxFiles(t, dir)
+	if len(files) != 1 || filepath.Ext(files[0]) != ".bad" {
+		t.Errorf("got files %v, want only the rejected batch set aside", files)
+	}
+}
+
+func TestOutbox_AppendShouldNotQueueRejectedEntries(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	client, err := database.NewLogAnalyticsClient("endpoint", "testRule", "testStream", database.WithCustomClient(rejectingUploader{}))
+	if err != nil {
+		t.Fatalf("error creating client, got %v", err)
+	}
+	outbox, err := database.NewOutbox(dir, client)
+	if err != nil {
+		t.Fatalf("error creating outbox, got %v", err)
+	}
+
+	err = outbox.Append(context.Background(), []models.PainDescriptionLogEntry{newTestLogEntry(t, time.Now(), 4)})
+	if !errors.Is(err, database.ErrRejected) || errors.Is(err, database.ErrQueued) {
+		t.Fatalf("Append() error = %v, want ErrRejected", err)
+	}
+	if outbox.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", outbox.Len())
+	}
+	files := outboxFiles(t, dir)
+	if len(files) != 1 || filepath.Ext(files[0]) != ".bad" {
+		t.Errorf("got files %v, want the batch set aside", files)
+	}
+}
+
+func TestOutbox_ShouldRetrySettingAsideWhenItFails(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001-000001.json"), []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("error writing batch, got %v", err)
+	}
+	// A directory in the way makes the rename fail
+	bad := filepath.Join(dir, "00000000000000000001-000001.bad")
+	if err := os.Mkdir(bad, 0o700); err != nil {
+		t.Fatalf("error creating directory, got %v", err)
+	}
+	outbox := newTestOutbox(t, dir, &flakyUploader{})
+
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if outbox.Len() != 1 {
+		t.Fatalf("Len() = %d, want the batch to stay pending", outbox.Len())
+	}
+
+	if err := os.Remove(bad); err != nil {
+		t.Fatalf("error removing directory, got %v", err)
+	}
+	if err := outbox.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if outbox.Len() != 0 {
+		t.Errorf("Len() = %d, want the batch set aside by the next flush", outbox.Len())
+	}
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// sqliteTimeFormat is a fixed width UTC format, so that the timestamps sort correctly as text
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// sqliteMigrations are run in order on startup. The index of the last applied migration + 1 is stored in the
+// user_version pragma, so new migrations must only ever be appended to the end
+var sqliteMigrations = []string{
+	`CREATE TABLE pain_descriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp TEXT NOT NULL,
+		level INTEGER NOT NULL,
+		location_id INTEGER NOT NULL,
+		side_id INTEGER NOT NULL,
+		description TEXT NOT NULL,
+		numbness INTEGER NOT NULL,
+		numbness_description TEXT NOT NULL,
+		location_name TEXT NOT NULL,
+		side_name TEXT NOT NULL,
+		user_name TEXT NOT NULL
+	)`,
+	`CREATE INDEX idx_pain_descriptions_user_timestamp ON pain_descriptions (user_name, timestamp)`,
+	`ALTER TABLE pain_descriptions ADD COLUMN parsed_by TEXT NOT NULL DEFAULT 'model'`,
+	`ALTER TABLE pain_descriptions ADD COLUMN prompt_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE pain_descriptions ADD COLUMN entry_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE pain_descriptions ADD COLUMN batch_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE pain_descriptions ADD COLUMN chat_id INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE pain_descriptions ADD COLUMN message_id INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE pain_descriptions ADD COLUMN source TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE pain_descriptions ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE pain_descriptions ADD COLUMN recorded_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE pain_descriptions ADD COLUMN supersedes TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE pain_descriptions ADD COLUMN retracted INTEGER NOT NULL DEFAULT 0`,
+}
+
+// SQLiteStore is a Store backed by a local SQLite database. Unlike Log Analytics, it allows editing the entries
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens or creates the database at path and migrates it to the latest schema
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sqlite database: %w", err)
+	}
+
+	err = migrateSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to migrate sqlite database: %w", err)
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not support parameters
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Append(ctx context.Context, entries []models.PainDescriptionLogEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %w", err)
+	}
+
+	for _, e := range entries {
+		_, err = tx.ExecContext(ctx, `INSERT INTO pain_descriptions
+			(timestamp, level, location_id, side_id, description, numbness, numbness_description, location_name, side_name, user_name, parsed_by, prompt_version,
+			entry_id, batch_id, chat_id, message_id, source, schema_version, recorded_at, supersedes, retracted)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Timestamp.UTC().Format(sqliteTimeFormat), e.Level, e.LocationId, e.SideId, e.Description, e.Numbness,
+			e.NumbnessDescription, e.LocationName, e.SideName, e.UserName, e.ParsedBy, e.PromptVersion,
+			e.EntryID, e.BatchID, e.ChatID, e.MessageID, e.Source, e.SchemaVersion,
+			e.RecordedAt.UTC().Format(sqliteTimeFormat), e.Supersedes, e.Retracted)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to insert pain description: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit pain descriptions: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) List(ctx context.Context, userName string, from, to time.Time) ([]StoredEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, timestamp, level, location_id, side_id, description, numbness,
+			numbness_description, location_name, side_name, user_name, parsed_by, prompt_version,
+			entry_id, batch_id, chat_id, message_id, source, schema_version, recorded_at, supersedes, retracted
+		FROM pain_descriptions
+		WHERE user_name = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id`,
+		userName, from.UTC().Format(sqliteTimeFormat), to.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("unable to query pain descriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []StoredEntry
+	for rows.Next() {
+		var e StoredEntry
+		var timestamp, recordedAt string
+		err = rows.Scan(&e.ID, &timestamp, &e.Level, &e.LocationId, &e.SideId, &e.Description, &e.Numbness,
+			&e.NumbnessDescription, &e.LocationName, &e.SideName, &e.UserName, &e.ParsedBy, &e.PromptVersion,
+			&e.EntryID, &e.BatchID, &e.ChatID, &e.MessageID, &e.Source, &e.SchemaVersion, &recordedAt, &e.Supersedes,
+			&e.Retracted)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pain description: %w", err)
+		}
+		e.Timestamp, err = time.Parse(sqliteTimeFormat, timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timestamp of entry %d: %w", e.ID, err)
+		}
+		// Entries saved before the column was added have no time
+		if recordedAt != "" {
+			e.RecordedAt, err = time.Parse(sqliteTimeFormat, recordedAt)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse recorded time of entry %d: %w", e.ID, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read pain descriptions: %w", err)
+	}
+	return entries, nil
+}
+
+// Update replaces the contents of the entry. The metadata of where the entry came from is kept
+func (s *SQLiteStore) Update(ctx context.Context, id int64, e models.PainDescriptionLogEntry) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE pain_descriptions SET
+			timestamp = ?, level = ?, location_id = ?, side_id = ?, description = ?, numbness = ?,
+			numbness_description = ?, location_name = ?, side_name = ?, user_name = ?, parsed_by = ?,
+			prompt_version = ?
+		WHERE id = ?`,
+		e.Timestamp.UTC().Format(sqliteTimeFormat), e.Level, e.LocationId, e.SideId, e.Description, e.Numbness,
+		e.NumbnessDescription, e.LocationName, e.SideName, e.UserName, e.ParsedBy, e.PromptVersion, id)
+	if err != nil {
+		return fmt.Errorf("unable to update entry %d: %w", id, err)
+	}
+	return checkAffected(res, id)
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pain_descriptions WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("unable to delete entry %d: %w", id, err)
+	}
+	return checkAffected(res, id)
+}
+
+func checkAffected(res sql.Result, id int64) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to check affected rows for entry %d: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("entry %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package database_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteStore(t *testing.T) *database.SQLiteStore {
+	t.Helper()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("error creating store, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newTestLogEntry(t *testing.T, timestamp time.Time, level int) models.PainDescriptionLogEntry {
+	t.Helper()
+	pd := models.PainDescription{Timestamp: timestamp, Level: level, LocationId: 9, SideId: 1, Description: "Test"}
+	entry, err := pd.MapToLogEntry(1111111111111111111)
+	if err != nil {
+		t.Fatalf("error mapping to log entry, got %v", err)
+	}
+	return entry
+}
+
+func TestSQLiteStore_AppendAndList(t *testing.T) {
+	t.Parallel()
+	store := newTestSQLiteStore(t)
+	now := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	err := store.Append(context.Background(), []models.PainDescriptionLogEntry{
+		newTestLogEntry(t, now.Add(-48*time.Hour), 3),
+		newTestLogEntry(t, now.Add(-time.Hour), 5),
+		newTestLogEntry(t, now, 7),
+	})
+	if err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+
+	entries, err := store.List(context.Background(), "Test", now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry in range, got %d", len(entries))
+	}
+	if entries[0].Level != 5 || !entries[0].Timestamp.Equal(now.Add(-time.Hour)) || entries[0].LocationName != "Lower Back" ||
+		entries[0].ParsedBy != models.ParserModel {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+
+	entries, err = store.List(context.Background(), "Someone else", now.Add(-72*time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries for another user, got %d", len(entries))
+	}
+}
+
+func TestSQLiteStore_ShouldKeepParserAndPromptVersion(t *testing.T) {
+	t.Parallel()
+	store := newTestSQLiteStore(t)
+	now := time.Now()
+
+	pd := models.PainDescription{Timestamp: now, Level: 4, LocationId: 2, SideId: 1, Description: "niska 4", Parser: models.ParserFallback}
+	entry, err := pd.MapToLogEntry(1111111111111111111)
+	if err != nil {
+		t.Fatalf("error mapping to log entry, got %v", err)
+	}
+	entry.PromptVersion = "pain-v1"
+	if err := store.Append(context.Background(), []models.PainDescriptionLogEntry{entry}); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+
+	entries, err := store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List() = %v, %v", entries, err)
+	}
+	if entries[0].ParsedBy != models.ParserFallback {
+		t.Errorf("expected the entry to be parsed by %q, got %q", models.ParserFallback, entries[0].ParsedBy)
+	}
+	if entries[0].PromptVersion != "pain-v1" {
+		t.Errorf("expected prompt version %q, got %q", "pain-v1", entries[0].PromptVersion)
+	}
+}
+
+func TestSQLiteStore_ShouldKeepEntryMetadata(t *testing.T) {
+	t.Parallel()
+	store := newTestSQLiteStore(t)
+	now := time.Now()
+
+	meta := models.NewEntryMetadata(1234, 56, models.SourceVoice)
+	pains := []models.PainDescription{{Timestamp: now, Level: 4, LocationId: 2, SideId: 1, Description: "niska 4"}}
+	entries, err := models.MapToLogEntries(1111111111111111111, pains, meta)
+	if err != nil {
+		t.Fatalf("error mapping to log entries, got %v", err)
+	}
+	if err := store.Append(context.Background(), entries); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+
+	stored, err := store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("List() = %v, %v", stored, err)
+	}
+	e := stored[0]
+	if e.EntryID != entries[0].EntryID || e.BatchID != meta.BatchID || e.ChatID != 1234 || e.MessageID != 56 ||
+		e.Source != models.SourceVoice || e.SchemaVersion != models.LogEntrySchemaVersion {
+		t.Errorf("unexpected metadata %+v", e)
+	}
+
+	// Editing the contents keeps the metadata
+	updated := stored[0].PainDescriptionLogEntry
+	updated.Level = 6
+	updated.EntryID = "changed"
+	if err := store.Update(context.Background(), stored[0].ID, updated); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	stored, _ = store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if stored[0].Level != 6 || stored[0].EntryID != entries[0].EntryID {
+		t.Errorf("expected the level to change and the entry ID to stay, got %+v", stored[0])
+	}
+}
+
+func TestSQLiteStore_UpdateAndDelete(t *testing.T) {
+	t.Parallel()
+	store := newTestSQLiteStore(t)
+	now := time.Now()
+
+	if err := store.Append(context.Background(), []models.PainDescriptionLogEntry{newTestLogEntry(t, now, 3)}); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	entries, err := store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List() = %v, %v", entries, err)
+	}
+	id := entries[0].ID
+
+	updated := entries[0].PainDescriptionLogEntry
+	updated.Level = 8
+	if err = store.Update(context.Background(), id, updated); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	entries, _ = store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if entries[0].Level != 8 {
+		t.Errorf("expected updated level 8, got %d", entries[0].Level)
+	}
+
+	if err = store.Delete(context.Background(), id); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	entries, _ = store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if len(entries) != 0 {
+		t.Errorf("expected no entries after delete, got %d", len(entries))
+	}
+
+	if err = store.Delete(context.Background(), id); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for deleted entry, got %v", err)
+	}
+	if err = store.Update(context.Background(), id, updated); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for deleted entry, got %v", err)
+	}
+}
+
+func TestNewSQLiteStore_ShouldReopenExistingDatabase(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.db")
+	now := time.Now()
+
+	store, err := database.NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("error creating store, got %v", err)
+	}
+	if err = store.Append(context.Background(), []models.PainDescriptionLogEntry{newTestLogEntry(t, now, 3)}); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	store.Close()
+
+	store, err = database.NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("error reopening store, got %v", err)
+	}
+	defer store.Close()
+	entries, err := store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected the entry to survive reopening, got %v, %v", entries, err)
+	}
+}
+
+func TestSQLiteStore_ShouldKeepCorrections(t *testing.T) {
+	t.Parallel()
+	store := newTestSQLiteStore(t)
+	now := time.Now()
+
+	pains := []models.PainDescription{{Timestamp: now, Level: 4, LocationId: 2, SideId: 1, Description: "niska 4"}}
+	entries, err := models.MapToLogEntries(1111111111111111111, pains, models.NewEntryMetadata(1234, 56, models.SourceText))
+	if err != nil {
+		t.Fatalf("error mapping to log entries, got %v", err)
+	}
+	tombstone, err := entries[0].Retract()
+	if err != nil {
+		t.Fatalf("Retract() error = %v", err)
+	}
+	if err := store.Append(context.Background(), append(entries, tombstone)); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+
+	stored, err := store.List(context.Background(), "Test", now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil || len(stored) != 2 {
+		t.Fatalf("List() = %v, %v", stored, err)
+	}
+	e := stored[1]
+	if e.Supersedes != entries[0].EntryID || !e.Retracted || !e.RecordedAt.Equal(tombstone.RecordedAt) {
+		t.Errorf("unexpected tombstone %+v", e)
+	}
+	if resolved := database.LatestVersions(stored); len(resolved) != 0 {
+		t.Errorf("expected the entry to be retracted, got %+v", resolved)
+	}
+}
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"t-pain/pkg/models"
+	"time"
+)
+
+var (
+	// ErrNotSupported is returned by stores that cannot perform the requested operation, e.g. Log Analytics
+	// cannot change data after it has been ingested
+	ErrNotSupported = errors.New("operation not supported by the store")
+	// ErrNotFound is returned when an entry with the given ID does not exist
+	ErrNotFound = errors.New("entry not found")
+	// ErrRejected is wrapped by the errors of entries the store will never accept, e.g. too large ones, so
+	// retrying them does not help
+	ErrRejected = errors.New("entries rejected by the store")
+)
+
+// Store is a storage backend for the pain descriptions. Cancelling the ctx of a call aborts it
+type Store interface {
+	// Append saves new entries
+	Append(ctx context.Context, entries []models.PainDescriptionLogEntry) error
+	// List returns the entries of the user with timestamps in [from, to), oldest first
+	List(ctx context.Context, userName string, from, to time.Time) ([]StoredEntry, error)
+	// Update replaces the entry with the given ID
+	Update(ctx context.Context, id int64, entry models.PainDescriptionLogEntry) error
+	// Delete removes the entry with the given ID
+	Delete(ctx context.Context, id int64) error
+}
+
+// StoredEntry is an entry read back from a Store along with the ID the store knows it by
+type StoredEntry struct {
+	ID int64
+	models.PainDescriptionLogEntry
+}
+
+// Make sure the stores keep implementing the interface
+var (
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*LogAnalyticsClient)(nil)
+	_ Store = (*Outbox)(nil)
+)
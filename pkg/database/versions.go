@@ -0,0 +1,39 @@
+package database
+
+// LatestVersions resolves the corrections and retractions of the entries, as an append-only store keeps every
+// version of an entry as a record of its own. Each entry is replaced by its latest version at the position of its
+// first record, and the retracted entries are left out. Entries without an EntryID, saved before versioning, are
+// kept as they are
+func LatestVersions(entries []StoredEntry) []StoredEntry {
+	latest := make(map[string]int, len(entries))
+	var resolved []StoredEntry
+	for _, e := range entries {
+		id := e.OriginalID()
+		if id == "" {
+			resolved = append(resolved, e)
+			continue
+		}
+		i, ok := latest[id]
+		if !ok {
+			latest[id] = len(resolved)
+			resolved = append(resolved, e)
+			continue
+		}
+		// A retraction is final, even if another version was recorded at the same time
+		current := resolved[i]
+		if current.Retracted {
+			continue
+		}
+		if e.Retracted || e.RecordedAt.After(current.RecordedAt) {
+			resolved[i] = e
+		}
+	}
+
+	result := resolved[:0]
+	for _, e := range resolved {
+		if !e.Retracted {
+			result = append(result, e)
+		}
+	}
+	return result
+}
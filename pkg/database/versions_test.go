@@ -0,0 +1,81 @@
+package database_test
+
+import (
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"testing"
+	"time"
+)
+
+func newVersionedEntry(entryID, supersedes string, level int, recordedAt time.Time, retracted bool) database.StoredEntry {
+	return database.StoredEntry{PainDescriptionLogEntry: models.PainDescriptionLogEntry{
+		PainDescription: models.PainDescription{Level: level},
+		EntryID:         entryID,
+		Supersedes:      supersedes,
+		RecordedAt:      recordedAt,
+		Retracted:       retracted,
+	}}
+}
+
+func TestLatestVersions(t *testing.T) {
+	t.Parallel()
+	recorded := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	later := recorded.Add(time.Hour)
+	latest := recorded.Add(2 * time.Hour)
+
+	testCases := map[string]struct {
+		entries    []database.StoredEntry
+		wantLevels []int
+	}{
+		"originals are kept": {
+			entries:    []database.StoredEntry{newVersionedEntry("a", "", 1, recorded, false), newVersionedEntry("b", "", 2, recorded, false)},
+			wantLevels: []int{1, 2},
+		},
+		"latest correction wins in place of the original": {
+			entries: []database.StoredEntry{
+				newVersionedEntry("a", "", 1, recorded, false),
+				newVersionedEntry("b", "", 2, recorded, false),
+				newVersionedEntry("a3", "a", 3, latest, false),
+				newVersionedEntry("a2", "a", 4, later, false),
+			},
+			wantLevels: []int{3, 2},
+		},
+		"retraction removes the entry": {
+			entries: []database.StoredEntry{
+				newVersionedEntry("a", "", 1, recorded, false),
+				newVersionedEntry("a2", "a", 4, later, false),
+				newVersionedEntry("a3", "a", 1, recorded, true),
+				newVersionedEntry("b", "", 2, recorded, false),
+			},
+			wantLevels: []int{2},
+		},
+		"correction without the original in range": {
+			entries:    []database.StoredEntry{newVersionedEntry("a2", "a", 4, later, false)},
+			wantLevels: []int{4},
+		},
+		"retried save is listed once": {
+			entries:    []database.StoredEntry{newVersionedEntry("a", "", 1, recorded, false), newVersionedEntry("a", "", 1, later, false)},
+			wantLevels: []int{1},
+		},
+		"entries without an ID are kept": {
+			entries:    []database.StoredEntry{newVersionedEntry("", "", 5, time.Time{}, false), newVersionedEntry("", "", 5, time.Time{}, false)},
+			wantLevels: []int{5, 5},
+		},
+	}
+
+	for name, tt := range testCases {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := database.LatestVersions(tt.entries)
+			if len(got) != len(tt.wantLevels) {
+				t.Fatalf("got %d entries, want %d: %+v", len(got), len(tt.wantLevels), got)
+			}
+			for i, e := range got {
+				if e.Level != tt.wantLevels[i] {
+					t.Errorf("entry %d has level %d, want %d", i, e.Level, tt.wantLevels[i])
+				}
+			}
+		})
+	}
+}
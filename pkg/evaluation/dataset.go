@@ -0,0 +1,64 @@
+// Package evaluation measures how well a parser extracts pain descriptions from messages, by running it on a golden
+// set of messages with known entries and comparing the fields
+package evaluation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"t-pain/pkg/models"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Case is a message of the golden set and the pain descriptions it should produce
+type Case struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+	// SentAt is when the message was sent, for messages that mention times. Defaults to the time of the run
+	SentAt   time.Time                `json:"sentAt,omitempty"`
+	Expected []models.PainDescription `json:"expected"`
+}
+
+// LoadDataset reads the cases from a JSON file, or a YAML file when the name ends in .yaml or .yml. Both have the
+// same field names
+func LoadDataset(path string) ([]Case, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read dataset: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse dataset %s: %w", path, err)
+		}
+	}
+
+	var cases []Case
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("unable to parse dataset %s: %w", path, err)
+	}
+	for i, c := range cases {
+		if c.Text == "" {
+			return nil, fmt.Errorf("case %d of dataset %s has no text", i+1, path)
+		}
+		if c.Name == "" {
+			cases[i].Name = fmt.Sprintf("case %d", i+1)
+		}
+	}
+	return cases, nil
+}
+
+// yamlToJSON converts YAML to JSON, so that the cases are decoded with the JSON tags of the models
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
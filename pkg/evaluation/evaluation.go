@@ -0,0 +1,228 @@
+package evaluation
+
+import (
+	"context"
+	"fmt"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"time"
+)
+
+// Client is the parser being evaluated, e.g. an openai.Client
+type Client interface {
+	GetPainDescriptionObject(context.Context, string, openai.MessageContext, *openai.Conversation) (openai.Result, error)
+}
+
+// Fields that are scored
+const (
+	FieldLocation = "location"
+	FieldSide     = "side"
+	FieldLevel    = "level"
+	FieldNumbness = "numbness"
+)
+
+// Fields are the scored fields in the order they are reported
+var Fields = []string{FieldLocation, FieldSide, FieldLevel, FieldNumbness}
+
+// Options of an evaluation run
+type Options struct {
+	// LevelTolerance is how far the level may be from the expected one and still be counted correct
+	LevelTolerance int
+	// Location is the timezone the messages are interpreted in, UTC if nil
+	Location *time.Location
+}
+
+// CaseResult is the outcome of a single case
+type CaseResult struct {
+	Case   Case
+	Actual []models.PainDescription
+	// Err is set when the client failed or did not return pain descriptions
+	Err error
+	// Mistakes describes the fields that were wrong, empty when the case was parsed correctly
+	Mistakes []string
+}
+
+// Report is the outcome of an evaluation run
+type Report struct {
+	Cases []CaseResult
+	// Expected is the number of expected pain descriptions, the denominator of the accuracies
+	Expected int
+	// Correct counts the correct pain descriptions of each field
+	Correct map[string]int
+	// Extra is the number of pain descriptions that were not expected
+	Extra int
+	// Confusion counts the body parts parsed for each expected body part. Body part 0 stands for a missing pain
+	// description as the actual value and for an extra one as the expected value
+	Confusion map[int]map[int]int
+}
+
+// Accuracy returns the share of expected pain descriptions whose field was correct
+func (r *Report) Accuracy(field string) float64 {
+	if r.Expected == 0 {
+		return 0
+	}
+	return float64(r.Correct[field]) / float64(r.Expected)
+}
+
+// Overall returns the mean accuracy of the fields
+func (r *Report) Overall() float64 {
+	var sum float64
+	for _, f := range Fields {
+		sum += r.Accuracy(f)
+	}
+	return sum / float64(len(Fields))
+}
+
+// Failed returns the cases that had errors or mistakes
+func (r *Report) Failed() []CaseResult {
+	var failed []CaseResult
+	for _, c := range r.Cases {
+		if c.Err != nil || len(c.Mistakes) > 0 {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// Evaluate runs every case through the client and scores the results. A failed case counts every expected
+// pain description of it as wrong, so errors lower the accuracy instead of stopping the run. Once ctx is done the
+// run stops, and the report has only the cases evaluated before that
+func Evaluate(ctx context.Context, client Client, cases []Case, opts Options) *Report {
+	r := &Report{Correct: make(map[string]int), Confusion: make(map[int]map[int]int)}
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	for _, c := range cases {
+		if ctx.Err() != nil {
+			break
+		}
+		result := CaseResult{Case: c}
+		mc := openai.MessageContext{SentAt: c.SentAt, Location: loc}
+		res, err := client.GetPainDescriptionObject(ctx, c.Text, mc, nil)
+		// The case was cut short rather than answered wrong
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		switch {
+		case err != nil:
+			result.Err = err
+		case res.Kind != openai.ResultPainDescriptions:
+			result.Err = fmt.Errorf("expected pain descriptions, got %s: %s", res.Kind, res.Text)
+		default:
+			result.Actual = res.PainDescriptions
+		}
+
+		result.Mistakes = r.score(c.Expected, result.Actual, opts.LevelTolerance)
+		r.Cases = append(r.Cases, result)
+	}
+
+	return r
+}
+
+// score pairs the expected pain descriptions with the actual ones and adds them to the report
+func (r *Report) score(expected, actual []models.PainDescription, tolerance int) []string {
+	var mistakes []string
+	pairs, extra := match(expected, actual)
+	r.Expected += len(expected)
+	r.Extra += len(extra)
+
+	for i, e := range expected {
+		a, ok := pairs[i]
+		if !ok {
+			r.confuse(e.LocationId, 0)
+			mistakes = append(mistakes, fmt.Sprintf("missing %s", describe(e)))
+			continue
+		}
+		r.confuse(e.LocationId, a.LocationId)
+
+		var wrong []string
+		if a.LocationId == e.LocationId {
+			r.Correct[FieldLocation]++
+		} else {
+			wrong = append(wrong, FieldLocation)
+		}
+		if a.SideId == e.SideId {
+			r.Correct[FieldSide]++
+		} else {
+			wrong = append(wrong, FieldSide)
+		}
+		if abs(a.Level-e.Level) <= tolerance {
+			r.Correct[FieldLevel]++
+		} else {
+			wrong = append(wrong, FieldLevel)
+		}
+		if a.Numbness == e.Numbness {
+			r.Correct[FieldNumbness]++
+		} else {
+			wrong = append(wrong, FieldNumbness)
+		}
+		if len(wrong) > 0 {
+			mistakes = append(mistakes, fmt.Sprintf("expected %s, got %s (%v wrong)", describe(e), describe(a), wrong))
+		}
+	}
+
+	for _, a := range extra {
+		r.confuse(0, a.LocationId)
+		mistakes = append(mistakes, fmt.Sprintf("unexpected %s", describe(a)))
+	}
+	return mistakes
+}
+
+func (r *Report) confuse(expected, actual int) {
+	if r.Confusion[expected] == nil {
+		r.Confusion[expected] = make(map[int]int)
+	}
+	r.Confusion[expected][actual]++
+}
+
+// match pairs each expected pain description with an actual one, preferring the same body part and side, then the
+// same body part, then any left in order. Returns the pairs by expected index and the actual ones left over
+func match(expected, actual []models.PainDescription) (map[int]models.PainDescription, []models.PainDescription) {
+	pairs := make(map[int]models.PainDescription)
+	used := make([]bool, len(actual))
+
+	passes := []func(e, a models.PainDescription) bool{
+		func(e, a models.PainDescription) bool { return e.LocationId == a.LocationId && e.SideId == a.SideId },
+		func(e, a models.PainDescription) bool { return e.LocationId == a.LocationId },
+		func(e, a models.PainDescription) bool { return true },
+	}
+	for _, same := range passes {
+		for i, e := range expected {
+			if _, ok := pairs[i]; ok {
+				continue
+			}
+			for j, a := range actual {
+				if !used[j] && same(e, a) {
+					pairs[i] = a
+					used[j] = true
+					break
+				}
+			}
+		}
+	}
+
+	var extra []models.PainDescription
+	for j, a := range actual {
+		if !used[j] {
+			extra = append(extra, a)
+		}
+	}
+	return pairs, extra
+}
+
+func describe(p models.PainDescription) string {
+	s := fmt.Sprintf("%s %s %d", models.SideMap[p.SideId], models.BodyPartMapping[p.LocationId], p.Level)
+	if p.Numbness {
+		s += " numb"
+	}
+	return s
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
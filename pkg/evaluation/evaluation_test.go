@@ -0,0 +1,236 @@
+package evaluation_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"t-pain/pkg/evaluation"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"testing"
+)
+
+// fakeClient answers each message with the result given for it
+type fakeClient map[string]openai.Result
+
+func (f fakeClient) GetPainDescriptionObject(_ context.Context, text string, _ openai.MessageContext, _ *openai.Conversation) (openai.Result, error) {
+	result, ok := f[text]
+	if !ok {
+		return openai.Result{}, errors.New("service unavailable")
+	}
+	return result, nil
+}
+
+func pains(pd ...models.PainDescription) openai.Result {
+	return openai.Result{Kind: openai.ResultPainDescriptions, PainDescriptions: pd}
+}
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expected  []models.PainDescription
+		actual    openai.Result
+		tolerance int
+		correct   map[string]int
+		extra     int
+		confusion map[int]map[int]int
+	}{
+		"AllCorrect": {
+			expected:  []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4}, {LocationId: 4, SideId: 2, Level: 5, Numbness: true}},
+			actual:    pains(models.PainDescription{LocationId: 4, SideId: 2, Level: 5, Numbness: true}, models.PainDescription{LocationId: 2, SideId: 1, Level: 4}),
+			correct:   map[string]int{"location": 2, "side": 2, "level": 2, "numbness": 2},
+			confusion: map[int]map[int]int{2: {2: 1}, 4: {4: 1}},
+		},
+		"LevelWithinTolerance": {
+			expected:  []models.PainDescription{{LocationId: 9, SideId: 1, Level: 6}},
+			actual:    pains(models.PainDescription{LocationId: 9, SideId: 1, Level: 7}),
+			tolerance: 1,
+			correct:   map[string]int{"location": 1, "side": 1, "level": 1, "numbness": 1},
+			confusion: map[int]map[int]int{9: {9: 1}},
+		},
+		"WrongFields": {
+			expected:  []models.PainDescription{{LocationId: 9, SideId: 2, Level: 6, Numbness: true}},
+			actual:    pains(models.PainDescription{LocationId: 8, SideId: 2, Level: 8}),
+			tolerance: 1,
+			correct:   map[string]int{"side": 1},
+			confusion: map[int]map[int]int{9: {8: 1}},
+		},
+		"MissingAndExtra": {
+			expected:  []models.PainDescription{{LocationId: 12, SideId: 2, Level: 3}, {LocationId: 12, SideId: 3, Level: 3}},
+			actual:    pains(models.PainDescription{LocationId: 12, SideId: 3, Level: 3}, models.PainDescription{LocationId: 1, SideId: 1, Level: 2}, models.PainDescription{LocationId: 2, SideId: 1, Level: 2}),
+			correct:   map[string]int{"location": 1, "side": 1, "level": 1, "numbness": 2},
+			extra:     1,
+			confusion: map[int]map[int]int{12: {12: 1, 1: 1}, 0: {2: 1}},
+		},
+		"Clarification": {
+			expected:  []models.PainDescription{{LocationId: 1, SideId: 1, Level: 3}},
+			actual:    openai.Result{Kind: openai.ResultClarification, Text: "Where does it hurt?"},
+			correct:   map[string]int{},
+			confusion: map[int]map[int]int{1: {0: 1}},
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			client := fakeClient{"message": tt.actual}
+			report := evaluation.Evaluate(context.Background(), client, []evaluation.Case{{Name: "case", Text: "message", Expected: tt.expected}},
+				evaluation.Options{LevelTolerance: tt.tolerance})
+
+			if report.Expected != len(tt.expected) || report.Extra != tt.extra {
+				t.Errorf("Expected %d expected and %d extra, got %d and %d", len(tt.expected), tt.extra, report.Expected, report.Extra)
+			}
+			for _, f := range evaluation.Fields {
+				if report.Correct[f] != tt.correct[f] {
+					t.Errorf("Expected %d correct %s, got %d", tt.correct[f], f, report.Correct[f])
+				}
+			}
+			for expected, row := range tt.confusion {
+				for actual, n := range row {
+					if report.Confusion[expected][actual] != n {
+						t.Errorf("Expected %d of body part %d parsed as %d, got %v", n, expected, actual, report.Confusion)
+					}
+				}
+			}
+			failed := len(report.Failed()) > 0
+			allCorrect := report.Overall() == 1 && tt.extra == 0
+			if failed == allCorrect {
+				t.Errorf("Expected the case to fail: %v, got %+v", !allCorrect, report.Cases)
+			}
+		})
+	}
+}
+
+func TestEvaluate_ShouldCountErrorsAsWrong(t *testing.T) {
+	t.Parallel()
+	cases := []evaluation.Case{
+		{Name: "ok", Text: "neck 4", Expected: []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4}}},
+		{Name: "error", Text: "knee 3", Expected: []models.PainDescription{{LocationId: 12, SideId: 1, Level: 3}}},
+	}
+	client := fakeClient{"neck 4": pains(models.PainDescription{LocationId: 2, SideId: 1, Level: 4})}
+
+	report := evaluation.Evaluate(context.Background(), client, cases, evaluation.Options{})
+	if report.Overall() != 0.5 {
+		t.Errorf("Expected an overall accuracy of 0.5, got %v", report.Overall())
+	}
+	failed := report.Failed()
+	if len(failed) != 1 || failed[0].Case.Name != "error" || failed[0].Err == nil {
+		t.Errorf("Expected the failed case with its error, got %+v", failed)
+	}
+
+	var out bytes.Buffer
+	if err := report.Print(&out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, s := range []string{"overall", "50.0%", "service unavailable", "Knee 12"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the report, got\n%s", s, out.String())
+		}
+	}
+}
+
+// interruptingClient answers like fakeClient, but is interrupted while answering interruptAt
+type interruptingClient struct {
+	fakeClient
+	interruptAt string
+	cancel      context.CancelFunc
+	calls       *int
+}
+
+func (c interruptingClient) GetPainDescriptionObject(ctx context.Context, text string, mc openai.MessageContext, conv *openai.Conversation) (openai.Result, error) {
+	*c.calls++
+	if text == c.interruptAt {
+		c.cancel()
+		return openai.Result{}, ctx.Err()
+	}
+	return c.fakeClient.GetPainDescriptionObject(ctx, text, mc, conv)
+}
+
+func TestEvaluate_ShouldStopWhenInterrupted(t *testing.T) {
+	t.Parallel()
+	cases := []evaluation.Case{
+		{Name: "ok", Text: "neck 4", Expected: []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4}}},
+		{Name: "interrupted", Text: "knee 3", Expected: []models.PainDescription{{LocationId: 12, SideId: 1, Level: 3}}},
+		{Name: "not run", Text: "back 5", Expected: []models.PainDescription{{LocationId: 9, SideId: 1, Level: 5}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	client := interruptingClient{
+		fakeClient:  fakeClient{"neck 4": pains(models.PainDescription{LocationId: 2, SideId: 1, Level: 4})},
+		interruptAt: "knee 3",
+		cancel:      cancel,
+		calls:       &calls,
+	}
+
+	report := evaluation.Evaluate(ctx, client, cases, evaluation.Options{})
+	if calls != 2 {
+		t.Errorf("Expected the run to stop after the interrupted case, got %d calls", calls)
+	}
+	if len(report.Cases) != 1 || report.Overall() != 1 {
+		t.Errorf("Expected only the case evaluated before the interrupt, got %d cases and accuracy %v", len(report.Cases), report.Overall())
+	}
+}
+
+func TestLoadDataset(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		file    string
+		content string
+	}{
+		"JSON": {
+			file:    "dataset.json",
+			content: `[{"name": "neck", "text": "neck 4", "expected": [{"locationId": 2, "sideId": 1, "level": 4, "numbness": false}]}]`,
+		},
+		"YAML": {
+			file:    "dataset.yaml",
+			content: "- name: neck\n  text: neck 4\n  expected:\n    - {locationId: 2, sideId: 1, level: 4, numbness: false}\n",
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cases, err := evaluation.LoadDataset(path)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(cases) != 1 || cases[0].Name != "neck" || len(cases[0].Expected) != 1 || cases[0].Expected[0].LocationId != 2 {
+				t.Errorf("Unexpected cases %+v", cases)
+			}
+		})
+	}
+}
+
+func TestLoadDataset_ShouldLoadTheGoldenSet(t *testing.T) {
+	t.Parallel()
+	cases, err := evaluation.LoadDataset("../../cmd/evaluate/dataset.yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, c := range cases {
+		if err := models.ValidatePainDescriptions(withDescriptions(c.Expected)); err != nil {
+			t.Errorf("Case %s has invalid expectations: %v", c.Name, err)
+		}
+	}
+}
+
+// withDescriptions fills in the description the golden set leaves out, as it is not scored
+func withDescriptions(pd []models.PainDescription) []models.PainDescription {
+	for i := range pd {
+		pd[i].Description = "-"
+	}
+	return pd
+}
@@ -0,0 +1,95 @@
+package evaluation
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"t-pain/pkg/models"
+	"text/tabwriter"
+)
+
+// Print writes the accuracies, the failed cases and the confusion matrix of the body parts
+func (r *Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Cases:\t%d\n", len(r.Cases))
+	fmt.Fprintf(tw, "Expected pain descriptions:\t%d\n", r.Expected)
+	fmt.Fprintf(tw, "Unexpected pain descriptions:\t%d\n\n", r.Extra)
+	fmt.Fprintln(tw, "Field\tCorrect\tAccuracy")
+	for _, f := range Fields {
+		fmt.Fprintf(tw, "%s\t%d/%d\t%.1f%%\n", f, r.Correct[f], r.Expected, 100*r.Accuracy(f))
+	}
+	fmt.Fprintf(tw, "overall\t\t%.1f%%\n", 100*r.Overall())
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if failed := r.Failed(); len(failed) > 0 {
+		fmt.Fprintf(w, "\nFailed cases (%d):\n", len(failed))
+		for _, c := range failed {
+			fmt.Fprintf(w, "- %s: %q\n", c.Case.Name, c.Case.Text)
+			if c.Err != nil {
+				fmt.Fprintf(w, "    error: %v\n", c.Err)
+			}
+			for _, m := range c.Mistakes {
+				fmt.Fprintf(w, "    %s\n", m)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "\nBody part confusion matrix (rows expected, columns parsed, - is none):")
+	return r.printConfusion(w)
+}
+
+// printConfusion writes the confusion matrix with the body parts that occur in it
+func (r *Report) printConfusion(w io.Writer) error {
+	seen := make(map[int]bool)
+	for expected, row := range r.Confusion {
+		seen[expected] = true
+		for actual := range row {
+			seen[actual] = true
+		}
+	}
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "\t")
+	for _, id := range ids {
+		fmt.Fprintf(tw, "%s\t", idLabel(id))
+	}
+	fmt.Fprintln(tw)
+	for _, expected := range ids {
+		fmt.Fprintf(tw, "%s %s\t", bodyPartName(expected), idLabel(expected))
+		for _, actual := range ids {
+			count := ""
+			if n := r.Confusion[expected][actual]; n > 0 {
+				count = strconv.Itoa(n)
+			}
+			fmt.Fprintf(tw, "%s\t", count)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func idLabel(id int) string {
+	if id == 0 {
+		return "-"
+	}
+	return strconv.Itoa(id)
+}
+
+func bodyPartName(id int) string {
+	if id == 0 {
+		return "none"
+	}
+	if name, ok := models.BodyPartMapping[id]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -2,8 +2,11 @@ package models
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"reflect"
+	"github.com/google/uuid"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,8 +16,8 @@ type BodyParts map[int]string
 func (bp BodyParts) String() string {
 	var result strings.Builder
 	result.WriteString("```\n")
-	for ID, bodyPart := range bp {
-		result.WriteString(fmt.Sprintf("%d: %s\n", ID, bodyPart))
+	for _, ID := range bp.IDs() {
+		result.WriteString(fmt.Sprintf("%d: %s\n", ID, bp[ID]))
 	}
 	result.WriteString("```\n")
 	return result.String()
@@ -23,13 +26,23 @@ func (bp BodyParts) String() string {
 func (bp BodyParts) StringNameFirst() string {
 	var result strings.Builder
 	result.WriteString("```\n")
-	for ID, bodyPart := range bp {
-		result.WriteString(fmt.Sprintf("%s: %d\n", bodyPart, ID))
+	for _, ID := range bp.IDs() {
+		result.WriteString(fmt.Sprintf("%s: %d\n", bp[ID], ID))
 	}
 	result.WriteString("```\n")
 	return result.String()
 }
 
+// IDs returns the body part IDs in ascending order
+func (bp BodyParts) IDs() []int {
+	ids := make([]int, 0, len(bp))
+	for ID := range bp {
+		ids = append(ids, ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
 var BodyPartMapping = BodyParts{
 	1:  "Head",
 	2:  "Neck",
@@ -59,8 +72,8 @@ type Sides map[int]string
 func (sd Sides) String() string {
 	var result strings.Builder
 	result.WriteString("```\n")
-	for ID, side := range sd {
-		result.WriteString(fmt.Sprintf("%d: %s\n", ID, side))
+	for _, ID := range sd.IDs() {
+		result.WriteString(fmt.Sprintf("%d: %s\n", ID, sd[ID]))
 	}
 	result.WriteString("```\n")
 	return result.String()
@@ -69,27 +82,104 @@ func (sd Sides) String() string {
 func (sd Sides) StringNameFirst() string {
 	var result strings.Builder
 	result.WriteString("```\n")
-	for ID, side := range sd {
-		result.WriteString(fmt.Sprintf("%s: %d\n", side, ID))
+	for _, ID := range sd.IDs() {
+		result.WriteString(fmt.Sprintf("%s: %d\n", sd[ID], ID))
 	}
 	result.WriteString("```\n")
 	return result.String()
 }
 
+// IDs returns the side IDs in ascending order
+func (sd Sides) IDs() []int {
+	ids := make([]int, 0, len(sd))
+	for ID := range sd {
+		ids = append(ids, ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
 var SideMap = Sides{
 	1: "Both",
 	2: "Left",
 	3: "Right",
 }
 
+// The range of the pain levels
+const (
+	MinLevel = 0
+	MaxLevel = 10
+)
+
+// TimestampSource tells where the Timestamp of a PainDescription came from
+type TimestampSource int
+
+const (
+	// TimestampFromMessage means the time the user's message was sent was used
+	TimestampFromMessage TimestampSource = iota
+	// TimestampFromText means the user mentioned when the pain occurred, e.g. "last night"
+	TimestampFromText
+	// TimestampImplausible means the mentioned time was in the future or too far in the past,
+	// so the time the message was sent was used instead
+	TimestampImplausible
+)
+
+// Parsers that turn messages into pain descriptions
+const (
+	// ParserModel is the language model
+	ParserModel = "model"
+	// ParserFallback is the rule based parser used when the language model is unavailable
+	ParserFallback = "fallback"
+)
+
+// LogEntrySchemaVersion is the version of the fields of PainDescriptionLogEntry. Entries saved before versioning
+// have no version, which reads as zero
+const LogEntrySchemaVersion = 3
+
+// Sources of the messages the entries are read from
+const (
+	SourceText  = "text"
+	SourceVoice = "voice"
+	// SourceImport is an entry imported or generated outside the bot
+	SourceImport = "import"
+	// SourceFallback is a message read by the fallback parser, whether typed or spoken
+	SourceFallback = "fallback"
+)
+
+// EntryMetadata tells which message the entries came from
+type EntryMetadata struct {
+	// BatchID links the entries read from the same message
+	BatchID string
+	// ChatID and MessageID are the Telegram ids of the message, zero if it did not come from Telegram
+	ChatID    int64
+	MessageID int
+	Source    string
+}
+
+// NewEntryMetadata creates the metadata of a message with a new batch ID
+func NewEntryMetadata(chatID int64, messageID int, source string) EntryMetadata {
+	return EntryMetadata{
+		BatchID:   uuid.NewString(),
+		ChatID:    chatID,
+		MessageID: messageID,
+		Source:    source,
+	}
+}
+
+// PainDescription is a single pain at a single time. The description tags are used in the JSON schema given to the model
 type PainDescription struct {
-	Timestamp           time.Time `json:"timestamp,omitempty"`
-	Level               int       `json:"level"`
-	LocationId          int       `json:"locationId"`
-	SideId              int       `json:"sideId"`
-	Description         string    `json:"description"`
-	Numbness            bool      `json:"numbness"`
-	NumbnessDescription string    `json:"numbnessDescription,omitempty"`
+	Timestamp           time.Time       `json:"timestamp,omitempty" description:"Local time the pain occurred in the format YYYY-MM-DDTHH:MM. Only set when the user mentions it"`
+	Level               int             `json:"level" description:"Pain level from 0 to 10"`
+	LocationId          int             `json:"locationId" description:"ID of the body part"`
+	SideId              int             `json:"sideId" description:"ID of the side of the body"`
+	Description         string          `json:"description" description:"The full description given by the user"`
+	Numbness            bool            `json:"numbness" description:"Whether the user mentions numbness"`
+	NumbnessDescription string          `json:"numbnessDescription,omitempty" description:"Description of the numbness, if any"`
+	TimestampSource     TimestampSource `json:"-"`
+	// Parser is the parser that produced the description, ParserModel when empty
+	Parser string `json:"-"`
+	// PromptVersion is the version of the prompt the model was given, empty for the fallback parser
+	PromptVersion string `json:"-"`
 }
 
 func NewPainDescription() PainDescription {
@@ -135,64 +225,134 @@ func (p *PainDescription) MapToLogEntry(userId int64) (PainDescriptionLogEntry,
 
 	p.Timestamp = p.Timestamp.UTC()
 
+	parsedBy := p.Parser
+	if parsedBy == "" {
+		parsedBy = ParserModel
+	}
+
 	pdLog := PainDescriptionLogEntry{
 		PainDescription: *p,
 		LocationName:    locationName,
 		SideName:        sideName,
 		UserName:        userName,
+		ParsedBy:        parsedBy,
+		PromptVersion:   p.PromptVersion,
+		EntryID:         uuid.NewString(),
+		SchemaVersion:   LogEntrySchemaVersion,
+		RecordedAt:      time.Now().UTC(),
 	}
 
 	return pdLog, nil
 }
 
-func PrintPainDescriptionJSONFormat() string {
-	sb := strings.Builder{}
-
-	p := NewPainDescription()
-	objType := reflect.TypeOf(p)
-
-	sb.WriteString("{\n")
-
-	objValue := reflect.ValueOf(p)
-	for i := 0; i < objType.NumField(); i++ {
-		field := objType.Field(i)
-		if field.Type == reflect.TypeOf(time.Time{}) {
-			continue
-		}
-		fieldValue := objValue.Field(i)
+// MapToLogEntries maps the pains read from one message to log entries. The entry IDs are derived from the batch ID
+// and the order of the pains, so mapping the same message again, e.g. when retrying a save, gives the same IDs
+func MapToLogEntries(userId int64, pains []PainDescription, meta EntryMetadata) ([]PainDescriptionLogEntry, error) {
+	batchID, err := uuid.Parse(meta.BatchID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BatchID %q: %w", meta.BatchID, err)
+	}
 
-		if i == objType.NumField()-1 {
-			sb.WriteString(fmt.Sprintf("\t\"%s\": %s\n", field.Name, fieldValue.Type()))
-		} else {
-			sb.WriteString(fmt.Sprintf("\t\"%s\": %s,\n", field.Name, fieldValue.Type()))
+	entries := make([]PainDescriptionLogEntry, 0, len(pains))
+	for i := range pains {
+		entry, err := pains[i].MapToLogEntry(userId)
+		if err != nil {
+			return nil, err
 		}
+		entry.EntryID = uuid.NewSHA1(batchID, []byte(strconv.Itoa(i))).String()
+		entry.BatchID = meta.BatchID
+		entry.ChatID = meta.ChatID
+		entry.MessageID = meta.MessageID
+		entry.Source = meta.Source
+		entries = append(entries, entry)
 	}
+	return entries, nil
+}
 
-	sb.WriteString("}\n")
-
-	return sb.String()
+type PainDescriptionLogEntry struct {
+	PainDescription
+	LocationName string `json:"locationName"`
+	SideName     string `json:"sideName"`
+	UserName     string `json:"userName"`
+	// ParsedBy is ParserModel or ParserFallback
+	ParsedBy string `json:"parsedBy"`
+	// PromptVersion is the version of the prompt that produced the entry
+	PromptVersion string `json:"promptVersion"`
+	// EntryID identifies the entry, so that it can be referenced, corrected or de-duplicated later
+	EntryID string `json:"entryId"`
+	// BatchID, ChatID, MessageID and Source are from the EntryMetadata of the message
+	BatchID   string `json:"batchId"`
+	ChatID    int64  `json:"chatId"`
+	MessageID int    `json:"messageId"`
+	Source    string `json:"source"`
+	// SchemaVersion is the LogEntrySchemaVersion the entry was saved with
+	SchemaVersion int `json:"schemaVersion"`
+	// RecordedAt is when the record was saved, which tells the versions of an entry apart
+	RecordedAt time.Time `json:"recordedAt"`
+	// Supersedes is the EntryID of the original entry this record corrects or retracts, empty for an original entry
+	Supersedes string `json:"supersedes"`
+	// Retracted marks a tombstone record, which removes the original entry
+	Retracted bool `json:"retracted"`
 }
 
-func PrintSinglePainDescriptionJSONFormat(p PainDescription) string {
-	sb := strings.Builder{}
+// UnmarshalJSON decodes all the fields of the entry. The UnmarshalJSON promoted from PainDescription would only
+// decode the pain and leave the rest empty
+func (e *PainDescriptionLogEntry) UnmarshalJSON(data []byte) error {
+	type entry PainDescriptionLogEntry
+	// The field hides the promoted UnmarshalJSON, so that the fields are decoded the default way
+	aux := struct {
+		*entry
+		UnmarshalJSON struct{} `json:"-"`
+	}{entry: (*entry)(e)}
+	return json.Unmarshal(data, &aux)
+}
 
-	sb.WriteString("{\n")
+// OriginalID returns the EntryID of the original entry of the record, which all its versions share
+func (e PainDescriptionLogEntry) OriginalID() string {
+	if e.Supersedes != "" {
+		return e.Supersedes
+	}
+	return e.EntryID
+}
 
-	sb.WriteString(fmt.Sprintf("\t\"%s\": %d,\n", "level", p.Level))
-	sb.WriteString(fmt.Sprintf("\t\"%s\": %d,\n", "locationId", p.LocationId))
-	sb.WriteString(fmt.Sprintf("\t\"%s\": %d,\n", "sideId", p.SideId))
-	sb.WriteString(fmt.Sprintf("\t\"%s\": %q,\n", "description", p.Description))
-	sb.WriteString(fmt.Sprintf("\t\"%s\": %t,\n", "numbness", p.Numbness))
-	sb.WriteString(fmt.Sprintf("\t\"%s\": %q\n", "numbnessDescription", p.NumbnessDescription))
+// Correct returns a record that supersedes the entry with the corrected pain. The metadata of the message is kept
+func (e PainDescriptionLogEntry) Correct(pain PainDescription) (PainDescriptionLogEntry, error) {
+	if e.EntryID == "" {
+		return PainDescriptionLogEntry{}, errors.New("entry has no EntryID to reference")
+	}
+	locationName, ok := BodyPartMapping[pain.LocationId]
+	if !ok {
+		return PainDescriptionLogEntry{}, fmt.Errorf("invalid LocationId: %d", pain.LocationId)
+	}
+	sideName, ok := SideMap[pain.SideId]
+	if !ok {
+		return PainDescriptionLogEntry{}, fmt.Errorf("invalid SideId: %d", pain.SideId)
+	}
 
-	sb.WriteString("}")
+	correction := e.newVersion()
+	correction.PainDescription = pain
+	correction.Timestamp = pain.Timestamp.UTC()
+	correction.LocationName = locationName
+	correction.SideName = sideName
+	return correction, nil
+}
 
-	return sb.String()
+// Retract returns a tombstone record that removes the entry
+func (e PainDescriptionLogEntry) Retract() (PainDescriptionLogEntry, error) {
+	if e.EntryID == "" {
+		return PainDescriptionLogEntry{}, errors.New("entry has no EntryID to reference")
+	}
+	tombstone := e.newVersion()
+	tombstone.Retracted = true
+	return tombstone, nil
 }
 
-type PainDescriptionLogEntry struct {
-	PainDescription
-	LocationName string `json:"locationName"`
-	SideName     string `json:"sideName"`
-	UserName     string `json:"userName"`
+// newVersion returns a copy of the entry as a new record referencing the original entry
+func (e PainDescriptionLogEntry) newVersion() PainDescriptionLogEntry {
+	version := e
+	version.Supersedes = e.OriginalID()
+	version.EntryID = uuid.NewString()
+	version.SchemaVersion = LogEntrySchemaVersion
+	version.RecordedAt = time.Now().UTC()
+	return version
 }
\ No newline at end of file
@@ -1,6 +1,9 @@
 package models_test
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
 	"t-pain/pkg/models"
 	"testing"
 	"time"
@@ -60,4 +63,235 @@ func TestMapToLogEntryWithInvalidDataShouldReturnError(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestIDsShouldBeSorted(t *testing.T) {
+	t.Parallel()
+	ids := models.BodyPartMapping.IDs()
+	if len(ids) != len(models.BodyPartMapping) {
+		t.Fatalf("expected %d ids, got %d", len(models.BodyPartMapping), len(ids))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i-1] >= ids[i] {
+			t.Errorf("ids are not sorted: %v", ids)
+		}
+	}
+
+	sides := models.SideMap.IDs()
+	if len(sides) != 3 || sides[0] != 1 || sides[2] != 3 {
+		t.Errorf("unexpected side ids: %v", sides)
+	}
+}
+
+func TestStringNameFirstShouldBeInIDOrder(t *testing.T) {
+	t.Parallel()
+	first := models.BodyPartMapping.StringNameFirst()
+	if !strings.HasPrefix(first, "```\nHead: 1\nNeck: 2\n") {
+		t.Errorf("expected the body parts in ID order, got %s", first)
+	}
+	for i := 0; i < 10; i++ {
+		if models.BodyPartMapping.StringNameFirst() != first {
+			t.Fatal("expected the same output every time")
+		}
+	}
+}
+
+func TestPainDescriptionJSONSchemaShouldFollowJSONTags(t *testing.T) {
+	t.Parallel()
+	schema := models.PainDescriptionJSONSchema()
+	properties := schema["properties"].(map[string]any)
+
+	if _, ok := properties["TimestampSource"]; ok {
+		t.Errorf("expected fields without JSON to be left out")
+	}
+	location := properties["locationId"].(map[string]any)
+	if location["type"] != "integer" || len(location["enum"].([]int)) != len(models.BodyPartMapping) {
+		t.Errorf("unexpected locationId schema: %v", location)
+	}
+	for _, name := range schema["required"].([]string) {
+		if name == "timestamp" || name == "numbnessDescription" {
+			t.Errorf("expected %s to be optional", name)
+		}
+	}
+}
+
+func TestValidateShouldReportAllProblems(t *testing.T) {
+	t.Parallel()
+	valid := models.PainDescription{Level: 5, LocationId: 9, SideId: 1, Description: "Lower back"}
+
+	tests := map[string]struct {
+		modify   func(p *models.PainDescription)
+		expected []string
+	}{
+		"Valid": {
+			modify: func(p *models.PainDescription) {},
+		},
+		"ValidWithNumbness": {
+			modify: func(p *models.PainDescription) {
+				p.Numbness = true
+				p.NumbnessDescription = "tingling"
+			},
+		},
+		"LevelTooHigh": {
+			modify:   func(p *models.PainDescription) { p.Level = 11 },
+			expected: []string{"level should be between 0 and 10, got 11"},
+		},
+		"NegativeLevel": {
+			modify:   func(p *models.PainDescription) { p.Level = -1 },
+			expected: []string{"level should be between 0 and 10, got -1"},
+		},
+		"UnknownIDs": {
+			modify: func(p *models.PainDescription) {
+				p.LocationId = 99
+				p.SideId = 0
+			},
+			expected: []string{"unknown locationId 99", "unknown sideId 0"},
+		},
+		"EmptyDescription": {
+			modify:   func(p *models.PainDescription) { p.Description = " " },
+			expected: []string{"description is empty"},
+		},
+		"NumbnessDescriptionWithoutNumbness": {
+			modify:   func(p *models.PainDescription) { p.NumbnessDescription = "tingling" },
+			expected: []string{"numbnessDescription is set but numbness is false"},
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			p := valid
+			tt.modify(&p)
+			err := p.Validate()
+			if len(tt.expected) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %v, got nil", tt.expected)
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("expected %q in %q", e, err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePainDescriptionsShouldNumberThePains(t *testing.T) {
+	t.Parallel()
+	pd := []models.PainDescription{
+		{Level: 5, LocationId: 9, SideId: 1, Description: "ok"},
+		{Level: 12, LocationId: 9, SideId: 7, Description: "not ok"},
+	}
+
+	err := models.ValidatePainDescriptions(pd)
+	expected := "pain 2: level should be between 0 and 10, got 12\npain 2: unknown sideId 7"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestMapToLogEntriesShouldLinkEntriesOfAMessage(t *testing.T) {
+	t.Parallel()
+	pains := []models.PainDescription{
+		{Timestamp: time.Now(), Level: 4, LocationId: 9, SideId: 1, Description: "Back and knee"},
+		{Timestamp: time.Now(), Level: 2, LocationId: 12, SideId: 2, Description: "Back and knee"},
+	}
+	meta := models.NewEntryMetadata(1234, 56, models.SourceVoice)
+
+	entries, err := models.MapToLogEntries(1111111111111111111, pains, meta)
+	if err != nil {
+		t.Fatalf("MapToLogEntries() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.BatchID != meta.BatchID || e.ChatID != 1234 || e.MessageID != 56 || e.Source != models.SourceVoice ||
+			e.SchemaVersion != models.LogEntrySchemaVersion {
+			t.Errorf("unexpected metadata %+v", e)
+		}
+	}
+	if entries[0].EntryID == "" || entries[0].EntryID == entries[1].EntryID {
+		t.Errorf("expected unique entry IDs, got %q and %q", entries[0].EntryID, entries[1].EntryID)
+	}
+
+	// Mapping the same message again, e.g. to retry saving it, gives the same IDs
+	again, err := models.MapToLogEntries(1111111111111111111, pains, meta)
+	if err != nil {
+		t.Fatalf("MapToLogEntries() error = %v", err)
+	}
+	if again[0].EntryID != entries[0].EntryID || again[1].EntryID != entries[1].EntryID {
+		t.Errorf("expected the same entry IDs when mapping again")
+	}
+
+	if _, err := models.MapToLogEntries(1111111111111111111, pains, models.EntryMetadata{}); err == nil {
+		t.Errorf("expected error without a batch ID, got nil")
+	}
+}
+
+func TestCorrectionsShouldReferenceTheOriginalEntry(t *testing.T) {
+	t.Parallel()
+	pains := []models.PainDescription{{Timestamp: time.Now(), Level: 4, LocationId: 9, SideId: 1, Description: "Back"}}
+	entries, err := models.MapToLogEntries(1111111111111111111, pains, models.NewEntryMetadata(1234, 56, models.SourceText))
+	if err != nil {
+		t.Fatalf("MapToLogEntries() error = %v", err)
+	}
+	original := entries[0]
+
+	corrected := original.PainDescription
+	corrected.Level = 6
+	corrected.LocationId = 2
+	correction, err := original.Correct(corrected)
+	if err != nil {
+		t.Fatalf("Correct() error = %v", err)
+	}
+	if correction.Supersedes != original.EntryID || correction.EntryID == original.EntryID || correction.Retracted {
+		t.Errorf("unexpected correction %+v", correction)
+	}
+	if correction.Level != 6 || correction.LocationName != models.BodyPartMapping[2] || correction.BatchID != original.BatchID {
+		t.Errorf("expected the pain to change and the metadata to stay, got %+v", correction)
+	}
+
+	// Later versions reference the original entry, not the version they replace
+	tombstone, err := correction.Retract()
+	if err != nil {
+		t.Fatalf("Retract() error = %v", err)
+	}
+	if tombstone.Supersedes != original.EntryID || !tombstone.Retracted || tombstone.OriginalID() != original.EntryID {
+		t.Errorf("unexpected tombstone %+v", tombstone)
+	}
+
+	if _, err := (models.PainDescriptionLogEntry{}).Retract(); err == nil {
+		t.Errorf("expected an entry without an EntryID to not be retractable")
+	}
+	corrected.SideId = 7
+	if _, err := original.Correct(corrected); err == nil {
+		t.Errorf("expected an invalid side to be rejected")
+	}
+}
+
+func TestLogEntryShouldSurviveAJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+	pains := []models.PainDescription{{Timestamp: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC), Level: 4, LocationId: 9, SideId: 1, Description: "Back"}}
+	entries, err := models.MapToLogEntries(1111111111111111111, pains, models.NewEntryMetadata(1234, 56, models.SourceText))
+	if err != nil {
+		t.Fatalf("MapToLogEntries() error = %v", err)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var decoded []models.PainDescriptionLogEntry
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("got %+v, want %+v", decoded, entries)
+	}
+}
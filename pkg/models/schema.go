@@ -0,0 +1,69 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// PainDescriptionJSONSchema generates the JSON schema of a PainDescription as returned by the model.
+// Property names and requirements follow the json tags, the ID fields are limited to the known mappings
+func PainDescriptionJSONSchema() map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	objType := reflect.TypeOf(PainDescription{})
+	for i := 0; i < objType.NumField(); i++ {
+		field := objType.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		property := map[string]any{
+			"type": schemaType(field.Type),
+		}
+		if description := field.Tag.Get("description"); description != "" {
+			property["description"] = description
+		}
+		for key, value := range schemaConstraints()[name] {
+			property[key] = value
+		}
+		properties[name] = property
+
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// schemaConstraints are the allowed values of the fields that have them
+func schemaConstraints() map[string]map[string]any {
+	return map[string]map[string]any{
+		"level":      {"minimum": MinLevel, "maximum": MaxLevel},
+		"locationId": {"enum": BodyPartMapping.IDs()},
+		"sideId":     {"enum": SideMap.IDs()},
+	}
+}
+
+// schemaType maps a Go type to a JSON schema type. Times are local time strings
+func schemaType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
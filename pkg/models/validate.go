@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate checks that the pain description has a valid level, known location and side IDs, a description and that
+// the numbness fields agree. All problems are returned joined together
+func (p PainDescription) Validate() error {
+	var errs []error
+	if p.Level < MinLevel || p.Level > MaxLevel {
+		errs = append(errs, fmt.Errorf("level should be between %d and %d, got %d", MinLevel, MaxLevel, p.Level))
+	}
+	if _, ok := BodyPartMapping[p.LocationId]; !ok {
+		errs = append(errs, fmt.Errorf("unknown locationId %d", p.LocationId))
+	}
+	if _, ok := SideMap[p.SideId]; !ok {
+		errs = append(errs, fmt.Errorf("unknown sideId %d", p.SideId))
+	}
+	if strings.TrimSpace(p.Description) == "" {
+		errs = append(errs, errors.New("description is empty"))
+	}
+	if !p.Numbness && strings.TrimSpace(p.NumbnessDescription) != "" {
+		errs = append(errs, errors.New("numbnessDescription is set but numbness is false"))
+	}
+	return errors.Join(errs...)
+}
+
+// ValidatePainDescriptions validates all the pain descriptions. The errors are prefixed with the 1-based
+// number of the pain description
+func ValidatePainDescriptions(pd []PainDescription) error {
+	var errs []error
+	for i, p := range pd {
+		if err := p.Validate(); err != nil {
+			for _, line := range strings.Split(err.Error(), "\n") {
+				errs = append(errs, fmt.Errorf("pain %d: %s", i+1, line))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -1,15 +1,121 @@
 package openai
 
 import (
+	"context"
 	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
-func LoginWithDefaultCredential() (*azidentity.DefaultAzureCredential, error) {
+// openAIScope is the scope of the Azure AD tokens for Azure OpenAI
+const openAIScope = "https://cognitiveservices.azure.com/.default"
+
+// defaultRefreshBefore is how long before expiry a cached token is refreshed
+const defaultRefreshBefore = 5 * time.Minute
+
+// LoginWithDefaultCredential returns the user assigned managed identity from AZURE_CLIENT_ID if it is set,
+// otherwise the default Azure credential
+func LoginWithDefaultCredential() (azcore.TokenCredential, error) {
+	if clientId := os.Getenv("AZURE_CLIENT_ID"); clientId != "" {
+		cred, err := azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ID: azidentity.ClientID(clientId),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get managed identity credential: %w", err)
+		}
+		return cred, nil
+	}
+
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get default credential: %w", err)
 	}
 
 	return cred, nil
-}
\ No newline at end of file
+}
+
+// TokenRoundTripper is a http.RoundTripper that adds a bearer token from an Azure credential to the requests.
+// The token is cached and refreshed before it expires, and a request rejected with 401 is retried once with a
+// new token. It is safe for concurrent use
+type TokenRoundTripper struct {
+	Transport  http.RoundTripper
+	Credential azcore.TokenCredential
+	Scopes     []string
+	// RefreshBefore is how long before expiry the cached token is refreshed
+	RefreshBefore time.Duration
+
+	mu    sync.Mutex
+	token azcore.AccessToken
+}
+
+// NewTokenRoundTripper creates a TokenRoundTripper for the Azure OpenAI scope
+func NewTokenRoundTripper(transport http.RoundTripper, cred azcore.TokenCredential) *TokenRoundTripper {
+	return &TokenRoundTripper{
+		Transport:     transport,
+		Credential:    cred,
+		Scopes:        []string{openAIScope},
+		RefreshBefore: defaultRefreshBefore,
+	}
+}
+
+func (rt *TokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.getToken(req.Context(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.Transport.RoundTrip(withBearerToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The token may have been revoked before its expiry. Retry once with a new token if the body can be sent again
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	token, err = rt.getToken(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	retry := withBearerToken(req, token)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("unable to reset request body: %w", err)
+		}
+	}
+	return rt.Transport.RoundTrip(retry)
+}
+
+// getToken returns the cached token, fetching a new one if it expires soon or it is the rejected token
+func (rt *TokenRoundTripper) getToken(ctx context.Context, rejected string) (string, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	valid := rt.token.Token != "" && time.Now().Add(rt.RefreshBefore).Before(rt.token.ExpiresOn)
+	if valid && rt.token.Token != rejected {
+		return rt.token.Token, nil
+	}
+
+	token, err := rt.Credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: rt.Scopes})
+	if err != nil {
+		return "", fmt.Errorf("unable to get access token: %w", err)
+	}
+	rt.token = token
+	return token.Token, nil
+}
+
+// withBearerToken returns a copy of the request with the token in the Authorization header,
+// as a RoundTripper should not modify the request it was given
+func withBearerToken(req *http.Request, token string) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
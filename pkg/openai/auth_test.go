@@ -0,0 +1,181 @@
+package openai_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"io"
+	"net/http"
+	"sync"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+// fakeCredential returns numbered tokens valid for validFor
+type fakeCredential struct {
+	mu       sync.Mutex
+	calls    int
+	validFor time.Duration
+}
+
+func (c *fakeCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return azcore.AccessToken{Token: fmt.Sprintf("token-%d", c.calls), ExpiresOn: time.Now().Add(c.validFor)}, nil
+}
+
+func (c *fakeCredential) getCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func okResponse() *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString("{}"))}
+}
+
+func TestTokenRoundTripper_ShouldCacheToken(t *testing.T) {
+	t.Parallel()
+	cred := &fakeCredential{validFor: time.Hour}
+	var headers []string
+	rt := openai.NewTokenRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		headers = append(headers, req.Header.Get("Authorization"))
+		return okResponse(), nil
+	}), cred)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "https://example.com", bytes.NewBufferString("body"))
+		if _, err := rt.RoundTrip(req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Error("Expected the original request not to be modified")
+		}
+	}
+
+	if cred.getCalls() != 1 {
+		t.Errorf("Expected 1 token request, got %d", cred.getCalls())
+	}
+	for _, h := range headers {
+		if h != "Bearer token-1" {
+			t.Errorf("Expected the cached token, got %q", h)
+		}
+	}
+}
+
+func TestTokenRoundTripper_ShouldRefreshBeforeExpiry(t *testing.T) {
+	t.Parallel()
+	// Tokens that expire within RefreshBefore are never reused
+	cred := &fakeCredential{validFor: time.Minute}
+	rt := openai.NewTokenRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return okResponse(), nil
+	}), cred)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		if _, err := rt.RoundTrip(req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if cred.getCalls() != 2 {
+		t.Errorf("Expected 2 token requests, got %d", cred.getCalls())
+	}
+}
+
+func TestTokenRoundTripper_ShouldRetryOnceOnUnauthorized(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		statuses         []int
+		expectedStatus   int
+		expectedRequests int
+	}{
+		"SucceedsWithNewToken": {[]int{http.StatusUnauthorized, http.StatusOK}, http.StatusOK, 2},
+		"StillUnauthorized":    {[]int{http.StatusUnauthorized, http.StatusUnauthorized}, http.StatusUnauthorized, 2},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cred := &fakeCredential{validFor: time.Hour}
+			var headers, bodies []string
+			rt := openai.NewTokenRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				headers = append(headers, req.Header.Get("Authorization"))
+				body, _ := io.ReadAll(req.Body)
+				bodies = append(bodies, string(body))
+				return &http.Response{StatusCode: tt.statuses[len(headers)-1], Body: io.NopCloser(bytes.NewBufferString(""))}, nil
+			}), cred)
+
+			req, _ := http.NewRequest(http.MethodPost, "https://example.com", bytes.NewBufferString("body"))
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if resp.StatusCode != tt.expectedStatus || len(headers) != tt.expectedRequests {
+				t.Fatalf("Expected status %d after %d requests, got %d after %d", tt.expectedStatus, tt.expectedRequests, resp.StatusCode, len(headers))
+			}
+			if headers[0] != "Bearer token-1" || headers[1] != "Bearer token-2" {
+				t.Errorf("Expected a new token for the retry, got %v", headers)
+			}
+			if bodies[1] != "body" {
+				t.Errorf("Expected the body to be sent again, got %q", bodies[1])
+			}
+		})
+	}
+}
+
+func TestTokenRoundTripper_ShouldFetchOnceForConcurrentRequests(t *testing.T) {
+	t.Parallel()
+	cred := &fakeCredential{validFor: time.Hour}
+	rt := openai.NewTokenRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return okResponse(), nil
+	}), cred)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+			if _, err := rt.RoundTrip(req); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cred.getCalls() != 1 {
+		t.Errorf("Expected 1 token request, got %d", cred.getCalls())
+	}
+}
+
+func TestNewClient_ShouldNotFetchTokenUpFront(t *testing.T) {
+	t.Parallel()
+	cred := &fakeCredential{validFor: time.Hour}
+	provider, err := openai.NewAzureProvider("https://example.com", "deployment", openai.WithTokenCredential(cred))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	config, err := openai.NewConfig(provider)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := openai.NewClient(config); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cred.getCalls() != 0 {
+		t.Errorf("Expected the token to be fetched with the first request, got %d calls", cred.getCalls())
+	}
+}
@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
 	"t-pain/pkg/models"
 	"time"
 )
 
+// finishReasonContentFilter is the finish reason of a response that was cut by the content filter
+const finishReasonContentFilter = "content_filter"
+
 type Doer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
@@ -21,6 +24,8 @@ type Doer interface {
 type Client struct {
 	config     *Config
 	HttpClient Doer
+	// limiter keeps the requests within the TPM quota, or is nil when there is no client side limit
+	limiter *TokenBucket
 }
 
 func NewClient(config *Config, opts ...ClientOption) (*Client, error) {
@@ -28,33 +33,22 @@ func NewClient(config *Config, opts ...ClientOption) (*Client, error) {
 		return nil, fmt.Errorf("config is nil")
 	}
 
-	// create http client
-	httpClient := http.Client{}
+	if config.Provider == nil {
+		return nil, fmt.Errorf("provider is nil")
+	}
 
-	if config.AzureCredential != nil {
-		accessToken, err := config.AzureCredential.GetToken(context.Background(), policy.TokenRequestOptions{
-			Scopes: []string{"https://openai.azure.com/.default"},
-		})
-		if err != nil {
-			return nil, fmt.Errorf("unable to get access token: %w", err)
-		}
-		transport := BearerTokenRoundTripper{
-			Transport:   http.DefaultTransport,
-			BearerToken: accessToken.Token,
-		}
-		httpClient.Transport = transport
-	} else {
-		transport := ApiKeyRoundTripper{
-			Transport: http.DefaultTransport,
-			ApiKey:    config.ApiKey,
-		}
-		httpClient.Transport = transport
+	// create http client with the authentication of the provider
+	httpClient := http.Client{
+		Transport: config.Provider.RoundTripper(http.DefaultTransport),
 	}
 
 	client := Client{
 		config:     config,
 		HttpClient: &httpClient,
 	}
+	if config.TokensPerMinute > 0 {
+		client.limiter = NewTokenBucket(config.TokensPerMinute)
+	}
 
 	for _, opt := range opts {
 		err := opt(&client)
@@ -75,7 +69,8 @@ func WithDoer(client Doer) ClientOption {
 	}
 }
 
-// BearerTokenRoundTripper is a http.RoundTripper that adds a bearer token to the request
+// BearerTokenRoundTripper is a http.RoundTripper that adds a bearer token to the request. The token is never refreshed,
+// use TokenRoundTripper for tokens from an Azure credential
 type BearerTokenRoundTripper struct {
 	Transport   http.RoundTripper
 	BearerToken string
@@ -96,69 +91,206 @@ func (rt ApiKeyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 	return rt.Transport.RoundTrip(req)
 }
 
-// GetPainDescriptionObject uses the text description provided to return a slice of pain description objects generated by the OpenAI API
-func (c Client) GetPainDescriptionObject(painDescription string) ([]models.PainDescription, error) {
-	painDescMsg := NewUserMessage(painDescription)
-	conversation := c.config.SystemContext
-	conversation.Messages = append(conversation.Messages, painDescMsg)
+// GetPainDescriptionObject uses the text description provided to return the pain description objects generated by the OpenAI API.
+// The model returns them by calling a function, and any text it answers with instead is returned as a ResultText or
+// ResultRefusal. The timestamps are the occurrence times mentioned in the text, or the time the message was sent.
+// Invalid pain descriptions are sent back to the model for fixing up to MaxRepairAttempts times, after which
+// an *InvalidOutputError is returned. Failed and rate limited requests are retried according to the RetryPolicy,
+// after which an *APIError is returned for error responses. The tokens used are returned in the Usage of the result,
+// also with errors. Cancelling ctx aborts the request in flight and the waits between the requests.
+// history is the earlier exchange returned in a ResultClarification, or nil when the message starts a new one
+func (c Client) GetPainDescriptionObject(ctx context.Context, painDescription string, mc MessageContext, history *Conversation) (Result, error) {
+	mc = mc.withDefaults()
 
-	var painDescObj []models.PainDescription
+	var historyMessages []Message
+	if history != nil {
+		historyMessages = history.Messages
+	}
 
-	// create request
-	req, cancel, err := c.createRequest(&conversation)
+	// Copy the messages so that concurrent requests do not share the backing array of the system context or history
+	start := len(c.config.SystemContext.Messages)
+	conversation := Conversation{Messages: make([]Message, 0, start+len(historyMessages)+2)}
+	conversation.Messages = append(conversation.Messages, c.config.SystemContext.Messages...)
+	conversation.Messages = append(conversation.Messages, historyMessages...)
+	conversation.Messages = append(conversation.Messages, NewSystemMessage(mc.prompt()), NewUserMessage(painDescription))
+
+	lookback := c.config.TimestampLookback
+	if lookback <= 0 {
+		lookback = DefaultTimestampLookback
+	}
+
+	var usage Usage
+	for attempt := 1; ; attempt++ {
+		resp, err := c.complete(ctx, &conversation, mc)
+		if err != nil {
+			return Result{Usage: usage}, err
+		}
+		usage.Add(resp.Usage)
+		message := resp.Choices[0].Message
+
+		if resp.Choices[0].FinishReason == finishReasonContentFilter {
+			log.Println("response was filtered by the content filter")
+			return Result{Kind: ResultRefusal, Text: message.Content, Usage: usage}, nil
+		}
+		if len(message.ToolCalls) == 0 {
+			return Result{Kind: ResultText, Text: message.Content, Usage: usage}, nil
+		}
+
+		if question, ok := parseClarificationCall(message.ToolCalls); ok {
+			conversation.AddMessage(resp)
+			conversation.Messages = append(conversation.Messages, newToolReplies(message, "The question was sent to the user")...)
+
+			// The exchange without the system context is kept by the caller until the user answers
+			exchange := make([]Message, len(conversation.Messages)-start)
+			copy(exchange, conversation.Messages[start:])
+			return Result{Kind: ResultClarification, Text: question, Conversation: &Conversation{Messages: exchange}, Usage: usage}, nil
+		}
+
+		var pd []models.PainDescription
+		painDescResp, err := parsePainDescriptionCalls(message.ToolCalls)
+		if err == nil {
+			pd = toPainDescriptions(painDescResp, mc, lookback)
+			for i := range pd {
+				pd[i].PromptVersion = c.config.PromptVersion
+			}
+			err = models.ValidatePainDescriptions(pd)
+		}
+		if err == nil {
+			return Result{Kind: ResultPainDescriptions, PainDescriptions: pd, Usage: usage}, nil
+		}
+
+		if attempt > c.config.MaxRepairAttempts {
+			return Result{Usage: usage}, &InvalidOutputError{Attempts: attempt, Err: err}
+		}
+		log.Printf("invalid pain descriptions from the model on attempt %d, asking for a fix: %v", attempt, err)
+		conversation.AddMessage(resp)
+		conversation.Messages = append(conversation.Messages, newToolReplies(message, "The arguments were not valid:\n"+err.Error()+
+			"\nCall "+painDescriptionsFunction+" again with all the pain descriptions of the message and the errors fixed.")...)
+	}
+}
+
+// complete sends the conversation to the API and returns the response, which has at least one choice.
+// Temporary failures are retried with exponential backoff, waiting at least as long as the API asks for, until
+// ctx is done
+func (c Client) complete(ctx context.Context, conversation *Conversation, mc MessageContext) (OpenAiCompletionResponse, error) {
+	body, err := c.generateRequestBody(conversation)
 	if err != nil {
-		return painDescObj, fmt.Errorf("unable to create request: %w", err)
+		return OpenAiCompletionResponse{}, fmt.Errorf("unable to generate request body: %w", err)
+	}
+
+	policy := c.config.RetryPolicy
+	for retry := 0; ; retry++ {
+		resp, err := c.send(ctx, body)
+		if err == nil || retry >= policy.MaxRetries || !retryable(err) {
+			return resp, err
+		}
+		if ctx.Err() != nil {
+			return resp, fmt.Errorf("gave up retrying: %w: %w", ctx.Err(), err)
+		}
+
+		wait := policy.backoff(retry)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			wait = maxDuration(wait, apiErr.RetryAfter)
+		}
+		log.Printf("request failed, retrying in %s: %v", wait.Round(time.Millisecond), err)
+		if mc.OnRetry != nil {
+			mc.OnRetry(RetryInfo{Retry: retry + 1, Wait: wait, Err: err})
+		}
+		if ctxErr := sleep(ctx, wait); ctxErr != nil {
+			return resp, fmt.Errorf("gave up retrying: %w: %w", ctxErr, err)
+		}
+	}
+}
+
+// send makes a single request with the body, waiting first for the client side rate limit
+func (c Client) send(ctx context.Context, body []byte) (OpenAiCompletionResponse, error) {
+	var parsedResp OpenAiCompletionResponse
+
+	estimate := estimateTokens(body)
+	if c.limiter != nil {
+		if wait := c.limiter.Reserve(estimate); wait > 0 {
+			log.Printf("waiting %s for the tokens per minute limit", wait.Round(time.Millisecond))
+			if err := sleep(ctx, wait); err != nil {
+				c.limiter.Adjust(estimate)
+				return parsedResp, fmt.Errorf("waiting for the tokens per minute limit: %w", err)
+			}
+		}
+	}
+
+	req, cancel, err := c.createRequest(ctx, body)
+	if err != nil {
+		return parsedResp, fmt.Errorf("unable to create request: %w", err)
 	}
 	defer cancel()
 	resp, err := c.HttpClient.Do(req)
 	if err != nil {
-		return painDescObj, fmt.Errorf("unable to send request: %w", err)
+		return parsedResp, fmt.Errorf("unable to send request: %w", err)
 	}
 	defer resp.Body.Close()
+	c.syncLimiter(resp.Header)
 	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return parsedResp, fmt.Errorf("unable to read response: %w", err)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return painDescObj, fmt.Errorf("request failed with status code %d and body %s", resp.StatusCode, responseBody)
+		if c.limiter != nil && resp.StatusCode != http.StatusTooManyRequests {
+			// The request was not processed, so it did not use the quota
+			c.limiter.Adjust(estimate)
+		}
+		return parsedResp, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(responseBody),
+			RetryAfter: retryAfter(resp.Header, time.Now()),
+		}
 	}
 
 	// parse response
-	var parsedResp OpenAiCompletionResponse
 	err = json.Unmarshal(responseBody, &parsedResp)
 	if err != nil {
-		return painDescObj, fmt.Errorf("unable to parse response: %w", err)
+		return parsedResp, fmt.Errorf("unable to parse response: %w", err)
 	}
-	split := strings.Split(parsedResp.Choices[0].Message.Content, "####")
-	oaiText := split[len(split)-1]
-	b := []byte(oaiText)
-
-	err = json.Unmarshal(b, &painDescObj)
-	if err != nil {
-		log.Println("unable to parse to PainDescObject:", err)
-		return painDescObj, fmt.Errorf(oaiText)
+	if c.limiter != nil && parsedResp.Usage.TotalTokens > 0 {
+		c.limiter.Adjust(estimate - parsedResp.Usage.TotalTokens)
 	}
-	for i := range painDescObj {
-		now := time.Now()
-		painDescObj[i].Timestamp = now
+	if len(parsedResp.Choices) == 0 {
+		return parsedResp, fmt.Errorf("response has no choices")
 	}
-	return painDescObj, nil
+	// Only the first choice is used, AddMessage would add all of them to the conversation
+	parsedResp.Choices = parsedResp.Choices[:1]
+	return parsedResp, nil
 }
 
-// createRequest creates a request for the OpenAI API
-func (c Client) createRequest(conversation *Conversation) (*http.Request, context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+// syncLimiter lowers the client side limit to the remaining tokens reported by the API, as other clients may
+// share the quota of the deployment
+func (c Client) syncLimiter(header http.Header) {
+	if c.limiter == nil {
+		return
+	}
+	if remaining, err := strconv.Atoi(header.Get("x-ratelimit-remaining-tokens")); err == nil {
+		c.limiter.Limit(remaining)
+	}
+}
 
-	body, err := c.generateRequestBody(conversation)
-	if err != nil {
-		return nil, cancel, fmt.Errorf("unable to generate request body: %w", err)
+// createRequest creates a request for the OpenAI API with the request timeout on top of ctx
+func (c Client) createRequest(ctx context.Context, body []byte) (*http.Request, context.CancelFunc, error) {
+	timeout := c.config.RequestTimeout
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.Url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.Provider.URL(), bytes.NewBuffer(body))
 
 	return req, cancel, err
 }
 
 func (c Client) generateRequestBody(conversation *Conversation) ([]byte, error) {
 	body := OpenAiCompletionRequest{
-		Messages: conversation.Messages,
+		Model:      c.config.Provider.Model(),
+		Messages:   conversation.Messages,
+		Tools:      []Tool{painDescriptionsTool(), clarificationTool()},
+		ToolChoice: "auto",
 	}
 
 	bodyBytes, err := json.Marshal(body)
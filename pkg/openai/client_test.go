@@ -2,6 +2,7 @@ package openai_test
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"t-pain/pkg/openai"
@@ -18,10 +19,8 @@ func (m *MockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 
 func TestNewClient(t *testing.T) {
 	config := &openai.Config{
-		AzureCredential: nil,
-		ApiKey:          "test-api-key",
-		Url:             "test-url",
-		SystemContext:   *openai.NewConversation(openai.NewSystemMessage("test"), openai.NewUserMessage("test")),
+		Provider:      &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+		SystemContext: *openai.NewConversation(openai.NewSystemMessage("test"), openai.NewUserMessage("test")),
 	}
 
 	mockClient := &MockHTTPClient{
@@ -52,15 +51,13 @@ func TestClient_GetPainDescriptionObject_ShouldSucceedOnNormalResponse(t *testin
 	}
 
 	config := &openai.Config{
-		AzureCredential: nil,
-		ApiKey:          "test-api-key",
-		Url:             "test-url",
-		SystemContext:   *openai.NewConversation(openai.NewSystemMessage("test"), openai.NewUserMessage("test")),
+		Provider:      &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+		SystemContext: *openai.NewConversation(openai.NewSystemMessage("test"), openai.NewUserMessage("test")),
 	}
 
 	client, _ := openai.NewClient(config, openai.WithDoer(mockClient))
 
-	_, err := client.GetPainDescriptionObject("test pain description")
+	_, err := client.GetPainDescriptionObject(context.Background(), "test pain description", openai.MessageContext{}, nil)
 	if err == nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -72,21 +69,19 @@ func TestClient_GetPainDescriptionObject_ShouldErrorOnFailedOutputFromModel(t *t
 		DoFunc: func(req *http.Request) (*http.Response, error) {
 			return &http.Response{
 				StatusCode: http.StatusOK,
-				Body:       io.NopCloser(bytes.NewBufferString("{\"choices\":[{\"message\":{\"content\":\"####\"}}]}")), // sample response
+				Body:       io.NopCloser(bytes.NewBufferString("{\"choices\":[{\"message\":{\"tool_calls\":[{\"type\":\"function\",\"function\":{\"name\":\"save_pain_descriptions\",\"arguments\":\"####\"}}]}}]}")), // sample response
 			}, nil
 		},
 	}
 
 	config := &openai.Config{
-		AzureCredential: nil,
-		ApiKey:          "test-api-key",
-		Url:             "test-url",
-		SystemContext:   *openai.NewConversation(openai.NewSystemMessage("test"), openai.NewUserMessage("test")),
+		Provider:      &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+		SystemContext: *openai.NewConversation(openai.NewSystemMessage("test"), openai.NewUserMessage("test")),
 	}
 
 	client, _ := openai.NewClient(config, openai.WithDoer(mockClient))
 
-	_, err := client.GetPainDescriptionObject("test pain description")
+	_, err := client.GetPainDescriptionObject(context.Background(), "test pain description", openai.MessageContext{}, nil)
 	if err == nil {
 		t.Errorf("Expected failing parse of painDescription error, got nil")
 	}
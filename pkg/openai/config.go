@@ -2,8 +2,7 @@ package openai
 
 import (
 	"fmt"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"t-pain/pkg/models"
+	"time"
 )
 
 // CreateUrl creates an url for the request
@@ -13,116 +12,55 @@ func CreateUrl(endpoint, deploymentName string) string {
 		endpoint = endpoint[:len(endpoint)-1]
 	}
 
-	apiVersion := "2023-03-15-preview"
+	apiVersion := "2024-02-01"
 	return fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", endpoint, deploymentName, apiVersion)
 }
 
-// Config is the configuration for calling the Azure OpenAI API
+const (
+	// DefaultTimestampLookback is how far in the past a time mentioned in a message may be by default
+	DefaultTimestampLookback = 7 * 24 * time.Hour
+	// DefaultMaxRepairAttempts is how many times invalid output is sent back to the model by default
+	DefaultMaxRepairAttempts = 2
+	// DefaultRequestTimeout is how long a single request to the API may take by default
+	DefaultRequestTimeout = 30 * time.Second
+)
+
+// Config is the configuration for calling the chat completions API of a provider
 type Config struct {
-	Url             string
-	ApiKey          string
-	SystemContext   Conversation
-	AzureCredential *azidentity.DefaultAzureCredential
+	Provider      Provider
+	SystemContext Conversation
+	// PromptVersion is the version of the prompt in the SystemContext, stored with the pain descriptions
+	PromptVersion string
+	// TimestampLookback is how far before the message a mentioned time may be. Zero means DefaultTimestampLookback
+	TimestampLookback time.Duration
+	// MaxRepairAttempts is how many times invalid pain descriptions are sent back to the model for fixing
+	MaxRepairAttempts int
+	// RetryPolicy controls the retries of failed and rate limited requests
+	RetryPolicy RetryPolicy
+	// RequestTimeout is how long a single attempt may take
+	RequestTimeout time.Duration
+	// TokensPerMinute is the TPM quota of the deployment. When set, the client waits before sending requests
+	// that would exceed it. Zero disables the client side limit
+	TokensPerMinute int
 }
 
-func NewConfig(endpoint, deploymentName string, opts ...ConfigOpt) (*Config, error) {
-	systemRole := "Assistant is an AI chatbot that helps users turn a natural language description of their pain levels into valid JSON format. " +
-		"After users inputs a description of their pain levels, location of the pain, optional numbness description and further description of their feelings, it will provide a json array representation in the format preceded by ####.\n" +
-		"- Ignore any references to previous messages by the user. The pain description you return should only contain items from the latest message from the user. \n" +
-		"- If the user does not give a direct 0-10 number for their pain level, the assistant makes an estimate of the level on that range based on the given description. The numbers should always be full integers rounded up.\n" +
-		"- The location and side fields should be an integer mapping to the following chart= delmited by ```. If no body part is mentioned directly, try to map the pain from the description to the closest body part in the mapping. If no side is mentioned, set the value to both.\n" +
-		"- The assistant's response should always include \"####\" before the JSON array representation and SHOULD NOT include any other text\n" +
-		"- The description might have multiple pain areas, they should be considered in the json by adding a new object in the result array. However, if both pain areas would map to the same location, only add that location once." +
-		"- Do not mention anything about the JSON format to the user" +
-		"- If the user writes in Finnish, respond to them in Finnish. Do not modify the names of the properties in the JSON object in any situation" +
-		"- If the user mentions pain radiating to other locations, add those locations to the response along with respective pain levels. Include full description on all entries.\n" +
-		"Body Parts:\n" +
-		fmt.Sprintf("%v", models.BodyPartMapping.StringNameFirst()) +
-		"Sides:\n" +
-		fmt.Sprintf("%v", models.SideMap.StringNameFirst()) +
-		"JSON Format:\n" +
-		"[\n" +
-		fmt.Sprintf(models.PrintPainDescriptionJSONFormat()) +
-		"]\n"
-
-	examples := []Message{
-		{
-			Content: "My left arm is quite painful today. About level 5. The pain is radiating to my left shoulder also",
-			Role:    "user",
-		},
-		{
-			Content: "####\n" +
-				"[\n" +
-				models.PrintSinglePainDescriptionJSONFormat(models.PainDescription{
-					Level:               5,
-					LocationId:          4,
-					SideId:              2,
-					Description:         "My left arm is quite painful today. About level 5. The pain is radiating to my left shoulder also",
-					Numbness:            false,
-					NumbnessDescription: "",
-				}) + ",\n" +
-				models.PrintSinglePainDescriptionJSONFormat(models.PainDescription{
-					Level:               5,
-					LocationId:          3,
-					SideId:              2,
-					Description:         "My left arm is quite painful today. About level 5. The pain is radiating to my left shoulder also",
-					Numbness:            false,
-					NumbnessDescription: "",
-				}) + "\n" +
-				"]\n",
-			Role: "assistant",
-		},
-		{
-			Content: "Pitkät selkälihakset vähän krampissa. Alaselkä aika perustasoa lääkkeiden oton jälkeen. Tippu ehkä seiska puolikkaasta kutoseen. Istuessa.",
-			Role:    "user",
-		},
-		{
-			Content: "####\n" +
-				"[\n" +
-				models.PrintSinglePainDescriptionJSONFormat(models.PainDescription{
-					Level:               7,
-					LocationId:          8,
-					SideId:              1,
-					Description:         "Pitkät selkälihakset vähän krampissa. Alaselkä aika perustasoa lääkkeiden oton jälkeen. Tippu ehkä seiska puolikkaasta kutoseen. Istuessa.",
-					Numbness:            false,
-					NumbnessDescription: "",
-				}) + ",\n" +
-				models.PrintSinglePainDescriptionJSONFormat(models.PainDescription{
-					Level:               7,
-					LocationId:          9,
-					SideId:              1,
-					Description:         "Pitkät selkälihakset vähän krampissa. Alaselkä aika perustasoa lääkkeiden oton jälkeen. Tippu ehkä seiska puolikkaasta kutoseen. Istuessa.",
-					Numbness:            false,
-					NumbnessDescription: "",
-				}) + "\n" +
-				"]\n",
-			Role: "assistant",
-		},
-		{
-			Content: "Lisäyksenä edelliseen, myös oikea käsi on kipeä. Taso 3.",
-			Role:    "user",
-		},
-		{
-			Content: "####\n" +
-				"[\n" +
-				models.PrintSinglePainDescriptionJSONFormat(models.PainDescription{
-					Level:               3,
-					LocationId:          4,
-					SideId:              3,
-					Description:         "Lisäyksenä edelliseen, myös oikea käsi on kipeä ja turtunut. Taso 3. ",
-					Numbness:            true,
-					NumbnessDescription: "oikea käsi kipeä ja turtunut",
-				}) + "\n" +
-				"]\n",
-			Role: "assistant",
-		},
+func NewConfig(provider Provider, opts ...ConfigOpt) (*Config, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("provider is nil")
 	}
 
-	sc := NewConversation(NewSystemMessage(systemRole), examples...)
+	prompt, err := LoadPrompt(DefaultPromptVersion)
+	if err != nil {
+		return nil, err
+	}
 
 	c := Config{
-		Url:           CreateUrl(endpoint, deploymentName),
-		SystemContext: *sc,
+		Provider:          provider,
+		SystemContext:     *NewConversation(NewSystemMessage(prompt.System), prompt.Examples...),
+		PromptVersion:     prompt.Version,
+		MaxRepairAttempts: DefaultMaxRepairAttempts,
+		RetryPolicy:       DefaultRetryPolicy(),
+		RequestTimeout:    DefaultRequestTimeout,
 	}
 
 	for _, opt := range opts {
@@ -132,31 +70,78 @@ func NewConfig(endpoint, deploymentName string, opts ...ConfigOpt) (*Config, err
 		}
 	}
 
-	if c.AzureCredential == nil && c.ApiKey == "" {
-		return nil, fmt.Errorf("no authentication method provided, please provide an API key or Azure credential")
-	}
-
 	return &c, nil
 }
 
 type ConfigOpt func(*Config) error
 
-func WithApiKey(apiKey string) ConfigOpt {
+// WithPrompt replaces the default prompt, e.g. with one from LoadPromptFile
+func WithPrompt(prompt *Prompt) ConfigOpt {
 	return func(c *Config) error {
-		c.ApiKey = apiKey
+		if prompt == nil {
+			return fmt.Errorf("prompt is nil")
+		}
+		c.SystemContext = *NewConversation(NewSystemMessage(prompt.System), prompt.Examples...)
+		c.PromptVersion = prompt.Version
 		return nil
 	}
 }
 
-func WithAzureCredential() ConfigOpt {
-	// TODO: This should be tested with a real environment
+// WithTimestampLookback sets how far before the message a mentioned time may be
+func WithTimestampLookback(lookback time.Duration) ConfigOpt {
 	return func(c *Config) error {
-		cred, err := LoginWithDefaultCredential()
-		if err != nil {
-			return err
+		if lookback <= 0 {
+			return fmt.Errorf("timestamp lookback should be positive, got %s", lookback)
+		}
+		c.TimestampLookback = lookback
+		return nil
+	}
+}
+
+// WithMaxRepairAttempts sets how many times invalid pain descriptions are sent back to the model for fixing.
+// Zero disables the repairs
+func WithMaxRepairAttempts(attempts int) ConfigOpt {
+	return func(c *Config) error {
+		if attempts < 0 {
+			return fmt.Errorf("max repair attempts should not be negative, got %d", attempts)
+		}
+		c.MaxRepairAttempts = attempts
+		return nil
+	}
+}
+
+// WithRetryPolicy sets how failed and rate limited requests are retried
+func WithRetryPolicy(policy RetryPolicy) ConfigOpt {
+	return func(c *Config) error {
+		if policy.MaxRetries < 0 {
+			return fmt.Errorf("max retries should not be negative, got %d", policy.MaxRetries)
+		}
+		if policy.BaseDelay < 0 || policy.MaxDelay < policy.BaseDelay {
+			return fmt.Errorf("retry delays should satisfy 0 <= base delay <= max delay, got %s and %s", policy.BaseDelay, policy.MaxDelay)
+		}
+		c.RetryPolicy = policy
+		return nil
+	}
+}
+
+// WithRequestTimeout sets how long a single request to the API may take
+func WithRequestTimeout(timeout time.Duration) ConfigOpt {
+	return func(c *Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("request timeout should be positive, got %s", timeout)
 		}
+		c.RequestTimeout = timeout
+		return nil
+	}
+}
 
-		c.AzureCredential = cred
+// WithTokensPerMinute limits the requests to the tokens per minute quota of the deployment
+func WithTokensPerMinute(tpm int) ConfigOpt {
+	return func(c *Config) error {
+		if tpm < 0 {
+			return fmt.Errorf("tokens per minute should not be negative, got %d", tpm)
+		}
+		c.TokensPerMinute = tpm
 		return nil
 	}
-}
\ No newline at end of file
+}
@@ -4,6 +4,10 @@ package openai
 type Message struct {
 	Content string `json:"content"`
 	Role    string `json:"role"`
+	// ToolCalls are the tools the assistant called instead of answering with text
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallId is the call a message with the tool role replies to
+	ToolCallId string `json:"tool_call_id,omitempty"`
 }
 
 func NewUserMessage(content string) Message {
@@ -46,7 +50,11 @@ func (c *Conversation) AddMessage(response OpenAiCompletionResponse) {
 
 // OpenAiCompletionRequest is the request body to the OpenAI API
 type OpenAiCompletionRequest struct {
-	Messages []Message `json:"messages"`
+	// Model is required by the public API and compatible servers, Azure selects it by the deployment
+	Model      string    `json:"model,omitempty"`
+	Messages   []Message `json:"messages"`
+	Tools      []Tool    `json:"tools,omitempty"`
+	ToolChoice string    `json:"tool_choice,omitempty"`
 }
 
 // OpenAiCompletionResponse is the response body from the OpenAI API
@@ -60,9 +68,19 @@ type OpenAiCompletionResponse struct {
 	Id      string `json:"id"`
 	Model   string `json:"model"`
 	Object  string `json:"object"`
-	Usage   struct {
-		CompletionTokens int `json:"completion_tokens"`
-		PromptTokens     int `json:"prompt_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+	Usage   Usage  `json:"usage"`
+}
+
+// Usage is the number of tokens used by requests to the API
+type Usage struct {
+	CompletionTokens int `json:"completion_tokens"`
+	PromptTokens     int `json:"prompt_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Add adds the tokens of another request to the usage
+func (u *Usage) Add(other Usage) {
+	u.CompletionTokens += other.CompletionTokens
+	u.PromptTokens += other.PromptTokens
+	u.TotalTokens += other.TotalTokens
 }
\ No newline at end of file
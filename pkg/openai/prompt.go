@@ -0,0 +1,148 @@
+package openai
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"t-pain/pkg/models"
+	"text/template"
+	"time"
+)
+
+// DefaultPromptVersion is the embedded prompt used unless another one is chosen
+const DefaultPromptVersion = "pain-v1"
+
+// embeddedPrompts are the prompts shipped with the binary. Each version is a manifest <version>.json naming its
+// system prompt template and listing the examples. Released versions should not be changed, add a new version instead
+//
+//go:embed prompts
+var embeddedPrompts embed.FS
+
+// Prompt is a rendered system prompt and the example exchanges shown to the model after it
+type Prompt struct {
+	// Version identifies the prompt, it is stored with the entries the prompt produced
+	Version  string
+	System   string
+	Examples []Message
+}
+
+// promptManifest is the file format of a prompt version
+type promptManifest struct {
+	Version string `json:"version"`
+	// System is the file name of the system prompt template, relative to the manifest
+	System   string          `json:"system"`
+	Examples []promptExample `json:"examples"`
+}
+
+// promptExample is a user message and the pain descriptions the model should save for it
+type promptExample struct {
+	// SentAt is given to the model before the message like for real messages. Examples without it have no time
+	SentAt           time.Time         `json:"sentAt,omitempty"`
+	Message          string            `json:"message"`
+	PainDescriptions []json.RawMessage `json:"painDescriptions"`
+}
+
+// promptData is what the system prompt templates can refer to
+type promptData struct {
+	PainDescriptionsFunction string
+	ClarificationFunction    string
+	BodyParts                string
+	Sides                    string
+}
+
+// LoadPrompt loads an embedded prompt by its version
+func LoadPrompt(version string) (*Prompt, error) {
+	prompts, err := fs.Sub(embeddedPrompts, "prompts")
+	if err != nil {
+		return nil, err
+	}
+	return loadPrompt(prompts, version+".json")
+}
+
+// LoadPromptFile loads a prompt from a manifest file, so prompts can be tried out without building a new binary
+func LoadPromptFile(path string) (*Prompt, error) {
+	return loadPrompt(os.DirFS(filepath.Dir(path)), filepath.Base(path))
+}
+
+func loadPrompt(fsys fs.FS, manifestName string) (*Prompt, error) {
+	data, err := fs.ReadFile(fsys, manifestName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prompt %s: %w", manifestName, err)
+	}
+	var manifest promptManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse prompt %s: %w", manifestName, err)
+	}
+	if manifest.Version == "" {
+		return nil, fmt.Errorf("prompt %s has no version", manifestName)
+	}
+
+	system, err := renderSystemPrompt(fsys, manifest.System)
+	if err != nil {
+		return nil, fmt.Errorf("prompt %s: %w", manifest.Version, err)
+	}
+
+	p := Prompt{Version: manifest.Version, System: system}
+	for i, example := range manifest.Examples {
+		messages, err := example.messages(fmt.Sprintf("call_example_%d", i+1))
+		if err != nil {
+			return nil, fmt.Errorf("prompt %s: example %d: %w", manifest.Version, i+1, err)
+		}
+		p.Examples = append(p.Examples, messages...)
+	}
+
+	return &p, nil
+}
+
+// renderSystemPrompt executes the template with the function names and the taxonomy of body parts and sides
+func renderSystemPrompt(fsys fs.FS, name string) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").ParseFS(fsys, name)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse system prompt: %w", err)
+	}
+
+	var sb bytes.Buffer
+	err = tmpl.Execute(&sb, promptData{
+		PainDescriptionsFunction: painDescriptionsFunction,
+		ClarificationFunction:    clarificationFunction,
+		BodyParts:                models.BodyPartMapping.StringNameFirst(),
+		Sides:                    models.SideMap.StringNameFirst(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to render system prompt: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// messages returns the example as the messages of a real exchange. The pain descriptions are validated, as the
+// model would copy any mistakes in them
+func (e promptExample) messages(callId string) ([]Message, error) {
+	var messages []Message
+	if !e.SentAt.IsZero() {
+		messages = append(messages, NewSystemMessage(MessageContext{SentAt: e.SentAt, Location: e.SentAt.Location()}.prompt()))
+	}
+	messages = append(messages, NewUserMessage(e.Message))
+
+	items := make([]string, 0, len(e.PainDescriptions))
+	for i, raw := range e.PainDescriptions {
+		var resp painDescriptionResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return nil, fmt.Errorf("pain description %d: %w", i+1, err)
+		}
+		if err := models.PainDescription(resp.modelPainDescription).Validate(); err != nil {
+			return nil, fmt.Errorf("pain description %d: %w", i+1, err)
+		}
+
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, raw); err != nil {
+			return nil, fmt.Errorf("pain description %d: %w", i+1, err)
+		}
+		items = append(items, compact.String())
+	}
+
+	return append(messages, newExampleCall(callId, items...)...), nil
+}
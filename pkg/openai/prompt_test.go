@@ -0,0 +1,135 @@
+package openai_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"t-pain/pkg/openai"
+	"testing"
+)
+
+func TestLoadPrompt_ShouldRenderEmbeddedPrompt(t *testing.T) {
+	t.Parallel()
+	prompt, err := openai.LoadPrompt(openai.DefaultPromptVersion)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if prompt.Version != openai.DefaultPromptVersion {
+		t.Errorf("Expected version %s, got %s", openai.DefaultPromptVersion, prompt.Version)
+	}
+	if strings.Contains(prompt.System, "{{") || !strings.Contains(prompt.System, "save_pain_descriptions") {
+		t.Errorf("Expected a rendered system prompt naming the tool, got %s", prompt.System)
+	}
+	if !strings.Contains(prompt.System, "Head: 1") {
+		t.Errorf("Expected the body parts in the system prompt, got %s", prompt.System)
+	}
+	if len(prompt.Examples) == 0 {
+		t.Error("Expected examples")
+	}
+
+	again, _ := openai.LoadPrompt(openai.DefaultPromptVersion)
+	if again.System != prompt.System {
+		t.Error("Expected the same prompt on every load")
+	}
+}
+
+func TestLoadPrompt_ShouldFailOnUnknownVersion(t *testing.T) {
+	t.Parallel()
+	if _, err := openai.LoadPrompt("pain-v0"); err == nil {
+		t.Error("Expected an error, got none")
+	}
+}
+
+func TestLoadPromptFile(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		template    string
+		example     string
+		expectError bool
+	}{
+		"Valid": {
+			template: "Call {{.PainDescriptionsFunction}}. Sides: {{.Sides}}",
+			example:  `{"level": 3, "locationId": 2, "sideId": 1, "description": "neck", "numbness": false}`,
+		},
+		"InvalidExample": {
+			template:    "Call {{.PainDescriptionsFunction}}",
+			example:     `{"level": 11, "locationId": 2, "sideId": 1, "description": "neck", "numbness": false}`,
+			expectError: true,
+		},
+		"UnknownTemplateField": {
+			template:    "Call {{.Tool}}",
+			example:     `{"level": 3, "locationId": 2, "sideId": 1, "description": "neck", "numbness": false}`,
+			expectError: true,
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			manifest := `{"version": "test-v1", "system": "test.tmpl", "examples": [{"message": "niska 3", "painDescriptions": [` + tt.example + `]}]}`
+			if err := os.WriteFile(filepath.Join(dir, "test.tmpl"), []byte(tt.template), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "test.json"), []byte(manifest), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			prompt, err := openai.LoadPromptFile(filepath.Join(dir, "test.json"))
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if prompt.Version != "test-v1" || !strings.HasPrefix(prompt.System, "Call save_pain_descriptions. Sides: ") {
+				t.Errorf("Unexpected prompt %+v", prompt)
+			}
+			// The user message, the tool call and its result
+			if len(prompt.Examples) != 3 {
+				t.Errorf("Expected 3 example messages, got %d", len(prompt.Examples))
+			}
+		})
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldRecordPromptVersion(t *testing.T) {
+	t.Parallel()
+	message := newToolCallMessage(`{"painDescriptions": [{"level": 3, "locationId": 2, "sideId": 1, "description": "neck", "numbness": false}]}`)
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			resp, _ := json.Marshal(openai.OpenAiCompletionResponse{Choices: []struct {
+				FinishReason string         `json:"finish_reason"`
+				Index        int            `json:"index"`
+				Message      openai.Message `json:"message"`
+			}{{Message: message, FinishReason: "tool_calls"}}})
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBuffer(resp))}, nil
+		},
+	}
+
+	config, err := openai.NewConfig(&openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "key"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	client, err := openai.NewClient(config, openai.WithDoer(mockClient))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	result, err := client.GetPainDescriptionObject(context.Background(), "niska 3", openai.MessageContext{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.PainDescriptions) != 1 || result.PainDescriptions[0].PromptVersion != openai.DefaultPromptVersion {
+		t.Errorf("Expected the prompt version on the pain descriptions, got %+v", result.PainDescriptions)
+	}
+}
@@ -0,0 +1,177 @@
+package openai
+
+import (
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"net/http"
+	"strings"
+)
+
+// DefaultOpenAIBaseURL is the base URL of the public OpenAI API
+const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// Names of the providers, as chosen in the configuration of the bot and the evaluation
+const (
+	ProviderAzure      = "azure"
+	ProviderOpenAI     = "openai"
+	ProviderCompatible = "compatible"
+)
+
+// NewProvider creates the provider with the given name. The endpoint is not used with ProviderOpenAI, and the
+// managed identity replaces the API key with ProviderAzure
+func NewProvider(name, endpoint, deploymentName, apiKey string, managedIdentity bool) (Provider, error) {
+	switch name {
+	case ProviderAzure:
+		auth := WithApiKey(apiKey)
+		if managedIdentity {
+			auth = WithAzureCredential()
+		}
+		return NewAzureProvider(endpoint, deploymentName, auth)
+	case ProviderOpenAI:
+		return NewOpenAIProvider(apiKey, deploymentName)
+	case ProviderCompatible:
+		return NewCompatibleProvider(endpoint, deploymentName, apiKey)
+	default:
+		return nil, fmt.Errorf("unknown OpenAI provider %q", name)
+	}
+}
+
+// Provider is a backend serving the chat completions API, such as Azure OpenAI, the public OpenAI API or an
+// OpenAI-compatible server like llama.cpp or Ollama
+type Provider interface {
+	// URL returns the chat completions endpoint
+	URL() string
+	// Model returns the model sent in the request body, or "" when the URL selects the model
+	Model() string
+	// RoundTripper wraps the transport with the authentication of the backend
+	RoundTripper(transport http.RoundTripper) http.RoundTripper
+}
+
+// AzureProvider is an Azure OpenAI deployment, authenticated with an API key or an Azure AD credential
+type AzureProvider struct {
+	Endpoint       string
+	DeploymentName string
+	ApiKey         string
+	Credential     azcore.TokenCredential
+}
+
+// NewAzureProvider creates a provider for the deployment. One of WithApiKey, WithAzureCredential or
+// WithTokenCredential is required
+func NewAzureProvider(endpoint, deploymentName string, opts ...AzureOption) (*AzureProvider, error) {
+	if endpoint == "" || deploymentName == "" {
+		return nil, fmt.Errorf("endpoint and deployment name are required for Azure OpenAI")
+	}
+
+	p := AzureProvider{
+		Endpoint:       endpoint,
+		DeploymentName: deploymentName,
+	}
+
+	for _, opt := range opts {
+		err := opt(&p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Credential == nil && p.ApiKey == "" {
+		return nil, fmt.Errorf("no authentication method provided, please provide an API key or Azure credential")
+	}
+
+	return &p, nil
+}
+
+func (p *AzureProvider) URL() string {
+	return CreateUrl(p.Endpoint, p.DeploymentName)
+}
+
+// Model returns "", as the deployment in the URL selects the model
+func (p *AzureProvider) Model() string {
+	return ""
+}
+
+func (p *AzureProvider) RoundTripper(transport http.RoundTripper) http.RoundTripper {
+	if p.Credential != nil {
+		// Tokens expire in about an hour, so they are fetched per request from the cache of the round tripper
+		return NewTokenRoundTripper(transport, p.Credential)
+	}
+	return ApiKeyRoundTripper{
+		Transport: transport,
+		ApiKey:    p.ApiKey,
+	}
+}
+
+type AzureOption func(*AzureProvider) error
+
+func WithApiKey(apiKey string) AzureOption {
+	return func(p *AzureProvider) error {
+		p.ApiKey = apiKey
+		return nil
+	}
+}
+
+// WithAzureCredential authenticates with Azure AD using the managed identity or the default credential
+// instead of an API key
+func WithAzureCredential() AzureOption {
+	return func(p *AzureProvider) error {
+		cred, err := LoginWithDefaultCredential()
+		if err != nil {
+			return err
+		}
+
+		p.Credential = cred
+		return nil
+	}
+}
+
+// WithTokenCredential authenticates with Azure AD using the given credential instead of an API key
+func WithTokenCredential(cred azcore.TokenCredential) AzureOption {
+	return func(p *AzureProvider) error {
+		p.Credential = cred
+		return nil
+	}
+}
+
+// OpenAIProvider is the public OpenAI API or a server implementing the same API. The API key is sent as
+// a bearer token
+type OpenAIProvider struct {
+	// BaseURL is the URL the API paths are relative to, e.g. "http://localhost:11434/v1" for Ollama
+	BaseURL   string
+	ApiKey    string
+	ModelName string
+}
+
+// NewOpenAIProvider creates a provider for the public OpenAI API
+func NewOpenAIProvider(apiKey, model string) (*OpenAIProvider, error) {
+	if apiKey == "" || model == "" {
+		return nil, fmt.Errorf("API key and model are required for OpenAI")
+	}
+	return &OpenAIProvider{BaseURL: DefaultOpenAIBaseURL, ApiKey: apiKey, ModelName: model}, nil
+}
+
+// NewCompatibleProvider creates a provider for an OpenAI-compatible server at baseURL. Local servers often
+// need no API key, and some serve a single model and ignore the model name, so both may be empty
+func NewCompatibleProvider(baseURL, model, apiKey string) (*OpenAIProvider, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("base URL is required for an OpenAI-compatible server")
+	}
+	return &OpenAIProvider{BaseURL: baseURL, ApiKey: apiKey, ModelName: model}, nil
+}
+
+func (p *OpenAIProvider) URL() string {
+	return strings.TrimSuffix(p.BaseURL, "/") + "/chat/completions"
+}
+
+func (p *OpenAIProvider) Model() string {
+	return p.ModelName
+}
+
+func (p *OpenAIProvider) RoundTripper(transport http.RoundTripper) http.RoundTripper {
+	if p.ApiKey == "" {
+		return transport
+	}
+	return BearerTokenRoundTripper{
+		Transport:   transport,
+		BearerToken: p.ApiKey,
+	}
+}
@@ -0,0 +1,188 @@
+package openai_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"t-pain/pkg/openai"
+	"testing"
+)
+
+// receivedRequest is what the test server saw of a request
+type receivedRequest struct {
+	path          string
+	query         string
+	authorization string
+	apiKey        string
+	body          openai.OpenAiCompletionRequest
+}
+
+// newTestServer starts a stand-in for the chat completions API that answers with a text message
+func newTestServer(t *testing.T, received *receivedRequest) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.path = r.URL.Path
+		received.query = r.URL.RawQuery
+		received.authorization = r.Header.Get("Authorization")
+		received.apiKey = r.Header.Get("api-key")
+		if err := json.NewDecoder(r.Body).Decode(&received.body); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices": [{"finish_reason": "stop", "message": {"role": "assistant", "content": "no pain"}}]}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_ShouldUseProvider(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		provider func(serverURL string) (openai.Provider, error)
+		expected receivedRequest
+	}{
+		"Azure": {
+			provider: func(serverURL string) (openai.Provider, error) {
+				return openai.NewAzureProvider(serverURL+"/", "gpt-35", openai.WithApiKey("azure-key"))
+			},
+			expected: receivedRequest{path: "/openai/deployments/gpt-35/chat/completions", query: "api-version=2024-02-01", apiKey: "azure-key"},
+		},
+		"OpenAI": {
+			provider: func(serverURL string) (openai.Provider, error) {
+				p, err := openai.NewOpenAIProvider("openai-key", "gpt-4o-mini")
+				if err != nil {
+					return nil, err
+				}
+				// The public API is replaced by the test server
+				p.BaseURL = serverURL + "/v1"
+				return p, nil
+			},
+			expected: receivedRequest{path: "/v1/chat/completions", authorization: "Bearer openai-key", body: openai.OpenAiCompletionRequest{Model: "gpt-4o-mini"}},
+		},
+		"CompatibleWithoutKey": {
+			provider: func(serverURL string) (openai.Provider, error) {
+				return openai.NewCompatibleProvider(serverURL+"/v1/", "llama3", "")
+			},
+			expected: receivedRequest{path: "/v1/chat/completions", body: openai.OpenAiCompletionRequest{Model: "llama3"}},
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var received receivedRequest
+			server := newTestServer(t, &received)
+
+			provider, err := tt.provider(server.URL)
+			if err != nil {
+				t.Fatalf("unable to create provider: %v", err)
+			}
+			config, err := openai.NewConfig(provider)
+			if err != nil {
+				t.Fatalf("unable to create config: %v", err)
+			}
+			client, err := openai.NewClient(config)
+			if err != nil {
+				t.Fatalf("unable to create client: %v", err)
+			}
+
+			result, err := client.GetPainDescriptionObject(context.Background(), "no pain today", openai.MessageContext{}, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if result.Kind != openai.ResultText || result.Text != "no pain" {
+				t.Errorf("Expected the text answer, got %+v", result)
+			}
+
+			if received.path != tt.expected.path || received.query != tt.expected.query {
+				t.Errorf("Expected a request to %s?%s, got %s?%s", tt.expected.path, tt.expected.query, received.path, received.query)
+			}
+			if received.authorization != tt.expected.authorization || received.apiKey != tt.expected.apiKey {
+				t.Errorf("Expected authorization %q and api-key %q, got %q and %q",
+					tt.expected.authorization, tt.expected.apiKey, received.authorization, received.apiKey)
+			}
+			if received.body.Model != tt.expected.body.Model {
+				t.Errorf("Expected model %q, got %q", tt.expected.body.Model, received.body.Model)
+			}
+			if len(received.body.Tools) != 2 {
+				t.Errorf("Expected the tools to be sent, got %d", len(received.body.Tools))
+			}
+		})
+	}
+}
+
+func TestNewProvider_ShouldRequireSettings(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]func() error{
+		"AzureWithoutAuthentication": func() error {
+			_, err := openai.NewAzureProvider("https://example.com", "deployment")
+			return err
+		},
+		"AzureWithoutDeployment": func() error {
+			_, err := openai.NewAzureProvider("https://example.com", "", openai.WithApiKey("key"))
+			return err
+		},
+		"OpenAIWithoutModel": func() error {
+			_, err := openai.NewOpenAIProvider("key", "")
+			return err
+		},
+		"CompatibleWithoutBaseURL": func() error {
+			_, err := openai.NewCompatibleProvider("", "llama3", "")
+			return err
+		},
+		"ConfigWithoutProvider": func() error {
+			_, err := openai.NewConfig(nil)
+			return err
+		},
+	}
+
+	for name, newProvider := range tests {
+		newProvider := newProvider
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if err := newProvider(); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		name     string
+		endpoint string
+		wantURL  string
+		wantErr  bool
+	}{
+		"azure":      {name: openai.ProviderAzure, endpoint: "https://example.openai.azure.com", wantURL: "https://example.openai.azure.com/openai/deployments/gpt/chat/completions"},
+		"openai":     {name: openai.ProviderOpenAI, endpoint: "ignored", wantURL: openai.DefaultOpenAIBaseURL + "/chat/completions"},
+		"compatible": {name: openai.ProviderCompatible, endpoint: "http://localhost:11434/v1", wantURL: "http://localhost:11434/v1/chat/completions"},
+		"unknown":    {name: "bard", wantErr: true},
+	}
+
+	for name, tt := range testCases {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			provider, err := openai.NewProvider(tt.name, tt.endpoint, "gpt", "key", false)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got provider %+v", provider)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewProvider() error = %v", err)
+			}
+			if got := provider.URL(); !strings.HasPrefix(got, tt.wantURL) {
+				t.Errorf("URL() = %q, want %q", got, tt.wantURL)
+			}
+		})
+	}
+}
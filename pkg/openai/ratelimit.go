@@ -0,0 +1,79 @@
+package openai
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the tokens sent to the API to the tokens per minute (TPM) quota of the deployment, so that
+// bursts of messages wait on the client instead of being rejected with 429. It is safe for concurrent use
+type TokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	perSec   float64
+	last     time.Time
+}
+
+// NewTokenBucket creates a full bucket for the given tokens per minute
+func NewTokenBucket(tokensPerMinute int) *TokenBucket {
+	return &TokenBucket{
+		capacity: float64(tokensPerMinute),
+		tokens:   float64(tokensPerMinute),
+		perSec:   float64(tokensPerMinute) / 60,
+		last:     time.Now(),
+	}
+}
+
+// Reserve takes n tokens from the bucket and returns how long the caller should wait before sending the request.
+// The bucket may go negative, which makes the later callers wait longer
+func (tb *TokenBucket) Reserve(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.perSec * float64(time.Second))
+}
+
+// Adjust returns tokens to the bucket, or takes more with a negative n, once the actual usage of a request is known
+func (tb *TokenBucket) Adjust(n int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	tb.tokens += float64(n)
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+}
+
+// Limit lowers the tokens in the bucket to n if it has more
+func (tb *TokenBucket) Limit(n int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	if float64(n) < tb.tokens {
+		tb.tokens = float64(n)
+	}
+}
+
+// refill adds the tokens accumulated since the last call
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.perSec
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.last = now
+}
+
+// estimateTokens roughly estimates the tokens of a request from its size, as a token is about four characters
+// of English text. The completion is included with a fixed allowance
+func estimateTokens(body []byte) int {
+	const completionAllowance = 500
+	return len(body)/4 + completionAllowance
+}
@@ -0,0 +1,50 @@
+package openai
+
+import (
+	"fmt"
+	"t-pain/pkg/models"
+)
+
+// ResultKind tells what kind of answer the model gave
+type ResultKind int
+
+const (
+	// ResultPainDescriptions means the model returned pain descriptions
+	ResultPainDescriptions ResultKind = iota
+	// ResultText means the model answered with text instead, e.g. when the message does not describe any pain
+	ResultText
+	// ResultRefusal means the model refused to answer or the answer was filtered
+	ResultRefusal
+	// ResultClarification means the model needs more information and asks the user a question
+	ResultClarification
+)
+
+func (k ResultKind) String() string {
+	switch k {
+	case ResultPainDescriptions:
+		return "painDescriptions"
+	case ResultText:
+		return "text"
+	case ResultRefusal:
+		return "refusal"
+	case ResultClarification:
+		return "clarification"
+	default:
+		return fmt.Sprintf("ResultKind(%d)", int(k))
+	}
+}
+
+// Result is the answer of the model to a pain description message
+type Result struct {
+	Kind ResultKind
+	// PainDescriptions are set when Kind is ResultPainDescriptions
+	PainDescriptions []models.PainDescription
+	// Text is the text of the model when Kind is ResultText or ResultRefusal, or the question when Kind is
+	// ResultClarification. It may be empty for a refusal
+	Text string
+	// Conversation is the exchange so far when Kind is ResultClarification. It is passed back with the answer of the user
+	Conversation *Conversation
+	// Usage is the total of all the requests made for the result, including repair attempts. It is also set when
+	// an error is returned, for the requests that succeeded before it
+	Usage Usage
+}
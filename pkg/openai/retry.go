@@ -0,0 +1,139 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests to the API are retried
+type RetryPolicy struct {
+	// MaxRetries is how many times a request is retried after the first attempt. Zero disables retries
+	MaxRetries int
+	// BaseDelay is the delay before the first retry. It doubles for every retry up to MaxDelay
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff. Delays requested by the API in its headers are not capped
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy retries three times, waiting up to 1s, 2s and 4s
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  time.Second,
+		MaxDelay:   10 * time.Second,
+	}
+}
+
+// backoff returns the delay before the given retry, starting from 0, with full jitter so that concurrent
+// requests do not retry at the same moment
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay << retry
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// RetryInfo describes a retry that is about to happen
+type RetryInfo struct {
+	// Retry is the number of the retry, starting from 1
+	Retry int
+	// Wait is how long the client waits before the retry
+	Wait time.Duration
+	// Err is the error of the failed attempt
+	Err error
+}
+
+// APIError is an error response from the API
+type APIError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay the API asked for in its headers, or zero
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("request failed with status code %d and body %s", e.StatusCode, e.Body)
+}
+
+// Busy tells if the request was rejected because of the rate limits or an overloaded service
+func (e *APIError) Busy() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// Temporary tells if the same request may succeed when retried
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout || e.StatusCode >= 500
+}
+
+// retryAfter reads the delay the API asks for from the headers. Azure OpenAI sends retry-after-ms and Retry-After,
+// the public API also the x-ratelimit-reset-* headers. The longest delay wins
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	var delay time.Duration
+
+	if ms, err := strconv.Atoi(header.Get("retry-after-ms")); err == nil {
+		delay = maxDuration(delay, time.Duration(ms)*time.Millisecond)
+	}
+
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			delay = maxDuration(delay, time.Duration(seconds)*time.Second)
+		} else if t, err := http.ParseTime(value); err == nil {
+			delay = maxDuration(delay, t.Sub(now))
+		}
+	}
+
+	// Only wait for the limit that has run out
+	if header.Get("x-ratelimit-remaining-requests") == "0" {
+		if d, err := time.ParseDuration(header.Get("x-ratelimit-reset-requests")); err == nil {
+			delay = maxDuration(delay, d)
+		}
+	}
+	if header.Get("x-ratelimit-remaining-tokens") == "0" {
+		if d, err := time.ParseDuration(header.Get("x-ratelimit-reset-tokens")); err == nil {
+			delay = maxDuration(delay, d)
+		}
+	}
+
+	return delay
+}
+
+// retryable tells if a failed request may succeed when sent again. Error responses are retried if they are
+// temporary, and network errors and timeouts always
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sleep waits for d, or returns the error of ctx if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,263 @@
+package openai_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+// newRetryTestClient returns a client whose API answers with the given responses in order before succeeding
+func newRetryTestClient(t *testing.T, failures []*http.Response, policy openai.RetryPolicy, requests *int) *openai.Client {
+	t.Helper()
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			*requests++
+			if *requests <= len(failures) {
+				return failures[*requests-1], nil
+			}
+
+			resp, _ := json.Marshal(openai.OpenAiCompletionResponse{Choices: []struct {
+				FinishReason string         `json:"finish_reason"`
+				Index        int            `json:"index"`
+				Message      openai.Message `json:"message"`
+			}{{Message: openai.Message{Role: "assistant", Content: "no pain"}, FinishReason: "stop"}}})
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBuffer(resp)),
+			}, nil
+		},
+	}
+
+	config := &openai.Config{
+		Provider:      &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+		SystemContext: *openai.NewConversation(openai.NewSystemMessage("test")),
+		RetryPolicy:   policy,
+	}
+	client, err := openai.NewClient(config, openai.WithDoer(mockClient))
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	return client
+}
+
+func errorResponse(status int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewBufferString(`{"error": {"message": "request failed"}}`)),
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldRetry(t *testing.T) {
+	t.Parallel()
+	policy := openai.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	tests := map[string]struct {
+		failures         []*http.Response
+		expectedRequests int
+		expectedStatus   int
+		expectedBusy     bool
+	}{
+		"RateLimitedOnce": {
+			failures:         []*http.Response{errorResponse(http.StatusTooManyRequests, nil)},
+			expectedRequests: 2,
+		},
+		"ServerErrorTwice": {
+			failures:         []*http.Response{errorResponse(http.StatusInternalServerError, nil), errorResponse(http.StatusBadGateway, nil)},
+			expectedRequests: 3,
+		},
+		"RateLimitedUntilGivingUp": {
+			failures: []*http.Response{
+				errorResponse(http.StatusTooManyRequests, nil),
+				errorResponse(http.StatusTooManyRequests, nil),
+				errorResponse(http.StatusTooManyRequests, nil),
+			},
+			expectedRequests: 3,
+			expectedStatus:   http.StatusTooManyRequests,
+			expectedBusy:     true,
+		},
+		"BadRequestNotRetried": {
+			failures:         []*http.Response{errorResponse(http.StatusBadRequest, nil)},
+			expectedRequests: 1,
+			expectedStatus:   http.StatusBadRequest,
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var requests int
+			client := newRetryTestClient(t, tt.failures, policy, &requests)
+
+			_, err := client.GetPainDescriptionObject(context.Background(), "back 5", openai.MessageContext{}, nil)
+			if requests != tt.expectedRequests {
+				t.Errorf("Expected %d requests, got %d", tt.expectedRequests, requests)
+			}
+			if tt.expectedStatus == 0 {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+
+			var apiErr *openai.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected an *APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tt.expectedStatus || apiErr.Busy() != tt.expectedBusy {
+				t.Errorf("Expected status %d and busy %v, got %d and %v", tt.expectedStatus, tt.expectedBusy, apiErr.StatusCode, apiErr.Busy())
+			}
+		})
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldWaitForRetryAfter(t *testing.T) {
+	t.Parallel()
+	policy := openai.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	tests := map[string]struct {
+		header  http.Header
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		"RetryAfterMs": {
+			header:  http.Header{"Retry-After-Ms": {"50"}},
+			minWait: 50 * time.Millisecond,
+			maxWait: 50 * time.Millisecond,
+		},
+		"RateLimitReset": {
+			header:  http.Header{"X-Ratelimit-Remaining-Tokens": {"0"}, "X-Ratelimit-Reset-Tokens": {"40ms"}},
+			minWait: 40 * time.Millisecond,
+			maxWait: 40 * time.Millisecond,
+		},
+		"ResetOfRemainingLimitIgnored": {
+			header:  http.Header{"X-Ratelimit-Remaining-Requests": {"10"}, "X-Ratelimit-Reset-Requests": {"1h"}},
+			maxWait: time.Millisecond,
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var requests int
+			client := newRetryTestClient(t, []*http.Response{errorResponse(http.StatusTooManyRequests, tt.header)}, policy, &requests)
+
+			var retries []openai.RetryInfo
+			mc := openai.MessageContext{OnRetry: func(info openai.RetryInfo) { retries = append(retries, info) }}
+			start := time.Now()
+			_, err := client.GetPainDescriptionObject(context.Background(), "back 5", mc, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if len(retries) != 1 {
+				t.Fatalf("Expected one retry, got %d", len(retries))
+			}
+			if retries[0].Retry != 1 || retries[0].Wait < tt.minWait || retries[0].Wait > tt.maxWait {
+				t.Errorf("Expected retry 1 with a wait between %s and %s, got %+v", tt.minWait, tt.maxWait, retries[0])
+			}
+			if elapsed := time.Since(start); elapsed < retries[0].Wait {
+				t.Errorf("Expected to wait %s before retrying, took %s", retries[0].Wait, elapsed)
+			}
+		})
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldStopWhenCancelled(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		// hang keeps the request open until it is cancelled instead of failing it
+		hang bool
+	}{
+		"HangingRequest":  {hang: true},
+		"WaitingForRetry": {},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			var requests int
+			mockClient := &MockHTTPClient{
+				DoFunc: func(req *http.Request) (*http.Response, error) {
+					requests++
+					cancel()
+					if tt.hang {
+						<-req.Context().Done()
+						return nil, req.Context().Err()
+					}
+					return errorResponse(http.StatusTooManyRequests, nil), nil
+				},
+			}
+			config := &openai.Config{
+				Provider:      &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+				SystemContext: *openai.NewConversation(openai.NewSystemMessage("test")),
+				RetryPolicy:   openai.RetryPolicy{MaxRetries: 3, BaseDelay: time.Hour, MaxDelay: time.Hour},
+			}
+			client, err := openai.NewClient(config, openai.WithDoer(mockClient))
+			if err != nil {
+				t.Fatalf("unable to create client: %v", err)
+			}
+
+			_, err = client.GetPainDescriptionObject(ctx, "back 5", openai.MessageContext{}, nil)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", err)
+			}
+			if requests != 1 {
+				t.Errorf("Expected no retries after cancelling, got %d requests", requests)
+			}
+		})
+	}
+}
+
+func TestNewConfig_ShouldRejectInvalidRetryPolicy(t *testing.T) {
+	t.Parallel()
+	_, err := openai.NewConfig(&openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "key"},
+		openai.WithRetryPolicy(openai.RetryPolicy{MaxRetries: 1, BaseDelay: time.Second, MaxDelay: time.Millisecond}))
+	if err == nil {
+		t.Error("Expected an error for a max delay shorter than the base delay")
+	}
+
+	_, err = openai.NewConfig(&openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "key"}, openai.WithTokensPerMinute(-1))
+	if err == nil {
+		t.Error("Expected an error for negative tokens per minute")
+	}
+}
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	t.Parallel()
+	// 60000 TPM refills 1000 tokens a second
+	tb := openai.NewTokenBucket(60000)
+
+	if wait := tb.Reserve(60000); wait != 0 {
+		t.Errorf("Expected a full bucket to allow the whole quota, got a wait of %s", wait)
+	}
+	wait := tb.Reserve(500)
+	if wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Expected a wait of about 500ms for an empty bucket, got %s", wait)
+	}
+
+	// Returning the overestimated tokens lets the next request through
+	tb.Adjust(1000)
+	if wait := tb.Reserve(100); wait != 0 {
+		t.Errorf("Expected no wait after adjusting, got %s", wait)
+	}
+
+	tb.Limit(0)
+	if wait := tb.Reserve(1000); wait < 900*time.Millisecond {
+		t.Errorf("Expected a wait of about 1s after limiting, got %s", wait)
+	}
+}
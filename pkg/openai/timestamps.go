@@ -0,0 +1,98 @@
+package openai
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// MessageContext describes when and where the user sent the message being parsed
+type MessageContext struct {
+	// SentAt is the time the message was sent. Relative times such as "last night" are resolved against it
+	// and it is used when the message does not say when the pain occurred
+	SentAt time.Time
+	// Location is the timezone of the user
+	Location *time.Location
+	// OnRetry is called before a failed or rate limited request is retried, if set
+	OnRetry func(RetryInfo)
+}
+
+// withDefaults fills in the processing time and UTC for missing values
+func (mc MessageContext) withDefaults() MessageContext {
+	if mc.Location == nil {
+		mc.Location = time.UTC
+	}
+	if mc.SentAt.IsZero() {
+		mc.SentAt = time.Now()
+	}
+	mc.SentAt = mc.SentAt.In(mc.Location)
+	return mc
+}
+
+// modelTimeFormat is the local time format the model is asked to use for the occurrence time
+const modelTimeFormat = "2006-01-02T15:04"
+
+// prompt tells the model the local time the message was sent, so that it can resolve relative times
+func (mc MessageContext) prompt() string {
+	return fmt.Sprintf("The next message was sent on %s at local time %s (timezone %s).",
+		mc.SentAt.Format("Monday"), mc.SentAt.Format(modelTimeFormat), mc.Location)
+}
+
+// futureTolerance allows times slightly after the message was sent, as the model only returns minutes
+const futureTolerance = 5 * time.Minute
+
+// modelTimeLayouts are the layouts accepted for the timestamp returned by the model, most specific first
+var modelTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	modelTimeFormat,
+	"2006-01-02 15:04",
+}
+
+// painDescriptionResponse is a pain description as returned by the model. The timestamp is a local time string
+// instead of the RFC 3339 time models.PainDescription expects
+type painDescriptionResponse struct {
+	modelPainDescription
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// modelPainDescription drops the custom unmarshaling of models.PainDescription
+type modelPainDescription models.PainDescription
+
+// resolveTimestamp parses the timestamp returned by the model in the user's timezone. Falls back to the
+// time the message was sent when the model did not return a time, it could not be parsed or it is not plausible:
+// in the future or more than lookback before the message
+func resolveTimestamp(raw string, mc MessageContext, lookback time.Duration) (time.Time, models.TimestampSource) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return mc.SentAt, models.TimestampFromMessage
+	}
+
+	for _, layout := range modelTimeLayouts {
+		t, err := time.ParseInLocation(layout, raw, mc.Location)
+		if err != nil {
+			continue
+		}
+		if t.After(mc.SentAt.Add(futureTolerance)) || t.Before(mc.SentAt.Add(-lookback)) {
+			log.Printf("timestamp %s from the model is not within %s before the message, using the message time", t, lookback)
+			return mc.SentAt, models.TimestampImplausible
+		}
+		return t, models.TimestampFromText
+	}
+
+	log.Printf("unable to parse timestamp %q from the model, using the message time", raw)
+	return mc.SentAt, models.TimestampFromMessage
+}
+
+// toPainDescriptions converts the model output to pain descriptions with resolved timestamps
+func toPainDescriptions(resp []painDescriptionResponse, mc MessageContext, lookback time.Duration) []models.PainDescription {
+	result := make([]models.PainDescription, 0, len(resp))
+	for _, r := range resp {
+		pd := models.PainDescription(r.modelPainDescription)
+		pd.Timestamp, pd.TimestampSource = resolveTimestamp(r.Timestamp, mc, lookback)
+		result = append(result, pd)
+	}
+	return result
+}
@@ -0,0 +1,211 @@
+package openai_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+// newToolCallMessage returns an assistant message calling the pain description function with the given arguments
+func newToolCallMessage(arguments string) openai.Message {
+	return openai.Message{
+		Role: "assistant",
+		ToolCalls: []openai.ToolCall{{
+			Id:       "call_1",
+			Type:     "function",
+			Function: openai.FunctionCall{Name: "save_pain_descriptions", Arguments: arguments},
+		}},
+	}
+}
+
+// newTestClient returns a client whose model answers with the given message
+func newTestClient(t *testing.T, message openai.Message, finishReason string, lookback time.Duration, requests *[]openai.OpenAiCompletionRequest) *openai.Client {
+	t.Helper()
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if requests != nil {
+				var body openai.OpenAiCompletionRequest
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					t.Fatalf("unable to decode request: %v", err)
+				}
+				*requests = append(*requests, body)
+			}
+
+			resp, _ := json.Marshal(openai.OpenAiCompletionResponse{Choices: []struct {
+				FinishReason string         `json:"finish_reason"`
+				Index        int            `json:"index"`
+				Message      openai.Message `json:"message"`
+			}{{Message: message, FinishReason: finishReason}}})
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBuffer(resp)),
+			}, nil
+		},
+	}
+
+	config := &openai.Config{
+		Provider:          &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+		SystemContext:     *openai.NewConversation(openai.NewSystemMessage("test")),
+		TimestampLookback: lookback,
+	}
+	client, err := openai.NewClient(config, openai.WithDoer(mockClient))
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	return client
+}
+
+func TestClient_GetPainDescriptionObject_ShouldResolveTimestamps(t *testing.T) {
+	t.Parallel()
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	sentAt := time.Date(2023, 8, 1, 6, 30, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		timestamp      string
+		lookback       time.Duration
+		expectedTime   time.Time
+		expectedSource models.TimestampSource
+	}{
+		"NoTimestamp": {
+			timestamp:      "",
+			expectedTime:   sentAt,
+			expectedSource: models.TimestampFromMessage,
+		},
+		"LocalTime": {
+			timestamp:      `"timestamp": "2023-07-31T23:00",`,
+			expectedTime:   time.Date(2023, 7, 31, 23, 0, 0, 0, helsinki),
+			expectedSource: models.TimestampFromText,
+		},
+		"LocalTimeWithSeconds": {
+			timestamp:      `"timestamp": "2023-07-31T23:00:00",`,
+			expectedTime:   time.Date(2023, 7, 31, 23, 0, 0, 0, helsinki),
+			expectedSource: models.TimestampFromText,
+		},
+		"WithOffset": {
+			timestamp:      `"timestamp": "2023-07-31T20:00:00Z",`,
+			expectedTime:   time.Date(2023, 7, 31, 20, 0, 0, 0, time.UTC),
+			expectedSource: models.TimestampFromText,
+		},
+		"Unparseable": {
+			timestamp:      `"timestamp": "last night",`,
+			expectedTime:   sentAt,
+			expectedSource: models.TimestampFromMessage,
+		},
+		"SameMinute": {
+			timestamp:      `"timestamp": "2023-08-01T09:30",`,
+			expectedTime:   sentAt,
+			expectedSource: models.TimestampFromText,
+		},
+		"InTheFuture": {
+			timestamp:      `"timestamp": "2023-08-01T12:00",`,
+			expectedTime:   sentAt,
+			expectedSource: models.TimestampImplausible,
+		},
+		"BeforeDefaultLookback": {
+			timestamp:      `"timestamp": "2023-07-20T12:00",`,
+			expectedTime:   sentAt,
+			expectedSource: models.TimestampImplausible,
+		},
+		"WithinConfiguredLookback": {
+			timestamp:      `"timestamp": "2023-07-20T12:00",`,
+			lookback:       30 * 24 * time.Hour,
+			expectedTime:   time.Date(2023, 7, 20, 12, 0, 0, 0, helsinki),
+			expectedSource: models.TimestampFromText,
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			args := `{"painDescriptions": [{` + tt.timestamp + `"level": 8, "locationId": 9, "sideId": 1, "description": "test", "numbness": false}]}`
+			client := newTestClient(t, newToolCallMessage(args), "tool_calls", tt.lookback, nil)
+
+			result, err := client.GetPainDescriptionObject(context.Background(), "test", openai.MessageContext{SentAt: sentAt, Location: helsinki}, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			pd := result.PainDescriptions
+			if len(pd) != 1 {
+				t.Fatalf("Expected 1 pain description, got %d", len(pd))
+			}
+			if !pd[0].Timestamp.Equal(tt.expectedTime) {
+				t.Errorf("Expected timestamp %v, got %v", tt.expectedTime, pd[0].Timestamp)
+			}
+			if pd[0].TimestampSource != tt.expectedSource {
+				t.Errorf("Expected source %v, got %v", tt.expectedSource, pd[0].TimestampSource)
+			}
+			if pd[0].Level != 8 || pd[0].LocationId != 9 {
+				t.Errorf("Expected the other fields to be parsed, got %+v", pd[0])
+			}
+		})
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldSendMessageTime(t *testing.T) {
+	t.Parallel()
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	var requests []openai.OpenAiCompletionRequest
+	client := newTestClient(t, newToolCallMessage(`{"painDescriptions": []}`), "tool_calls", 0, &requests)
+
+	sentAt := time.Date(2023, 8, 1, 6, 30, 0, 0, time.UTC)
+	_, err := client.GetPainDescriptionObject(context.Background(), "eilen illalla alaselkä 8", openai.MessageContext{SentAt: sentAt, Location: helsinki}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	messages := requests[0].Messages
+	timeMsg := messages[len(messages)-2]
+	if timeMsg.Role != "system" || !strings.Contains(timeMsg.Content, "2023-08-01T09:30") || !strings.Contains(timeMsg.Content, "Europe/Helsinki") {
+		t.Errorf("Expected a system message with the local message time, got %+v", timeMsg)
+	}
+	if messages[len(messages)-1].Content != "eilen illalla alaselkä 8" {
+		t.Errorf("Expected the user message last, got %+v", messages[len(messages)-1])
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldResolveEachObjectSeparately(t *testing.T) {
+	t.Parallel()
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	args := `{"painDescriptions": [` +
+		`{"timestamp": "2023-08-02T08:00", "level": 3, "locationId": 2, "sideId": 1, "description": "diary", "numbness": false},` +
+		`{"timestamp": "2023-08-02T17:00", "level": 6, "locationId": 2, "sideId": 1, "description": "diary", "numbness": false},` +
+		`{"level": 4, "locationId": 2, "sideId": 1, "description": "diary", "numbness": false}]}`
+	client := newTestClient(t, newToolCallMessage(args), "tool_calls", 0, nil)
+
+	sentAt := time.Date(2023, 8, 2, 22, 15, 0, 0, helsinki)
+	result, err := client.GetPainDescriptionObject(context.Background(), "diary", openai.MessageContext{SentAt: sentAt, Location: helsinki}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	pd := result.PainDescriptions
+
+	expected := []time.Time{
+		time.Date(2023, 8, 2, 8, 0, 0, 0, helsinki),
+		time.Date(2023, 8, 2, 17, 0, 0, 0, helsinki),
+		sentAt,
+	}
+	if len(pd) != len(expected) {
+		t.Fatalf("Expected %d pain descriptions, got %d", len(expected), len(pd))
+	}
+	for i := range expected {
+		if !pd[i].Timestamp.Equal(expected[i]) {
+			t.Errorf("Expected timestamp %v for object %d, got %v", expected[i], i, pd[i].Timestamp)
+		}
+	}
+}
+
+func TestWithTimestampLookback_ShouldRejectNonPositive(t *testing.T) {
+	t.Parallel()
+	_, err := openai.NewConfig(&openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "key"}, openai.WithTimestampLookback(0))
+	if err == nil {
+		t.Error("Expected an error for a zero lookback")
+	}
+}
@@ -0,0 +1,181 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"t-pain/pkg/models"
+)
+
+const (
+	// painDescriptionsFunction is the function the model calls with the pain descriptions it found
+	painDescriptionsFunction = "save_pain_descriptions"
+	// clarificationFunction is the function the model calls to ask the user a question
+	clarificationFunction = "ask_clarification"
+)
+
+// Tool is a tool the model can call in the chat completions API
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition describes a function and its parameters as a JSON schema
+type FunctionDefinition struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+// ToolCall is a call to a tool made by the model
+type ToolCall struct {
+	Id       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall is the function and its JSON encoded arguments in a ToolCall
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// painDescriptionsTool returns the tool the model uses to return the pain descriptions, with the schema
+// generated from models.PainDescription
+func painDescriptionsTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        painDescriptionsFunction,
+			Description: "Saves the pain descriptions found in the latest message of the user",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"painDescriptions": map[string]any{
+						"type":  "array",
+						"items": models.PainDescriptionJSONSchema(),
+					},
+				},
+				"required": []string{"painDescriptions"},
+			},
+		},
+	}
+}
+
+// clarificationTool returns the tool the model uses to ask the user a question when the message is too ambiguous
+// to turn into pain descriptions
+func clarificationTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        clarificationFunction,
+			Description: "Asks the user a question when the pain description is too ambiguous to save, e.g. the location of the pain is missing",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"question": map[string]any{
+						"type":        "string",
+						"description": "A short question to the user, in the language of the user",
+					},
+				},
+				"required": []string{"question"},
+			},
+		},
+	}
+}
+
+// parseClarificationCall returns the question when the model called clarificationFunction
+func parseClarificationCall(calls []ToolCall) (string, bool) {
+	for _, call := range calls {
+		if call.Function.Name != clarificationFunction {
+			continue
+		}
+		var args struct {
+			Question string `json:"question"`
+		}
+		if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil || strings.TrimSpace(args.Question) == "" {
+			continue
+		}
+		return args.Question, true
+	}
+	return "", false
+}
+
+// painDescriptionsArguments are the arguments of a painDescriptionsFunction call
+type painDescriptionsArguments struct {
+	PainDescriptions []painDescriptionResponse `json:"painDescriptions"`
+}
+
+// parsePainDescriptionCalls collects the pain descriptions from all painDescriptionsFunction calls
+func parsePainDescriptionCalls(calls []ToolCall) ([]painDescriptionResponse, error) {
+	var result []painDescriptionResponse
+	for _, call := range calls {
+		if call.Function.Name != painDescriptionsFunction {
+			return nil, fmt.Errorf("unknown function %q", call.Function.Name)
+		}
+		var args painDescriptionsArguments
+		if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+			return nil, fmt.Errorf("unable to parse arguments of %s: %w", call.Function.Name, err)
+		}
+		result = append(result, args.PainDescriptions...)
+	}
+	return result, nil
+}
+
+// InvalidOutputError is returned when the model did not return valid pain descriptions even after
+// the validation errors were sent back to it
+type InvalidOutputError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *InvalidOutputError) Error() string {
+	return fmt.Sprintf("invalid pain descriptions after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *InvalidOutputError) Unwrap() error {
+	return e.Err
+}
+
+// newToolReplies creates the replies to the tool calls in message. The API requires a reply to every call
+// before the conversation can continue, so all of them get the same content
+func newToolReplies(message Message, content string) []Message {
+	var messages []Message
+	for _, call := range message.ToolCalls {
+		messages = append(messages, Message{
+			Role:       "tool",
+			ToolCallId: call.Id,
+			Content:    content,
+		})
+	}
+	return messages
+}
+
+// newExampleCall creates the assistant message calling painDescriptionsFunction and the tool reply to it,
+// used for the examples in the system context. items are JSON objects of the pain descriptions
+func newExampleCall(id string, items ...string) []Message {
+	args := "{\"painDescriptions\": ["
+	for i, item := range items {
+		if i > 0 {
+			args += ", "
+		}
+		args += item
+	}
+	args += "]}"
+
+	return []Message{
+		{
+			Role: "assistant",
+			ToolCalls: []ToolCall{{
+				Id:       id,
+				Type:     "function",
+				Function: FunctionCall{Name: painDescriptionsFunction, Arguments: args},
+			}},
+		},
+		{
+			Role:       "tool",
+			ToolCallId: id,
+			Content:    "saved",
+		},
+	}
+}
@@ -0,0 +1,264 @@
+package openai_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"t-pain/pkg/openai"
+	"testing"
+)
+
+func TestClient_GetPainDescriptionObject_ShouldReturnTypedResults(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		message      openai.Message
+		finishReason string
+		expectedKind openai.ResultKind
+		expectedText string
+	}{
+		"ToolCall": {
+			message:      newToolCallMessage(`{"painDescriptions": [{"level": 3, "locationId": 2, "sideId": 1, "description": "neck", "numbness": false}]}`),
+			finishReason: "tool_calls",
+			expectedKind: openai.ResultPainDescriptions,
+		},
+		"Text": {
+			message:      openai.Message{Role: "assistant", Content: "Missä kohtaa kipua tuntuu?"},
+			finishReason: "stop",
+			expectedKind: openai.ResultText,
+			expectedText: "Missä kohtaa kipua tuntuu?",
+		},
+		"ContentFilter": {
+			message:      openai.Message{Role: "assistant"},
+			finishReason: "content_filter",
+			expectedKind: openai.ResultRefusal,
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			client := newTestClient(t, tt.message, tt.finishReason, 0, nil)
+
+			result, err := client.GetPainDescriptionObject(context.Background(), "test", openai.MessageContext{}, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if result.Kind != tt.expectedKind {
+				t.Errorf("Expected kind %v, got %v", tt.expectedKind, result.Kind)
+			}
+			if result.Text != tt.expectedText {
+				t.Errorf("Expected text %q, got %q", tt.expectedText, result.Text)
+			}
+			if tt.expectedKind == openai.ResultPainDescriptions && len(result.PainDescriptions) != 1 {
+				t.Errorf("Expected 1 pain description, got %d", len(result.PainDescriptions))
+			}
+		})
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldSendPainDescriptionTool(t *testing.T) {
+	t.Parallel()
+	var requests []openai.OpenAiCompletionRequest
+	client := newTestClient(t, newToolCallMessage(`{"painDescriptions": []}`), "tool_calls", 0, &requests)
+
+	_, err := client.GetPainDescriptionObject(context.Background(), "test", openai.MessageContext{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tools := requests[0].Tools
+	if len(tools) != 2 || tools[0].Function.Name != "save_pain_descriptions" || tools[1].Function.Name != "ask_clarification" {
+		t.Fatalf("Expected the pain description and clarification tools, got %+v", tools)
+	}
+	params, _ := json.Marshal(tools[0].Function.Parameters)
+	var schema struct {
+		Properties struct {
+			PainDescriptions struct {
+				Items struct {
+					Properties map[string]any `json:"properties"`
+					Required   []string       `json:"required"`
+				} `json:"items"`
+			} `json:"painDescriptions"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(params, &schema); err != nil {
+		t.Fatalf("unable to parse the parameters: %v", err)
+	}
+	items := schema.Properties.PainDescriptions.Items
+	if _, ok := items.Properties["locationId"]; !ok {
+		t.Errorf("Expected locationId in the schema, got %v", items.Properties)
+	}
+	if len(items.Required) != 5 {
+		t.Errorf("Expected the fields without omitempty to be required, got %v", items.Required)
+	}
+}
+
+func TestNewConfig_ExamplesShouldHaveValidArguments(t *testing.T) {
+	t.Parallel()
+	config, err := openai.NewConfig(&openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "key"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	calls := 0
+	for _, msg := range config.SystemContext.Messages {
+		for _, call := range msg.ToolCalls {
+			calls++
+			var args map[string]any
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				t.Errorf("Invalid arguments in example %s: %v", call.Id, err)
+			}
+		}
+	}
+	if calls == 0 {
+		t.Error("Expected examples with tool calls")
+	}
+}
+
+// newSequenceTestClient returns a client whose model answers with the given messages in order, repeating the last one
+func newSequenceTestClient(t *testing.T, messages []openai.Message, maxRepairAttempts int, requests *[]openai.OpenAiCompletionRequest) *openai.Client {
+	t.Helper()
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			var body openai.OpenAiCompletionRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatalf("unable to decode request: %v", err)
+			}
+			*requests = append(*requests, body)
+
+			message := messages[len(messages)-1]
+			if len(*requests) <= len(messages) {
+				message = messages[len(*requests)-1]
+			}
+			resp, _ := json.Marshal(openai.OpenAiCompletionResponse{Choices: []struct {
+				FinishReason string         `json:"finish_reason"`
+				Index        int            `json:"index"`
+				Message      openai.Message `json:"message"`
+			}{{Message: message, FinishReason: "tool_calls"}}, Usage: openai.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}})
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBuffer(resp)),
+			}, nil
+		},
+	}
+
+	config := &openai.Config{
+		Provider:          &openai.AzureProvider{Endpoint: "https://example.com", DeploymentName: "deployment", ApiKey: "test-api-key"},
+		SystemContext:     *openai.NewConversation(openai.NewSystemMessage("test")),
+		MaxRepairAttempts: maxRepairAttempts,
+	}
+	client, err := openai.NewClient(config, openai.WithDoer(mockClient))
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	return client
+}
+
+func TestClient_GetPainDescriptionObject_ShouldRepairInvalidOutput(t *testing.T) {
+	t.Parallel()
+	invalid := newToolCallMessage(`{"painDescriptions": [{"level": 12, "locationId": 9, "sideId": 1, "description": "back", "numbness": false}]}`)
+	valid := newToolCallMessage(`{"painDescriptions": [{"level": 10, "locationId": 9, "sideId": 1, "description": "back", "numbness": false}]}`)
+	var requests []openai.OpenAiCompletionRequest
+	client := newSequenceTestClient(t, []openai.Message{invalid, valid}, 2, &requests)
+
+	result, err := client.GetPainDescriptionObject(context.Background(), "back 12/10", openai.MessageContext{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.PainDescriptions) != 1 || result.PainDescriptions[0].Level != 10 {
+		t.Errorf("Expected the repaired pain description, got %+v", result.PainDescriptions)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	if result.Usage != (openai.Usage{PromptTokens: 200, CompletionTokens: 20, TotalTokens: 220}) {
+		t.Errorf("Expected the usage of both requests, got %+v", result.Usage)
+	}
+
+	messages := requests[1].Messages
+	repair := messages[len(messages)-1]
+	if repair.Role != "tool" || repair.ToolCallId != "call_1" || !strings.Contains(repair.Content, "pain 1: level should be between 0 and 10, got 12") {
+		t.Errorf("Expected the validation error as the tool reply, got %+v", repair)
+	}
+	if len(messages[len(messages)-2].ToolCalls) != 1 {
+		t.Errorf("Expected the invalid call before the reply, got %+v", messages[len(messages)-2])
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldGiveUpAfterMaxRepairAttempts(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		message openai.Message
+	}{
+		"InvalidValues":    {newToolCallMessage(`{"painDescriptions": [{"level": 5, "locationId": 99, "sideId": 1, "description": "x", "numbness": false}]}`)},
+		"InvalidArguments": {newToolCallMessage(`####`)},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var requests []openai.OpenAiCompletionRequest
+			client := newSequenceTestClient(t, []openai.Message{tt.message}, 1, &requests)
+
+			_, err := client.GetPainDescriptionObject(context.Background(), "test", openai.MessageContext{}, nil)
+			var invalidErr *openai.InvalidOutputError
+			if !errors.As(err, &invalidErr) {
+				t.Fatalf("Expected an InvalidOutputError, got %v", err)
+			}
+			if invalidErr.Attempts != 2 || len(requests) != 2 {
+				t.Errorf("Expected 2 attempts and requests, got %d and %d", invalidErr.Attempts, len(requests))
+			}
+		})
+	}
+}
+
+func TestClient_GetPainDescriptionObject_ShouldContinueAfterClarification(t *testing.T) {
+	t.Parallel()
+	question := openai.Message{
+		Role: "assistant",
+		ToolCalls: []openai.ToolCall{{
+			Id:       "call_q",
+			Type:     "function",
+			Function: openai.FunctionCall{Name: "ask_clarification", Arguments: `{"question": "Where does it hurt?"}`},
+		}},
+	}
+	answer := newToolCallMessage(`{"painDescriptions": [{"level": 6, "locationId": 9, "sideId": 1, "description": "it hurts again, lower back", "numbness": false}]}`)
+	var requests []openai.OpenAiCompletionRequest
+	client := newSequenceTestClient(t, []openai.Message{question, answer}, 0, &requests)
+
+	result, err := client.GetPainDescriptionObject(context.Background(), "it hurts again", openai.MessageContext{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Kind != openai.ResultClarification || result.Text != "Where does it hurt?" {
+		t.Fatalf("Expected a clarification, got %+v", result)
+	}
+	// The time of the message, the message, the question and the reply to the question
+	history := result.Conversation.Messages
+	if len(history) != 4 || history[1].Content != "it hurts again" || history[3].ToolCallId != "call_q" {
+		t.Fatalf("Unexpected conversation %+v", history)
+	}
+
+	result, err = client.GetPainDescriptionObject(context.Background(), "lower back", openai.MessageContext{}, result.Conversation)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Kind != openai.ResultPainDescriptions || len(result.PainDescriptions) != 1 {
+		t.Fatalf("Expected pain descriptions, got %+v", result)
+	}
+
+	// The second request has the system context, the earlier exchange and the answer
+	messages := requests[1].Messages
+	if len(messages) != 1+len(history)+2 {
+		t.Fatalf("Expected %d messages, got %d", 1+len(history)+2, len(messages))
+	}
+	if messages[2].Content != "it hurts again" || messages[len(messages)-1].Content != "lower back" {
+		t.Errorf("Expected the earlier message before the answer, got %+v", messages)
+	}
+}
@@ -0,0 +1,166 @@
+package ruleparser
+
+import "sort"
+
+type wordKind int
+
+const (
+	// kindIgnore marks words that start with a stem of another kind but mean something else, e.g. "selkeä"
+	kindIgnore wordKind = iota
+	kindBodyPart
+	kindSide
+	kindLevel
+	kindIntensity
+	kindNumbness
+)
+
+// lexeme is a word form, or the stem of inflected and compound words when prefix is set. value is the body part ID,
+// side ID or level of the word
+type lexeme struct {
+	form   string
+	prefix bool
+	kind   wordKind
+	value  int
+}
+
+func exact(kind wordKind, value int, forms ...string) []lexeme {
+	l := make([]lexeme, 0, len(forms))
+	for _, f := range forms {
+		l = append(l, lexeme{form: f, kind: kind, value: value})
+	}
+	return l
+}
+
+func stems(kind wordKind, value int, forms ...string) []lexeme {
+	l := exact(kind, value, forms...)
+	for i := range l {
+		l[i].prefix = true
+	}
+	return l
+}
+
+// lexicon holds the known words, longest first so that e.g. "alaselkä" matches lower back before "selk" does.
+// The body part and side IDs are those of models.BodyPartMapping and models.SideMap
+var lexicon = sortLexicon(concat(
+	// Body parts in English
+	exact(kindBodyPart, 1, "head", "headache", "forehead", "temple", "temples"),
+	exact(kindBodyPart, 2, "neck"),
+	exact(kindBodyPart, 3, "shoulder", "shoulders"),
+	exact(kindBodyPart, 4, "arm", "arms", "forearm", "forearms"),
+	exact(kindBodyPart, 5, "elbow", "elbows"),
+	exact(kindBodyPart, 6, "wrist", "wrists"),
+	exact(kindBodyPart, 7, "hand", "hands", "finger", "fingers", "palm", "thumb"),
+	exact(kindBodyPart, 9, "back", "backache", "lumbar"),
+	exact(kindBodyPart, 10, "hip", "hips"),
+	exact(kindBodyPart, 11, "leg", "legs"),
+	exact(kindBodyPart, 12, "knee", "knees"),
+	exact(kindBodyPart, 13, "ankle", "ankles"),
+	exact(kindBodyPart, 14, "foot", "feet", "heel", "heels", "sole"),
+	exact(kindBodyPart, 15, "chest"),
+	exact(kindBodyPart, 16, "stomach", "abdomen", "belly", "tummy"),
+	exact(kindBodyPart, 17, "pelvis", "pelvic"),
+	exact(kindBodyPart, 18, "groin", "genitals"),
+	exact(kindBodyPart, 19, "thigh", "thighs", "hamstring", "hamstrings"),
+	exact(kindBodyPart, 20, "calf", "calves"),
+	exact(kindBodyPart, 21, "toe", "toes"),
+
+	// Body parts in Finnish. The stems cover the inflected forms, e.g. "alaselässä", and compounds, e.g. "niskahartiat"
+	exact(kindBodyPart, 1, "pää", "pään", "päätä", "päässä", "päähän"),
+	stems(kindBodyPart, 1, "päänsär", "ohimo"),
+	stems(kindBodyPart, 2, "nisk", "kaula"),
+	stems(kindBodyPart, 3, "olka", "hartia", "hartio", "hartij"),
+	// käsi is used of the whole arm, like in the examples given to the model
+	stems(kindBodyPart, 4, "käsi", "käde", "kät", "käsivar", "käsivarr", "olkavar", "olkavarr", "kyynärvar", "kyynärvarr"),
+	stems(kindBodyPart, 5, "kyynär"),
+	stems(kindBodyPart, 6, "ranne", "rante", "rannet"),
+	stems(kindBodyPart, 7, "kämmen", "kämmene", "sormi", "sormet", "sorme", "peukalo"),
+	// The long back muscles are mapped to the upper back like in the examples given to the model
+	stems(kindBodyPart, 8, "yläselk", "yläselä", "selkälihak", "selkälihas", "lapaluu", "lapaluid"),
+	stems(kindBodyPart, 9, "alaselk", "alaselä", "ristiselk", "ristiselä", "selk", "selä", "lanneran"),
+	stems(kindBodyPart, 10, "lonk"),
+	stems(kindBodyPart, 11, "jalk", "jala", "jalo"),
+	stems(kindBodyPart, 12, "polv"),
+	stems(kindBodyPart, 13, "nilk"),
+	stems(kindBodyPart, 14, "jalkapohj", "jalkater", "kantapä", "jalkaterä"),
+	stems(kindBodyPart, 15, "rint", "rinn"),
+	stems(kindBodyPart, 16, "vats", "maha"),
+	stems(kindBodyPart, 17, "lanti"),
+	stems(kindBodyPart, 18, "nivu"),
+	stems(kindBodyPart, 19, "reisi", "reide", "reit"),
+	stems(kindBodyPart, 20, "pohje", "pohke"),
+	stems(kindBodyPart, 21, "varva", "varpa"),
+	stems(kindIgnore, 0, "selkeä", "selkee", "selvä", "jalkapallo", "reitti", "reitill", "kätevä", "käsit"),
+
+	// Sides
+	exact(kindSide, 1, "both", "bilateral", "molemmat", "molempien", "molemmissa", "molemmilla", "molempiin", "kumpikin"),
+	exact(kindSide, 2, "left", "vasen", "vasemman", "vasemmalla", "vasemmassa", "vasemmalle", "vasempi", "vasempaan", "vasemmat"),
+	exact(kindSide, 3, "right", "oikea", "oikean", "oikealla", "oikeassa", "oikealle", "oikeaa", "oikeat", "oikeaan", "oikeanpuoleinen"),
+
+	// Levels written as words, including the colloquial Finnish numbers. "one" and "yksi" are left out as they are
+	// more often articles than levels
+	exact(kindLevel, 0, "zero", "nolla"),
+	exact(kindLevel, 2, "two", "kaksi"),
+	exact(kindLevel, 3, "three", "kolme"),
+	exact(kindLevel, 4, "four", "neljä"),
+	exact(kindLevel, 5, "five", "viisi"),
+	exact(kindLevel, 6, "six", "kuusi"),
+	exact(kindLevel, 7, "seven", "seitsemän"),
+	exact(kindLevel, 8, "eight", "kahdeksan", "kasi", "kasin", "kasiin", "kasilla", "kasissa"),
+	exact(kindLevel, 9, "nine", "yhdeksän", "ysi", "ysin", "ysiin", "ysillä", "ysissä"),
+	exact(kindLevel, 10, "ten", "kymmenen"),
+	stems(kindLevel, 1, "ykkö"),
+	stems(kindLevel, 2, "kakko"),
+	stems(kindLevel, 3, "kolmo"),
+	stems(kindLevel, 4, "nelo"),
+	stems(kindLevel, 5, "vito"),
+	stems(kindLevel, 6, "kuto"),
+	stems(kindLevel, 7, "seisk"),
+	stems(kindLevel, 10, "kymp"),
+
+	// Words that describe the intensity without a number, used only when the message has no levels
+	exact(kindIntensity, 2, "slight", "slightly"),
+	exact(kindIntensity, 3, "mild", "mildly"),
+	exact(kindIntensity, 5, "moderate", "kohtalainen", "kohtalaista", "kohtalaisen"),
+	exact(kindIntensity, 6, "bad"),
+	exact(kindIntensity, 7, "kova", "kovaa", "kovia"),
+	exact(kindIntensity, 8, "severe", "intense"),
+	exact(kindIntensity, 9, "terrible", "excruciating"),
+	exact(kindIntensity, 10, "unbearable", "worst"),
+	stems(kindIntensity, 3, "lievä", "lievi", "lieve"),
+	stems(kindIntensity, 9, "hirveä", "hirvee", "kamala", "kauhea"),
+	stems(kindIntensity, 10, "sietämät"),
+
+	// Numbness
+	exact(kindNumbness, 0, "numb", "numbness", "tingling", "tingles", "tingly"),
+	stems(kindNumbness, 0, "turt", "puutu", "pistel", "kihel"),
+))
+
+func concat(groups ...[]lexeme) []lexeme {
+	var all []lexeme
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+func sortLexicon(l []lexeme) []lexeme {
+	sort.SliceStable(l, func(i, j int) bool {
+		return len([]rune(l[i].form)) > len([]rune(l[j].form))
+	})
+	return l
+}
+
+// lookup returns the longest lexeme the word matches. Exact forms match the whole word, stems its beginning
+func lookup(word string) (lexeme, bool) {
+	runes := []rune(word)
+	for _, l := range lexicon {
+		form := []rune(l.form)
+		if len(form) > len(runes) {
+			continue
+		}
+		if string(runes) == l.form || (l.prefix && string(runes[:len(form)]) == l.form) {
+			return l, true
+		}
+	}
+	return lexeme{}, false
+}
@@ -0,0 +1,265 @@
+// Package ruleparser turns pain descriptions into entries with fixed rules instead of a language model. It is much
+// less capable than the model, but it works offline, so messages can still be logged when the model is unavailable
+package ruleparser
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"t-pain/pkg/models"
+	"time"
+)
+
+var (
+	// ErrNoBodyPart is returned when the message mentions no known body part
+	ErrNoBodyPart = errors.New("no body part recognised")
+	// ErrNoLevel is returned when the message has no pain level, as a number or a word like "mild"
+	ErrNoLevel = errors.New("no pain level recognised")
+)
+
+// segmentSplitter splits the message into clauses at punctuation. Decimal points and commas, e.g. "7.5", are kept
+var segmentSplitter = regexp.MustCompile(`[.,](\s|$)|[;!?\n]`)
+
+// tokenPattern matches times like "8:30", numbers like "7", "7,5" and "6/10", and words
+var tokenPattern = regexp.MustCompile(`\d{1,2}[:.]\d{2}|\d+(?:[.,]\d+)?(?:\s*/\s*10)?|\p{L}+`)
+
+// timePattern matches the times among the numeric tokens, which are not levels
+var timePattern = regexp.MustCompile(`^\d{1,2}[:.]\d{2}$`)
+
+// timeWords precede or follow numbers that are times instead of levels, e.g. "klo 23" or "8 am"
+var timeWords = map[string]bool{"klo": true, "kello": true, "am": true, "pm": true}
+
+// levelAt is a level mentioned in the segment with the given index
+type levelAt struct {
+	segment int
+	level   int
+}
+
+// pain is a body part mentioned in the message and what is known of it so far
+type pain struct {
+	segment  int
+	location int
+	side     int
+	level    int
+	hasLevel bool
+	numbness bool
+	numbDesc string
+}
+
+// Parse finds the body parts, sides, levels and numbness mentioned in the text. A level applies to the body parts
+// mentioned before it in the same clause, or after it if there are none, and a clause with only a level applies to
+// the body parts of the previous clauses. Body parts left without a level get the nearest level in the message.
+// The entries are timestamped at sentAt, as the parser does not understand times
+func Parse(text string, sentAt time.Time) ([]models.PainDescription, error) {
+	segments := segmentSplitter.Split(strings.ToLower(text), -1)
+
+	var pains []*pain
+	var levels []levelAt
+	intensity := -1
+
+	for i, segment := range segments {
+		tokens := tokenPattern.FindAllString(segment, -1)
+
+		var segmentPains []*pain
+		pendingSide := 0
+		pendingLevel := -1
+		numbness := false
+		for j, token := range tokens {
+			if level, ok := parseLevel(token); ok {
+				if (j > 0 && timeWords[tokens[j-1]]) || (j+1 < len(tokens) && timeWords[tokens[j+1]]) {
+					continue
+				}
+				levels = append(levels, levelAt{segment: i, level: level})
+				if !assignLevel(segmentPains, level) {
+					pendingLevel = level
+				}
+				continue
+			}
+
+			if j+1 < len(tokens) && tokens[j+1] == "back" {
+				switch token {
+				case "upper":
+					segmentPains = append(segmentPains, newPain(i, 8, &pendingSide, pendingLevel))
+					continue
+				case "lower", "low":
+					segmentPains = append(segmentPains, newPain(i, 9, &pendingSide, pendingLevel))
+					continue
+				}
+			}
+			if token == "back" && j > 0 && (tokens[j-1] == "upper" || tokens[j-1] == "lower" || tokens[j-1] == "low") {
+				continue
+			}
+
+			l, ok := lookup(token)
+			if !ok {
+				continue
+			}
+			switch l.kind {
+			case kindBodyPart:
+				segmentPains = append(segmentPains, newPain(i, l.value, &pendingSide, pendingLevel))
+			case kindSide:
+				pendingSide = l.value
+			case kindLevel:
+				levels = append(levels, levelAt{segment: i, level: l.value})
+				if !assignLevel(segmentPains, l.value) {
+					pendingLevel = l.value
+				}
+			case kindIntensity:
+				if l.value > intensity {
+					intensity = l.value
+				}
+			case kindNumbness:
+				numbness = true
+			}
+		}
+
+		// A side after the body part, e.g. "knee, left", applies to the last body part of the clause
+		if pendingSide != 0 && len(segmentPains) > 0 && segmentPains[len(segmentPains)-1].side == 0 {
+			segmentPains[len(segmentPains)-1].side = pendingSide
+		}
+
+		// A clause with only a level or numbness continues the previous ones, e.g. "My left arm hurts. Level 5."
+		target := segmentPains
+		if len(target) == 0 {
+			target = unfinished(pains)
+		}
+		if numbness {
+			if len(target) == 0 && len(pains) > 0 {
+				target = pains[len(pains)-1:]
+			}
+			for _, p := range target {
+				p.numbness = true
+				p.numbDesc = strings.TrimSpace(segment)
+			}
+		}
+		if len(segmentPains) == 0 && pendingLevel >= 0 {
+			assignLevel(target, pendingLevel)
+		}
+
+		pains = append(pains, segmentPains...)
+	}
+
+	if len(pains) == 0 {
+		return nil, ErrNoBodyPart
+	}
+
+	for _, p := range pains {
+		if p.hasLevel {
+			continue
+		}
+		level, ok := nearestLevel(p.segment, levels)
+		if !ok {
+			if intensity < 0 {
+				return nil, ErrNoLevel
+			}
+			level = intensity
+		}
+		p.level = level
+		p.hasLevel = true
+	}
+
+	return toPainDescriptions(pains, strings.TrimSpace(text), sentAt), nil
+}
+
+func newPain(segment, location int, pendingSide *int, pendingLevel int) *pain {
+	p := &pain{segment: segment, location: location, side: *pendingSide}
+	*pendingSide = 0
+	if pendingLevel >= 0 {
+		p.level = pendingLevel
+		p.hasLevel = true
+	}
+	return p
+}
+
+// assignLevel sets the level of the pains that have none. Returns false if there were none to set
+func assignLevel(pains []*pain, level int) bool {
+	assigned := false
+	for _, p := range pains {
+		if !p.hasLevel {
+			p.level = level
+			p.hasLevel = true
+			assigned = true
+		}
+	}
+	return assigned
+}
+
+// unfinished returns the pains at the end of the list that have no level yet
+func unfinished(pains []*pain) []*pain {
+	i := len(pains)
+	for i > 0 && !pains[i-1].hasLevel {
+		i--
+	}
+	return pains[i:]
+}
+
+// nearestLevel returns the last level before or in the segment, or the first one after it
+func nearestLevel(segment int, levels []levelAt) (int, bool) {
+	for i := len(levels) - 1; i >= 0; i-- {
+		if levels[i].segment <= segment {
+			return levels[i].level, true
+		}
+	}
+	if len(levels) > 0 {
+		return levels[0].level, true
+	}
+	return 0, false
+}
+
+// parseLevel parses a numeric token. Decimals are rounded up like the model is told to do, and numbers outside
+// the level range, e.g. years, are not levels
+func parseLevel(token string) (int, bool) {
+	if token == "" || token[0] < '0' || token[0] > '9' || timePattern.MatchString(token) {
+		return 0, false
+	}
+	token = strings.TrimSuffix(strings.ReplaceAll(token, " ", ""), "/10")
+	value, err := strconv.ParseFloat(strings.Replace(token, ",", ".", 1), 64)
+	if err != nil {
+		return 0, false
+	}
+	level := int(math.Ceil(value))
+	if level < models.MinLevel || level > models.MaxLevel {
+		return 0, false
+	}
+	return level, true
+}
+
+// toPainDescriptions merges the pains of the same body part and side, the last level winning
+func toPainDescriptions(pains []*pain, description string, sentAt time.Time) []models.PainDescription {
+	type key struct{ location, side int }
+	var pd []models.PainDescription
+	index := make(map[key]int)
+
+	for _, p := range pains {
+		side := p.side
+		if side == 0 {
+			side = 1
+		}
+		k := key{p.location, side}
+
+		d := models.PainDescription{
+			Timestamp:           sentAt,
+			Level:               p.level,
+			LocationId:          p.location,
+			SideId:              side,
+			Description:         description,
+			Numbness:            p.numbness,
+			NumbnessDescription: p.numbDesc,
+			TimestampSource:     models.TimestampFromMessage,
+			Parser:              models.ParserFallback,
+		}
+		if i, ok := index[k]; ok {
+			if !d.Numbness {
+				d.Numbness, d.NumbnessDescription = pd[i].Numbness, pd[i].NumbnessDescription
+			}
+			pd[i] = d
+			continue
+		}
+		index[k] = len(pd)
+		pd = append(pd, d)
+	}
+
+	return pd
+}
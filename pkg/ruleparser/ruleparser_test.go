@@ -0,0 +1,123 @@
+package ruleparser_test
+
+import (
+	"errors"
+	"t-pain/pkg/models"
+	"t-pain/pkg/ruleparser"
+	"testing"
+	"time"
+)
+
+// expectedPain is the part of a parsed pain description the tests check
+type expectedPain struct {
+	level    int
+	location int
+	side     int
+	numbness bool
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		text     string
+		expected []expectedPain
+	}{
+		"EnglishWithLevelInNextSentence": {
+			text:     "My left arm is quite painful today. About level 5. The pain is radiating to my left shoulder also",
+			expected: []expectedPain{{level: 5, location: 4, side: 2}, {level: 5, location: 3, side: 2}},
+		},
+		"FinnishInflectedAndCompoundWords": {
+			text:     "Pitkät selkälihakset vähän krampissa. Alaselkä aika perustasoa lääkkeiden oton jälkeen. Tippu ehkä seiska puolikkaasta kutoseen. Istuessa.",
+			expected: []expectedPain{{level: 6, location: 8, side: 1}, {level: 6, location: 9, side: 1}},
+		},
+		"FinnishNumbness": {
+			text:     "Lisäyksenä edelliseen, myös oikea käsi on kipeä ja turtunut. Taso 3.",
+			expected: []expectedPain{{level: 3, location: 4, side: 3, numbness: true}},
+		},
+		"SeveralPainsInOneClause": {
+			text:     "lower back 6 left knee 3/10",
+			expected: []expectedPain{{level: 6, location: 9, side: 1}, {level: 3, location: 12, side: 2}},
+		},
+		"LevelBeforeBodyPart": {
+			text:     "8 in the upper back",
+			expected: []expectedPain{{level: 8, location: 8, side: 1}},
+		},
+		"DecimalRoundedUp": {
+			text:     "niska 4,5",
+			expected: []expectedPain{{level: 5, location: 2, side: 1}},
+		},
+		"TimeIsNotALevel": {
+			text:     "Viime yönä klo 23 alaselässä kasin kipu",
+			expected: []expectedPain{{level: 8, location: 9, side: 1}},
+		},
+		"IntensityWordWithoutLevel": {
+			text:     "Mild headache",
+			expected: []expectedPain{{level: 3, location: 1, side: 1}},
+		},
+		"SameBodyPartMerged": {
+			text:     "Back hurts, back is at 7 now",
+			expected: []expectedPain{{level: 7, location: 9, side: 1}},
+		},
+		"TimeInEnglish": {
+			text:     "Neck 4 since 8 am",
+			expected: []expectedPain{{level: 4, location: 2, side: 1}},
+		},
+		"SideAfterBodyPart": {
+			text:     "Polvi vasen 2",
+			expected: []expectedPain{{level: 2, location: 12, side: 2}},
+		},
+	}
+
+	sentAt := time.Date(2023, 8, 1, 6, 30, 0, 0, time.UTC)
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pd, err := ruleparser.Parse(tt.text, sentAt)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(pd) != len(tt.expected) {
+				t.Fatalf("Expected %d pain descriptions, got %d: %+v", len(tt.expected), len(pd), pd)
+			}
+			for i, e := range tt.expected {
+				p := pd[i]
+				if p.Level != e.level || p.LocationId != e.location || p.SideId != e.side || p.Numbness != e.numbness {
+					t.Errorf("Expected pain %d to be %+v, got level %d, location %d, side %d, numbness %v",
+						i+1, e, p.Level, p.LocationId, p.SideId, p.Numbness)
+				}
+				if p.Parser != models.ParserFallback || !p.Timestamp.Equal(sentAt) || p.Description == "" {
+					t.Errorf("Expected a fallback entry at %s with the description, got %+v", sentAt, p)
+				}
+			}
+			if err := models.ValidatePainDescriptions(pd); err != nil {
+				t.Errorf("Expected valid pain descriptions, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParse_ShouldFailWithoutBodyPartOrLevel(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		text     string
+		expected error
+	}{
+		"NoBodyPart":      {text: "Feeling 5 today", expected: ruleparser.ErrNoBodyPart},
+		"NoLevel":         {text: "My knee hurts", expected: ruleparser.ErrNoLevel},
+		"ClearIsNotABack": {text: "Selkeä päivä, taso 2", expected: ruleparser.ErrNoBodyPart},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ruleparser.Parse(tt.text, time.Now())
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package speechtotext
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
@@ -11,7 +12,7 @@ import (
 )
 
 // handleAudioFileSetup downloads the audio file from the url, converts it to wav, and returns the wav file name
-func handleAudioFileSetup(url string) (string, error) {
+func handleAudioFileSetup(ctx context.Context, url string) (string, error) {
 	// Generate new guid
 	newGuid, err := uuid.NewUUID()
 	if err != nil {
@@ -20,7 +21,7 @@ func handleAudioFileSetup(url string) (string, error) {
 
 	// Download file from url
 	oggFileName := fmt.Sprintf("%s.ogg", newGuid.String())
-	err = downloadFile(url, oggFileName)
+	err = downloadFile(ctx, url, oggFileName)
 	if err != nil {
 		return "", err
 	}
@@ -29,7 +30,7 @@ func handleAudioFileSetup(url string) (string, error) {
 
 	// Convert file to wav
 	wavFileName := fmt.Sprintf("%s.wav", newGuid.String())
-	err = convertOggToWav(fmt.Sprintf("%s.ogg", newGuid.String()), wavFileName)
+	err = convertOggToWav(ctx, fmt.Sprintf("%s.ogg", newGuid.String()), wavFileName)
 	if err != nil {
 		log.Println("handleAudioFileSetup: Error converting file to wav: ", err)
 		return "", err
@@ -41,8 +42,8 @@ func handleAudioFileSetup(url string) (string, error) {
 }
 
 // convertOggToWav converts an Ogg audio file to a WAV file using FFmpeg.
-func convertOggToWav(inputFile string, outputFile string) error {
-	cmd := exec.Command("ffmpeg", "-i", inputFile, "-acodec", "pcm_s16le", "-ar", "16000", "-ac", "1", outputFile)
+func convertOggToWav(ctx context.Context, inputFile string, outputFile string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", inputFile, "-acodec", "pcm_s16le", "-ar", "16000", "-ac", "1", outputFile)
 	err := cmd.Run()
 	if err != nil {
 		return err
@@ -50,13 +51,20 @@ func convertOggToWav(inputFile string, outputFile string) error {
 	return nil
 }
 
-func downloadFile(url string, fileName string) error {
+func downloadFile(ctx context.Context, url string, fileName string) error {
 	// Open file
 	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("downloadFile: error creating file, %w", err)
+	}
 	defer file.Close()
 
 	// Send a GET request to the URL
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("downloadFile: error creating request, %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("downloadFile: error sending request, %w", err)
 	}
@@ -76,8 +84,7 @@ func downloadFile(url string, fileName string) error {
 			break
 		}
 		if err != nil {
-			fmt.Println("Error reading file: ", err)
-			break
+			return fmt.Errorf("downloadFile: error reading response, %w", err)
 		}
 		_, err = file.Write(buffer[0:n])
 		if err != nil {
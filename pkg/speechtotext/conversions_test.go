@@ -1,6 +1,7 @@
 package speechtotext
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -21,7 +22,7 @@ func TestHandleAudioFileSetup_WithValidValues(t *testing.T) {
 	defer server.Close()
 
 	// Run handleAudioFileSetup with the URL from our test server
-	filename, err := handleAudioFileSetup(server.URL)
+	filename, err := handleAudioFileSetup(context.Background(), server.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -38,7 +39,7 @@ func Test_ConvertOggToWav_ShouldErrorOnFileNotFound(t *testing.T) {
 	inputFile := "./testdata/doesnotexist.ogg"
 	outputFile := "./testdata/doesnotexist.wav"
 
-	err := convertOggToWav(inputFile, outputFile)
+	err := convertOggToWav(context.Background(), inputFile, outputFile)
 	if err == nil {
 		defer os.Remove(outputFile)
 		t.Errorf("Expected error, got nil")
@@ -55,7 +56,7 @@ func Test_DownloadFile(t *testing.T) {
 
 	filename := "./testdata/downloaded.txt"
 
-	err := downloadFile(server.URL, filename)
+	err := downloadFile(context.Background(), server.URL, filename)
 	if err != nil {
 		t.Fatal(err)
 	}
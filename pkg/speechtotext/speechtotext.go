@@ -1,10 +1,10 @@
 package speechtotext
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
-	"time"
 )
 
 type Wrapper interface {
@@ -13,9 +13,11 @@ type Wrapper interface {
 	Writer
 }
 
-func HandleAudioLink(url string, wrapper Wrapper) (string, error) {
+// HandleAudioLink downloads the audio at url and recognizes the speech in it. Cancelling ctx, or its deadline,
+// aborts the download, the conversion and the recognition
+func HandleAudioLink(ctx context.Context, url string, wrapper Wrapper) (string, error) {
 	// Download and convert
-	wavFile, err := handleAudioFileSetup(url)
+	wavFile, err := handleAudioFileSetup(ctx, url)
 	if err != nil {
 		return "", err
 	}
@@ -55,10 +57,10 @@ func HandleAudioLink(url string, wrapper Wrapper) (string, error) {
 		if err != nil {
 			log.Println("Error stopping continuous: ", err)
 		}
-	case <-time.After(120 * time.Second):
+	case <-ctx.Done():
 		close(stop)
 		_ = wrapper.StopContinuous()
-		return "", fmt.Errorf("timeout")
+		return "", fmt.Errorf("recognition stopped: %w", ctx.Err())
 	}
 	defer wrapper.StopContinuous()
 
@@ -1,6 +1,7 @@
 package speechtotext_test
 
 import (
+	"context"
 	"errors"
 	"github.com/Microsoft/cognitive-services-speech-sdk-go/common"
 	"github.com/Microsoft/cognitive-services-speech-sdk-go/speech"
@@ -64,7 +65,7 @@ func TestHandleAudioLink_Success(t *testing.T) {
 	// Use the URL of the test server as the audio link
 	audioLink := server.URL
 
-	result, err := speechtotext.HandleAudioLink(audioLink, mockWrapper)
+	result, err := speechtotext.HandleAudioLink(context.Background(), audioLink, mockWrapper)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -92,10 +93,48 @@ func TestHandleAudioLink_ErrorFromDownload(t *testing.T) {
 	// Use the URL of the test server as the audio link
 	audioLink := server.URL
 
-	_, err := speechtotext.HandleAudioLink(audioLink, mockWrapper)
+	_, err := speechtotext.HandleAudioLink(context.Background(), audioLink, mockWrapper)
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
 }
 
+func TestHandleAudioLink_ShouldStopStuckRecognitionWhenCancelled(t *testing.T) {
+	t.Parallel()
+	stopped := make(chan struct{})
+	// Cancelled only after the recognition has started, so a slow download or conversion does not fail the test
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockWrapper := &MockSDKWrapper{
+		StartContinuousFunc: func(eventHandler func(event *speechtotext.SDKWrapperEvent)) error {
+			// The recognizer never sends any events
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return nil
+		},
+		StopContinuousFunc: func() error {
+			select {
+			case <-stopped:
+			default:
+				close(stopped)
+			}
+			return nil
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/working.ogg")
+	}))
+	defer server.Close()
+
+	_, err := speechtotext.HandleAudioLink(ctx, server.URL, mockWrapper)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("expected the recognition to be stopped")
+	}
+}
+
 // TODO: Add cases
\ No newline at end of file
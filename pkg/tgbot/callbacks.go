@@ -0,0 +1,264 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// Callback data of the draft buttons. Telegram limits the data to 64 bytes
+const (
+	callbackSave    = "save"
+	callbackDiscard = "discard"
+	callbackEdit    = "edit"
+	// callbackUndo and callbackKeep answer the confirmation of /undo
+	callbackUndo = "undo"
+	callbackKeep = "keep"
+)
+
+// draftKeyboard returns the buttons shown under a draft preview
+func draftKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Save", callbackSave),
+			tgbotapi.NewInlineKeyboardButtonData("Discard", callbackDiscard),
+			tgbotapi.NewInlineKeyboardButtonData("Edit", callbackEdit),
+		),
+	)
+}
+
+// sendDraft sends the parsed pain descriptions to the user for confirmation and stores them as a draft
+func (b *Bot) sendDraft(update tgbotapi.Update, pd []models.PainDescription) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmtDraft(pd, b.location))
+	msg.ReplyMarkup = draftKeyboard()
+
+	sent, err := b.Bot.Send(msg)
+	if err != nil {
+		log.Printf("Error sending draft: %v", err)
+		return
+	}
+
+	key := draftKey{chatID: update.Message.Chat.ID, messageID: sent.MessageID}
+	meta := models.NewEntryMetadata(update.Message.Chat.ID, update.Message.MessageID, messageSource(update, pd))
+	b.drafts.add(key, update.Message.From.ID, pd, meta)
+}
+
+// messageSource tells how the pains were read from the message
+func messageSource(update tgbotapi.Update, pd []models.PainDescription) string {
+	for _, pain := range pd {
+		if pain.Parser == models.ParserFallback {
+			return models.SourceFallback
+		}
+	}
+	if update.Message.Voice != nil {
+		return models.SourceVoice
+	}
+	return models.SourceText
+}
+
+// processCallback handles the button presses on a draft preview. Returns an error if saving was aborted by
+// stopping the bot
+func (b *Bot) processCallback(update tgbotapi.Update) error {
+	query := update.CallbackQuery
+	if query.Message == nil {
+		b.answerCallback(query.ID, "This entry is no longer available")
+		return nil
+	}
+
+	key := draftKey{chatID: query.Message.Chat.ID, messageID: query.Message.MessageID}
+
+	switch query.Data {
+	case callbackSave, callbackDiscard:
+		if err := b.finishDraft(query, key); err != nil {
+			return fmt.Errorf("processCallback: %w", err)
+		}
+	case callbackUndo, callbackKeep:
+		if err := b.finishUndo(query, key); err != nil {
+			return fmt.Errorf("processCallback: %w", err)
+		}
+	default:
+		b.editDraft(query, key)
+	}
+	return nil
+}
+
+// finishDraft saves or discards a draft, after which it can no longer be changed. Returns an error if saving was
+// aborted by stopping the bot, as the draft does not survive the restart
+func (b *Bot) finishDraft(query *tgbotapi.CallbackQuery, key draftKey) error {
+	d, ok := b.drafts.take(key)
+	if !ok {
+		b.answerCallback(query.ID, "This entry is no longer pending")
+		return nil
+	}
+	if d.userID != query.From.ID {
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Only the sender can confirm this entry")
+		return nil
+	}
+	if len(d.retracts) > 0 {
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Unknown action")
+		return nil
+	}
+
+	if query.Data == callbackDiscard {
+		b.answerCallback(query.ID, "Discarded")
+		b.editMessage(key, "Discarded, nothing was saved.", nil)
+		return nil
+	}
+
+	if len(d.corrects) > 0 {
+		return b.finishCorrection(query, key, d)
+	}
+
+	// A message delivered again can have another draft, which must not save the same entries twice, also when both
+	// are confirmed at the same time
+	if b.processed != nil && !b.processed.reserve(d.meta.ChatID, d.meta.MessageID) {
+		b.answerCallback(query.ID, "Already saved")
+		b.editMessage(key, "The entries of this message were already saved.", nil)
+		return nil
+	}
+
+	err := b.saveData(d.userID, d.painDesc, d.meta)
+	if b.processed != nil {
+		if err == nil || errors.Is(err, database.ErrQueued) {
+			b.processed.markSaved(d.meta.ChatID, d.meta.MessageID, time.Now())
+		} else {
+			b.processed.release(d.meta.ChatID, d.meta.MessageID)
+		}
+	}
+	if errors.Is(err, database.ErrQueued) {
+		log.Printf("Error saving data, queued for retry: %v", err)
+		b.answerCallback(query.ID, "Queued")
+		b.editMessage(key, "Queued, the storage is not available right now. The entry is kept and saved automatically "+
+			"once it is, there is no need to send it again:\n"+fmtReply(d.painDesc, b.location), nil)
+		return nil
+	}
+	if errors.Is(err, context.Canceled) {
+		b.answerCallback(query.ID, "Not saved")
+		b.editMessage(key, stoppedDraftReply, nil)
+		return fmt.Errorf("finishDraft: %w", err)
+	}
+	if err != nil {
+		log.Printf("Error saving data: %v", err)
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Error saving data. Please contact Pasi and try again later.")
+		return nil
+	}
+	b.answerCallback(query.ID, "Saved")
+	b.editMessage(key, "Saved:\n"+fmtReply(d.painDesc, b.location), nil)
+	return nil
+}
+
+// finishCorrection saves the edited draft as corrections of the entries it was made of. Returns an error if saving
+// was aborted by stopping the bot
+func (b *Bot) finishCorrection(query *tgbotapi.CallbackQuery, key draftKey, d *draft) error {
+	err := b.saveCorrections(d.userID, d.corrects, d.painDesc)
+	if errors.Is(err, database.ErrQueued) {
+		log.Printf("Error saving correction, queued for retry: %v", err)
+		b.answerCallback(query.ID, "Queued")
+		b.editMessage(key, "Queued, the storage is not available right now. The correction is saved automatically "+
+			"once it is:\n"+fmtReply(d.painDesc, b.location), nil)
+		return nil
+	}
+	if errors.Is(err, context.Canceled) {
+		b.answerCallback(query.ID, "Not saved")
+		b.editMessage(key, stoppedDraftReply, nil)
+		return fmt.Errorf("finishCorrection: %w", err)
+	}
+	if err != nil {
+		log.Printf("Error saving correction: %v", err)
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Error saving data. Please contact Pasi and try again later.")
+		return nil
+	}
+	b.answerCallback(query.ID, "Corrected")
+	b.editMessage(key, "Corrected:\n"+fmtReply(d.painDesc, b.location), nil)
+	return nil
+}
+
+// editDraft handles the buttons of the edit mode, changing the draft in place and redrawing the preview
+func (b *Bot) editDraft(query *tgbotapi.CallbackQuery, key draftKey) {
+	action, err := parseEditAction(query.Data)
+	if err != nil {
+		log.Printf("Unknown callback data %q: %v", query.Data, err)
+		b.answerCallback(query.ID, "Unknown action")
+		return
+	}
+
+	pd, err := b.drafts.update(key, query.From.ID, action.apply)
+	if errors.Is(err, errNotDraftOwner) {
+		b.answerCallback(query.ID, "Only the sender can edit this entry")
+		return
+	}
+	if errors.Is(err, errUnknownRow) {
+		b.answerCallback(query.ID, "Unknown action")
+		return
+	}
+	if errors.Is(err, errInvalidEdit) {
+		log.Printf("Rejected edit %q: %v", query.Data, err)
+		b.answerCallback(query.ID, "This change would make the entry invalid")
+		return
+	}
+	if err != nil {
+		b.answerCallback(query.ID, "This entry is no longer pending")
+		return
+	}
+
+	b.answerCallback(query.ID, "")
+
+	switch action.kind {
+	case callbackEdit:
+		if len(pd) == 1 {
+			keyboard := rowEditorKeyboard(pd[0], 0, false)
+			b.editMessage(key, fmtRowEditor(pd, 0, b.location), &keyboard)
+			return
+		}
+		keyboard := rowPickerKeyboard(pd)
+		b.editMessage(key, fmtDraft(pd, b.location)+"\nWhich pain do you want to edit?", &keyboard)
+	case editDone:
+		keyboard := draftKeyboard()
+		b.editMessage(key, fmtDraft(pd, b.location), &keyboard)
+	default:
+		keyboard := rowEditorKeyboard(pd[action.row], action.row, len(pd) > 1)
+		b.editMessage(key, fmtRowEditor(pd, action.row, b.location), &keyboard)
+	}
+}
+
+// expireDrafts removes the drafts that were not confirmed in time and tells the user about it
+func (b *Bot) expireDrafts(now time.Time) {
+	for key, d := range b.drafts.removeExpired(now) {
+		if len(d.retracts) > 0 {
+			b.editMessage(key, "This removal has expired, nothing was removed.", nil)
+			continue
+		}
+		b.editMessage(key, "This entry has expired and was not saved. Please send it again.", nil)
+	}
+}
+
+// answerCallback stops the loading indicator of a pressed button, optionally showing a short notification
+func (b *Bot) answerCallback(queryID, text string) {
+	if _, err := b.Bot.Request(tgbotapi.NewCallback(queryID, text)); err != nil {
+		log.Printf("Error answering callback: %v", err)
+	}
+}
+
+// editMessage replaces the text and buttons of a message sent by the bot. A nil markup removes the buttons
+func (b *Bot) editMessage(key draftKey, text string, markup *tgbotapi.InlineKeyboardMarkup) {
+	edit := tgbotapi.NewEditMessageText(key.chatID, key.messageID, text)
+	edit.ReplyMarkup = markup
+
+	if _, err := b.Bot.Request(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
+
+// fmtDraft formats the preview of a draft that is waiting for confirmation
+func fmtDraft(pd []models.PainDescription, loc *time.Location) string {
+	return fmt.Sprintf("%s\nSave this entry?", fmtReply(pd, loc))
+}
@@ -0,0 +1,218 @@
+package tgbot
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Command is a bot command such as /history
+type Command struct {
+	// Name is the command without the leading slash
+	Name string
+	// Description is shown in /help and in the Telegram command menu
+	Description string
+	// Usage describes the arguments, e.g. "[days]". Empty for commands without arguments
+	Usage string
+	// ParseArgs parses the text following the command. A nil ParseArgs means the command takes no arguments
+	ParseArgs func(args string) (any, error)
+	// Handler runs the command with the parsed arguments. Errors are logged and reported to the user
+	Handler func(b *Bot, update tgbotapi.Update, args any) error
+}
+
+// commandNamePattern follows the Telegram rules for command names
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// CommandRegistry holds the commands of the bot in the order they were registered
+type CommandRegistry struct {
+	commands map[string]Command
+	order    []string
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		commands: make(map[string]Command),
+	}
+}
+
+// Register adds a command to the registry
+func (r *CommandRegistry) Register(cmd Command) error {
+	if !commandNamePattern.MatchString(cmd.Name) {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Description == "" || len(cmd.Description) > 256 {
+		return fmt.Errorf("command %s: description should be 1-256 characters", cmd.Name)
+	}
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %s: handler is nil", cmd.Name)
+	}
+	if _, ok := r.commands[cmd.Name]; ok {
+		return fmt.Errorf("command %s is already registered", cmd.Name)
+	}
+
+	r.commands[cmd.Name] = cmd
+	r.order = append(r.order, cmd.Name)
+	return nil
+}
+
+// Lookup returns the command with the given name
+func (r *CommandRegistry) Lookup(name string) (Command, bool) {
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Commands returns the commands in registration order
+func (r *CommandRegistry) Commands() []Command {
+	commands := make([]Command, 0, len(r.order))
+	for _, name := range r.order {
+		commands = append(commands, r.commands[name])
+	}
+	return commands
+}
+
+// BotCommands returns the commands in the format of the Telegram command menu
+func (r *CommandRegistry) BotCommands() []tgbotapi.BotCommand {
+	var botCommands []tgbotapi.BotCommand
+	for _, cmd := range r.Commands() {
+		botCommands = append(botCommands, tgbotapi.BotCommand{Command: cmd.Name, Description: cmd.Description})
+	}
+	return botCommands
+}
+
+// Help lists the commands with their usage and description
+func (r *CommandRegistry) Help() string {
+	var result strings.Builder
+	result.WriteString("Commands:\n")
+	for _, cmd := range r.Commands() {
+		result.WriteString("/" + cmd.Name)
+		if cmd.Usage != "" {
+			result.WriteString(" " + cmd.Usage)
+		}
+		result.WriteString(fmt.Sprintf(" - %s\n", cmd.Description))
+	}
+	return result.String()
+}
+
+const aboutText = "T-Pain bot helps you track your pain levels. Send me a voice or text message describing " +
+	"your pains, their levels from 0 to 10 and any numbness, and I will log it after you confirm it."
+
+// newDefaultCommands creates the registry with all the commands of the bot
+func newDefaultCommands() (*CommandRegistry, error) {
+	r := NewCommandRegistry()
+	commands := []Command{
+		{
+			Name:        "help",
+			Description: "List the available commands",
+			Handler: func(b *Bot, update tgbotapi.Update, _ any) error {
+				b.reply(update, b.commands.Help())
+				return nil
+			},
+		},
+		{
+			Name:        "about",
+			Description: "What this bot does",
+			Handler: func(b *Bot, update tgbotapi.Update, _ any) error {
+				b.reply(update, aboutText+"\n\n"+b.commands.Help())
+				return nil
+			},
+		},
+		{
+			Name:        "cancel",
+			Description: "Cancel the question the bot is waiting an answer to",
+			Handler: func(b *Bot, update tgbotapi.Update, _ any) error {
+				if b.conversations.remove(update.Message.Chat.ID) {
+					b.reply(update, "Cancelled. Send a new description when you are ready.")
+				} else {
+					b.reply(update, "There is nothing to cancel.")
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "history",
+			Description: "Show your entries from the last days",
+			Usage:       "[days]",
+			ParseArgs: func(args string) (any, error) {
+				return parseHistoryDays(args)
+			},
+			Handler: func(b *Bot, update tgbotapi.Update, args any) error {
+				return b.showHistory(update, args.(int))
+			},
+		},
+		{
+			Name:        "undo",
+			Description: "Remove your last saved entry",
+			Handler: func(b *Bot, update tgbotapi.Update, _ any) error {
+				return b.undoLast(update)
+			},
+		},
+		{
+			Name:        "correct",
+			Description: "Edit your last saved entry",
+			Handler: func(b *Bot, update tgbotapi.Update, _ any) error {
+				return b.startCorrection(update)
+			},
+		},
+		{
+			Name:        "usage",
+			Description: "Show the language model usage and cost of the last days",
+			Usage:       "[days]",
+			ParseArgs: func(args string) (any, error) {
+				return parseDays(args, defaultUsageDays, usageRetentionDays)
+			},
+			Handler: func(b *Bot, update tgbotapi.Update, args any) error {
+				return b.showUsage(update, args.(int))
+			},
+		},
+	}
+
+	for _, cmd := range commands {
+		if err := r.Register(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// handleCommand parses the arguments of a command message and runs the matching handler
+func (b *Bot) handleCommand(update tgbotapi.Update) {
+	name := update.Message.Command()
+	if name == "start" {
+		b.reply(update, "Welcome to the T-Pain bot. "+aboutText+"\n\n"+b.commands.Help())
+		return
+	}
+
+	cmd, ok := b.commands.Lookup(name)
+	if !ok {
+		b.reply(update, fmt.Sprintf("Unknown command /%s. See /help for the available commands.", name))
+		return
+	}
+
+	var args any
+	rawArgs := update.Message.CommandArguments()
+	if cmd.ParseArgs != nil {
+		var err error
+		args, err = cmd.ParseArgs(rawArgs)
+		if err != nil {
+			b.reply(update, fmt.Sprintf("Usage: /%s %s, %s.", cmd.Name, cmd.Usage, err))
+			return
+		}
+	} else if strings.TrimSpace(rawArgs) != "" {
+		b.reply(update, fmt.Sprintf("/%s does not take any arguments.", cmd.Name))
+		return
+	}
+
+	if err := cmd.Handler(b, update, args); err != nil {
+		log.Printf("Error running /%s: %v", cmd.Name, err)
+		b.reply(update, fmt.Sprintf("Error running /%s. Please contact Pasi and try again later.", cmd.Name))
+	}
+}
+
+// registerCommandMenu pushes the commands to the Telegram command menu
+func (b *Bot) registerCommandMenu() {
+	if _, err := b.Bot.Request(tgbotapi.NewSetMyCommands(b.commands.BotCommands()...)); err != nil {
+		log.Printf("Error setting the command menu: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package tgbot
+
+import (
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"testing"
+)
+
+func noopHandler(b *Bot, update tgbotapi.Update, args any) error {
+	return nil
+}
+
+func Test_CommandRegistry_Register(t *testing.T) {
+	testCases := map[string]struct {
+		cmd     Command
+		wantErr bool
+	}{
+		"valid":               {cmd: Command{Name: "test_2", Description: "Test", Handler: noopHandler}},
+		"uppercase name":      {cmd: Command{Name: "Test", Description: "Test", Handler: noopHandler}, wantErr: true},
+		"slash in name":       {cmd: Command{Name: "/test", Description: "Test", Handler: noopHandler}, wantErr: true},
+		"missing description": {cmd: Command{Name: "test", Handler: noopHandler}, wantErr: true},
+		"missing handler":     {cmd: Command{Name: "test", Description: "Test"}, wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			err := NewCommandRegistry().Register(tc.cmd)
+			assert.Equal(t, tc.wantErr, err != nil, "Register() error = %v", err)
+		})
+	}
+}
+
+func Test_CommandRegistry_ShouldRejectDuplicates(t *testing.T) {
+	t.Parallel()
+	r := NewCommandRegistry()
+
+	assert.Nil(t, r.Register(Command{Name: "test", Description: "Test", Handler: noopHandler}))
+	assert.NotNil(t, r.Register(Command{Name: "test", Description: "Other", Handler: noopHandler}))
+}
+
+func Test_CommandRegistry_HelpShouldListCommandsInOrder(t *testing.T) {
+	t.Parallel()
+	r := NewCommandRegistry()
+	assert.Nil(t, r.Register(Command{Name: "second", Description: "Second command", Usage: "[n]", Handler: noopHandler}))
+	assert.Nil(t, r.Register(Command{Name: "first", Description: "First command", Handler: noopHandler}))
+
+	assert.Equal(t, "Commands:\n/second [n] - Second command\n/first - First command\n", r.Help())
+	assert.Equal(t, []tgbotapi.BotCommand{
+		{Command: "second", Description: "Second command"},
+		{Command: "first", Description: "First command"},
+	}, r.BotCommands())
+}
+
+func newTestCommandBot(t *testing.T, commands ...Command) (*Bot, *MockBotAPI) {
+	t.Helper()
+	registry, err := newDefaultCommands()
+	assert.Nil(t, err)
+	for _, cmd := range commands {
+		assert.Nil(t, registry.Register(cmd))
+	}
+	mockBotAPI := new(MockBotAPI)
+	return &Bot{Bot: mockBotAPI, commands: registry}, mockBotAPI
+}
+
+func Test_Bot_HandleCommand_ShouldRunHandlerWithParsedArgs(t *testing.T) {
+	t.Parallel()
+	var got any
+	b, _ := newTestCommandBot(t, Command{
+		Name:        "echo",
+		Description: "Echo",
+		ParseArgs: func(args string) (any, error) {
+			return strings.ToUpper(args), nil
+		},
+		Handler: func(b *Bot, update tgbotapi.Update, args any) error {
+			got = args
+			return nil
+		},
+	})
+
+	b.handleCommand(generateTestCommand("/echo hello"))
+
+	assert.Equal(t, "HELLO", got)
+}
+
+func Test_Bot_HandleCommand_ShouldReplyWithUsageOnInvalidArgs(t *testing.T) {
+	t.Parallel()
+	b, mockBotAPI := newTestCommandBot(t)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "Usage: /history [days]")
+	})).Return(tgbotapi.Message{}, nil)
+
+	b.handleCommand(generateTestCommand("/history forever"))
+
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_HandleCommand_ShouldReplyToUnknownCommands(t *testing.T) {
+	t.Parallel()
+	b, mockBotAPI := newTestCommandBot(t)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Unknown command /nope")
+	})).Return(tgbotapi.Message{}, nil)
+
+	b.handleCommand(generateTestCommand("/nope"))
+
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_HandleCommand_HelpShouldBeGeneratedFromRegistry(t *testing.T) {
+	t.Parallel()
+	b, mockBotAPI := newTestCommandBot(t, Command{Name: "extra", Description: "Extra command", Handler: noopHandler})
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "/history [days] - ") && strings.Contains(msg.Text, "/extra - Extra command")
+	})).Return(tgbotapi.Message{}, nil)
+
+	b.handleCommand(generateTestCommand("/help"))
+
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_HandleCommand_ShouldReportHandlerErrors(t *testing.T) {
+	t.Parallel()
+	b, mockBotAPI := newTestCommandBot(t, Command{
+		Name:        "fail",
+		Description: "Fails",
+		Handler: func(b *Bot, update tgbotapi.Update, args any) error {
+			return errors.New("failed")
+		},
+	})
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "Error running /fail")
+	})).Return(tgbotapi.Message{}, nil)
+
+	b.handleCommand(generateTestCommand("/fail"))
+
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_RegisterCommandMenu_ShouldSetMyCommands(t *testing.T) {
+	t.Parallel()
+	b, mockBotAPI := newTestCommandBot(t)
+	mockBotAPI.On("Request", mock.MatchedBy(func(c tgbotapi.SetMyCommandsConfig) bool {
+		return len(c.Commands) == len(b.commands.Commands())
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.registerCommandMenu()
+
+	mockBotAPI.AssertExpectations(t)
+}
@@ -3,6 +3,33 @@ package tgbot
 import (
 	"fmt"
 	"reflect"
+	"strings"
+	"t-pain/pkg/openai"
+	"time"
+)
+
+const (
+	defaultDraftTimeout         = 30 * time.Minute
+	defaultClarificationTimeout = 10 * time.Minute
+	defaultSpeechTimeout        = 2 * time.Minute
+	defaultOpenAITimeout        = 2 * time.Minute
+	defaultStoreTimeout         = 30 * time.Second
+	defaultShutdownGracePeriod  = 30 * time.Second
+	defaultTimezone             = "Europe/Helsinki"
+)
+
+// Providers of the language model. Azure OpenAI is the default, the public OpenAI API and OpenAI-compatible servers
+// such as llama.cpp or Ollama allow developing without Azure
+const (
+	ProviderAzure      = openai.ProviderAzure
+	ProviderOpenAI     = openai.ProviderOpenAI
+	ProviderCompatible = openai.ProviderCompatible
+)
+
+// Storage backends for the pain descriptions
+const (
+	StorageLogAnalytics = "loganalytics"
+	StorageSQLite       = "sqlite"
 )
 
 type Config struct {
@@ -15,10 +42,47 @@ type Config struct {
 	dataCollectionEndpoint   string
 	dataCollectionRuleId     string
 	dataCollectionStreamName string
+	openAiProvider           string
+	storageBackend           string
+	sqlitePath               string
+	logAnalyticsWorkspaceId  string
+	openAiManagedIdentity    bool
+	openAiTokensPerMinute    int
+	openAiMaxRetries         int
+	draftTimeout             time.Duration
+	clarificationTimeout     time.Duration
+	timestampLookback        time.Duration
+	location                 *time.Location
+	openAiPrompt             *openai.Prompt
+	// The shadow client gets the same messages as the primary one, with another deployment or prompt
+	shadowEnabled        bool
+	shadowDeploymentName string
+	shadowPrompt         *openai.Prompt
+	shadowLogPath        string
+	openAiPrices         PriceTable
+	dailyTokenBudget     int
+	admins               []int64
+	metricsAddr          string
+	// The deadlines of the stages of handling a message, including the retries within them
+	speechTimeout time.Duration
+	openAiTimeout time.Duration
+	storeTimeout  time.Duration
+	// Stopping waits for the messages in progress for the grace period and saves the unfinished ones to pendingPath
+	shutdownGracePeriod time.Duration
+	pendingPath         string
+	// processedPath is where the handled updates and saved messages are kept over restarts, so that Telegram
+	// delivering them again does not save the entries twice. Empty keeps them in memory only
+	processedPath string
+	// outboxDir is where the entries are kept until the storage accepts them, empty to not retry failed saves
+	outboxDir string
+	// logAnalyticsGzip compresses the data uploaded to Log Analytics
+	logAnalyticsGzip bool
+	// The saves to Log Analytics within the flush interval are uploaded together, zero to upload each right away
+	logAnalyticsFlushInterval time.Duration
 }
 
 // NewConfig creates a new Config struct that contains all the configurations required for the bot to run
-func NewConfig(botToken, speechKey, speechRegion, openAiKey, openAiEndpoint, openAiDeploymentName, dataCollectionEndpoint, dataCollectionRuleId, dataCollectionStreamName string) (*Config, error) {
+func NewConfig(botToken, speechKey, speechRegion, openAiKey, openAiEndpoint, openAiDeploymentName, dataCollectionEndpoint, dataCollectionRuleId, dataCollectionStreamName string, opts ...ConfigOption) (*Config, error) {
 	c := &Config{
 		botToken:                 botToken,
 		speechKey:                speechKey,
@@ -29,23 +93,392 @@ func NewConfig(botToken, speechKey, speechRegion, openAiKey, openAiEndpoint, ope
 		dataCollectionEndpoint:   dataCollectionEndpoint,
 		dataCollectionRuleId:     dataCollectionRuleId,
 		dataCollectionStreamName: dataCollectionStreamName,
+		openAiProvider:           ProviderAzure,
+		storageBackend:           StorageLogAnalytics,
+		draftTimeout:             defaultDraftTimeout,
+		clarificationTimeout:     defaultClarificationTimeout,
+		timestampLookback:        openai.DefaultTimestampLookback,
+		speechTimeout:            defaultSpeechTimeout,
+		openAiTimeout:            defaultOpenAITimeout,
+		storeTimeout:             defaultStoreTimeout,
+		shutdownGracePeriod:      defaultShutdownGracePeriod,
+		openAiMaxRetries:         openai.DefaultRetryPolicy().MaxRetries,
+	}
+
+	loc, err := time.LoadLocation(defaultTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load default timezone: %w", err)
+	}
+	c.location = loc
+
+	for _, opt := range opts {
+		err := opt(c)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err := checkEmptyFields(c)
+	err = checkEmptyFields(c)
 	if err != nil {
 		return nil, err
 	}
 
+	// A save waits for the flush interval before the upload starts, so leave at least half of the store timeout for it
+	if c.logAnalyticsFlushInterval > c.storeTimeout/2 {
+		return nil, fmt.Errorf("log analytics flush interval %s must be at most half of the store timeout %s", c.logAnalyticsFlushInterval, c.storeTimeout)
+	}
+
 	return c, nil
 }
 
+type ConfigOption func(*Config) error
+
+// WithDraftTimeout sets how long a parsed message waits for the user to confirm it before it is discarded
+func WithDraftTimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("draft timeout must be positive, got %s", timeout)
+		}
+		c.draftTimeout = timeout
+		return nil
+	}
+}
+
+// WithClarificationTimeout sets how long the bot waits for the answer to a clarifying question. Later messages
+// start a new description
+func WithClarificationTimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("clarification timeout must be positive, got %s", timeout)
+		}
+		c.clarificationTimeout = timeout
+		return nil
+	}
+}
+
+// WithTimestampLookback sets how far in the past a time mentioned in a message may be. Older times are
+// replaced with the time the message was sent
+func WithTimestampLookback(lookback time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if lookback <= 0 {
+			return fmt.Errorf("timestamp lookback must be positive, got %s", lookback)
+		}
+		c.timestampLookback = lookback
+		return nil
+	}
+}
+
+// WithSpeechTimeout sets how long downloading and recognizing a voice message may take
+func WithSpeechTimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("speech timeout must be positive, got %s", timeout)
+		}
+		c.speechTimeout = timeout
+		return nil
+	}
+}
+
+// WithOpenAITimeout sets how long interpreting a message with the language model may take, including the retries
+// and the repairs of invalid output
+func WithOpenAITimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("OpenAI timeout must be positive, got %s", timeout)
+		}
+		c.openAiTimeout = timeout
+		return nil
+	}
+}
+
+// WithStoreTimeout sets how long a call to the storage backend, e.g. saving the entries, may take
+func WithStoreTimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("store timeout must be positive, got %s", timeout)
+		}
+		c.storeTimeout = timeout
+		return nil
+	}
+}
+
+// WithShutdownGracePeriod sets how long stopping the bot waits for the messages in progress to finish before
+// aborting them
+func WithShutdownGracePeriod(period time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if period < 0 {
+			return fmt.Errorf("shutdown grace period must not be negative, got %s", period)
+		}
+		c.shutdownGracePeriod = period
+		return nil
+	}
+}
+
+// WithPendingPath saves the messages left unfinished when stopping to the file at path, so that they are handled
+// after a restart instead of being dropped
+func WithPendingPath(path string) ConfigOption {
+	return func(c *Config) error {
+		c.pendingPath = path
+		return nil
+	}
+}
+
+// WithProcessedPath keeps the offset of the handled updates and the saved messages in the file at path, so that
+// the updates Telegram delivers again after a restart are not handled twice
+func WithProcessedPath(path string) ConfigOption {
+	return func(c *Config) error {
+		c.processedPath = path
+		return nil
+	}
+}
+
+// WithOutboxDir keeps the saved entries in the directory until the storage accepts them, retrying the failed
+// saves in the background
+func WithOutboxDir(dir string) ConfigOption {
+	return func(c *Config) error {
+		c.outboxDir = dir
+		return nil
+	}
+}
+
+// WithLogAnalyticsGzip compresses the data uploaded to Log Analytics
+func WithLogAnalyticsGzip() ConfigOption {
+	return func(c *Config) error {
+		c.logAnalyticsGzip = true
+		return nil
+	}
+}
+
+// WithLogAnalyticsFlushInterval gathers the entries saved within the interval into one upload to Log Analytics.
+// Saving waits for the upload, so the interval may be at most half of the store timeout
+func WithLogAnalyticsFlushInterval(interval time.Duration) ConfigOption {
+	return func(c *Config) error {
+		if interval < 0 {
+			return fmt.Errorf("log analytics flush interval must not be negative, got %s", interval)
+		}
+		c.logAnalyticsFlushInterval = interval
+		return nil
+	}
+}
+
+// WithOpenAIManagedIdentity authenticates to Azure OpenAI with the managed identity, or the default Azure credential
+// when running locally, instead of an API key. The OpenAI key is not required then
+func WithOpenAIManagedIdentity() ConfigOption {
+	return func(c *Config) error {
+		c.openAiManagedIdentity = true
+		return nil
+	}
+}
+
+// WithOpenAIProvider selects the provider of the language model. With ProviderOpenAI the deployment name is the
+// model and the endpoint is not required. With ProviderCompatible the endpoint is the base URL of the server,
+// e.g. "http://localhost:11434/v1", and the key is not required
+func WithOpenAIProvider(provider string) ConfigOption {
+	return func(c *Config) error {
+		switch provider {
+		case ProviderAzure, ProviderOpenAI, ProviderCompatible:
+			c.openAiProvider = provider
+			return nil
+		default:
+			return fmt.Errorf("unknown OpenAI provider %q", provider)
+		}
+	}
+}
+
+// WithOpenAITokensPerMinute limits the requests to the tokens per minute quota of the deployment, so that bursts
+// of messages wait in the bot instead of being rejected by the API
+func WithOpenAITokensPerMinute(tpm int) ConfigOption {
+	return func(c *Config) error {
+		if tpm < 0 {
+			return fmt.Errorf("tokens per minute must not be negative, got %d", tpm)
+		}
+		c.openAiTokensPerMinute = tpm
+		return nil
+	}
+}
+
+// WithOpenAIMaxRetries sets how many times failed and rate limited requests to the API are retried
+func WithOpenAIMaxRetries(retries int) ConfigOption {
+	return func(c *Config) error {
+		if retries < 0 {
+			return fmt.Errorf("max retries must not be negative, got %d", retries)
+		}
+		c.openAiMaxRetries = retries
+		return nil
+	}
+}
+
+// WithOpenAIPrompt sets the prompt given to the language model, either the version of an embedded prompt, e.g.
+// "pain-v1", or the path of a prompt manifest ending in .json
+func WithOpenAIPrompt(prompt string) ConfigOption {
+	return func(c *Config) error {
+		p, err := loadPrompt(prompt)
+		if err != nil {
+			return err
+		}
+		c.openAiPrompt = p
+		return nil
+	}
+}
+
+// WithShadowOpenAI sends the messages also to a shadow client with another deployment, or model, and prompt, and
+// records how its results differ from those of the primary client. Empty values are the same as the primary
+// client's. The shadow results are never shown to the user or saved
+func WithShadowOpenAI(deploymentName, prompt string) ConfigOption {
+	return func(c *Config) error {
+		if deploymentName == "" && prompt == "" {
+			return fmt.Errorf("shadow client needs a deployment or a prompt to compare")
+		}
+		c.shadowEnabled = true
+		c.shadowDeploymentName = deploymentName
+		if prompt != "" {
+			p, err := loadPrompt(prompt)
+			if err != nil {
+				return err
+			}
+			c.shadowPrompt = p
+		}
+		return nil
+	}
+}
+
+// WithShadowLog writes the differences found by the shadow client as JSON lines to the file at path instead of
+// the log
+func WithShadowLog(path string) ConfigOption {
+	return func(c *Config) error {
+		c.shadowLogPath = path
+		return nil
+	}
+}
+
+// WithOpenAIPrices sets the prices used for the cost in /usage, e.g. "gpt-4o-mini=0.15/0.6,*=2.5/10". Each price
+// is the deployment or model name and the price of a million prompt and completion tokens. "*" applies to the others
+func WithOpenAIPrices(spec string) ConfigOption {
+	return func(c *Config) error {
+		prices, err := parsePriceTable(spec)
+		if err != nil {
+			return err
+		}
+		c.openAiPrices = prices
+		return nil
+	}
+}
+
+// WithDailyTokenBudget limits the tokens a user may use a day. Messages over the budget are read with the rule
+// based parser instead of the language model
+func WithDailyTokenBudget(tokens int) ConfigOption {
+	return func(c *Config) error {
+		if tokens < 0 {
+			return fmt.Errorf("daily token budget must not be negative, got %d", tokens)
+		}
+		c.dailyTokenBudget = tokens
+		return nil
+	}
+}
+
+// WithAdmins sets the users who see the usage of everyone with /usage
+func WithAdmins(userIDs ...int64) ConfigOption {
+	return func(c *Config) error {
+		c.admins = append(c.admins, userIDs...)
+		return nil
+	}
+}
+
+// WithMetricsAddr serves the metrics, including the language model usage, at /debug/vars of the address, e.g. ":9090"
+func WithMetricsAddr(addr string) ConfigOption {
+	return func(c *Config) error {
+		c.metricsAddr = addr
+		return nil
+	}
+}
+
+// loadPrompt loads an embedded prompt by its version, or a prompt manifest if the name ends in .json
+func loadPrompt(name string) (*openai.Prompt, error) {
+	load := openai.LoadPrompt
+	if strings.HasSuffix(name, ".json") {
+		load = openai.LoadPromptFile
+	}
+	p, err := load(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load prompt %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// WithSQLiteStorage stores the pain descriptions in a local SQLite database at path instead of Log Analytics.
+// The data collection settings are not required then
+func WithSQLiteStorage(path string) ConfigOption {
+	return func(c *Config) error {
+		c.storageBackend = StorageSQLite
+		c.sqlitePath = path
+		return nil
+	}
+}
+
+// WithLogAnalyticsWorkspace enables reading the entries back from the Log Analytics workspace with the given ID,
+// which the /history command needs
+func WithLogAnalyticsWorkspace(workspaceId string) ConfigOption {
+	return func(c *Config) error {
+		c.logAnalyticsWorkspaceId = workspaceId
+		return nil
+	}
+}
+
+// WithTimezone sets the IANA timezone, e.g. "Europe/Helsinki", used when showing times to the users
+func WithTimezone(name string) ConfigOption {
+	return func(c *Config) error {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return fmt.Errorf("unable to load timezone %q: %w", name, err)
+		}
+		c.location = loc
+		return nil
+	}
+}
+
+// shadowDeployment returns the deployment, or model, of the shadow client, which defaults to the primary one
+func (c *Config) shadowDeployment() string {
+	if c.shadowDeploymentName == "" {
+		return c.openAiDeploymentName
+	}
+	return c.shadowDeploymentName
+}
+
+// optionalFields returns the names of the string fields that may be empty with the chosen backends
+func (c *Config) optionalFields() map[string]bool {
+	optional := map[string]bool{
+		"logAnalyticsWorkspaceId": true,
+		"shadowDeploymentName":    true,
+		"shadowLogPath":           true,
+		"metricsAddr":             true,
+		"pendingPath":             true,
+		"processedPath":           true,
+		"outboxDir":               true,
+		"openAiKey":               c.openAiManagedIdentity || c.openAiProvider == ProviderCompatible,
+		"openAiEndpoint":          c.openAiProvider == ProviderOpenAI,
+	}
+	switch c.storageBackend {
+	case StorageSQLite:
+		optional["dataCollectionEndpoint"] = true
+		optional["dataCollectionRuleId"] = true
+		optional["dataCollectionStreamName"] = true
+	default:
+		optional["sqlitePath"] = true
+	}
+	return optional
+}
+
 func checkEmptyFields(c *Config) error {
 	var emptyValues string
 
-	// This won't work if the struct has a field that is not a string, but good enough for now
+	// Only string fields are required, the rest have defaults set in NewConfig
 
+	optional := c.optionalFields()
 	v := reflect.ValueOf(*c)
 	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() != reflect.String || optional[v.Type().Field(i).Name] {
+			continue
+		}
 		if v.Field(i).String() == "" {
 			if emptyValues != "" && i != 0 {
 				emptyValues += ", "
@@ -59,4 +492,4 @@ func checkEmptyFields(c *Config) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
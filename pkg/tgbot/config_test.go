@@ -4,6 +4,7 @@ import (
 	"strings"
 	"t-pain/pkg/tgbot"
 	"testing"
+	"time"
 )
 
 func TestNewConfigShouldFailWithEmptyValues(t *testing.T) {
@@ -45,4 +46,202 @@ func TestNewConfigShouldFailWithEmptyValues(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestNewConfigShouldRejectInvalidDraftTimeout(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithDraftTimeout(0))
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestNewConfigShouldRejectInvalidClarificationTimeout(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithClarificationTimeout(0))
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestNewConfigShouldRejectInvalidTimestampLookback(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithTimestampLookback(-time.Hour))
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestNewConfigWithSQLiteShouldNotRequireDataCollectionFields(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "", "", "", tgbot.WithSQLiteStorage("pain.db"))
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "", "", "", tgbot.WithSQLiteStorage(""))
+	if err == nil || !strings.Contains(err.Error(), "sqlitePath") {
+		t.Errorf("expected error about sqlitePath, got %v", err)
+	}
+}
+
+func TestNewConfigWithManagedIdentityShouldNotRequireOpenAIKey(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "", "x", "x", "x", "x", "x", tgbot.WithOpenAIManagedIdentity())
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "", "x", "x", "x", "x", "x")
+	if err == nil || !strings.Contains(err.Error(), "openAiKey") {
+		t.Errorf("expected error about openAiKey, got %v", err)
+	}
+}
+
+func TestNewConfigShouldRejectUnknownTimezone(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithTimezone("Not/AZone"))
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestNewConfigShouldRejectNegativeOpenAILimits(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithOpenAITokensPerMinute(-1))
+	if err == nil {
+		t.Errorf("expected error for negative tokens per minute, got nil")
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithOpenAIMaxRetries(-1))
+	if err == nil {
+		t.Errorf("expected error for negative max retries, got nil")
+	}
+}
+
+func TestNewConfigShouldRequireFieldsOfOpenAIProvider(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "", "gpt-4o-mini", "x", "x", "x", tgbot.WithOpenAIProvider(tgbot.ProviderOpenAI))
+	if err != nil {
+		t.Errorf("expected no error without an endpoint for OpenAI, got %v", err)
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "", "http://localhost:11434/v1", "llama3", "x", "x", "x", tgbot.WithOpenAIProvider(tgbot.ProviderCompatible))
+	if err != nil {
+		t.Errorf("expected no error without a key for a compatible server, got %v", err)
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "", "", "gpt-4o-mini", "x", "x", "x", tgbot.WithOpenAIProvider(tgbot.ProviderOpenAI))
+	if err == nil {
+		t.Errorf("expected error without a key for OpenAI, got nil")
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithOpenAIProvider("anthropic"))
+	if err == nil {
+		t.Errorf("expected error for an unknown provider, got nil")
+	}
+}
+
+func TestNewConfigShouldLoadOpenAIPrompt(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithOpenAIPrompt("pain-v1"))
+	if err != nil {
+		t.Errorf("expected no error for the embedded prompt, got %v", err)
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithOpenAIPrompt("pain-v0"))
+	if err == nil {
+		t.Errorf("expected error for an unknown prompt version, got nil")
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithOpenAIPrompt("missing.json"))
+	if err == nil {
+		t.Errorf("expected error for a missing prompt file, got nil")
+	}
+}
+
+func TestNewConfigShouldRequireSomethingToShadow(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithShadowOpenAI("gpt-4o", ""))
+	if err != nil {
+		t.Errorf("expected no error with a shadow deployment, got %v", err)
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithShadowOpenAI("", ""))
+	if err == nil {
+		t.Errorf("expected error without a shadow deployment or prompt, got nil")
+	}
+}
+
+func TestNewConfigShouldRejectNonPositiveStageTimeouts(t *testing.T) {
+	t.Parallel()
+
+	for name, opt := range map[string]tgbot.ConfigOption{
+		"speech": tgbot.WithSpeechTimeout(0),
+		"openai": tgbot.WithOpenAITimeout(-time.Second),
+		"store":  tgbot.WithStoreTimeout(0),
+	} {
+		_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", opt)
+		if err == nil {
+			t.Errorf("expected error for a non-positive %s timeout, got nil", name)
+		}
+	}
+}
+
+func TestNewConfigShouldRejectNegativeFlushInterval(t *testing.T) {
+	t.Parallel()
+
+	_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithLogAnalyticsFlushInterval(-time.Second))
+	if err == nil {
+		t.Errorf("expected error for a negative flush interval, got nil")
+	}
+
+	_, err = tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tgbot.WithLogAnalyticsGzip(), tgbot.WithLogAnalyticsFlushInterval(0))
+	if err != nil {
+		t.Errorf("expected no error without a flush interval, got %v", err)
+	}
+}
+
+func TestNewConfigShouldRejectFlushIntervalTooCloseToStoreTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		opts    []tgbot.ConfigOption
+		wantErr bool
+	}{
+		"at the default store timeout": {
+			opts:    []tgbot.ConfigOption{tgbot.WithLogAnalyticsFlushInterval(30 * time.Second)},
+			wantErr: true,
+		},
+		"above half of the store timeout": {
+			opts:    []tgbot.ConfigOption{tgbot.WithLogAnalyticsFlushInterval(6 * time.Second), tgbot.WithStoreTimeout(10 * time.Second)},
+			wantErr: true,
+		},
+		"store timeout given after the interval": {
+			opts:    []tgbot.ConfigOption{tgbot.WithLogAnalyticsFlushInterval(5 * time.Second), tgbot.WithStoreTimeout(8 * time.Second)},
+			wantErr: true,
+		},
+		"half of the store timeout": {
+			opts: []tgbot.ConfigOption{tgbot.WithLogAnalyticsFlushInterval(5 * time.Second), tgbot.WithStoreTimeout(10 * time.Second)},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := tgbot.NewConfig("x", "x", "x", "x", "x", "x", "x", "x", "x", tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
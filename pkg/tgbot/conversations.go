@@ -0,0 +1,73 @@
+package tgbot
+
+import (
+	"sync"
+	"t-pain/pkg/openai"
+	"time"
+)
+
+// pendingConversation is an exchange with the model waiting for the user to answer a clarifying question
+type pendingConversation struct {
+	conversation *openai.Conversation
+	expiresAt    time.Time
+}
+
+// conversationStore holds the pending conversations by chat. Like the drafts, they are shared between the
+// message goroutines, so all access goes through the mutex
+type conversationStore struct {
+	mu            sync.Mutex
+	conversations map[int64]*pendingConversation
+	ttl           time.Duration
+}
+
+func newConversationStore(ttl time.Duration) *conversationStore {
+	return &conversationStore{
+		conversations: make(map[int64]*pendingConversation),
+		ttl:           ttl,
+	}
+}
+
+// get returns the pending conversation of the chat, or nil if there is none or it has expired
+func (cs *conversationStore) get(chatID int64) *openai.Conversation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	pc, ok := cs.conversations[chatID]
+	if !ok || time.Now().After(pc.expiresAt) {
+		return nil
+	}
+	return pc.conversation
+}
+
+// set stores the conversation of the chat, replacing any earlier one
+func (cs *conversationStore) set(chatID int64, conversation *openai.Conversation) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.conversations[chatID] = &pendingConversation{
+		conversation: conversation,
+		expiresAt:    time.Now().Add(cs.ttl),
+	}
+}
+
+// remove ends the conversation of the chat. Returns false if there was no pending conversation
+func (cs *conversationStore) remove(chatID int64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	pc, ok := cs.conversations[chatID]
+	delete(cs.conversations, chatID)
+	return ok && !time.Now().After(pc.expiresAt)
+}
+
+// removeExpired removes the conversations that have expired by now
+func (cs *conversationStore) removeExpired(now time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for chatID, pc := range cs.conversations {
+		if now.After(pc.expiresAt) {
+			delete(cs.conversations, chatID)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package tgbot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+func Test_ConversationStore_ShouldExpire(t *testing.T) {
+	t.Parallel()
+	cs := newConversationStore(time.Minute)
+	conversation := openai.NewConversation(openai.NewUserMessage("it hurts again"))
+	cs.set(1234, conversation)
+
+	assert.Same(t, conversation, cs.get(1234))
+	assert.Nil(t, cs.get(4321))
+
+	cs.removeExpired(time.Now().Add(2 * time.Minute))
+	assert.Nil(t, cs.get(1234))
+	assert.False(t, cs.remove(1234))
+}
+
+func Test_Bot_ProcessMessage_ShouldContinueConversationAfterClarification(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+	}
+
+	conversation := openai.NewConversation(openai.NewUserMessage("it hurts again"))
+	mockAI.On("GetPainDescriptionObject", "it hurts again", mock.Anything, (*openai.Conversation)(nil)).
+		Return(openai.Result{Kind: openai.ResultClarification, Text: "Where does it hurt?", Conversation: conversation}, nil)
+	mockAI.On("GetPainDescriptionObject", "lower back", mock.Anything, conversation).
+		Return(openai.Result{PainDescriptions: generateTestPainDescriptions()}, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "Where does it hurt?") && strings.Contains(msg.Text, "/cancel")
+	})).Return(tgbotapi.Message{}, nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.ReplyMarkup != nil
+	})).Return(tgbotapi.Message{MessageID: 42}, nil).Once()
+
+	update := generateTestUpdate()
+	update.Message.Text = "it hurts again"
+	b.processMessage(update)
+	assert.Same(t, conversation, b.conversations.get(update.Message.Chat.ID))
+
+	update.Message.Text = "lower back"
+	b.processMessage(update)
+
+	mockAI.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+	assert.Nil(t, b.conversations.get(update.Message.Chat.ID))
+}
+
+func Test_Bot_HandleCommand_CancelShouldEndConversation(t *testing.T) {
+	t.Parallel()
+	b, mockBotAPI := newTestCommandBot(t)
+	b.conversations = newConversationStore(time.Minute)
+	update := generateTestCommand("/cancel")
+	b.conversations.set(update.Message.Chat.ID, openai.NewConversation(openai.NewUserMessage("it hurts again")))
+
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "Cancelled")
+	})).Return(tgbotapi.Message{}, nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.Text == "There is nothing to cancel."
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	b.handleCommand(update)
+	b.handleCommand(update)
+
+	mockBotAPI.AssertExpectations(t)
+	assert.Nil(t, b.conversations.get(update.Message.Chat.ID))
+}
@@ -0,0 +1,357 @@
+package tgbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// correctionLookbackDays is how far back /undo and /correct look for the last saved entries
+const correctionLookbackDays = 7
+
+// lastSaves remembers the entries each user saved or corrected last, and the batches they removed, as the store
+// may not list them right after saving, e.g. Log Analytics ingests the records with a delay of minutes. With a path
+// it is written to the file on every change, so that it also holds right after a restart. The update goroutines
+// share it, so all access goes through the mutex
+type lastSaves struct {
+	mu   sync.Mutex
+	path string
+	// last are the latest versions of the last saved or corrected entries by Telegram user ID
+	last map[int64][]models.PainDescriptionLogEntry
+	// retracted are the BatchIDs of the removed entries and when they were removed
+	retracted map[string]time.Time
+}
+
+// lastSavesFile is the format of the file of lastSaves
+type lastSavesFile struct {
+	Last      map[int64][]models.PainDescriptionLogEntry `json:"last"`
+	Retracted map[string]time.Time                       `json:"retracted"`
+}
+
+// newLastSaves reads the last saves left by the last run from the file at path, if there is one. An empty path
+// keeps them in memory only
+func newLastSaves(path string) (*lastSaves, error) {
+	ls := &lastSaves{
+		path:      path,
+		last:      make(map[int64][]models.PainDescriptionLogEntry),
+		retracted: make(map[string]time.Time),
+	}
+	if path == "" {
+		return ls, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ls, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read last saves file: %w", err)
+	}
+	var f lastSavesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse last saves file: %w", err)
+	}
+	for userID, entries := range f.Last {
+		ls.last[userID] = entries
+	}
+	for batchID, retractedAt := range f.Retracted {
+		ls.retracted[batchID] = retractedAt
+	}
+	return ls, nil
+}
+
+// lastSavesPath returns the path of the file of lastSaves next to the processed updates file, empty if that is
+// not kept either
+func lastSavesPath(processedPath string) string {
+	if processedPath == "" {
+		return ""
+	}
+	return strings.TrimSuffix(processedPath, filepath.Ext(processedPath)) + ".last.json"
+}
+
+// record remembers the records of a save, a correction or a removal of the entries of one message by the user.
+// The removals older than the correction lookback are forgotten, as they are not looked up anymore
+func (ls *lastSaves) record(userID int64, records []models.PainDescriptionLogEntry, now time.Time) {
+	if len(records) == 0 {
+		return
+	}
+	first := records[0]
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if first.Retracted {
+		ls.retracted[first.BatchID] = now
+		if last := ls.last[userID]; len(last) > 0 && last[0].BatchID == first.BatchID {
+			delete(ls.last, userID)
+		}
+	} else {
+		ls.last[userID] = append([]models.PainDescriptionLogEntry(nil), records...)
+	}
+	for batchID, retractedAt := range ls.retracted {
+		if now.Sub(retractedAt) > correctionLookbackDays*24*time.Hour {
+			delete(ls.retracted, batchID)
+		}
+	}
+	if err := ls.write(); err != nil {
+		log.Printf("Error saving the last saves: %v", err)
+	}
+}
+
+// get returns the entries the user saved or corrected last, nil if there are none
+func (ls *lastSaves) get(userID int64) []models.PainDescriptionLogEntry {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return append([]models.PainDescriptionLogEntry(nil), ls.last[userID]...)
+}
+
+// isRetracted tells whether the entries of the batch were removed, even if the store does not list the removal yet
+func (ls *lastSaves) isRetracted(batchID string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	_, ok := ls.retracted[batchID]
+	return ok
+}
+
+// write replaces the file with the current state. A crash while writing leaves the old file in place. Must be
+// called with the mutex held
+func (ls *lastSaves) write() error {
+	if ls.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(lastSavesFile{Last: ls.last, Retracted: ls.retracted})
+	if err != nil {
+		return fmt.Errorf("unable to marshal last saves: %w", err)
+	}
+	tmp := ls.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write last saves file: %w", err)
+	}
+	if err := os.Rename(tmp, ls.path); err != nil {
+		return fmt.Errorf("unable to replace last saves file: %w", err)
+	}
+	return nil
+}
+
+// lastSaved returns the latest versions of the entries of the message the user saved or corrected last. Entries
+// saved before they had an EntryID cannot be referenced, so they are skipped
+func (b *Bot) lastSaved(update tgbotapi.Update) ([]models.PainDescriptionLogEntry, error) {
+	userName := models.UserIDs[update.Message.From.ID]
+	now := time.Now()
+	lookback := now.AddDate(0, 0, -correctionLookbackDays)
+	if b.lastSaves != nil {
+		if last := b.lastSaves.get(update.Message.From.ID); len(last) > 0 && !last[0].RecordedAt.Before(lookback) {
+			return last, nil
+		}
+	}
+
+	ctx, cancel := b.stageContext(b.timeouts.store)
+	defer cancel()
+	stored, err := b.store.List(ctx, userName, lookback, now)
+	if err != nil {
+		return nil, fmt.Errorf("lastSaved: %w", err)
+	}
+
+	entries := database.LatestVersions(stored)
+	var last *database.StoredEntry
+	for i := range entries {
+		if entries[i].EntryID == "" || (b.lastSaves != nil && b.lastSaves.isRetracted(entries[i].BatchID)) {
+			continue
+		}
+		if last == nil || savedAfter(entries[i], *last) {
+			last = &entries[i]
+		}
+	}
+	if last == nil {
+		return nil, nil
+	}
+
+	var batch []models.PainDescriptionLogEntry
+	for _, e := range entries {
+		if e.EntryID != "" && e.BatchID == last.BatchID {
+			batch = append(batch, e.PainDescriptionLogEntry)
+		}
+	}
+	return batch, nil
+}
+
+// savedAfter tells whether entry a was saved or corrected after entry b. The entries saved before RecordedAt was
+// added have none, so they are ordered by the time of the pain and then by the id of the store
+func savedAfter(a, b database.StoredEntry) bool {
+	if !a.RecordedAt.Equal(b.RecordedAt) {
+		return a.RecordedAt.After(b.RecordedAt)
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return a.ID > b.ID
+}
+
+// undoKeyboard returns the buttons shown under the confirmation of /undo
+func undoKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Remove", callbackUndo),
+			tgbotapi.NewInlineKeyboardButtonData("Keep", callbackKeep),
+		),
+	)
+}
+
+// undoLast sends the entries of the message the user saved or corrected last for confirming their removal
+func (b *Bot) undoLast(update tgbotapi.Update) error {
+	entries, err := b.lastSaved(update)
+	if errors.Is(err, database.ErrNotSupported) {
+		b.reply(update, "Undo is not available with the current storage.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("undoLast: %w", err)
+	}
+	if len(entries) == 0 {
+		b.reply(update, fmt.Sprintf("There is nothing to undo from the last %d days.", correctionLookbackDays))
+		return nil
+	}
+
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Remove your last entry?\n"+fmtReply(painsOf(entries), b.location))
+	msg.ReplyMarkup = undoKeyboard()
+	sent, err := b.Bot.Send(msg)
+	if err != nil {
+		return fmt.Errorf("undoLast: %w", err)
+	}
+
+	key := draftKey{chatID: update.Message.Chat.ID, messageID: sent.MessageID}
+	b.drafts.addRetraction(key, update.Message.From.ID, entries)
+	return nil
+}
+
+// finishUndo removes or keeps the entries of an /undo confirmation. Returns an error if removing was aborted by
+// stopping the bot
+func (b *Bot) finishUndo(query *tgbotapi.CallbackQuery, key draftKey) error {
+	d, ok := b.drafts.take(key)
+	if !ok {
+		b.answerCallback(query.ID, "This entry is no longer pending")
+		return nil
+	}
+	if d.userID != query.From.ID {
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Only the sender can confirm this removal")
+		return nil
+	}
+	if len(d.retracts) == 0 {
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Unknown action")
+		return nil
+	}
+
+	if query.Data == callbackKeep {
+		b.answerCallback(query.ID, "Kept")
+		b.editMessage(key, "Kept, nothing was removed.", nil)
+		return nil
+	}
+
+	err := b.retract(d.userID, d.retracts)
+	if errors.Is(err, database.ErrQueued) {
+		log.Printf("Error saving retraction, queued for retry: %v", err)
+		b.answerCallback(query.ID, "Queued")
+		b.editMessage(key, "Queued, the storage is not available right now. The entry is removed automatically "+
+			"once it is:\n"+fmtReply(d.painDesc, b.location), nil)
+		return nil
+	}
+	if errors.Is(err, context.Canceled) {
+		b.answerCallback(query.ID, "Not removed")
+		b.editMessage(key, "The bot is restarting and nothing was removed. Please try again in a minute.", nil)
+		return fmt.Errorf("finishUndo: %w", err)
+	}
+	if err != nil {
+		log.Printf("Error saving retraction: %v", err)
+		b.drafts.restore(key, d)
+		b.answerCallback(query.ID, "Error removing the entry. Please contact Pasi and try again later.")
+		return nil
+	}
+	b.answerCallback(query.ID, "Removed")
+	b.editMessage(key, "Removed your last entry:\n"+fmtReply(d.painDesc, b.location), nil)
+	return nil
+}
+
+// retract saves tombstones removing the entries of the user
+func (b *Bot) retract(userID int64, entries []models.PainDescriptionLogEntry) error {
+	tombstones := make([]models.PainDescriptionLogEntry, 0, len(entries))
+	for _, e := range entries {
+		tombstone, err := e.Retract()
+		if err != nil {
+			return fmt.Errorf("retract: %w", err)
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	if err := b.appendEntries(userID, tombstones); err != nil {
+		return fmt.Errorf("retract: %w", err)
+	}
+	return nil
+}
+
+// startCorrection sends the entries of the message the user saved or corrected last as a draft, which is edited
+// with the buttons like a new one. Saving it records the corrections
+func (b *Bot) startCorrection(update tgbotapi.Update) error {
+	entries, err := b.lastSaved(update)
+	if errors.Is(err, database.ErrNotSupported) {
+		b.reply(update, "Correcting is not available with the current storage.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("startCorrection: %w", err)
+	}
+	if len(entries) == 0 {
+		b.reply(update, fmt.Sprintf("There is nothing to correct from the last %d days.", correctionLookbackDays))
+		return nil
+	}
+
+	pd := painsOf(entries)
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Correcting your last entry, edit it and save.\n"+fmtDraft(pd, b.location))
+	msg.ReplyMarkup = draftKeyboard()
+	sent, err := b.Bot.Send(msg)
+	if err != nil {
+		return fmt.Errorf("startCorrection: %w", err)
+	}
+
+	key := draftKey{chatID: update.Message.Chat.ID, messageID: sent.MessageID}
+	b.drafts.addCorrection(key, update.Message.From.ID, entries)
+	return nil
+}
+
+// saveCorrections saves the edited pains as new versions of the original entries of the user
+func (b *Bot) saveCorrections(userID int64, originals []models.PainDescriptionLogEntry, pd []models.PainDescription) error {
+	if len(originals) != len(pd) {
+		return fmt.Errorf("saveCorrections: %d pains for %d entries", len(pd), len(originals))
+	}
+	corrections := make([]models.PainDescriptionLogEntry, 0, len(originals))
+	for i, original := range originals {
+		correction, err := original.Correct(pd[i])
+		if err != nil {
+			return fmt.Errorf("saveCorrections: %w", err)
+		}
+		corrections = append(corrections, correction)
+	}
+	if err := b.appendEntries(userID, corrections); err != nil {
+		return fmt.Errorf("saveCorrections: %w", err)
+	}
+	return nil
+}
+
+// painsOf returns the pain descriptions of the entries
+func painsOf(entries []models.PainDescriptionLogEntry) []models.PainDescription {
+	pd := make([]models.PainDescription, 0, len(entries))
+	for _, e := range entries {
+		pd = append(pd, e.PainDescription)
+	}
+	return pd
+}
@@ -0,0 +1,298 @@
+package tgbot
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"path/filepath"
+	"strings"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"testing"
+	"time"
+)
+
+// generateTestSavedEntries returns the entries of a saved message, recorded at the given time
+func generateTestSavedEntries(t *testing.T, recordedAt time.Time, levels ...int) []database.StoredEntry {
+	t.Helper()
+	var pains []models.PainDescription
+	for _, level := range levels {
+		pains = append(pains, models.PainDescription{Timestamp: recordedAt, LocationId: 9, SideId: 1, Level: level})
+	}
+	entries, err := models.MapToLogEntries(1111111111111111111, pains, generateTestEntryMetadata())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	stored := make([]database.StoredEntry, 0, len(entries))
+	for _, e := range entries {
+		e.RecordedAt = recordedAt
+		stored = append(stored, database.StoredEntry{PainDescriptionLogEntry: e})
+	}
+	return stored
+}
+
+func Test_Bot_UndoShouldRetractTheLastSavedMessageOnceConfirmed(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, drafts: newDraftStore(time.Minute), location: time.UTC}
+
+	now := time.Now()
+	older := generateTestSavedEntries(t, now.Add(-2*time.Hour), 3)
+	last := generateTestSavedEntries(t, now.Add(-time.Hour), 5, 6)
+	legacy := database.StoredEntry{PainDescriptionLogEntry: models.PainDescriptionLogEntry{PainDescription: models.PainDescription{
+		Timestamp: now, LocationId: 9, SideId: 1, Level: 7}}}
+	stored := append(append(older, last...), legacy)
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(stored, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "Remove your last entry?") && strings.Contains(msg.Text, "Level: 6") &&
+			msg.ReplyMarkup != nil
+	})).Return(tgbotapi.Message{MessageID: 77}, nil).Once()
+	mockStore.On("Append", mock.MatchedBy(func(data []models.PainDescriptionLogEntry) bool {
+		return len(data) == 2 && data[0].Retracted && data[1].Retracted &&
+			data[0].Supersedes == last[0].EntryID && data[1].Supersedes == last[1].EntryID
+	})).Return(nil).Once()
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 77 && strings.HasPrefix(edit.Text, "Removed your last entry")
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	err := b.undoLast(generateTestCommand("/undo"))
+	assert.Nil(t, err)
+	mockStore.AssertNotCalled(t, "Append", mock.Anything)
+	assert.Nil(t, b.processCallback(generateTestCallback(callbackUndo, 77)))
+
+	mockStore.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_UndoShouldKeepTheEntriesWhenNotConfirmed(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, drafts: newDraftStore(time.Minute), location: time.UTC}
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(generateTestSavedEntries(t, time.Now().Add(-time.Hour), 5), nil)
+	mockBotAPI.On("Send", mock.Anything).Return(tgbotapi.Message{MessageID: 77}, nil).Once()
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 77 && edit.Text == "Kept, nothing was removed."
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	assert.Nil(t, b.undoLast(generateTestCommand("/undo")))
+	assert.Nil(t, b.processCallback(generateTestCallback(callbackKeep, 77)))
+
+	mockStore.AssertNotCalled(t, "Append", mock.Anything)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_UndoShouldOrderEntriesWithoutRecordedAtByTimestamp(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, drafts: newDraftStore(time.Minute), location: time.UTC}
+
+	// Entries of schema version 2 were saved without RecordedAt
+	now := time.Now()
+	stored := append(generateTestSavedEntries(t, now.Add(-2*time.Hour), 3), generateTestSavedEntries(t, now.Add(-time.Hour), 5)...)
+	for i := range stored {
+		stored[i].RecordedAt = time.Time{}
+	}
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(stored, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Level: 5") && !strings.Contains(msg.Text, "Level: 3")
+	})).Return(tgbotapi.Message{MessageID: 77}, nil).Once()
+
+	assert.Nil(t, b.undoLast(generateTestCommand("/undo")))
+	mockBotAPI.AssertExpectations(t)
+}
+
+// newLastSavesTestBot returns a bot that remembers the last saves in the file at path
+func newLastSavesTestBot(t *testing.T, botAPI BotAPI, store database.Store, path string) *Bot {
+	t.Helper()
+	ls, err := newLastSaves(path)
+	if err != nil {
+		t.Fatalf("error creating last saves, got %v", err)
+	}
+	return &Bot{Bot: botAPI, store: store, drafts: newDraftStore(time.Minute), lastSaves: ls, location: time.UTC}
+}
+
+func Test_Bot_UndoShouldUseTheLastSaveBeforeTheStoreListsIt(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := newLastSavesTestBot(t, mockBotAPI, mockStore, "")
+	b.drafts.add(draftKey{chatID: 1234, messageID: 42}, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+	// The store does not list the entries saved just now, nor the removal queued for later
+	older := generateTestSavedEntries(t, time.Now().Add(-time.Hour), 3)
+	var saved []models.PainDescriptionLogEntry
+
+	mockStore.On("Append", mock.MatchedBy(func(data []models.PainDescriptionLogEntry) bool {
+		return !data[0].Retracted
+	})).Run(func(args mock.Arguments) {
+		saved = args.Get(0).([]models.PainDescriptionLogEntry)
+	}).Return(nil).Once()
+	mockStore.On("Append", mock.MatchedBy(func(data []models.PainDescriptionLogEntry) bool {
+		return data[0].Retracted && data[0].Supersedes == saved[0].EntryID
+	})).Return(fmt.Errorf("upload failed: %w", database.ErrQueued)).Once()
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(older, nil)
+	mockBotAPI.On("Send", mock.Anything).Return(tgbotapi.Message{MessageID: 77}, nil).Once()
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 77 && strings.HasPrefix(edit.Text, "Queued")
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Level: 3")
+	})).Return(tgbotapi.Message{MessageID: 78}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	assert.Nil(t, b.processCallback(generateTestCallback(callbackSave, 42)))
+	assert.Nil(t, b.undoLast(generateTestCommand("/undo")))
+	mockStore.AssertNotCalled(t, "List", mock.Anything, mock.Anything, mock.Anything)
+	assert.Nil(t, b.processCallback(generateTestCallback(callbackUndo, 77)))
+	// The queued removal is not undone again, the next undo is of the message before
+	assert.Nil(t, b.undoLast(generateTestCommand("/undo")))
+
+	mockStore.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_UndoShouldUseTheLastSaveAfterARestart(t *testing.T) {
+	t.Parallel()
+	path := lastSavesPath(filepath.Join(t.TempDir(), "processed.json"))
+	mockBotAPI := new(MockBotAPI)
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+	older := generateTestSavedEntries(t, time.Now().Add(-time.Hour), 3)
+
+	mockStore := new(MockStore)
+	b := newLastSavesTestBot(t, mockBotAPI, mockStore, path)
+	b.drafts.add(draftKey{chatID: 1234, messageID: 42}, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+	var saved []models.PainDescriptionLogEntry
+	mockStore.On("Append", mock.Anything).Run(func(args mock.Arguments) {
+		saved = args.Get(0).([]models.PainDescriptionLogEntry)
+	}).Return(nil).Once()
+	assert.Nil(t, b.processCallback(generateTestCallback(callbackSave, 42)))
+
+	// The store does not list the save yet after the restart
+	restartedStore := new(MockStore)
+	restarted := newLastSavesTestBot(t, mockBotAPI, restartedStore, path)
+	restartedStore.On("Append", mock.MatchedBy(func(data []models.PainDescriptionLogEntry) bool {
+		return data[0].Retracted && data[0].Supersedes == saved[0].EntryID
+	})).Return(nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Level: 1") && !strings.Contains(msg.Text, "Level: 3")
+	})).Return(tgbotapi.Message{MessageID: 77}, nil).Once()
+	assert.Nil(t, restarted.undoLast(generateTestCommand("/undo")))
+	assert.Nil(t, restarted.processCallback(generateTestCallback(callbackUndo, 77)))
+	restartedStore.AssertNotCalled(t, "List", mock.Anything, mock.Anything, mock.Anything)
+	restartedStore.AssertExpectations(t)
+
+	// After another restart the store lists the save but not its removal, which is still not undone again
+	listed := append([]database.StoredEntry(nil), older...)
+	for _, e := range saved {
+		listed = append(listed, database.StoredEntry{PainDescriptionLogEntry: e})
+	}
+	lastStore := new(MockStore)
+	last := newLastSavesTestBot(t, mockBotAPI, lastStore, path)
+	lastStore.On("List", "Test", mock.Anything, mock.Anything).Return(listed, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Level: 3") && !strings.Contains(msg.Text, "Level: 1")
+	})).Return(tgbotapi.Message{MessageID: 78}, nil).Once()
+	assert.Nil(t, last.undoLast(generateTestCommand("/undo")))
+
+	mockStore.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_UndoWithoutEntriesShouldSayNothingToUndo(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, location: time.UTC}
+
+	// The only entry was already undone
+	saved := generateTestSavedEntries(t, time.Now().Add(-time.Hour), 5)
+	tombstone, err := saved[0].Retract()
+	assert.NoError(t, err)
+	stored := append(saved, database.StoredEntry{PainDescriptionLogEntry: tombstone})
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(stored, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "There is nothing to undo")
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	err = b.undoLast(generateTestCommand("/undo"))
+	assert.Nil(t, err)
+
+	mockStore.AssertNotCalled(t, "Append", mock.Anything)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_CorrectShouldSaveTheEditedDraftAsCorrections(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		store:    mockStore,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	stored := generateTestSavedEntries(t, time.Now().Add(-time.Hour), 5)
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(stored, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "Correcting your last entry") && msg.ReplyMarkup != nil
+	})).Return(tgbotapi.Message{MessageID: 99}, nil).Once()
+	mockStore.On("Append", mock.MatchedBy(func(data []models.PainDescriptionLogEntry) bool {
+		return len(data) == 1 && data[0].Supersedes == stored[0].EntryID && data[0].Level == 8 && !data[0].Retracted &&
+			data[0].BatchID == stored[0].BatchID
+	})).Return(nil).Once()
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 99 && strings.HasPrefix(edit.Text, "Corrected")
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	err := b.startCorrection(generateTestCommand("/correct"))
+	assert.Nil(t, err)
+	key := draftKey{chatID: 1234, messageID: 99}
+	_, err = b.drafts.update(key, 1111111111111111111, func(pd []models.PainDescription) error {
+		pd[0].Level = 8
+		return nil
+	})
+	assert.Nil(t, err)
+	b.processCallback(generateTestCallback(callbackSave, 99))
+
+	mockStore.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+	_, ok := b.drafts.take(key)
+	assert.False(t, ok)
+}
+
+func Test_Bot_ProcessHistory_ShouldShowTheLatestVersions(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, location: time.UTC}
+
+	stored := generateTestSavedEntries(t, time.Now().Add(-time.Hour), 5, 6)
+	corrected := stored[0].PainDescription
+	corrected.Level = 2
+	correction, err := stored[0].Correct(corrected)
+	assert.NoError(t, err)
+	tombstone, err := stored[1].Retract()
+	assert.NoError(t, err)
+	stored = append(stored, database.StoredEntry{PainDescriptionLogEntry: correction}, database.StoredEntry{PainDescriptionLogEntry: tombstone})
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return(stored, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Lower Back (Both)  2\n") && strings.Count(msg.Text, "Lower Back") == 1
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	err = b.showHistory(generateTestCommand("/history"), defaultHistoryDays)
+	assert.Nil(t, err)
+
+	mockBotAPI.AssertExpectations(t)
+}
@@ -0,0 +1,156 @@
+package tgbot
+
+import (
+	"errors"
+	"sync"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// draftKey identifies a draft by the chat and the id of the preview message the bot sent for it
+type draftKey struct {
+	chatID    int64
+	messageID int
+}
+
+// draft is a parsed pain description waiting for the user to confirm it before it is saved
+type draft struct {
+	userID   int64
+	painDesc []models.PainDescription
+	// meta links the saved entries to the message of the user
+	meta models.EntryMetadata
+	// corrects are the saved entries the draft is a correction of, in the order of painDesc. Empty for a new entry
+	corrects []models.PainDescriptionLogEntry
+	// retracts are the saved entries the draft asks to remove. Empty for a draft to save
+	retracts  []models.PainDescriptionLogEntry
+	expiresAt time.Time
+}
+
+var (
+	errNoDraft       = errors.New("no pending draft")
+	errNotDraftOwner = errors.New("draft belongs to another user")
+)
+
+// draftStore holds the pending drafts. Drafts are shared between the update loop and the message goroutines,
+// so all access goes through the mutex
+type draftStore struct {
+	mu      sync.Mutex
+	drafts  map[draftKey]*draft
+	timeout time.Duration
+}
+
+func newDraftStore(timeout time.Duration) *draftStore {
+	return &draftStore{
+		drafts:  make(map[draftKey]*draft),
+		timeout: timeout,
+	}
+}
+
+// add stores a new draft for the given key, replacing any earlier one
+func (ds *draftStore) add(key draftKey, userID int64, pd []models.PainDescription, meta models.EntryMetadata) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.drafts[key] = &draft{
+		userID:    userID,
+		painDesc:  pd,
+		meta:      meta,
+		expiresAt: time.Now().Add(ds.timeout),
+	}
+}
+
+// addCorrection stores a draft for correcting the saved entries, replacing any earlier one
+func (ds *draftStore) addCorrection(key draftKey, userID int64, entries []models.PainDescriptionLogEntry) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.drafts[key] = &draft{
+		userID:    userID,
+		painDesc:  painsOf(entries),
+		corrects:  entries,
+		expiresAt: time.Now().Add(ds.timeout),
+	}
+}
+
+// addRetraction stores a draft asking to remove the saved entries, replacing any earlier one
+func (ds *draftStore) addRetraction(key draftKey, userID int64, entries []models.PainDescriptionLogEntry) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.drafts[key] = &draft{
+		userID:    userID,
+		painDesc:  painsOf(entries),
+		retracts:  entries,
+		expiresAt: time.Now().Add(ds.timeout),
+	}
+}
+
+// len returns the number of pending drafts
+func (ds *draftStore) len() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return len(ds.drafts)
+}
+
+// take removes the draft from the store and returns it. Expired drafts are left for removeExpired
+func (ds *draftStore) take(key draftKey) (*draft, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	d, ok := ds.drafts[key]
+	if !ok || time.Now().After(d.expiresAt) {
+		return nil, false
+	}
+	delete(ds.drafts, key)
+	return d, true
+}
+
+// update applies fn to the pain descriptions of the draft owned by userID and extends the draft's expiry.
+// A nil fn only extends the expiry. If fn returns an error, it must not have changed anything and the draft is left
+// as it was. Returns a copy of the pain descriptions after the update
+func (ds *draftStore) update(key draftKey, userID int64, fn func(pd []models.PainDescription) error) ([]models.PainDescription, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	d, ok := ds.drafts[key]
+	if !ok || time.Now().After(d.expiresAt) {
+		return nil, errNoDraft
+	}
+	if d.userID != userID {
+		return nil, errNotDraftOwner
+	}
+
+	if fn != nil {
+		if err := fn(d.painDesc); err != nil {
+			return nil, err
+		}
+	}
+	d.expiresAt = time.Now().Add(ds.timeout)
+
+	pd := make([]models.PainDescription, len(d.painDesc))
+	copy(pd, d.painDesc)
+	return pd, nil
+}
+
+// restore puts a draft taken with take back to the store, e.g. when saving it failed
+func (ds *draftStore) restore(key draftKey, d *draft) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.drafts[key] = d
+}
+
+// removeExpired removes all drafts that have expired by now and returns them by key
+func (ds *draftStore) removeExpired(now time.Time) map[draftKey]*draft {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	expired := make(map[draftKey]*draft)
+	for key, d := range ds.drafts {
+		if now.After(d.expiresAt) {
+			expired[key] = d
+			delete(ds.drafts, key)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,197 @@
+package tgbot
+
+import (
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strconv"
+	"strings"
+	"t-pain/pkg/models"
+	"time"
+)
+
+// Callback data prefixes of the edit mode. Row specific data has the form "prefix:row[:value]"
+const (
+	editRow      = "row"
+	editLocation = "loc"
+	editSide     = "side"
+	editLevel    = "lvl"
+	editDone     = "done"
+)
+
+const (
+	locationsPerRow   = 3
+	levelButtonsInRow = 6
+)
+
+var (
+	errUnknownRow  = errors.New("unknown row")
+	errInvalidEdit = errors.New("edit makes the pain invalid")
+)
+
+// editAction is a parsed edit mode button press
+type editAction struct {
+	kind  string
+	row   int
+	value int
+}
+
+// parseEditAction parses the callback data of an edit mode button. The data comes from the client,
+// so the values are validated against the known mappings
+func parseEditAction(data string) (editAction, error) {
+	parts := strings.Split(data, ":")
+	action := editAction{kind: parts[0]}
+
+	switch action.kind {
+	case callbackEdit, editDone:
+		if len(parts) != 1 {
+			return action, fmt.Errorf("unexpected arguments for %s", action.kind)
+		}
+		return action, nil
+	case editRow:
+		if len(parts) != 2 {
+			return action, fmt.Errorf("expected a row for %s", action.kind)
+		}
+	case editLocation, editSide, editLevel:
+		if len(parts) != 3 {
+			return action, fmt.Errorf("expected a row and a value for %s", action.kind)
+		}
+	default:
+		return action, fmt.Errorf("unknown action %s", action.kind)
+	}
+
+	row, err := strconv.Atoi(parts[1])
+	if err != nil || row < 0 {
+		return action, fmt.Errorf("invalid row %q", parts[1])
+	}
+	action.row = row
+
+	if len(parts) == 3 {
+		value, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return action, fmt.Errorf("invalid value %q", parts[2])
+		}
+		action.value = value
+	}
+
+	switch action.kind {
+	case editLocation:
+		if _, ok := models.BodyPartMapping[action.value]; !ok {
+			return action, fmt.Errorf("invalid location %d", action.value)
+		}
+	case editSide:
+		if _, ok := models.SideMap[action.value]; !ok {
+			return action, fmt.Errorf("invalid side %d", action.value)
+		}
+	case editLevel:
+		if action.value < models.MinLevel || action.value > models.MaxLevel {
+			return action, fmt.Errorf("invalid level %d", action.value)
+		}
+	}
+
+	return action, nil
+}
+
+// apply changes the pain descriptions according to the action. Actions that only navigate do nothing. A row that
+// does not exist or a change that leaves the pain invalid is an error and changes nothing
+func (a editAction) apply(pd []models.PainDescription) error {
+	if a.row >= len(pd) {
+		return errUnknownRow
+	}
+	pain := pd[a.row]
+	switch a.kind {
+	case editLocation:
+		if pain.LocationId != a.value {
+			// The numbness was of the old body part
+			pain.Numbness = false
+			pain.NumbnessDescription = ""
+		}
+		pain.LocationId = a.value
+	case editSide:
+		pain.SideId = a.value
+	case editLevel:
+		pain.Level = a.value
+	default:
+		return nil
+	}
+	if err := pain.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEdit, err)
+	}
+	pd[a.row] = pain
+	return nil
+}
+
+// rowPickerKeyboard lets the user pick which of the pains to edit
+func rowPickerKeyboard(pd []models.PainDescription) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, pain := range pd {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d. %s", i+1, fmtPainShort(pain)), fmt.Sprintf("%s:%d", editRow, i)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Done", editDone)))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// rowEditorKeyboard has pickers for the location, side and level of a single pain. The current values are marked
+func rowEditorKeyboard(pain models.PainDescription, row int, multipleRows bool) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, ID := range models.BodyPartMapping.IDs() {
+		label := markSelected(models.BodyPartMapping[ID], ID == pain.LocationId)
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s:%d:%d", editLocation, row, ID)))
+		if len(buttons) == locationsPerRow {
+			rows = append(rows, buttons)
+			buttons = nil
+		}
+	}
+	if len(buttons) > 0 {
+		rows = append(rows, buttons)
+	}
+
+	buttons = nil
+	for _, ID := range models.SideMap.IDs() {
+		label := markSelected(models.SideMap[ID], ID == pain.SideId)
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s:%d:%d", editSide, row, ID)))
+	}
+	rows = append(rows, buttons)
+
+	buttons = nil
+	for level := models.MinLevel; level <= models.MaxLevel; level++ {
+		label := markSelected(strconv.Itoa(level), level == pain.Level)
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s:%d:%d", editLevel, row, level)))
+		if len(buttons) == levelButtonsInRow {
+			rows = append(rows, buttons)
+			buttons = nil
+		}
+	}
+	if len(buttons) > 0 {
+		rows = append(rows, buttons)
+	}
+
+	navigation := []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("Done", editDone)}
+	if multipleRows {
+		navigation = append([]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("Other pains", callbackEdit)}, navigation...)
+	}
+	rows = append(rows, navigation)
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func markSelected(label string, selected bool) string {
+	if selected {
+		return "✓ " + label
+	}
+	return label
+}
+
+// fmtRowEditor formats the preview shown while a single pain is being edited
+func fmtRowEditor(pd []models.PainDescription, row int, loc *time.Location) string {
+	return fmt.Sprintf("%s\nEditing pain %d: %s\nPick the location, side and level, then press Done.", fmtReply(pd, loc), row+1, fmtPainShort(pd[row]))
+}
+
+// fmtPainShort formats a single pain on one line
+func fmtPainShort(pain models.PainDescription) string {
+	return fmt.Sprintf("%s, %s, %d", models.BodyPartMapping[pain.LocationId], models.SideMap[pain.SideId], pain.Level)
+}
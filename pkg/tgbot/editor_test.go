@@ -0,0 +1,162 @@
+package tgbot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func Test_ParseEditAction(t *testing.T) {
+	testCases := map[string]struct {
+		data    string
+		want    editAction
+		wantErr bool
+	}{
+		"edit":                {data: "edit", want: editAction{kind: callbackEdit}},
+		"done":                {data: "done", want: editAction{kind: editDone}},
+		"row":                 {data: "row:2", want: editAction{kind: editRow, row: 2}},
+		"location":            {data: "loc:1:9", want: editAction{kind: editLocation, row: 1, value: 9}},
+		"side":                {data: "side:0:3", want: editAction{kind: editSide, row: 0, value: 3}},
+		"level":               {data: "lvl:0:10", want: editAction{kind: editLevel, row: 0, value: 10}},
+		"unknown action":      {data: "foo:1", wantErr: true},
+		"unknown location":    {data: "loc:0:999", wantErr: true},
+		"unknown side":        {data: "side:0:4", wantErr: true},
+		"level out of range":  {data: "lvl:0:11", wantErr: true},
+		"negative row":        {data: "lvl:-1:5", wantErr: true},
+		"missing value":       {data: "lvl:0", wantErr: true},
+		"arguments for done":  {data: "done:1", wantErr: true},
+		"non-numeric value":   {data: "side:0:left", wantErr: true},
+		"non-numeric row":     {data: "row:first", wantErr: true},
+		"too many arguments":  {data: "loc:0:1:2", wantErr: true},
+		"empty callback data": {data: "", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseEditAction(tc.data)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_RowEditorKeyboard_ShouldFitCallbackDataLimit(t *testing.T) {
+	t.Parallel()
+	pd := generateTestPainDescriptions()
+
+	keyboard := rowEditorKeyboard(pd[0], 99, true)
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			assert.LessOrEqual(t, len(*button.CallbackData), 64)
+		}
+	}
+}
+
+func Test_Bot_EditDraft_ShouldUpdateDraftInPlace(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback("loc:0:9", 42))
+	b.processCallback(generateTestCallback("side:0:2", 42))
+	b.processCallback(generateTestCallback("lvl:0:7", 42))
+
+	pd, err := b.drafts.update(key, 1111111111111111111, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, pd[0].LocationId)
+	assert.Equal(t, 2, pd[0].SideId)
+	assert.Equal(t, 7, pd[0].Level)
+
+	mockBotAPI.AssertCalled(t, "Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 42 && edit.ReplyMarkup != nil
+	}))
+}
+
+func Test_Bot_EditDraft_ShouldRejectOtherUsers(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 175255021, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback("lvl:0:7", 42))
+
+	pd, err := b.drafts.update(key, 175255021, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pd[0].Level)
+	mockBotAPI.AssertNumberOfCalls(t, "Request", 1)
+}
+
+func Test_Bot_EditDraft_ShouldRejectUnknownRowBeforeChangingTheDraft(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+	expiresAt := b.drafts.drafts[key].expiresAt
+
+	mockBotAPI.On("Request", mock.MatchedBy(func(c tgbotapi.CallbackConfig) bool {
+		return c.Text == "Unknown action"
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+
+	b.processCallback(generateTestCallback("lvl:3:7", 42))
+
+	mockBotAPI.AssertExpectations(t)
+	assert.Equal(t, expiresAt, b.drafts.drafts[key].expiresAt, "a rejected edit should not extend the draft")
+}
+
+func Test_Bot_EditDraft_ChangingTheLocationShouldResetTheNumbness(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	pd := generateTestPainDescriptions()
+	pd[0].Numbness = true
+	pd[0].NumbnessDescription = "tingling fingers"
+	b.drafts.add(key, 1111111111111111111, pd, generateTestEntryMetadata())
+
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback("lvl:0:7", 42))
+	edited, err := b.drafts.update(key, 1111111111111111111, nil)
+	assert.Nil(t, err)
+	assert.True(t, edited[0].Numbness, "changing the level should keep the numbness")
+
+	b.processCallback(generateTestCallback("loc:0:9", 42))
+	edited, err = b.drafts.update(key, 1111111111111111111, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, edited[0].LocationId)
+	assert.False(t, edited[0].Numbness)
+	assert.Empty(t, edited[0].NumbnessDescription)
+	assert.Equal(t, "Test pain", edited[0].Description)
+}
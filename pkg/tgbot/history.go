@@ -0,0 +1,115 @@
+package tgbot
+
+import (
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strconv"
+	"strings"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"time"
+)
+
+const (
+	defaultHistoryDays = 7
+	maxHistoryDays     = 90
+	// maxMessageLength is the Telegram limit for the text of a single message
+	maxMessageLength = 4096
+)
+
+// parseHistoryDays parses the optional day count given to /history
+func parseHistoryDays(args string) (int, error) {
+	return parseDays(args, defaultHistoryDays, maxHistoryDays)
+}
+
+// parseDays parses an optional day count between 1 and maxDays
+func parseDays(args string, defaultDays, maxDays int) (int, error) {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return defaultDays, nil
+	}
+
+	days, err := strconv.Atoi(args)
+	if err != nil || days < 1 || days > maxDays {
+		return 0, fmt.Errorf("the number of days should be a whole number between 1 and %d", maxDays)
+	}
+	return days, nil
+}
+
+// showHistory replies with the entries the user has saved during the last days
+func (b *Bot) showHistory(update tgbotapi.Update, days int) error {
+	userName := models.UserIDs[update.Message.From.ID]
+	now := time.Now().In(b.location)
+	// Full days, including today
+	y, m, d := now.Date()
+	from := time.Date(y, m, d-(days-1), 0, 0, 0, 0, b.location)
+
+	ctx, cancel := b.stageContext(b.timeouts.store)
+	defer cancel()
+	entries, err := b.store.List(ctx, userName, from, now)
+	if errors.Is(err, database.ErrNotSupported) {
+		b.reply(update, "History is not available with the current storage.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("showHistory: %w", err)
+	}
+
+	for _, part := range splitMessage(fmtHistory(database.LatestVersions(entries), days, b.location), maxMessageLength) {
+		b.reply(update, part)
+	}
+	return nil
+}
+
+// fmtHistory formats the entries as a compact table grouped by day in the given location
+func fmtHistory(entries []database.StoredEntry, days int, loc *time.Location) string {
+	period := "today"
+	if days > 1 {
+		period = fmt.Sprintf("the last %d days", days)
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("No entries from %s.", period)
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Your entries from %s:\n", period))
+
+	var currentDay string
+	for _, e := range entries {
+		t := e.Timestamp.In(loc)
+		day := t.Format("Mon 02.01.2006")
+		if day != currentDay {
+			result.WriteString(fmt.Sprintf("\n%s\n", day))
+			currentDay = day
+		}
+		result.WriteString(fmt.Sprintf("  %s  %s  %d", t.Format("15:04"), fmtLocation(e.LocationId, e.SideId), e.Level))
+		if e.Numbness {
+			result.WriteString("  numb")
+		}
+		result.WriteString("\n")
+	}
+	return result.String()
+}
+
+// fmtLocation formats the body part and side names from the mappings, e.g. "Lower Back (Left)"
+func fmtLocation(locationId, sideId int) string {
+	return fmt.Sprintf("%s (%s)", models.BodyPartMapping[locationId], models.SideMap[sideId])
+}
+
+// splitMessage splits text on line boundaries into parts that fit in a single message
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if current.Len()+len(line) > limit && current.Len() > 0 {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
@@ -0,0 +1,118 @@
+package tgbot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"t-pain/pkg/database"
+	"t-pain/pkg/models"
+	"testing"
+	"time"
+)
+
+func generateTestCommand(text string) tgbotapi.Update {
+	update := generateTestUpdate()
+	update.Message.Text = text
+	update.Message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(strings.Fields(text)[0])}}
+	return update
+}
+
+func Test_ParseHistoryDays(t *testing.T) {
+	testCases := map[string]struct {
+		args    string
+		want    int
+		wantErr bool
+	}{
+		"default":  {args: "", want: defaultHistoryDays},
+		"number":   {args: " 14 ", want: 14},
+		"zero":     {args: "0", wantErr: true},
+		"too many": {args: "91", wantErr: true},
+		"text":     {args: "week", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseHistoryDays(tc.args)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_FmtHistory_ShouldGroupByDayInLocation(t *testing.T) {
+	t.Parallel()
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	assert.Nil(t, err)
+
+	entries := []database.StoredEntry{
+		// 23:30 in Helsinki on the 1st, but already the 2nd in UTC+3
+		{PainDescriptionLogEntry: models.PainDescriptionLogEntry{PainDescription: models.PainDescription{
+			Timestamp: time.Date(2023, 8, 1, 20, 30, 0, 0, time.UTC), LocationId: 9, SideId: 1, Level: 6}}},
+		{PainDescriptionLogEntry: models.PainDescriptionLogEntry{PainDescription: models.PainDescription{
+			Timestamp: time.Date(2023, 8, 1, 21, 30, 0, 0, time.UTC), LocationId: 2, SideId: 2, Level: 3, Numbness: true}}},
+	}
+
+	history := fmtHistory(entries, 7, loc)
+
+	assert.Contains(t, history, "Tue 01.08.2023\n  23:30  Lower Back (Both)  6\n")
+	assert.Contains(t, history, "Wed 02.08.2023\n  00:30  Neck (Left)  3  numb\n")
+	assert.Equal(t, "No entries from today.", fmtHistory(nil, 1, loc))
+}
+
+func Test_SplitMessage_ShouldRespectLimit(t *testing.T) {
+	t.Parallel()
+	text := strings.Repeat("0123456789\n", 10)
+
+	parts := splitMessage(text, 25)
+
+	assert.Equal(t, text, strings.Join(parts, ""))
+	for _, part := range parts {
+		assert.LessOrEqual(t, len(part), 25)
+	}
+}
+
+func Test_Bot_ProcessHistory_ShouldListUsersEntries(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, location: time.UTC}
+
+	entries := []database.StoredEntry{{PainDescriptionLogEntry: models.PainDescriptionLogEntry{PainDescription: models.PainDescription{
+		Timestamp: time.Now(), LocationId: 9, SideId: 1, Level: 6}}}}
+	mockStore.On("List", "Test", mock.MatchedBy(func(from time.Time) bool {
+		return time.Since(from) > 2*24*time.Hour && time.Since(from) <= 3*24*time.Hour
+	}), mock.Anything).Return(entries, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "Lower Back (Both)  6")
+	})).Return(tgbotapi.Message{}, nil)
+
+	err := b.showHistory(generateTestCommand("/history 3"), 3)
+	assert.Nil(t, err)
+
+	mockStore.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_ProcessHistory_ShouldExplainUnsupportedStore(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{Bot: mockBotAPI, store: mockStore, location: time.UTC}
+
+	mockStore.On("List", "Test", mock.Anything, mock.Anything).Return([]database.StoredEntry(nil), database.ErrNotSupported)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "not available")
+	})).Return(tgbotapi.Message{}, nil)
+
+	err := b.showHistory(generateTestCommand("/history"), defaultHistoryDays)
+	assert.Nil(t, err)
+
+	mockBotAPI.AssertExpectations(t)
+}
@@ -0,0 +1,330 @@
+package tgbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// abortTimeout is how long the updates still in progress after the grace period get to return once aborted
+const abortTimeout = 5 * time.Second
+
+// Replies to the messages left unfinished when stopping, depending on whether they could be saved for a restart
+const (
+	pendingReply = "The bot is restarting and will handle your message when it is back."
+	stoppedReply = "The bot is restarting and could not handle your message. Please send it again in a minute."
+	// redeliveryWindow is how far below the offset an update is taken for one delivered again. Telegram only
+	// delivers again the updates that were not confirmed, so a lower id means that the ids were restarted, which it
+	// does e.g. after a week without updates
+	redeliveryWindow = 1000
+	// stoppedDraftReply replaces a draft whose saving was aborted, as the drafts do not survive a restart
+	stoppedDraftReply = "The bot is restarting and this entry was not saved. Please send it again in a minute."
+)
+
+// ShutdownReport tells what happened to the work in progress when the bot stopped
+type ShutdownReport struct {
+	// Drained is how many updates in progress finished during the grace period
+	Drained int
+	// Persisted are the messages that did not finish and were saved to be handled after a restart
+	Persisted []string
+	// Dropped are the updates that were lost
+	Dropped []string
+	// Abandoned is how many drafts were still waiting for confirmation. Nothing was saved for them yet, so the users
+	// only need to send them again
+	Abandoned int
+}
+
+// Clean tells whether all the work in progress finished
+func (r ShutdownReport) Clean() bool {
+	return len(r.Persisted) == 0 && len(r.Dropped) == 0 && r.Abandoned == 0
+}
+
+func (r ShutdownReport) String() string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("%d updates finished, %d saved for retry, %d dropped, %d drafts abandoned",
+		r.Drained, len(r.Persisted), len(r.Dropped), r.Abandoned))
+	for _, p := range r.Persisted {
+		result.WriteString("\n  saved: " + p)
+	}
+	for _, d := range r.Dropped {
+		result.WriteString("\n  dropped: " + d)
+	}
+	return result.String()
+}
+
+// inFlight tracks the updates being handled, so that stopping can wait for them and save the unfinished ones.
+// The update goroutines share it, so all access goes through the mutex
+type inFlight struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	updates map[int]tgbotapi.Update
+	// next is the id after the last update received
+	next int
+	// advanced is called with the offset of the first update not handled yet whenever an update finishes, nil to
+	// not track it
+	advanced func(offset int)
+	// rebased is called with the new offset when Telegram restarted the numbering of the updates, nil to not track it
+	rebased func(offset int)
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{updates: make(map[int]tgbotapi.Update)}
+}
+
+// run handles a received update in a new goroutine. An update whose handler returns an error stays unfinished
+func (f *inFlight) run(update tgbotapi.Update, handle func() error) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		if err := handle(); err != nil {
+			log.Printf("Update %d was not finished: %v", update.UpdateID, err)
+			return
+		}
+		f.finish(update.UpdateID)
+	}()
+}
+
+// finish records that a received update was handled
+func (f *inFlight) finish(id int) {
+	f.mu.Lock()
+	delete(f.updates, id)
+	offset := f.offsetLocked()
+	f.mu.Unlock()
+	if f.advanced != nil {
+		f.advanced(offset)
+	}
+}
+
+// background runs fn in a new goroutine that stopping waits for like the updates, e.g. a shadow run. It is not an
+// update of its own, so it is not saved for a restart if it does not finish
+func (f *inFlight) background(fn func()) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		fn()
+	}()
+}
+
+// receive records that the update was received, after which it is unfinished until it is passed to finish or run.
+// Returns false if it was received before, i.e. Telegram delivered it again. Both happen under the same lock, so
+// the offset never moves past an update that is not tracked yet. An update further than redeliveryWindow below the
+// offset means that Telegram restarted the numbering, so the offset moves back to it
+func (f *inFlight) receive(update tgbotapi.Update) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if update.UpdateID < f.next {
+		if f.next-update.UpdateID <= redeliveryWindow {
+			return false
+		}
+		log.Printf("Update %d is far below the offset %d, Telegram restarted the update ids", update.UpdateID, f.next)
+		if f.rebased != nil {
+			f.rebased(update.UpdateID + 1)
+		}
+	}
+	f.next = update.UpdateID + 1
+	f.updates[update.UpdateID] = update
+	return true
+}
+
+// skipTo treats the updates before offset as received, e.g. the ones handled before a restart
+func (f *inFlight) skipTo(offset int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if offset > f.next {
+		f.next = offset
+	}
+}
+
+// received returns the id after the last update received
+func (f *inFlight) received() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.next
+}
+
+// offsetLocked returns the id of the first update that is received but not finished, or the id after the last
+// received update if all are. Must be called with the mutex held
+func (f *inFlight) offsetLocked() int {
+	offset := f.next
+	for id := range f.updates {
+		if id < offset {
+			offset = id
+		}
+	}
+	return offset
+}
+
+// wait waits for the goroutines to return for at most timeout. Returns false if some are still running
+func (f *inFlight) wait(timeout time.Duration) bool {
+	returned := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(returned)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-returned:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (f *inFlight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.updates)
+}
+
+// unfinished returns the updates that are still running or were aborted, in the order they were received
+func (f *inFlight) unfinished() []tgbotapi.Update {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	updates := make([]tgbotapi.Update, 0, len(f.updates))
+	for _, u := range f.updates {
+		updates = append(updates, u)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].UpdateID < updates[j].UpdateID
+	})
+	return updates
+}
+
+// shutdown stops polling for updates and waits for the grace period for the updates in progress, after which
+// the rest are aborted. The messages that did not finish are saved to be handled after a restart, and the users
+// are told about it
+func (b *Bot) shutdown() ShutdownReport {
+	b.Bot.StopReceivingUpdates()
+
+	inProgress := b.inFlight.len()
+	log.Printf("Stopping, waiting up to %s for %d updates in progress", b.gracePeriod, inProgress)
+	if !b.inFlight.wait(b.gracePeriod) {
+		log.Printf("The grace period passed, aborting the updates in progress")
+	}
+	if b.cancel != nil {
+		b.cancel()
+	}
+	if !b.inFlight.wait(abortTimeout) {
+		log.Printf("Some updates did not return in %s after aborting", abortTimeout)
+	}
+
+	unfinished := b.inFlight.unfinished()
+	report := ShutdownReport{Drained: inProgress - len(unfinished)}
+	var retry []tgbotapi.Update
+	for _, u := range unfinished {
+		// Only plain messages can be handled again, the drafts of the callbacks, e.g. a save aborted by stopping, do
+		// not survive a restart
+		if u.Message != nil && !u.Message.IsCommand() {
+			retry = append(retry, u)
+			continue
+		}
+		report.Dropped = append(report.Dropped, describeUpdate(u))
+	}
+
+	if len(retry) > 0 {
+		err := b.savePending(retry)
+		if err != nil {
+			log.Printf("Error saving the unfinished messages: %v", err)
+		}
+		for _, u := range retry {
+			if err != nil {
+				report.Dropped = append(report.Dropped, describeUpdate(u))
+				b.reply(u, stoppedReply)
+				continue
+			}
+			report.Persisted = append(report.Persisted, describeUpdate(u))
+			b.reply(u, pendingReply)
+		}
+	}
+
+	// The unfinished updates are saved for a restart or reported as dropped, so polling continues after all of them
+	if b.processed != nil {
+		b.processed.advance(b.inFlight.received())
+		b.processed.flush()
+	}
+	// The outbox is on disk, so its entries are not lost but uploaded after a restart
+	if b.outbox != nil && b.outbox.Len() > 0 {
+		log.Printf("%d batches of entries are waiting in the outbox for upload", b.outbox.Len())
+	}
+	if b.shadow != nil {
+		if err := b.shadow.close(); err != nil {
+			log.Printf("Error stopping shadow: %v", err)
+		}
+	}
+	if b.metrics != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		if err := b.metrics.Shutdown(ctx); err != nil {
+			log.Printf("Error stopping the metrics server: %v", err)
+		}
+		cancel()
+	}
+	report.Abandoned = b.drafts.len()
+	return report
+}
+
+// savePending writes the updates to the pending file for handling them after a restart. A crash while writing
+// leaves the old file in place
+func (b *Bot) savePending(updates []tgbotapi.Update) error {
+	if b.pendingPath == "" {
+		return errors.New("no pending file configured")
+	}
+	data, err := json.Marshal(updates)
+	if err != nil {
+		return fmt.Errorf("unable to marshal updates: %w", err)
+	}
+	tmp := b.pendingPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write pending file: %w", err)
+	}
+	if err := os.Rename(tmp, b.pendingPath); err != nil {
+		return fmt.Errorf("unable to replace pending file: %w", err)
+	}
+	return nil
+}
+
+// loadPending reads and removes the updates left unfinished by the last shutdown
+func (b *Bot) loadPending() ([]tgbotapi.Update, error) {
+	if b.pendingPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(b.pendingPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pending file: %w", err)
+	}
+	var updates []tgbotapi.Update
+	if err := json.Unmarshal(data, &updates); err != nil {
+		return nil, fmt.Errorf("unable to parse pending file: %w", err)
+	}
+	// The updates are handled once, if the bot stops again they are saved again
+	if err := os.Remove(b.pendingPath); err != nil {
+		return nil, fmt.Errorf("unable to remove pending file: %w", err)
+	}
+	return updates, nil
+}
+
+// describeUpdate describes the update for the shutdown report
+func describeUpdate(u tgbotapi.Update) string {
+	switch {
+	case u.Message != nil && u.Message.IsCommand():
+		return fmt.Sprintf("command /%s from %s", u.Message.Command(), u.Message.From.UserName)
+	case u.Message != nil:
+		return fmt.Sprintf("message %d from %s", u.Message.MessageID, u.Message.From.UserName)
+	case u.CallbackQuery != nil:
+		return fmt.Sprintf("button %q from %s", u.CallbackQuery.Data, u.CallbackQuery.From.UserName)
+	default:
+		return fmt.Sprintf("update %d", u.UpdateID)
+	}
+}
@@ -0,0 +1,295 @@
+package tgbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"os"
+	"path/filepath"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+// blockingAI answers when released, and otherwise only when its context is done, like a request to an API that hangs
+type blockingAI struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingAI() blockingAI {
+	return blockingAI{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (a blockingAI) GetPainDescriptionObject(ctx context.Context, _ string, _ openai.MessageContext, _ *openai.Conversation) (openai.Result, error) {
+	close(a.started)
+	select {
+	case <-a.release:
+		return openai.Result{Kind: openai.ResultText, Text: "No pains"}, nil
+	case <-ctx.Done():
+		return openai.Result{}, fmt.Errorf("unable to send request: %w", ctx.Err())
+	}
+}
+
+// blockingSpeech never recognizes anything, like a stuck recognition, until its context is done
+type blockingSpeech struct {
+	started chan struct{}
+}
+
+func (s blockingSpeech) Recognize(ctx context.Context, _ string) (string, error) {
+	close(s.started)
+	<-ctx.Done()
+	return "", fmt.Errorf("recognition stopped: %w", ctx.Err())
+}
+
+func newStoppableTestBot(botAPI BotAPI) *Bot {
+	ctx, cancel := context.WithCancel(context.Background())
+	commands, _ := newDefaultCommands()
+	return &Bot{
+		Bot:           botAPI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		commands:      commands,
+		location:      time.UTC,
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		inFlight:      newInFlight(),
+		gracePeriod:   10 * time.Millisecond,
+	}
+}
+
+// startTestBot runs the bot, which gets the updates sent to the returned channel, until it is stopped
+func startTestBot(b *Bot, mockBotAPI *MockBotAPI) (chan<- tgbotapi.Update, <-chan ShutdownReport) {
+	updates := make(chan tgbotapi.Update)
+	mockBotAPI.On("Request", mock.AnythingOfType("tgbotapi.SetMyCommandsConfig")).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+	mockBotAPI.On("GetUpdatesChan", mock.Anything).Return(tgbotapi.UpdatesChannel(updates))
+	mockBotAPI.On("StopReceivingUpdates").Return().Maybe()
+
+	reports := make(chan ShutdownReport, 1)
+	go func() {
+		reports <- b.Run()
+	}()
+	return updates, reports
+}
+
+func waitForReport(t *testing.T, reports <-chan ShutdownReport) ShutdownReport {
+	t.Helper()
+	select {
+	case report := <-reports:
+		return report
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the bot to stop")
+		return ShutdownReport{}
+	}
+}
+
+func Test_Bot_StopShouldWaitForMessagesInProgress(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	ai := newBlockingAI()
+	b := newStoppableTestBot(mockBotAPI)
+	b.openAIClient = ai
+	b.gracePeriod = time.Second
+	// The answer comes only once the bot has started stopping
+	mockBotAPI.On("StopReceivingUpdates").Run(func(mock.Arguments) { close(ai.release) }).Return().Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.Text == "No pains"
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	updates, reports := startTestBot(b, mockBotAPI)
+	update := generateTestUpdate()
+	update.Message.Text = "Test Message"
+	updates <- update
+	<-ai.started
+	b.Stop()
+
+	report := waitForReport(t, reports)
+	assert.True(t, report.Clean(), report.String())
+	assert.Equal(t, 1, report.Drained)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_StopShouldAbortHangingOpenAICallAndSaveTheMessage(t *testing.T) {
+	t.Parallel()
+	pendingPath := filepath.Join(t.TempDir(), "pending.json")
+	mockBotAPI := new(MockBotAPI)
+	ai := newBlockingAI()
+	b := newStoppableTestBot(mockBotAPI)
+	b.openAIClient = ai
+	b.pendingPath = pendingPath
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.Text == pendingReply
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	updates, reports := startTestBot(b, mockBotAPI)
+	update := generateTestUpdate()
+	update.UpdateID = 7
+	update.Message.Text = "Test Message"
+	updates <- update
+	<-ai.started
+	b.Stop()
+
+	report := waitForReport(t, reports)
+	assert.Equal(t, []string{"message 0 from tester"}, report.Persisted)
+	assert.Empty(t, report.Dropped)
+	mockBotAPI.AssertExpectations(t)
+	// Stopping after Run has returned does not block
+	b.Stop()
+
+	data, err := os.ReadFile(pendingPath)
+	if assert.NoError(t, err) {
+		var pending []tgbotapi.Update
+		assert.NoError(t, json.Unmarshal(data, &pending))
+		if assert.Len(t, pending, 1) {
+			assert.Equal(t, 7, pending[0].UpdateID)
+			assert.Equal(t, "Test Message", pending[0].Message.Text)
+		}
+	}
+
+	// After a restart the saved message is handled before the new updates
+	restartedAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	restarted := newStoppableTestBot(restartedAPI)
+	restarted.openAIClient = mockAI
+	restarted.pendingPath = pendingPath
+	handled := make(chan struct{})
+	mockAI.On("GetPainDescriptionObject", "Test Message", mock.Anything, mock.Anything).
+		Return(openai.Result{Kind: openai.ResultText, Text: "No pains"}, nil)
+	restartedAPI.On("Send", mock.Anything).Run(func(mock.Arguments) { close(handled) }).Return(tgbotapi.Message{}, nil).Once()
+
+	_, reports = startTestBot(restarted, restartedAPI)
+	<-handled
+	restarted.Stop()
+	assert.True(t, waitForReport(t, reports).Clean())
+	_, err = os.Stat(pendingPath)
+	assert.True(t, os.IsNotExist(err), "the pending file should be removed once loaded")
+}
+
+func Test_Bot_StopShouldAbortStuckRecognition(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	speech := blockingSpeech{started: make(chan struct{})}
+	b := newStoppableTestBot(mockBotAPI)
+	b.openAIClient = mockAI
+	b.speechClient = speech
+	mockBotAPI.On("GetFileDirectURL", "voice").Return("https://example.com/voice.ogg", nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.Text == stoppedReply
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	updates, reports := startTestBot(b, mockBotAPI)
+	update := generateTestUpdate()
+	update.Message.Voice = &tgbotapi.Voice{FileID: "voice"}
+	updates <- update
+	<-speech.started
+	b.Stop()
+
+	report := waitForReport(t, reports)
+	// Without a pending file the message cannot be saved for later
+	assert.Equal(t, []string{"message 0 from tester"}, report.Dropped)
+	assert.False(t, report.Clean())
+	mockBotAPI.AssertExpectations(t)
+	mockAI.AssertNotCalled(t, "GetPainDescriptionObject", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_Bot_StopShouldReportAnAbortedSaveAsDropped(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := newStoppableTestBot(mockBotAPI)
+	b.store = mockStore
+	b.drafts.add(draftKey{chatID: 1234, messageID: 42}, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+	started := make(chan struct{})
+	// The store hangs until the save is aborted
+	mockStore.On("Append", mock.Anything).Run(func(mock.Arguments) {
+		close(started)
+		<-b.ctx.Done()
+	}).Return(context.Canceled).Once()
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 42 && edit.Text == stoppedDraftReply
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	updates, reports := startTestBot(b, mockBotAPI)
+	updates <- generateTestCallback(callbackSave, 42)
+	<-started
+	b.Stop()
+
+	report := waitForReport(t, reports)
+	assert.Equal(t, []string{`button "save" from tester`}, report.Dropped)
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_StopShouldReportOpenDraftsAsAbandoned(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := newStoppableTestBot(mockBotAPI)
+	b.drafts.add(draftKey{chatID: 1234, messageID: 42}, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	_, reports := startTestBot(b, mockBotAPI)
+	b.Stop()
+
+	report := waitForReport(t, reports)
+	assert.Empty(t, report.Dropped)
+	assert.Empty(t, report.Persisted)
+	assert.Equal(t, 1, report.Abandoned)
+	assert.False(t, report.Clean())
+}
+
+func Test_Bot_SavePendingShouldReplaceTheFile(t *testing.T) {
+	t.Parallel()
+	pendingPath := filepath.Join(t.TempDir(), "pending.json")
+	b := &Bot{pendingPath: pendingPath}
+	assert.NoError(t, os.WriteFile(pendingPath, []byte("old"), 0o600))
+
+	assert.NoError(t, b.savePending([]tgbotapi.Update{generateTestUpdate()}))
+
+	loaded, err := b.loadPending()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	_, err = os.Stat(pendingPath + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the temporary file should be renamed")
+}
+
+func Test_inFlight_ShouldRebaseWhenTheUpdateIdsRestart(t *testing.T) {
+	t.Parallel()
+	f := newInFlight()
+	var rebased []int
+	f.rebased = func(offset int) { rebased = append(rebased, offset) }
+	f.skipTo(5000)
+	redelivered := generateTestUpdate()
+	redelivered.UpdateID = 5000 - redeliveryWindow
+	restarted := generateTestUpdate()
+	restarted.UpdateID = 3
+
+	assert.False(t, f.receive(redelivered), "an update just below the offset is delivered again")
+	assert.Empty(t, rebased)
+	assert.True(t, f.receive(restarted), "an update far below the offset is new")
+	assert.Equal(t, []int{4}, rebased)
+	assert.Equal(t, 4, f.received())
+}
+
+func Test_inFlight_ShouldNotAdvancePastUnfinishedUpdates(t *testing.T) {
+	t.Parallel()
+	f := newInFlight()
+	offsets := make(chan int, 2)
+	f.advanced = func(offset int) { offsets <- offset }
+	first := generateTestUpdate()
+	first.UpdateID = 5
+	second := generateTestUpdate()
+	second.UpdateID = 6
+
+	assert.True(t, f.receive(first))
+	assert.True(t, f.receive(second))
+	assert.False(t, f.receive(first))
+	// The first update is received but not running yet when the second one finishes
+	f.run(second, func() error { return nil })
+	assert.Equal(t, 5, <-offsets)
+	f.finish(first.UpdateID)
+	assert.Equal(t, 7, <-offsets)
+}
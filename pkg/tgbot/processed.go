@@ -0,0 +1,206 @@
+package tgbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// savedRetention is how long the saved messages are remembered. Telegram keeps the updates that were not
+	// confirmed for 24 hours, so an older message is not delivered again
+	savedRetention = 48 * time.Hour
+	// offsetWriteInterval is how long a new offset may wait before it is written to the file. Losing it in a crash
+	// only makes Telegram deliver the handled updates again, and the saved messages are still skipped
+	offsetWriteInterval = 5 * time.Second
+)
+
+// messageKey identifies a message of the user by its chat and id
+type messageKey struct {
+	chatID    int64
+	messageID int
+}
+
+// processedUpdates remembers how far the updates have been handled and which messages have been saved, so that the
+// updates Telegram delivers again after a crash or restart are not handled twice. With a path the saved messages
+// are written to the file right away and the offset at most every offsetWriteInterval, otherwise it only lasts
+// until the bot stops. The update goroutines share it, so all access goes through the mutex
+type processedUpdates struct {
+	mu   sync.Mutex
+	path string
+	// next is the id of the first update that has not been handled
+	next  int
+	saved map[messageKey]time.Time
+	// saving are the messages whose entries are being saved, which are not written to the file
+	saving map[messageKey]bool
+	// dirty tells that next has changed since the file was written, and flushTimer writes it later
+	dirty      bool
+	flushTimer *time.Timer
+}
+
+// processedFile is the format of the file of processedUpdates
+type processedFile struct {
+	Offset int            `json:"offset"`
+	Saved  []savedMessage `json:"saved"`
+}
+
+// savedMessage is a message whose entries were saved
+type savedMessage struct {
+	ChatID    int64     `json:"chatId"`
+	MessageID int       `json:"messageId"`
+	SavedAt   time.Time `json:"savedAt"`
+}
+
+// newProcessedUpdates reads the state left by the last run from the file at path, if there is one. An empty path
+// keeps the state in memory only
+func newProcessedUpdates(path string) (*processedUpdates, error) {
+	p := &processedUpdates{path: path, saved: make(map[messageKey]time.Time), saving: make(map[messageKey]bool)}
+	if path == "" {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read processed updates file: %w", err)
+	}
+	var f processedFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse processed updates file: %w", err)
+	}
+	p.next = f.Offset
+	for _, s := range f.Saved {
+		p.saved[messageKey{chatID: s.ChatID, messageID: s.MessageID}] = s.SavedAt
+	}
+	return p, nil
+}
+
+// offset returns the id of the first update that has not been handled, which polling continues from
+func (p *processedUpdates) offset() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next
+}
+
+// advance records that the updates before offset have been handled. The offset never moves back, e.g. when the
+// updates left unfinished by the last shutdown are handled again
+func (p *processedUpdates) advance(offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset <= p.next {
+		return
+	}
+	p.next = offset
+	if p.path == "" {
+		return
+	}
+	p.dirty = true
+	if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(offsetWriteInterval, p.flush)
+	}
+}
+
+// rebase moves the offset to where Telegram restarted the numbering of the updates, also when it is lower. It is
+// written right away, as the old offset would skip all the new updates after a restart
+func (p *processedUpdates) rebase(offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = offset
+	if err := p.write(); err != nil {
+		log.Printf("Error saving the update offset: %v", err)
+	}
+}
+
+// flush writes the offset if it has not been written yet, e.g. when stopping
+func (p *processedUpdates) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+	if !p.dirty {
+		return
+	}
+	if err := p.write(); err != nil {
+		log.Printf("Error saving the update offset: %v", err)
+	}
+}
+
+// isSaved tells whether the entries of the message have already been saved
+func (p *processedUpdates) isSaved(chatID int64, messageID int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.saved[messageKey{chatID: chatID, messageID: messageID}]
+	return ok
+}
+
+// reserve claims saving the entries of the message. Returns false if they are saved or being saved already. The
+// claim ends with markSaved, or with release if saving failed
+func (p *processedUpdates) reserve(chatID int64, messageID int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := messageKey{chatID: chatID, messageID: messageID}
+	if _, ok := p.saved[key]; ok || p.saving[key] {
+		return false
+	}
+	p.saving[key] = true
+	return true
+}
+
+// release gives up the claim of reserve, so that the entries of the message can be saved again
+func (p *processedUpdates) release(chatID int64, messageID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.saving, messageKey{chatID: chatID, messageID: messageID})
+}
+
+// markSaved records that the entries of the message were saved, and forgets the messages saved before the
+// retention
+func (p *processedUpdates) markSaved(chatID int64, messageID int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := messageKey{chatID: chatID, messageID: messageID}
+	delete(p.saving, key)
+	p.saved[key] = now
+	for key, savedAt := range p.saved {
+		if now.Sub(savedAt) > savedRetention {
+			delete(p.saved, key)
+		}
+	}
+	if err := p.write(); err != nil {
+		log.Printf("Error saving the saved messages: %v", err)
+	}
+}
+
+// write replaces the file with the current state. A crash while writing leaves the old file in place. Must be
+// called with the mutex held
+func (p *processedUpdates) write() error {
+	if p.path == "" {
+		return nil
+	}
+
+	f := processedFile{Offset: p.next}
+	for key, savedAt := range p.saved {
+		f.Saved = append(f.Saved, savedMessage{ChatID: key.chatID, MessageID: key.messageID, SavedAt: savedAt})
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("unable to marshal processed updates: %w", err)
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write processed updates file: %w", err)
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return fmt.Errorf("unable to replace processed updates file: %w", err)
+	}
+	p.dirty = false
+	return nil
+}
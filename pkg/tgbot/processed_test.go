@@ -0,0 +1,179 @@
+package tgbot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"path/filepath"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+func newProcessedTestBot(t *testing.T, botAPI BotAPI, path string) *Bot {
+	t.Helper()
+	processed, err := newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error creating processed updates, got %v", err)
+	}
+	b := newStoppableTestBot(botAPI)
+	b.processed = processed
+	b.inFlight.advanced = processed.advance
+	return b
+}
+
+func Test_Bot_ShouldSkipRedeliveredUpdates(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "processed.json")
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := newProcessedTestBot(t, mockBotAPI, path)
+	b.openAIClient = mockAI
+	replies := make(chan struct{}, 2)
+	mockAI.On("GetPainDescriptionObject", mock.Anything, mock.Anything, mock.Anything).
+		Return(openai.Result{Kind: openai.ResultText, Text: "No pains"}, nil)
+	mockBotAPI.On("Send", mock.Anything).Run(func(mock.Arguments) { replies <- struct{}{} }).Return(tgbotapi.Message{}, nil)
+
+	updates, reports := startTestBot(b, mockBotAPI)
+	first := generateTestUpdate()
+	first.UpdateID = 5
+	first.Message.MessageID = 50
+	first.Message.Text = "First message"
+	second := generateTestUpdate()
+	second.UpdateID = 6
+	second.Message.MessageID = 51
+	second.Message.Text = "Second message"
+	updates <- first
+	<-replies
+	// Telegram delivers the first update again, e.g. after a poll timed out
+	updates <- first
+	updates <- second
+	<-replies
+	b.Stop()
+
+	assert.True(t, waitForReport(t, reports).Clean())
+	mockAI.AssertNumberOfCalls(t, "GetPainDescriptionObject", 2)
+	mockAI.AssertCalled(t, "GetPainDescriptionObject", "Second message", mock.Anything, mock.Anything)
+
+	// After a restart polling continues after the handled updates
+	restartedAPI := new(MockBotAPI)
+	restarted := newProcessedTestBot(t, restartedAPI, path)
+	restarted.openAIClient = mockAI
+	restartedUpdates, reports := startTestBot(restarted, restartedAPI)
+	restartedUpdates <- second
+	restarted.Stop()
+
+	assert.True(t, waitForReport(t, reports).Clean())
+	restartedAPI.AssertCalled(t, "GetUpdatesChan", mock.MatchedBy(func(u tgbotapi.UpdateConfig) bool {
+		return u.Offset == 7
+	}))
+	mockAI.AssertNumberOfCalls(t, "GetPainDescriptionObject", 2)
+}
+
+func Test_Bot_ShouldNotSaveAMessageTwice(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "processed.json")
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	mockAI := new(MockAI)
+	b := newProcessedTestBot(t, mockBotAPI, path)
+	b.store = mockStore
+	b.openAIClient = mockAI
+	meta := generateTestEntryMetadata()
+	// Both previews are of the same message, which was delivered twice
+	b.drafts.add(draftKey{chatID: 1234, messageID: 42}, 1111111111111111111, generateTestPainDescriptions(), meta)
+	b.drafts.add(draftKey{chatID: 1234, messageID: 43}, 1111111111111111111, generateTestPainDescriptions(), meta)
+
+	mockStore.On("Append", mock.Anything).Return(nil).Once()
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return edit.MessageID == 43 && edit.Text == "The entries of this message were already saved."
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback(callbackSave, 42))
+	b.processCallback(generateTestCallback(callbackSave, 43))
+
+	mockStore.AssertNumberOfCalls(t, "Append", 1)
+	mockBotAPI.AssertExpectations(t)
+
+	// The saved message is remembered over a restart, so handling it again does nothing
+	restarted := newProcessedTestBot(t, mockBotAPI, path)
+	restarted.openAIClient = mockAI
+	update := generateTestUpdate()
+	update.Message.MessageID = meta.MessageID
+	update.Message.Text = "Test Message"
+	assert.NoError(t, restarted.processMessage(update))
+	mockAI.AssertNotCalled(t, "GetPainDescriptionObject", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_processedUpdates_ShouldForgetOldSavedMessages(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "processed.json")
+	processed, err := newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error creating processed updates, got %v", err)
+	}
+	now := time.Now()
+
+	processed.markSaved(1234, 1, now.Add(-savedRetention-time.Minute))
+	processed.markSaved(1234, 2, now)
+	processed.advance(10)
+	processed.advance(3)
+	processed.flush()
+
+	reloaded, err := newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error reading processed updates, got %v", err)
+	}
+	assert.Equal(t, 10, reloaded.offset(), "the offset should never move back")
+	assert.False(t, reloaded.isSaved(1234, 1))
+	assert.True(t, reloaded.isSaved(1234, 2))
+}
+
+func Test_processedUpdates_ReserveShouldClaimAMessageOnce(t *testing.T) {
+	t.Parallel()
+	processed, err := newProcessedUpdates("")
+	if err != nil {
+		t.Fatalf("error creating processed updates, got %v", err)
+	}
+
+	assert.True(t, processed.reserve(1234, 1))
+	assert.False(t, processed.reserve(1234, 1), "a message being saved should not be claimed again")
+	assert.True(t, processed.reserve(1234, 2))
+	processed.release(1234, 1)
+	assert.True(t, processed.reserve(1234, 1), "a failed save should be possible to try again")
+	processed.markSaved(1234, 1, time.Now())
+	assert.False(t, processed.reserve(1234, 1))
+}
+
+func Test_processedUpdates_ShouldWriteTheOffsetLater(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "processed.json")
+	processed, err := newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error creating processed updates, got %v", err)
+	}
+
+	processed.advance(10)
+	processed.advance(11)
+	reloaded, err := newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error reading processed updates, got %v", err)
+	}
+	assert.Equal(t, 0, reloaded.offset(), "advancing should not write the file every time")
+
+	processed.flush()
+	reloaded, err = newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error reading processed updates, got %v", err)
+	}
+	assert.Equal(t, 11, reloaded.offset())
+
+	// A restart of the update ids moves the offset back and is written right away
+	processed.rebase(6)
+	reloaded, err = newProcessedUpdates(path)
+	if err != nil {
+		t.Fatalf("error reading processed updates, got %v", err)
+	}
+	assert.Equal(t, 6, reloaded.offset())
+}
@@ -0,0 +1,224 @@
+package tgbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"time"
+)
+
+// shadow runs the messages also through a second client, e.g. another deployment or prompt, and records how its
+// results differ from those of the primary client. The shadow results are never shown to the user or saved
+type shadow struct {
+	client OpenAIClient
+	// model is the deployment or model name of the client, which its usage is priced with
+	model string
+	mu    sync.Mutex
+	out   io.Writer
+}
+
+func newShadow(client OpenAIClient, model string, out io.Writer) *shadow {
+	return &shadow{client: client, model: model, out: out}
+}
+
+// shadowPain is a pain description in a shadow record
+type shadowPain struct {
+	LocationId int    `json:"locationId"`
+	Location   string `json:"location"`
+	SideId     int    `json:"sideId"`
+	Side       string `json:"side"`
+	Level      int    `json:"level"`
+	Numbness   bool   `json:"numbness"`
+}
+
+// levelDelta is a pain both clients found with different levels. Delta is the shadow level minus the primary level
+type levelDelta struct {
+	shadowPain
+	ShadowLevel int `json:"shadowLevel"`
+	Delta       int `json:"delta"`
+}
+
+// shadowDiff is how the pain descriptions of the shadow client differ from those of the primary client. The pains
+// are paired by body part and side, then by body part only
+type shadowDiff struct {
+	// Added are the pains only the shadow client found
+	Added []shadowPain `json:"added,omitempty"`
+	// Missing are the pains the shadow client did not find
+	Missing     []shadowPain `json:"missing,omitempty"`
+	LevelDeltas []levelDelta `json:"levelDeltas,omitempty"`
+	// SideChanges are the pains the shadow client found on another side, as the shadow client has them
+	SideChanges []shadowPain `json:"sideChanges,omitempty"`
+	// NumbnessChanges are the pains where the clients disagree on numbness, as the shadow client has them
+	NumbnessChanges []shadowPain `json:"numbnessChanges,omitempty"`
+}
+
+// shadowRecord is a line of the shadow log
+type shadowRecord struct {
+	Time      time.Time    `json:"time"`
+	ChatId    int64        `json:"chatId"`
+	MessageId int          `json:"messageId"`
+	Text      string       `json:"text"`
+	Primary   []shadowPain `json:"primary"`
+	Shadow    []shadowPain `json:"shadow"`
+	// PrimaryKind and ShadowKind tell when a client did not return pain descriptions, e.g. "clarification"
+	PrimaryKind  string     `json:"primaryKind,omitempty"`
+	ShadowKind   string     `json:"shadowKind,omitempty"`
+	PrimaryError string     `json:"primaryError,omitempty"`
+	ShadowError  string     `json:"shadowError,omitempty"`
+	Same         bool       `json:"same"`
+	Diff         shadowDiff `json:"diff"`
+}
+
+// run sends the text to the shadow client and records the difference to the result of the primary client. It is
+// meant to be run in its own goroutine after the primary client has answered, so the user does not wait for it.
+// Returns the usage of the shadow client
+func (s *shadow) run(ctx context.Context, chatID int64, messageID int, text string, mc openai.MessageContext, primary openai.Result, primaryErr error) openai.Usage {
+	// The shadow must not talk to the user
+	mc.OnRetry = nil
+	result, err := s.client.GetPainDescriptionObject(ctx, text, mc, nil)
+
+	record := shadowRecord{
+		Time:      time.Now().UTC(),
+		ChatId:    chatID,
+		MessageId: messageID,
+		Text:      text,
+		Primary:   toShadowPains(primary.PainDescriptions),
+		Shadow:    toShadowPains(result.PainDescriptions),
+		Diff:      diffPains(primary.PainDescriptions, result.PainDescriptions),
+	}
+	if primaryErr != nil {
+		record.PrimaryError = primaryErr.Error()
+	} else {
+		record.PrimaryKind = primary.Kind.String()
+	}
+	if err != nil {
+		record.ShadowError = err.Error()
+	} else {
+		record.ShadowKind = result.Kind.String()
+	}
+	record.Same = primaryErr == nil && err == nil && primary.Kind == result.Kind && record.Diff.empty()
+
+	if err := s.record(record); err != nil {
+		log.Printf("Error recording shadow result: %v", err)
+	}
+	return result.Usage
+}
+
+// record writes the record as a line of JSON
+func (s *shadow) record(record shadowRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to marshal shadow record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(data, '\n'))
+	return err
+}
+
+// close closes the shadow log file, if there is one. The records of the runs that are still going after it are
+// written to the log
+func (s *shadow) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closer, ok := s.out.(io.Closer)
+	s.out = logWriter{}
+	if !ok {
+		return nil
+	}
+	if err := closer.Close(); err != nil {
+		return fmt.Errorf("unable to close shadow log: %w", err)
+	}
+	return nil
+}
+
+// diffPains compares the pain descriptions of the shadow client to those of the primary client
+func diffPains(primary, shadow []models.PainDescription) shadowDiff {
+	var diff shadowDiff
+	paired := make([]bool, len(shadow))
+
+	sameSide := func(p, s models.PainDescription) bool { return p.LocationId == s.LocationId && p.SideId == s.SideId }
+	sameLocation := func(p, s models.PainDescription) bool { return p.LocationId == s.LocationId }
+	pairs := make(map[int]int)
+	for _, same := range []func(p, s models.PainDescription) bool{sameSide, sameLocation} {
+		for i, p := range primary {
+			if _, ok := pairs[i]; ok {
+				continue
+			}
+			for j, s := range shadow {
+				if !paired[j] && same(p, s) {
+					pairs[i] = j
+					paired[j] = true
+					break
+				}
+			}
+		}
+	}
+
+	for i, p := range primary {
+		j, ok := pairs[i]
+		if !ok {
+			diff.Missing = append(diff.Missing, toShadowPain(p))
+			continue
+		}
+		s := shadow[j]
+		if s.Level != p.Level {
+			diff.LevelDeltas = append(diff.LevelDeltas, levelDelta{
+				shadowPain:  toShadowPain(p),
+				ShadowLevel: s.Level,
+				Delta:       s.Level - p.Level,
+			})
+		}
+		if s.SideId != p.SideId {
+			diff.SideChanges = append(diff.SideChanges, toShadowPain(s))
+		}
+		if s.Numbness != p.Numbness {
+			diff.NumbnessChanges = append(diff.NumbnessChanges, toShadowPain(s))
+		}
+	}
+	for j, s := range shadow {
+		if !paired[j] {
+			diff.Added = append(diff.Added, toShadowPain(s))
+		}
+	}
+	return diff
+}
+
+func (d shadowDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Missing) == 0 && len(d.LevelDeltas) == 0 && len(d.SideChanges) == 0 &&
+		len(d.NumbnessChanges) == 0
+}
+
+func toShadowPain(p models.PainDescription) shadowPain {
+	return shadowPain{
+		LocationId: p.LocationId,
+		Location:   models.BodyPartMapping[p.LocationId],
+		SideId:     p.SideId,
+		Side:       models.SideMap[p.SideId],
+		Level:      p.Level,
+		Numbness:   p.Numbness,
+	}
+}
+
+func toShadowPains(pd []models.PainDescription) []shadowPain {
+	pains := make([]shadowPain, 0, len(pd))
+	for _, p := range pd {
+		pains = append(pains, toShadowPain(p))
+	}
+	return pains
+}
+
+// logWriter writes the shadow records to the log when no shadow log file is configured
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Printf("Shadow: %s", bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
@@ -0,0 +1,192 @@
+package tgbot
+
+import (
+	"encoding/json"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"os"
+	"path/filepath"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+// recordWriter passes the written shadow records to the test
+type recordWriter chan []byte
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func Test_DiffPains(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		primary  []models.PainDescription
+		shadow   []models.PainDescription
+		expected shadowDiff
+		same     bool
+	}{
+		"Same": {
+			primary: []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4}},
+			shadow:  []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4}},
+			same:    true,
+		},
+		"AddedAndMissing": {
+			primary: []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4}},
+			shadow:  []models.PainDescription{{LocationId: 3, SideId: 1, Level: 4}},
+			expected: shadowDiff{
+				Added:   []shadowPain{{LocationId: 3, Location: "Shoulder", SideId: 1, Side: "Both", Level: 4}},
+				Missing: []shadowPain{{LocationId: 2, Location: "Neck", SideId: 1, Side: "Both", Level: 4}},
+			},
+		},
+		"LevelDelta": {
+			primary: []models.PainDescription{{LocationId: 9, SideId: 1, Level: 6}, {LocationId: 12, SideId: 2, Level: 3}},
+			shadow:  []models.PainDescription{{LocationId: 12, SideId: 2, Level: 3}, {LocationId: 9, SideId: 1, Level: 4}},
+			expected: shadowDiff{
+				LevelDeltas: []levelDelta{{
+					shadowPain:  shadowPain{LocationId: 9, Location: "Lower Back", SideId: 1, Side: "Both", Level: 6},
+					ShadowLevel: 4,
+					Delta:       -2,
+				}},
+			},
+		},
+		"SideAndNumbness": {
+			primary: []models.PainDescription{{LocationId: 4, SideId: 2, Level: 5}},
+			shadow:  []models.PainDescription{{LocationId: 4, SideId: 3, Level: 5, Numbness: true}},
+			expected: shadowDiff{
+				SideChanges:     []shadowPain{{LocationId: 4, Location: "Arm", SideId: 3, Side: "Right", Level: 5, Numbness: true}},
+				NumbnessChanges: []shadowPain{{LocationId: 4, Location: "Arm", SideId: 3, Side: "Right", Level: 5, Numbness: true}},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			diff := diffPains(tt.primary, tt.shadow)
+			assert.Equal(t, tt.expected, diff)
+			assert.Equal(t, tt.same, diff.empty())
+		})
+	}
+}
+
+func Test_Bot_ShadowShouldNotAffectReply(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	mockShadowAI := new(MockAI)
+	records := make(recordWriter, 1)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+		inFlight:      newInFlight(),
+		shadow:        newShadow(mockShadowAI, "shadow", records),
+		usage:         newUsageTracker(nil, "deployment", 0, time.UTC),
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "neck 4"
+	update.Message.MessageID = 7
+	primary := []models.PainDescription{{LocationId: 2, SideId: 1, Level: 4, Description: "neck 4"}}
+	mockAI.On("GetPainDescriptionObject", update.Message.Text, mock.Anything, mock.Anything).
+		Return(openai.Result{Kind: openai.ResultPainDescriptions, PainDescriptions: primary}, nil)
+	mockShadowAI.On("GetPainDescriptionObject", update.Message.Text, mock.Anything, mock.Anything).
+		Return(openai.Result{}, errors.New("deployment not found"))
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.ReplyMarkup != nil
+	})).Return(tgbotapi.Message{MessageID: 42}, nil).Once()
+
+	b.processMessage(update)
+
+	var record shadowRecord
+	select {
+	case line := <-records:
+		assert.NoError(t, json.Unmarshal(line, &record))
+	case <-time.After(time.Second):
+		t.Fatal("expected a shadow record")
+	}
+	mockBotAPI.AssertExpectations(t)
+	assert.Equal(t, int64(1234), record.ChatId)
+	assert.Equal(t, 7, record.MessageId)
+	assert.Equal(t, "deployment not found", record.ShadowError)
+	assert.False(t, record.Same)
+	assert.Len(t, record.Diff.Missing, 1)
+	assert.True(t, b.inFlight.wait(time.Second))
+	assert.Contains(t, b.usage.summary("", 1, time.Now()), shadowUsageUser+"\n", "the shadow calls should be counted apart")
+
+	d, ok := b.drafts.take(draftKey{chatID: 1234, messageID: 42})
+	if assert.True(t, ok) {
+		assert.Equal(t, primary, d.painDesc)
+	}
+}
+
+func Test_Bot_ShadowShouldSkipAnswersToClarifications(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	mockShadowAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+		shadow:        newShadow(mockShadowAI, "shadow", make(recordWriter, 1)),
+	}
+	b.conversations.set(1234, openai.NewConversation(openai.NewUserMessage("it hurts again")))
+
+	update := generateTestUpdate()
+	update.Message.Text = "neck 4 now"
+	mockAI.On("GetPainDescriptionObject", update.Message.Text, mock.Anything, mock.Anything).
+		Return(openai.Result{Kind: openai.ResultText, Text: "ok"}, nil)
+	mockBotAPI.On("Send", mock.Anything).Return(tgbotapi.Message{}, nil)
+
+	b.processMessage(update)
+
+	mockShadowAI.AssertNotCalled(t, "GetPainDescriptionObject", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_Bot_StopShouldWaitForShadowAndCloseTheLog(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	shadowAI := newBlockingAI()
+	logFile, err := os.Create(filepath.Join(t.TempDir(), "shadow.jsonl"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := newStoppableTestBot(mockBotAPI)
+	b.openAIClient = mockAI
+	b.shadow = newShadow(shadowAI, "shadow", logFile)
+	replied := make(chan struct{})
+	mockAI.On("GetPainDescriptionObject", "neck 4", mock.Anything, mock.Anything).
+		Return(openai.Result{Kind: openai.ResultText, Text: "ok"}, nil)
+	mockBotAPI.On("Send", mock.Anything).Run(func(mock.Arguments) { close(replied) }).Return(tgbotapi.Message{}, nil).Once()
+
+	updates, reports := startTestBot(b, mockBotAPI)
+	update := generateTestUpdate()
+	update.Message.Text = "neck 4"
+	updates <- update
+	<-replied
+	<-shadowAI.started
+	b.Stop()
+
+	// The shadow run is aborted once the grace period has passed, and its record is written before the log is closed
+	assert.True(t, waitForReport(t, reports).Clean())
+	data, err := os.ReadFile(logFile.Name())
+	assert.NoError(t, err)
+	var record shadowRecord
+	assert.NoError(t, json.Unmarshal(data, &record))
+	assert.Contains(t, record.ShadowError, "context canceled")
+	_, err = logFile.Write([]byte("{}\n"))
+	assert.Error(t, err, "the shadow log should be closed")
+}
@@ -1,13 +1,22 @@
 package tgbot
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"t-pain/pkg/database"
 	"t-pain/pkg/models"
 	"t-pain/pkg/openai"
+	"t-pain/pkg/ruleparser"
 	"t-pain/pkg/speechtotext"
 	"time"
 	_ "time/tzdata"
@@ -18,31 +27,147 @@ type BotAPI interface {
 	GetFileDirectURL(fileID string) (string, error)
 	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
 	GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	StopReceivingUpdates()
 }
 
 type OpenAIClient interface {
-	GetPainDescriptionObject(string) ([]models.PainDescription, error)
+	GetPainDescriptionObject(context.Context, string, openai.MessageContext, *openai.Conversation) (openai.Result, error)
 }
 
-type LogAnalyticsClient interface {
-	SavePainDescriptionsToLogAnalytics([]models.PainDescriptionLogEntry) error
+// SpeechClient turns the voice message at the URL into text
+type SpeechClient interface {
+	Recognize(ctx context.Context, fileURL string) (string, error)
+}
+
+// azureSpeechClient recognizes speech with the Azure Speech service
+type azureSpeechClient struct {
+	config *speechtotext.Config
+}
+
+func (c azureSpeechClient) Recognize(ctx context.Context, fileURL string) (string, error) {
+	recognizer, err := speechtotext.NewWrapper(c.config.Key, c.config.Region)
+	if err != nil {
+		return "", fmt.Errorf("recognizer creation: %w", err)
+	}
+	return speechtotext.HandleAudioLink(ctx, fileURL, recognizer)
+}
+
+// stageTimeouts are the deadlines of the stages of handling a message, zero for none
+type stageTimeouts struct {
+	speech time.Duration
+	openAI time.Duration
+	store  time.Duration
 }
 
 // Bot contains the bot and all the clients
 type Bot struct {
-	Bot                BotAPI
-	speechConfig       *speechtotext.Config
-	openAIClient       OpenAIClient
-	logAnalyticsClient LogAnalyticsClient
-	done               chan struct{}
+	Bot          BotAPI
+	speechClient SpeechClient
+	openAIClient OpenAIClient
+	store        database.Store
+	// outbox retries the saves the store did not accept, nil when not enabled. It is also the store then
+	outbox *database.Outbox
+	drafts *draftStore
+	// lastSaves are the entries each user saved or corrected last, nil when not tracked
+	lastSaves *lastSaves
+	// conversations are the chats where the bot waits for an answer to a clarifying question
+	conversations *conversationStore
+	commands      *CommandRegistry
+	location      *time.Location
+	timeouts      stageTimeouts
+	// ctx is cancelled to abort the work in progress once the grace period of stopping has passed
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
+	inFlight *inFlight
+	// gracePeriod is how long stopping waits for the updates in progress
+	gracePeriod time.Duration
+	// pendingPath is the file the unfinished messages are saved to when stopping, empty to drop them
+	pendingPath string
+	// processed keeps Telegram from getting the handled updates handled again, nil when not tracked
+	processed *processedUpdates
+	// shadow compares the results of another client to those of openAIClient, nil when not enabled
+	shadow *shadow
+	usage  *usageTracker
+	// metrics serves the expvar metrics, nil when not enabled
+	metrics *http.Server
+	// admins see the usage of every user
+	admins map[int64]bool
 }
 
 // NewDefaultBot creates a new Bot with just a config struct
 func NewDefaultBot(c *Config) (*Bot, error) {
+	// OPENAI
+	openAIClient, err := newOpenAIClient(c, c.openAiDeploymentName, c.openAiPrompt)
+	if err != nil {
+		return nil, err
+	}
+	deps := botDeps{openAIClient: openAIClient}
 
+	if c.shadowEnabled {
+		prompt := c.shadowPrompt
+		if prompt == nil {
+			prompt = c.openAiPrompt
+		}
+		shadowClient, err := newOpenAIClient(c, c.shadowDeployment(), prompt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create shadow client: %w", err)
+		}
+		deps.shadowClient = shadowClient
+	}
+
+	// DATA SAVING
+	deps.store, err = newStore(c)
+	if err != nil {
+		return nil, err
+	}
+	return newBot(c, deps)
+}
+
+// botDeps are the clients of the Bot that NewInjectedBot lets the caller replace
+type botDeps struct {
+	openAIClient OpenAIClient
+	// shadowClient is nil when the shadow is not enabled
+	shadowClient OpenAIClient
+	store        database.Store
+}
+
+// newBot creates a Bot with the clients, doing the setup both constructors share
+func newBot(c *Config, deps botDeps) (*Bot, error) {
 	botObj := &Bot{}
-	done := make(chan struct{})
-	botObj.done = done
+	botObj.ctx, botObj.cancel = context.WithCancel(context.Background())
+	botObj.done = make(chan struct{})
+	botObj.inFlight = newInFlight()
+	botObj.gracePeriod = c.shutdownGracePeriod
+	botObj.pendingPath = c.pendingPath
+	processed, err := newProcessedUpdates(c.processedPath)
+	if err != nil {
+		return nil, err
+	}
+	botObj.processed = processed
+	botObj.inFlight.advanced = processed.advance
+	botObj.inFlight.rebased = processed.rebase
+	botObj.timeouts = newStageTimeouts(c)
+	botObj.drafts = newDraftStore(c.draftTimeout)
+	botObj.lastSaves, err = newLastSaves(lastSavesPath(c.processedPath))
+	if err != nil {
+		return nil, err
+	}
+	botObj.conversations = newConversationStore(c.clarificationTimeout)
+	botObj.location = c.location
+	botObj.usage = newUsageTracker(c.openAiPrices, c.openAiDeploymentName, c.dailyTokenBudget, c.location)
+	botObj.admins = make(map[int64]bool)
+	for _, id := range c.admins {
+		botObj.admins[id] = true
+	}
+
+	commands, err := newDefaultCommands()
+	if err != nil {
+		return nil, err
+	}
+	botObj.commands = commands
 
 	bot, err := tgbotapi.NewBotAPI(c.botToken)
 	if err != nil {
@@ -57,83 +182,247 @@ func NewDefaultBot(c *Config) (*Bot, error) {
 	botObj.Bot = bot
 
 	// SPEECH TO TEXT
-	botObj.speechConfig = speechtotext.NewConfig(c.speechKey, c.speechRegion)
+	botObj.speechClient = azureSpeechClient{config: speechtotext.NewConfig(c.speechKey, c.speechRegion)}
+
+	botObj.openAIClient = deps.openAIClient
+	if deps.shadowClient != nil {
+		var out io.Writer = logWriter{}
+		if c.shadowLogPath != "" {
+			f, err := os.OpenFile(c.shadowLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open shadow log: %w", err)
+			}
+			out = f
+		}
+		botObj.shadow = newShadow(deps.shadowClient, c.shadowDeployment(), out)
+	}
 
-	// OPENAI
-	oaiConf, err := openai.NewConfig(c.openAiEndpoint, c.openAiDeploymentName, openai.WithApiKey(c.openAiKey))
-	if err != nil {
+	if err := botObj.setStore(c, deps.store); err != nil {
 		return nil, err
 	}
-	openAIClient, err := openai.NewClient(oaiConf)
-	if err != nil {
-		return nil, err
+	// The expvar names are global, so only the first bot of the process publishes its outbox
+	if botObj.outbox != nil && expvar.Get("outbox_depth") == nil {
+		expvar.Publish("outbox_depth", expvar.Func(func() any { return botObj.outbox.Len() }))
 	}
-	botObj.openAIClient = openAIClient
 
-	// DATA SAVING
-	dcClient, err := database.NewLogAnalyticsClient(c.dataCollectionEndpoint, c.dataCollectionRuleId, c.dataCollectionStreamName)
-	if err != nil {
-		return nil, err
+	if c.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		botObj.metrics = &http.Server{Addr: c.metricsAddr, Handler: mux}
+		go func() {
+			if err := botObj.metrics.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Error serving metrics: %v", err)
+			}
+		}()
 	}
-	botObj.logAnalyticsClient = dcClient
 
 	return botObj, nil
 }
 
-// NewInjectedBot creates a new Bot with all the clients injected to assist with testing if tests were placed outside the package
-func NewInjectedBot(c *Config, openAIClient OpenAIClient, logAnalyticsClient LogAnalyticsClient) (*Bot, error) {
-	botObj := &Bot{}
-	botObj.done = make(chan struct{})
+func newStageTimeouts(c *Config) stageTimeouts {
+	return stageTimeouts{speech: c.speechTimeout, openAI: c.openAiTimeout, store: c.storeTimeout}
+}
 
-	bot, err := tgbotapi.NewBotAPI(c.botToken)
+// newOpenAIClient creates a client for the deployment, or model, with the prompt. A nil prompt is the default one
+func newOpenAIClient(c *Config, deploymentName string, prompt *openai.Prompt) (*openai.Client, error) {
+	provider, err := openai.NewProvider(c.openAiProvider, c.openAiEndpoint, deploymentName, c.openAiKey, c.openAiManagedIdentity)
 	if err != nil {
 		return nil, err
 	}
-	bot.Debug = true
-	botObj.Bot = bot
+	retryPolicy := openai.DefaultRetryPolicy()
+	retryPolicy.MaxRetries = c.openAiMaxRetries
+	oaiOpts := []openai.ConfigOpt{
+		openai.WithTimestampLookback(c.timestampLookback),
+		openai.WithRetryPolicy(retryPolicy),
+		openai.WithTokensPerMinute(c.openAiTokensPerMinute),
+	}
+	if prompt != nil {
+		oaiOpts = append(oaiOpts, openai.WithPrompt(prompt))
+	}
+	oaiConf, err := openai.NewConfig(provider, oaiOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return openai.NewClient(oaiConf)
+}
 
-	botObj.speechConfig = speechtotext.NewConfig(c.speechKey, c.speechRegion)
-	botObj.openAIClient = openAIClient
-	botObj.logAnalyticsClient = logAnalyticsClient
-	return botObj, nil
+// newStore creates the storage backend chosen in the config
+func newStore(c *Config) (database.Store, error) {
+	switch c.storageBackend {
+	case StorageSQLite:
+		return database.NewSQLiteStore(c.sqlitePath)
+	case StorageLogAnalytics:
+		var opts []database.LogAnalyticsClientOption
+		if c.logAnalyticsWorkspaceId != "" {
+			opts = append(opts, database.WithQueryWorkspace(c.logAnalyticsWorkspaceId))
+		}
+		if c.logAnalyticsGzip {
+			opts = append(opts, database.WithGzip())
+		}
+		if c.logAnalyticsFlushInterval > 0 {
+			// A save waits for the interval and then the upload, all within the store timeout
+			opts = append(opts, database.WithFlushInterval(c.logAnalyticsFlushInterval),
+				database.WithFlushTimeout(c.storeTimeout-c.logAnalyticsFlushInterval))
+		}
+		return database.NewLogAnalyticsClient(c.dataCollectionEndpoint, c.dataCollectionRuleId, c.dataCollectionStreamName, opts...)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", c.storageBackend)
+	}
 }
 
-func (b *Bot) Run() {
-	u := tgbotapi.NewUpdate(0)
+// NewInjectedBot creates a new Bot with all the clients injected to assist with testing if tests were placed outside the package.
+// With the shadow enabled, the injected OpenAI client is also the shadow client
+func NewInjectedBot(c *Config, openAIClient OpenAIClient, store database.Store) (*Bot, error) {
+	deps := botDeps{openAIClient: openAIClient, store: store}
+	if c.shadowEnabled {
+		deps.shadowClient = openAIClient
+	}
+	return newBot(c, deps)
+}
+
+// setStore sets the store the entries are saved to, behind an outbox if one is configured
+func (b *Bot) setStore(c *Config, store database.Store) error {
+	b.store = store
+	if c.outboxDir == "" {
+		return nil
+	}
+	outbox, err := database.NewOutbox(c.outboxDir, store)
+	if err != nil {
+		return err
+	}
+	b.store = outbox
+	b.outbox = outbox
+	return nil
+}
+
+// Run handles the updates until Stop is called or the updates channel is closed. The messages left unfinished by
+// the last shutdown are handled first. Returns what happened to the updates in progress when stopping
+func (b *Bot) Run() ShutdownReport {
+	// Polling continues from the first update that was not handled before the restart
+	offset := 0
+	if b.processed != nil {
+		offset = b.processed.offset()
+	}
+	u := tgbotapi.NewUpdate(offset)
 	u.Timeout = 60
 
+	b.registerCommandMenu()
+
+	pending, err := b.loadPending()
+	if err != nil {
+		log.Printf("Error loading the unfinished messages: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Printf("Handling %d messages left unfinished by the last shutdown", len(pending))
+	}
+	for _, update := range pending {
+		b.handleUpdate(update)
+	}
+	b.inFlight.skipTo(offset)
+	if b.outbox != nil {
+		go b.outbox.Run(b.ctx)
+	}
+
 	updates := b.Bot.GetUpdatesChan(u)
 
+	expiryTicker := time.NewTicker(time.Minute)
+	defer expiryTicker.Stop()
+
 	for {
 		select {
 		case update, ok := <-updates:
 			if !ok {
-				return
+				return b.shutdown()
 			}
-			if update.Message != nil {
-				if _, ok := models.UserIDs[update.Message.From.ID]; !ok {
-					log.Printf("Unauthorized user tried to use the bot: %v", update.Message.From)
-					b.reply(update, "You are not authorized to use this bot")
-					continue
-				}
-				if update.Message.IsCommand() {
-					b.reply(update, "Welcome to the T-Pain bot. You can send me a voice message or text message and I will log it. No commands are currently supported.")
-					continue
-				}
-				go b.processMessage(update)
+			b.handleUpdate(update)
+		case now := <-expiryTicker.C:
+			b.expireDrafts(now)
+			b.conversations.removeExpired(now)
+			if b.usage != nil {
+				b.usage.removeOld(now)
 			}
 		case <-b.done:
+			return b.shutdown()
+		}
+	}
+}
+
+// handleUpdate checks that the user is authorized and handles the update in the background. The updates that
+// Telegram delivers again are skipped
+func (b *Bot) handleUpdate(update tgbotapi.Update) {
+	if !b.inFlight.receive(update) {
+		log.Printf("Skipping update %d, it was already received", update.UpdateID)
+		return
+	}
+	if update.CallbackQuery != nil {
+		if _, ok := models.UserIDs[update.CallbackQuery.From.ID]; !ok {
+			log.Printf("Unauthorized user tried to use the bot: %v", update.CallbackQuery.From)
+			b.answerCallback(update.CallbackQuery.ID, "You are not authorized to use this bot")
+			b.inFlight.finish(update.UpdateID)
+			return
+		}
+		b.inFlight.run(update, func() error {
+			return b.processCallback(update)
+		})
+		return
+	}
+	if update.Message != nil {
+		if _, ok := models.UserIDs[update.Message.From.ID]; !ok {
+			log.Printf("Unauthorized user tried to use the bot: %v", update.Message.From)
+			b.reply(update, "You are not authorized to use this bot")
+			b.inFlight.finish(update.UpdateID)
 			return
 		}
+		if update.Message.IsCommand() {
+			b.inFlight.run(update, func() error {
+				b.handleCommand(update)
+				return nil
+			})
+			return
+		}
+		b.inFlight.run(update, func() error {
+			return b.processMessage(update)
+		})
+		return
 	}
+	// The other kinds of updates are not handled
+	b.inFlight.finish(update.UpdateID)
 }
 
+// Stop makes Run stop polling for updates, wait for the ones in progress and return. It may be called many times,
+// also after Run has returned
 func (b *Bot) Stop() {
-	b.done <- struct{}{}
+	b.stopOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+// stageContext returns the context for a stage of handling a message, which is done when the timeout of the stage
+// passes or the bot is stopped
+func (b *Bot) stageContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := b.ctx
+	if ctx == nil {
+		// The bot was not created with a constructor, e.g. in tests
+		ctx = context.Background()
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
-func (b *Bot) processMessage(update tgbotapi.Update) {
+// processMessage turns the message into a draft, or answers why it could not. Returns an error only when the bot
+// was stopped before the message was handled, so that it can be handled again after a restart
+func (b *Bot) processMessage(update tgbotapi.Update) error {
+	if b.processed != nil && b.processed.isSaved(update.Message.Chat.ID, update.Message.MessageID) {
+		log.Printf("Skipping message %d, its entries were already saved", update.Message.MessageID)
+		return nil
+	}
+
 	receivedText, err := b.processToText(update)
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("processMessage: %w", err)
+	}
 	if err != nil {
 		log.Printf("Error processing message: %v", err)
 		if err.Error() == "This bot can only handle text and voice messages" {
@@ -141,26 +430,120 @@ func (b *Bot) processMessage(update tgbotapi.Update) {
 		} else {
 			b.reply(update, "Error processing message. Please contact Pasi")
 		}
-		return
+		return nil
+	}
+
+	// Times like "last night" are relative to when the user sent the message, not when it is processed
+	mc := openai.MessageContext{SentAt: update.Message.Time(), Location: b.location}
+	mc.OnRetry = func(info openai.RetryInfo) {
+		// Tell the user once why the answer is slow, the later retries are only logged
+		if info.Retry == 1 {
+			b.reply(update, fmt.Sprintf("The language model is busy, retrying in %s...", info.Wait.Round(time.Second)))
+		}
+	}
+	chatID := update.Message.Chat.ID
+	usageUser := usageUser(update.Message.From.ID)
+	if b.usage != nil && b.usage.exceeded(usageUser, time.Now()) {
+		log.Printf("[%s] daily token budget exceeded", update.Message.From.UserName)
+		if !b.sendFallbackDraft(update, receivedText, "You have used your daily share of the language model, so "+
+			"your message was read with a simple offline parser. Please check the entries carefully before saving.") {
+			b.reply(update, "You have used your daily share of the language model and the simple offline parser "+
+				"could not read your message. The limit resets at midnight, please try again tomorrow.")
+		}
+		return nil
 	}
 
-	painDesc, err := b.openAIClient.GetPainDescriptionObject(receivedText)
+	conversation := b.conversations.get(chatID)
+	ctx, cancel := b.stageContext(b.timeouts.openAI)
+	result, err := b.openAIClient.GetPainDescriptionObject(ctx, receivedText, mc, conversation)
+	cancel()
+	if b.usage != nil {
+		b.usage.add(usageUser, time.Now(), result.Usage)
+	}
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("processMessage: %w", err)
+	}
+	// Answers to clarifying questions only make sense in the conversation of the primary client
+	if b.shadow != nil && conversation == nil {
+		b.inFlight.background(func() {
+			ctx, cancel := b.stageContext(b.timeouts.openAI)
+			defer cancel()
+			usage := b.shadow.run(ctx, chatID, update.Message.MessageID, receivedText, mc, result, err)
+			if b.usage != nil {
+				b.usage.addModel(shadowUsageUser, b.shadow.model, time.Now(), usage)
+			}
+		})
+	}
+	var invalidErr *openai.InvalidOutputError
+	if errors.As(err, &invalidErr) {
+		log.Printf("Error processing message: %v", err)
+		b.reply(update, fmt.Sprintf("I could not turn your message into valid entries:\n%v\nPlease try describing the pains again, "+
+			"for example \"lower back 6, left knee 3\".", invalidErr.Err))
+		return nil
+	}
 	if err != nil {
 		log.Printf("Error processing message: %v", err)
-		b.reply(update, err.Error())
-		return
+		// The model is unavailable, so fall back to the rules to still get the message logged
+		if b.sendFallbackDraft(update, receivedText, "The language model is not available, so your message was read "+
+			"with a simple offline parser. Please check the entries carefully before saving.") {
+			return nil
+		}
+		var apiErr *openai.APIError
+		if errors.As(err, &apiErr) && apiErr.Busy() {
+			b.reply(update, "The language model is too busy at the moment. Please send your message again in a minute.")
+			return nil
+		}
+		b.reply(update, "Error interpreting your message. Please contact Pasi and try again later.")
+		return nil
 	}
 
-	err = b.saveDataToLogAnalytics(update.Message.From.ID, painDesc)
-	if err != nil {
-		log.Printf("Error saving data to log analytics: %v", err)
-		b.reply(update, "Error saving data. Please contact Pasi and try again later.")
-		return
+	// The conversation continues only while the model keeps asking questions
+	if result.Kind == openai.ResultClarification {
+		b.conversations.set(chatID, result.Conversation)
+		b.reply(update, result.Text+"\n\nAnswer the question, or send /cancel to start over.")
+		return nil
+	}
+	b.conversations.remove(chatID)
+
+	switch result.Kind {
+	case openai.ResultRefusal:
+		log.Printf("Model refused to process the message: %s", result.Text)
+		b.reply(update, "Sorry, I can't process this message. Please describe your pains differently.")
+		return nil
+	case openai.ResultText:
+		if result.Text == "" {
+			result.Text = "I could not find any pain descriptions in your message. Please try again."
+		}
+		b.reply(update, result.Text)
+		return nil
+	}
+
+	painDesc := result.PainDescriptions
+	if len(painDesc) == 0 {
+		b.reply(update, "I could not find any pain descriptions in your message. Please try again.")
+		return nil
 	}
 
 	log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
 
-	b.reply(update, fmtReply(painDesc))
+	b.sendDraft(update, painDesc)
+	return nil
+}
+
+// sendFallbackDraft parses the text with the rule based parser and sends the notice and the result as a draft.
+// Returns false if the parser did not understand the text
+func (b *Bot) sendFallbackDraft(update tgbotapi.Update, text, notice string) bool {
+	painDesc, err := ruleparser.Parse(text, update.Message.Time())
+	if err != nil {
+		log.Printf("Fallback parser could not parse the message: %v", err)
+		return false
+	}
+
+	b.conversations.remove(update.Message.Chat.ID)
+	log.Printf("[%s] %s (fallback parser)", update.Message.From.UserName, update.Message.Text)
+	b.reply(update, notice)
+	b.sendDraft(update, painDesc)
+	return true
 }
 
 func (b *Bot) reply(update tgbotapi.Update, replyText string) {
@@ -178,11 +561,12 @@ func (b *Bot) processToText(update tgbotapi.Update) (string, error) {
 	if update.Message.Voice != nil {
 		log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Voice.FileID)
 		fileLink, err := b.Bot.GetFileDirectURL(update.Message.Voice.FileID)
-		recognizer, err := speechtotext.NewWrapper(b.speechConfig.Key, b.speechConfig.Region)
 		if err != nil {
-			return "", fmt.Errorf("processToText: recognizer creation: %w", err)
+			return "", fmt.Errorf("processToText: file link: %w", err)
 		}
-		text, err = speechtotext.HandleAudioLink(fileLink, recognizer)
+		ctx, cancel := b.stageContext(b.timeouts.speech)
+		defer cancel()
+		text, err = b.speechClient.Recognize(ctx, fileLink)
 		if err != nil {
 			log.Printf("processToText: Error handling audio: %v", err)
 			return "", fmt.Errorf("processToText: Error handling audio: %w", err)
@@ -196,24 +580,32 @@ func (b *Bot) processToText(update tgbotapi.Update) (string, error) {
 	return text, nil
 }
 
-func (b *Bot) saveDataToLogAnalytics(userId int64, pd []models.PainDescription) error {
-	var data []models.PainDescriptionLogEntry
-	for _, pain := range pd {
-		logEntry, err := pain.MapToLogEntry(userId)
-		if err != nil {
-			return fmt.Errorf("saveDataToLogAnalytics: %w", err)
-		}
-		data = append(data, logEntry)
-	}
-	err := b.logAnalyticsClient.SavePainDescriptionsToLogAnalytics(data)
+// saveData saves the pains read from the message the metadata is of
+func (b *Bot) saveData(userId int64, pd []models.PainDescription, meta models.EntryMetadata) error {
+	data, err := models.MapToLogEntries(userId, pd, meta)
 	if err != nil {
-		return fmt.Errorf("saveDataToLogAnalytics: %w", err)
+		return fmt.Errorf("saveData: %w", err)
+	}
+	if err := b.appendEntries(userId, data); err != nil {
+		return fmt.Errorf("saveData: %w", err)
 	}
 	return nil
 }
 
-// fmtReply formats a non-error reply to the user
-func fmtReply(pd []models.PainDescription) string {
+// appendEntries saves the records to the store and remembers them as the user's last save. An error wrapping
+// database.ErrQueued means the records are saved later by the outbox
+func (b *Bot) appendEntries(userID int64, data []models.PainDescriptionLogEntry) error {
+	ctx, cancel := b.stageContext(b.timeouts.store)
+	defer cancel()
+	err := b.store.Append(ctx, data)
+	if b.lastSaves != nil && (err == nil || errors.Is(err, database.ErrQueued)) {
+		b.lastSaves.record(userID, data, time.Now())
+	}
+	return err
+}
+
+// fmtReply formats a non-error reply to the user, showing the time in the given location
+func fmtReply(pd []models.PainDescription, loc *time.Location) string {
 	var result strings.Builder
 	if len(pd) == 0 {
 		return ""
@@ -221,20 +613,38 @@ func fmtReply(pd []models.PainDescription) string {
 
 	first := pd[0]
 
-	loc, err := time.LoadLocation("Europe/Helsinki")
-	if err != nil {
-		log.Printf("Error loading location: %v", err)
-		return "Error generating reply from description. Your data has been saved. Please contact Pasi"
-	}
-	tstamp := first.Timestamp.Round(time.Minute).In(loc).Format("02-01-2006 15:04")
-
-	result.WriteString(fmt.Sprintf("Timestamp: %s\n", tstamp))
-	result.WriteString("Pains:\n")
-	for _, pain := range pd {
+	// Group the pains by time, a diary style message can describe several times of the day
+	sorted := make([]models.PainDescription, len(pd))
+	copy(sorted, pd)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	var currentHeader string
+	for _, pain := range sorted {
+		tstamp := pain.Timestamp.Round(time.Minute).In(loc).Format("02-01-2006 15:04")
+		header := fmt.Sprintf("Timestamp: %s (%s)\n", tstamp, fmtTimestampSource(pain.TimestampSource))
+		if header != currentHeader {
+			result.WriteString(header)
+			result.WriteString("Pains:\n")
+			currentHeader = header
+		}
 		result.WriteString(fmt.Sprintf("\t- Location: %s, Side: %s, Level: %d\n", models.BodyPartMapping[pain.LocationId], models.SideMap[pain.SideId], pain.Level))
 	}
 	result.WriteString(fmt.Sprintf("Description: %s\n", first.Description))
 	result.WriteString(fmt.Sprintf("Numbness: %t\n", first.Numbness))
 	result.WriteString(fmt.Sprintf("Numbness Description: %s\n", first.NumbnessDescription))
 	return result.String()
-}
\ No newline at end of file
+}
+
+// fmtTimestampSource tells the user which time was used for the entry
+func fmtTimestampSource(source models.TimestampSource) string {
+	switch source {
+	case models.TimestampFromText:
+		return "mentioned in your message"
+	case models.TimestampImplausible:
+		return "when the message was sent, the mentioned time was in the future or too far in the past"
+	default:
+		return "when the message was sent"
+	}
+}
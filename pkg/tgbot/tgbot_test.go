@@ -1,11 +1,17 @@
 package tgbot
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"net/http"
+	"strings"
+	"t-pain/pkg/database"
 	"t-pain/pkg/models"
-	"t-pain/pkg/speechtotext"
+	"t-pain/pkg/openai"
 	"testing"
 	"time"
 )
@@ -29,24 +35,48 @@ func (m *MockBotAPI) GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.Updat
 	return args.Get(0).(tgbotapi.UpdatesChannel)
 }
 
+func (m *MockBotAPI) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	args := m.Called(c)
+	return args.Get(0).(*tgbotapi.APIResponse), args.Error(1)
+}
+
+func (m *MockBotAPI) StopReceivingUpdates() {
+	m.Called()
+}
+
 type MockAI struct {
 	mock.Mock
 }
 
-func (m *MockAI) GetPainDescriptionObject(text string) ([]models.PainDescription, error) {
-	args := m.Called(text)
-	return args.Get(0).([]models.PainDescription), args.Error(1)
+func (m *MockAI) GetPainDescriptionObject(_ context.Context, text string, mc openai.MessageContext, history *openai.Conversation) (openai.Result, error) {
+	args := m.Called(text, mc, history)
+	return args.Get(0).(openai.Result), args.Error(1)
 }
 
-type MockLogAnalytics struct {
+type MockStore struct {
 	mock.Mock
 }
 
-func (m *MockLogAnalytics) SavePainDescriptionsToLogAnalytics(data []models.PainDescriptionLogEntry) error {
+func (m *MockStore) Append(_ context.Context, data []models.PainDescriptionLogEntry) error {
 	args := m.Called(data)
 	return args.Error(0)
 }
 
+func (m *MockStore) List(_ context.Context, userName string, from, to time.Time) ([]database.StoredEntry, error) {
+	args := m.Called(userName, from, to)
+	return args.Get(0).([]database.StoredEntry), args.Error(1)
+}
+
+func (m *MockStore) Update(_ context.Context, id int64, entry models.PainDescriptionLogEntry) error {
+	args := m.Called(id, entry)
+	return args.Error(0)
+}
+
+func (m *MockStore) Delete(_ context.Context, id int64) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
 func generateTestUpdate() tgbotapi.Update {
 	return tgbotapi.Update{
 		Message: &tgbotapi.Message{
@@ -54,37 +84,385 @@ func generateTestUpdate() tgbotapi.Update {
 				ID: 1234,
 			},
 			From: &tgbotapi.User{
+				ID:       1111111111111111111,
+				UserName: "tester",
+			},
+		},
+	}
+}
+
+func generateTestCallback(data string, messageID int) tgbotapi.Update {
+	return tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   "callback",
+			Data: data,
+			From: &tgbotapi.User{
+				ID:       1111111111111111111,
 				UserName: "tester",
 			},
+			Message: &tgbotapi.Message{
+				MessageID: messageID,
+				Chat: &tgbotapi.Chat{
+					ID: 1234,
+				},
+			},
 		},
 	}
 }
 
-func Test_Bot_ShouldProcessNormalTextMessage(t *testing.T) {
+func generateTestPainDescriptions() []models.PainDescription {
+	return []models.PainDescription{{
+		Timestamp:   time.Now(),
+		LocationId:  1,
+		SideId:      1,
+		Level:       1,
+		Description: "Test pain",
+	}}
+}
+
+func generateTestEntryMetadata() models.EntryMetadata {
+	return models.NewEntryMetadata(1234, 7, models.SourceText)
+}
+
+func Test_Bot_ShouldProcessNormalTextMessageIntoDraft(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	mockStore := new(MockStore)
+
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		store:         mockStore,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "Test Message"
+
+	mockAI.On("GetPainDescriptionObject", "Test Message", mock.Anything, mock.Anything).Return(openai.Result{PainDescriptions: generateTestPainDescriptions()}, nil)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.ReplyMarkup != nil
+	})).Return(tgbotapi.Message{MessageID: 42}, nil)
+
+	b.processMessage(update)
+
+	mockAI.AssertExpectations(t)
+	mockBotAPI.AssertExpectations(t)
+	mockStore.AssertNotCalled(t, "Append", mock.Anything)
+
+	d, ok := b.drafts.take(draftKey{chatID: 1234, messageID: 42})
+	assert.True(t, ok)
+	assert.Equal(t, update.Message.From.ID, d.userID)
+	// The saved entries are linked to the message of the user, not the preview
+	assert.Equal(t, update.Message.MessageID, d.meta.MessageID)
+	assert.Equal(t, models.SourceText, d.meta.Source)
+	assert.NotEmpty(t, d.meta.BatchID)
+}
+
+func Test_Bot_ShouldNotCreateDraftWithoutPainDescriptions(t *testing.T) {
 	t.Parallel()
 	mockBotAPI := new(MockBotAPI)
 	mockAI := new(MockAI)
-	mockLogAnalytics := new(MockLogAnalytics)
 
 	b := &Bot{
-		Bot:                mockBotAPI,
-		openAIClient:       mockAI,
-		logAnalyticsClient: mockLogAnalytics,
-		speechConfig:       speechtotext.NewConfig("key", "region"),
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
 	}
 
 	update := generateTestUpdate()
 	update.Message.Text = "Test Message"
 
-	mockAI.On("GetPainDescriptionObject", "Test Message").Return([]models.PainDescription{}, nil)
-	mockLogAnalytics.On("SavePainDescriptionsToLogAnalytics", mock.Anything).Return(nil)
+	mockAI.On("GetPainDescriptionObject", "Test Message", mock.Anything, mock.Anything).Return(openai.Result{}, nil)
 	mockBotAPI.On("Send", mock.Anything).Return(tgbotapi.Message{}, nil)
 
 	b.processMessage(update)
 
-	mockAI.AssertExpectations(t)
-	mockLogAnalytics.AssertExpectations(t)
+	mockBotAPI.AssertNumberOfCalls(t, "Send", 1)
+	assert.Empty(t, b.drafts.removeExpired(time.Now().Add(time.Hour)))
+}
+
+func Test_Bot_ShouldReplyWithTextResults(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		result   openai.Result
+		expected string
+	}{
+		"Text":    {openai.Result{Kind: openai.ResultText, Text: "Missä kohtaa kipua tuntuu?"}, "Missä kohtaa kipua tuntuu?"},
+		"Empty":   {openai.Result{Kind: openai.ResultText}, "I could not find any pain descriptions in your message. Please try again."},
+		"Refusal": {openai.Result{Kind: openai.ResultRefusal}, "Sorry, I can't process this message. Please describe your pains differently."},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			mockBotAPI := new(MockBotAPI)
+			mockAI := new(MockAI)
+			b := &Bot{
+				Bot:           mockBotAPI,
+				openAIClient:  mockAI,
+				drafts:        newDraftStore(time.Minute),
+				conversations: newConversationStore(time.Minute),
+				location:      time.UTC,
+			}
+
+			update := generateTestUpdate()
+			update.Message.Text = "Test Message"
+
+			mockAI.On("GetPainDescriptionObject", "Test Message", mock.Anything, mock.Anything).Return(tt.result, nil)
+			mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+				return msg.Text == tt.expected && msg.ReplyMarkup == nil
+			})).Return(tgbotapi.Message{}, nil)
+
+			b.processMessage(update)
+
+			mockBotAPI.AssertExpectations(t)
+			assert.Empty(t, b.drafts.removeExpired(time.Now().Add(time.Hour)))
+		})
+	}
+}
+
+func Test_Bot_ShouldExplainInvalidOutput(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "Test Message"
+
+	invalidErr := &openai.InvalidOutputError{Attempts: 3, Err: errors.New("pain 1: unknown locationId 99")}
+	mockAI.On("GetPainDescriptionObject", "Test Message", mock.Anything, mock.Anything).Return(openai.Result{}, invalidErr)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "pain 1: unknown locationId 99")
+	})).Return(tgbotapi.Message{}, nil)
+
+	b.processMessage(update)
+
+	mockBotAPI.AssertExpectations(t)
+}
+
+func Test_Bot_ShouldTellUserWhenModelIsBusy(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "Test Message"
+
+	busyErr := &openai.APIError{StatusCode: http.StatusTooManyRequests, Body: "rate limit exceeded"}
+	mockAI.On("GetPainDescriptionObject", "Test Message", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			mc := args.Get(1).(openai.MessageContext)
+			mc.OnRetry(openai.RetryInfo{Retry: 1, Wait: 2 * time.Second, Err: busyErr})
+			mc.OnRetry(openai.RetryInfo{Retry: 2, Wait: 4 * time.Second, Err: busyErr})
+		}).
+		Return(openai.Result{}, busyErr)
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.Text == "The language model is busy, retrying in 2s..."
+	})).Return(tgbotapi.Message{}, nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.HasPrefix(msg.Text, "The language model is too busy") && !strings.Contains(msg.Text, "rate limit exceeded")
+	})).Return(tgbotapi.Message{}, nil).Once()
+
+	b.processMessage(update)
+
+	mockBotAPI.AssertExpectations(t)
+	mockBotAPI.AssertNumberOfCalls(t, "Send", 2)
+}
+
+func Test_Bot_ShouldUseFallbackParserWhenModelIsUnavailable(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "alaselkä 6, vasen polvi 3"
+
+	mockAI.On("GetPainDescriptionObject", update.Message.Text, mock.Anything, mock.Anything).
+		Return(openai.Result{}, &openai.APIError{StatusCode: http.StatusServiceUnavailable})
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "offline parser")
+	})).Return(tgbotapi.Message{}, nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.ReplyMarkup != nil && strings.Contains(msg.Text, "Lower Back") && strings.Contains(msg.Text, "Knee")
+	})).Return(tgbotapi.Message{MessageID: 42}, nil).Once()
+
+	b.processMessage(update)
+
 	mockBotAPI.AssertExpectations(t)
+	d, ok := b.drafts.take(draftKey{chatID: 1234, messageID: 42})
+	if assert.True(t, ok) && assert.Len(t, d.painDesc, 2) {
+		assert.Equal(t, models.ParserFallback, d.painDesc[0].Parser)
+		assert.Equal(t, models.SourceFallback, d.meta.Source)
+	}
+}
+
+func Test_Bot_ProcessCallback_SaveShouldPersistDraft(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		store:    mockStore,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockStore.On("Append", mock.Anything).Return(nil)
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback(callbackSave, 42))
+
+	mockStore.AssertNumberOfCalls(t, "Append", 1)
+	_, ok := b.drafts.take(key)
+	assert.False(t, ok, "saved draft should be removed")
+
+	// A second press must not save the same draft twice
+	b.processCallback(generateTestCallback(callbackSave, 42))
+	mockStore.AssertNumberOfCalls(t, "Append", 1)
+}
+
+func Test_Bot_ProcessCallback_SaveErrorShouldKeepDraft(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		store:    mockStore,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockStore.On("Append", mock.Anything).Return(errors.New("upload failed"))
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback(callbackSave, 42))
+
+	_, ok := b.drafts.take(key)
+	assert.True(t, ok, "draft should be kept for another try")
+}
+
+func Test_Bot_ProcessCallback_QueuedSaveShouldFinishDraft(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		store:    mockStore,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockStore.On("Append", mock.Anything).Return(fmt.Errorf("%w: upload failed", database.ErrQueued))
+	mockBotAPI.On("Request", mock.MatchedBy(func(edit tgbotapi.EditMessageTextConfig) bool {
+		return strings.HasPrefix(edit.Text, "Queued")
+	})).Return(&tgbotapi.APIResponse{Ok: true}, nil).Once()
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback(callbackSave, 42))
+
+	mockBotAPI.AssertExpectations(t)
+	_, ok := b.drafts.take(key)
+	assert.False(t, ok, "queued draft should not be saved again")
+}
+
+func Test_Bot_ProcessCallback_DiscardShouldNotSave(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		store:    mockStore,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback(callbackDiscard, 42))
+
+	mockStore.AssertNotCalled(t, "Append", mock.Anything)
+	_, ok := b.drafts.take(key)
+	assert.False(t, ok)
+}
+
+func Test_Bot_ProcessCallback_ShouldRejectOtherUsers(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockStore := new(MockStore)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		store:    mockStore,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 175255021, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.processCallback(generateTestCallback(callbackSave, 42))
+
+	mockStore.AssertNotCalled(t, "Append", mock.Anything)
+	_, ok := b.drafts.take(key)
+	assert.True(t, ok)
+}
+
+func Test_Bot_ExpireDrafts_ShouldRemoveOldDrafts(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		drafts:   newDraftStore(time.Minute),
+		location: time.UTC,
+	}
+	key := draftKey{chatID: 1234, messageID: 42}
+	b.drafts.add(key, 1111111111111111111, generateTestPainDescriptions(), generateTestEntryMetadata())
+
+	mockBotAPI.On("Request", mock.Anything).Return(&tgbotapi.APIResponse{Ok: true}, nil)
+
+	b.expireDrafts(time.Now())
+	mockBotAPI.AssertNotCalled(t, "Request", mock.Anything)
+
+	b.expireDrafts(time.Now().Add(2 * time.Minute))
+	mockBotAPI.AssertNumberOfCalls(t, "Request", 1)
+	_, ok := b.drafts.take(key)
+	assert.False(t, ok)
 }
 
 func Test_Bot_Reply_ShouldSendMessageToUser(t *testing.T) {
@@ -105,7 +483,7 @@ func Test_Bot_Reply_ShouldSendMessageToUser(t *testing.T) {
 func Test_Bot_ProcessToText_ShouldProcessText(t *testing.T) {
 	t.Parallel()
 	mockBotAPI := new(MockBotAPI)
-	b := &Bot{Bot: mockBotAPI, speechConfig: speechtotext.NewConfig("key", "region")}
+	b := &Bot{Bot: mockBotAPI}
 
 	update := generateTestUpdate()
 	update.Message.Text = "Hello"
@@ -117,7 +495,7 @@ func Test_Bot_ProcessToText_ShouldProcessText(t *testing.T) {
 func Test_Bot_ProcessToText_ShouldNotProcessVideo(t *testing.T) {
 	t.Parallel()
 	mockBotAPI := new(MockBotAPI)
-	b := &Bot{Bot: mockBotAPI, speechConfig: speechtotext.NewConfig("key", "region")}
+	b := &Bot{Bot: mockBotAPI}
 
 	update := generateTestUpdate()
 	update.Message.Video = &tgbotapi.Video{}
@@ -126,10 +504,10 @@ func Test_Bot_ProcessToText_ShouldNotProcessVideo(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
-func Test_Bot_SaveDataToLogAnalytics_ShouldCallExternalPackageWithDataIncluded(t *testing.T) {
+func Test_Bot_SaveData_ShouldCallStoreWithDataIncluded(t *testing.T) {
 	t.Parallel()
-	mockLogAnalytics := new(MockLogAnalytics)
-	b := &Bot{logAnalyticsClient: mockLogAnalytics}
+	mockStore := new(MockStore)
+	b := &Bot{store: mockStore}
 
 	painDesc := []models.PainDescription{{
 		Timestamp:           time.Now(),
@@ -142,12 +520,93 @@ func Test_Bot_SaveDataToLogAnalytics_ShouldCallExternalPackageWithDataIncluded(t
 	}}
 	userId := int64(1111111111111111111)
 
-	mockLogAnalytics.On("SavePainDescriptionsToLogAnalytics", mock.Anything).Return(nil)
+	meta := generateTestEntryMetadata()
+	mockStore.On("Append", mock.MatchedBy(func(entries []models.PainDescriptionLogEntry) bool {
+		return len(entries) == 1 && entries[0].EntryID != "" && entries[0].BatchID == meta.BatchID &&
+			entries[0].ChatID == 1234 && entries[0].MessageID == 7 && entries[0].Source == models.SourceText
+	})).Return(nil)
 
-	err := b.saveDataToLogAnalytics(userId, painDesc)
+	err := b.saveData(userId, painDesc, meta)
 
 	assert.Nil(t, err)
-	mockLogAnalytics.AssertExpectations(t)
+	mockStore.AssertExpectations(t)
+}
+
+func Test_Bot_ProcessMessage_ShouldPassMessageTimeAndLocation(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      helsinki,
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "Test Message"
+	update.Message.Date = int(time.Date(2023, 8, 1, 6, 30, 0, 0, time.UTC).Unix())
+
+	mockAI.On("GetPainDescriptionObject", "Test Message", mock.MatchedBy(func(mc openai.MessageContext) bool {
+		return mc.SentAt.Equal(update.Message.Time()) && mc.Location == helsinki
+	}), mock.Anything).Return(openai.Result{}, nil)
+	mockBotAPI.On("Send", mock.Anything).Return(tgbotapi.Message{}, nil)
+
+	b.processMessage(update)
+
+	mockAI.AssertExpectations(t)
+}
+
+func Test_FmtReply_ShouldShowTimestampSource(t *testing.T) {
+	t.Parallel()
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	tests := map[string]struct {
+		source   models.TimestampSource
+		expected string
+	}{
+		"FromMessage": {models.TimestampFromMessage, "Timestamp: 01-08-2023 02:00 (when the message was sent)"},
+		"FromText":    {models.TimestampFromText, "Timestamp: 01-08-2023 02:00 (mentioned in your message)"},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pd := []models.PainDescription{{
+				Timestamp:       time.Date(2023, 7, 31, 23, 0, 0, 0, time.UTC),
+				TimestampSource: tt.source,
+				LocationId:      9,
+				SideId:          1,
+				Level:           8,
+			}}
+			assert.Contains(t, fmtReply(pd, helsinki), tt.expected)
+		})
+	}
+}
+
+func Test_FmtReply_ShouldGroupPainsByTime(t *testing.T) {
+	t.Parallel()
+	morning := time.Date(2023, 8, 2, 8, 0, 0, 0, time.UTC)
+	evening := time.Date(2023, 8, 2, 20, 0, 0, 0, time.UTC)
+	pd := []models.PainDescription{
+		{Timestamp: evening, TimestampSource: models.TimestampFromText, LocationId: 2, SideId: 1, Level: 4},
+		{Timestamp: morning, TimestampSource: models.TimestampFromText, LocationId: 2, SideId: 1, Level: 3},
+		{Timestamp: morning, TimestampSource: models.TimestampFromText, LocationId: 9, SideId: 1, Level: 5},
+	}
+
+	expected := "Timestamp: 02-08-2023 08:00 (mentioned in your message)\n" +
+		"Pains:\n" +
+		"\t- Location: Neck, Side: Both, Level: 3\n" +
+		"\t- Location: Lower Back, Side: Both, Level: 5\n" +
+		"Timestamp: 02-08-2023 20:00 (mentioned in your message)\n" +
+		"Pains:\n" +
+		"\t- Location: Neck, Side: Both, Level: 4\n"
+
+	reply := fmtReply(pd, time.UTC)
+	assert.True(t, strings.HasPrefix(reply, expected), reply)
 }
 
 func Test_FmtReply_ShouldNotBeEmpty(t *testing.T) {
@@ -164,6 +623,21 @@ func Test_FmtReply_ShouldNotBeEmpty(t *testing.T) {
 		},
 	}
 
-	reply := fmtReply(painDesc)
+	reply := fmtReply(painDesc, time.UTC)
 	assert.NotEmpty(t, reply)
-}
\ No newline at end of file
+}
+
+func Test_Bot_ShouldTimeOutStuckRecognition(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := newStoppableTestBot(mockBotAPI)
+	b.speechClient = blockingSpeech{started: make(chan struct{})}
+	b.timeouts.speech = 10 * time.Millisecond
+
+	update := generateTestUpdate()
+	update.Message.Voice = &tgbotapi.Voice{FileID: "voice"}
+	mockBotAPI.On("GetFileDirectURL", "voice").Return("https://example.com/voice.ogg", nil)
+
+	_, err := b.processToText(update)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,272 @@
+package tgbot
+
+import (
+	"expvar"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"time"
+)
+
+const (
+	defaultUsageDays = 7
+	// usageRetentionDays is how long the daily usage is kept in memory
+	usageRetentionDays = 31
+	// shadowUsageUser is the user the usage of the shadow client is recorded under. It is not on any user's budget
+	shadowUsageUser = "(shadow)"
+)
+
+// usageMetrics publishes the token usage and cost in expvar, served at /debug/vars of the metrics address. It is
+// created once as expvar names are global
+var usageMetrics = expvar.NewMap("openai_usage")
+
+// Price is the price of a million prompt and completion tokens, e.g. in US dollars
+type Price struct {
+	Prompt     float64
+	Completion float64
+}
+
+// PriceTable has the prices by deployment or model name. The price under "*" applies to the others
+type PriceTable map[string]Price
+
+// cost returns the price of the usage with the deployment or model
+func (pt PriceTable) cost(model string, usage openai.Usage) float64 {
+	price, ok := pt[model]
+	if !ok {
+		price = pt["*"]
+	}
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6
+}
+
+// parsePriceTable parses a price table like "gpt-4o-mini=0.15/0.6,*=2.5/10", where the numbers are the prices of
+// a million prompt and completion tokens
+func parsePriceTable(spec string) (PriceTable, error) {
+	pt := make(PriceTable)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, prices, ok := strings.Cut(entry, "=")
+		prompt, completion, ok2 := strings.Cut(prices, "/")
+		if !ok || !ok2 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("invalid price %q, expected model=prompt/completion", entry)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSpace(prompt), 64)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid prompt price in %q", entry)
+		}
+		c, err := strconv.ParseFloat(strings.TrimSpace(completion), 64)
+		if err != nil || c < 0 {
+			return nil, fmt.Errorf("invalid completion price in %q", entry)
+		}
+		pt[strings.TrimSpace(model)] = Price{Prompt: p, Completion: c}
+	}
+	return pt, nil
+}
+
+// usageKey identifies the usage of a user on a day, formatted as YYYY-MM-DD in the timezone of the bot
+type usageKey struct {
+	user string
+	day  string
+}
+
+// usageTotals is the usage of the language model summed over requests
+type usageTotals struct {
+	messages         int
+	promptTokens     int
+	completionTokens int
+	cost             float64
+}
+
+func (t usageTotals) tokens() int {
+	return t.promptTokens + t.completionTokens
+}
+
+func (t *usageTotals) add(other usageTotals) {
+	t.messages += other.messages
+	t.promptTokens += other.promptTokens
+	t.completionTokens += other.completionTokens
+	t.cost += other.cost
+}
+
+// usageTracker sums the usage of the language model by user and day. It is kept in memory only, so the totals
+// start over when the bot is restarted. The message goroutines share it, so all access goes through the mutex
+type usageTracker struct {
+	mu     sync.Mutex
+	totals map[usageKey]*usageTotals
+	prices PriceTable
+	// model is the deployment or model name the prices are looked up with
+	model string
+	// dailyBudget is the number of tokens a user may use a day, zero for no limit
+	dailyBudget int
+	location    *time.Location
+}
+
+func newUsageTracker(prices PriceTable, model string, dailyBudget int, loc *time.Location) *usageTracker {
+	return &usageTracker{
+		totals:      make(map[usageKey]*usageTotals),
+		prices:      prices,
+		model:       model,
+		dailyBudget: dailyBudget,
+		location:    loc,
+	}
+}
+
+// usageUser returns the user the usage of the Telegram user is recorded under. The users without a name are told
+// apart by their id, as the usage of an empty user would be everyone's in the summary
+func usageUser(userID int64) string {
+	if name := models.UserIDs[userID]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("id %d", userID)
+}
+
+func (ut *usageTracker) key(user string, at time.Time) usageKey {
+	return usageKey{user: user, day: at.In(ut.location).Format(time.DateOnly)}
+}
+
+// add records the usage of a message of the user
+func (ut *usageTracker) add(user string, at time.Time, usage openai.Usage) {
+	ut.addModel(user, ut.model, at, usage)
+}
+
+// addModel records the usage of a message of the user with another deployment or model, e.g. that of the shadow
+func (ut *usageTracker) addModel(user, model string, at time.Time, usage openai.Usage) {
+	t := usageTotals{
+		messages:         1,
+		promptTokens:     usage.PromptTokens,
+		completionTokens: usage.CompletionTokens,
+		cost:             ut.prices.cost(model, usage),
+	}
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	k := ut.key(user, at)
+	if ut.totals[k] == nil {
+		ut.totals[k] = &usageTotals{}
+	}
+	ut.totals[k].add(t)
+
+	for _, prefix := range []string{"total.", user + "."} {
+		usageMetrics.Add(prefix+"messages", 1)
+		usageMetrics.Add(prefix+"prompt_tokens", int64(t.promptTokens))
+		usageMetrics.Add(prefix+"completion_tokens", int64(t.completionTokens))
+		usageMetrics.AddFloat(prefix+"cost", t.cost)
+	}
+}
+
+// exceeded tells whether the user has used the daily budget of tokens on the day of at
+func (ut *usageTracker) exceeded(user string, at time.Time) bool {
+	if ut.dailyBudget <= 0 {
+		return false
+	}
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	t, ok := ut.totals[ut.key(user, at)]
+	return ok && t.tokens() >= ut.dailyBudget
+}
+
+// removeOld removes the usage of days older than the retention
+func (ut *usageTracker) removeOld(now time.Time) {
+	oldest := now.In(ut.location).AddDate(0, 0, -usageRetentionDays).Format(time.DateOnly)
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	for k := range ut.totals {
+		if k.day < oldest {
+			delete(ut.totals, k)
+		}
+	}
+}
+
+// summary formats the usage of the last days, including today, by user and day. An empty user includes everyone
+func (ut *usageTracker) summary(user string, days int, now time.Time) string {
+	now = now.In(ut.location)
+	y, m, d := now.Date()
+	from := time.Date(y, m, d-(days-1), 0, 0, 0, 0, ut.location).Format(time.DateOnly)
+
+	ut.mu.Lock()
+	byUser := make(map[string]map[string]usageTotals)
+	for k, t := range ut.totals {
+		if k.day < from || (user != "" && k.user != user) {
+			continue
+		}
+		if byUser[k.user] == nil {
+			byUser[k.user] = make(map[string]usageTotals)
+		}
+		byUser[k.user][k.day] = *t
+	}
+	ut.mu.Unlock()
+
+	period := "today"
+	if days > 1 {
+		period = fmt.Sprintf("the last %d days", days)
+	}
+	if len(byUser) == 0 {
+		return fmt.Sprintf("No language model usage from %s.", period)
+	}
+
+	users := make([]string, 0, len(byUser))
+	for u := range byUser {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Language model usage from %s:\n", period))
+	var total usageTotals
+	for _, u := range users {
+		result.WriteString(fmt.Sprintf("\n%s\n", u))
+		daysOfUser := make([]string, 0, len(byUser[u]))
+		for day := range byUser[u] {
+			daysOfUser = append(daysOfUser, day)
+		}
+		sort.Strings(daysOfUser)
+
+		var userTotal usageTotals
+		for _, day := range daysOfUser {
+			t := byUser[u][day]
+			result.WriteString("  " + day + "  " + fmtUsageTotals(t) + "\n")
+			userTotal.add(t)
+		}
+		if len(daysOfUser) > 1 {
+			result.WriteString("  Total       " + fmtUsageTotals(userTotal) + "\n")
+		}
+		total.add(userTotal)
+	}
+	if len(users) > 1 {
+		result.WriteString("\nAll users  " + fmtUsageTotals(total) + "\n")
+	}
+	if ut.dailyBudget > 0 {
+		result.WriteString(fmt.Sprintf("\nDaily budget: %d tokens per user", ut.dailyBudget))
+	}
+	return strings.TrimRight(result.String(), "\n")
+}
+
+func fmtUsageTotals(t usageTotals) string {
+	return fmt.Sprintf("%d msgs, %d + %d tokens, $%.4f", t.messages, t.promptTokens, t.completionTokens, t.cost)
+}
+
+// showUsage replies with the usage of the language model. Admins see every user, the others only themselves
+func (b *Bot) showUsage(update tgbotapi.Update, days int) error {
+	if b.usage == nil {
+		b.reply(update, "Usage tracking is not enabled.")
+		return nil
+	}
+
+	user := usageUser(update.Message.From.ID)
+	if b.admins[update.Message.From.ID] {
+		user = ""
+	}
+	for _, part := range splitMessage(b.usage.summary(user, days, time.Now()), maxMessageLength) {
+		b.reply(update, part)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package tgbot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"t-pain/pkg/models"
+	"t-pain/pkg/openai"
+	"testing"
+	"time"
+)
+
+func Test_ParsePriceTable(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec        string
+		expected    PriceTable
+		expectError bool
+	}{
+		"Single":        {spec: "gpt-4o-mini=0.15/0.6", expected: PriceTable{"gpt-4o-mini": {Prompt: 0.15, Completion: 0.6}}},
+		"WithDefault":   {spec: "gpt-4o-mini=0.15/0.6, *=2.5/10", expected: PriceTable{"gpt-4o-mini": {Prompt: 0.15, Completion: 0.6}, "*": {Prompt: 2.5, Completion: 10}}},
+		"MissingPrice":  {spec: "gpt-4o-mini=0.15", expectError: true},
+		"MissingModel":  {spec: "=0.15/0.6", expectError: true},
+		"NegativePrice": {spec: "gpt-4o=-1/2", expectError: true},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pt, err := parsePriceTable(tt.spec)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, pt)
+		})
+	}
+}
+
+func Test_UsageTracker_ShouldSumByUserAndDay(t *testing.T) {
+	t.Parallel()
+	prices := PriceTable{"deployment": {Prompt: 1, Completion: 2}, "*": {Prompt: 100, Completion: 100}}
+	ut := newUsageTracker(prices, "deployment", 0, time.UTC)
+	today := time.Date(2023, 8, 2, 12, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+
+	ut.add("Jenny", today, openai.Usage{PromptTokens: 1000, CompletionTokens: 100})
+	ut.add("Jenny", today, openai.Usage{PromptTokens: 500, CompletionTokens: 50})
+	ut.add("Jenny", yesterday, openai.Usage{PromptTokens: 200, CompletionTokens: 20})
+	ut.add("Pasi", today, openai.Usage{PromptTokens: 300, CompletionTokens: 30})
+
+	jenny := ut.totals[usageKey{user: "Jenny", day: "2023-08-02"}]
+	if assert.NotNil(t, jenny) {
+		assert.Equal(t, 2, jenny.messages)
+		assert.Equal(t, 1650, jenny.tokens())
+		assert.InDelta(t, 0.0018, jenny.cost, 1e-12)
+	}
+
+	summary := ut.summary("", 7, today)
+	assert.Contains(t, summary, "Jenny\n  2023-08-01  1 msgs, 200 + 20 tokens")
+	assert.Contains(t, summary, "  Total       3 msgs, 1700 + 170 tokens")
+	assert.Contains(t, summary, "Pasi\n  2023-08-02  1 msgs, 300 + 30 tokens")
+	assert.Contains(t, summary, "All users  4 msgs")
+
+	own := ut.summary("Pasi", 1, today)
+	assert.NotContains(t, own, "Jenny")
+
+	assert.Equal(t, "No language model usage from today.", ut.summary("Test", 1, today))
+}
+
+func Test_UsageTracker_ShouldEnforceDailyBudget(t *testing.T) {
+	t.Parallel()
+	ut := newUsageTracker(nil, "deployment", 1000, time.UTC)
+	today := time.Date(2023, 8, 2, 12, 0, 0, 0, time.UTC)
+
+	ut.add("Jenny", today, openai.Usage{PromptTokens: 900, CompletionTokens: 99})
+	assert.False(t, ut.exceeded("Jenny", today))
+	ut.add("Jenny", today, openai.Usage{PromptTokens: 1})
+	assert.True(t, ut.exceeded("Jenny", today))
+	assert.False(t, ut.exceeded("Pasi", today), "the budget is per user")
+	assert.False(t, ut.exceeded("Jenny", today.AddDate(0, 0, 1)), "the budget is per day")
+
+	ut.removeOld(today.AddDate(0, 0, usageRetentionDays+1))
+	assert.Empty(t, ut.totals)
+}
+
+func Test_Bot_ShouldUseFallbackParserWhenBudgetIsExceeded(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+		usage:         newUsageTracker(nil, "deployment", 100, time.UTC),
+	}
+	b.usage.add(models.UserIDs[1111111111111111111], time.Now(), openai.Usage{PromptTokens: 100})
+
+	update := generateTestUpdate()
+	update.Message.Text = "niska 4"
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return strings.Contains(msg.Text, "daily share")
+	})).Return(tgbotapi.Message{}, nil).Once()
+	mockBotAPI.On("Send", mock.MatchedBy(func(msg tgbotapi.MessageConfig) bool {
+		return msg.ReplyMarkup != nil
+	})).Return(tgbotapi.Message{MessageID: 42}, nil).Once()
+
+	b.processMessage(update)
+
+	mockBotAPI.AssertExpectations(t)
+	mockAI.AssertNotCalled(t, "GetPainDescriptionObject", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_Bot_ShouldRecordUsageOfTheUser(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	mockAI := new(MockAI)
+	b := &Bot{
+		Bot:           mockBotAPI,
+		openAIClient:  mockAI,
+		drafts:        newDraftStore(time.Minute),
+		conversations: newConversationStore(time.Minute),
+		location:      time.UTC,
+		usage:         newUsageTracker(nil, "deployment", 0, time.UTC),
+		admins:        map[int64]bool{},
+	}
+
+	update := generateTestUpdate()
+	update.Message.Text = "niska 4"
+	mockAI.On("GetPainDescriptionObject", update.Message.Text, mock.Anything, mock.Anything).
+		Return(openai.Result{Kind: openai.ResultText, Text: "No pains", Usage: openai.Usage{PromptTokens: 120, CompletionTokens: 7}}, nil)
+	var replies []string
+	mockBotAPI.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		replies = append(replies, args.Get(0).(tgbotapi.MessageConfig).Text)
+	}).Return(tgbotapi.Message{}, nil)
+
+	b.processMessage(update)
+	assert.NoError(t, b.showUsage(update, 1))
+
+	if assert.Len(t, replies, 2) {
+		assert.Contains(t, replies[1], "Test\n")
+		assert.Contains(t, replies[1], "1 msgs, 120 + 7 tokens")
+	}
+}
+
+func Test_Bot_ShouldRecordUsageOfUnknownUsersByID(t *testing.T) {
+	t.Parallel()
+	mockBotAPI := new(MockBotAPI)
+	b := &Bot{
+		Bot:      mockBotAPI,
+		location: time.UTC,
+		usage:    newUsageTracker(nil, "deployment", 0, time.UTC),
+		admins:   map[int64]bool{},
+	}
+	b.usage.add(usageUser(1111111111111111111), time.Now(), openai.Usage{PromptTokens: 100})
+	b.usage.add(usageUser(42), time.Now(), openai.Usage{PromptTokens: 5})
+
+	update := generateTestUpdate()
+	update.Message.From.ID = 42
+	var reply string
+	mockBotAPI.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		reply = args.Get(0).(tgbotapi.MessageConfig).Text
+	}).Return(tgbotapi.Message{}, nil).Once()
+
+	assert.NoError(t, b.showUsage(update, 1))
+	assert.Contains(t, reply, "id 42\n")
+	assert.NotContains(t, reply, "Test", "an unknown user should only see their own usage")
+}